@@ -1,11 +1,15 @@
 package banking
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/blinkinglight/bee"
 	"github.com/blinkinglight/bee/gen"
@@ -28,25 +32,84 @@ func (a *AccountAggregate) ApplyEvent(e *gen.EventEnvelope) error {
 	}
 
 	switch evt := ev.(type) {
+	case *AccountCreated:
+		a.Balance = evt.Balance
+		a.Currency = evt.Currency
 	case *AccountDebited:
 		a.Balance -= evt.Amount
 	case *AccountCredited:
 		a.Balance += evt.Amount
+	case *AccountFrozen, *AccountUnfrozen, *AccountClosed, *OverdraftLimitSet, *HoldAuthorized, *HoldCaptured, *HoldReleased:
+		// Do not change the balance
 	default:
 		return fmt.Errorf("unknown event type: %T", ev)
 	}
 	return nil
 }
 
+// Hold statuses; a hold is active until nothing of it is reserved any more.
+const (
+	HoldStatusActive   = "active"
+	HoldStatusCaptured = "captured"
+	HoldStatusVoided   = "voided"
+	HoldStatusExpired  = "expired"
+)
+
+// DefaultHoldTTL is how long a hold lasts if it was authorized without an
+// expiry.
+const DefaultHoldTTL = 7 * 24 * time.Hour
+
+// Hold reserves part of the balance of an account for a later capture.
+type Hold struct {
+	Counterparty string
+	Amount       int64 // Still reserved
+	Captured     int64
+	ExpiresAt    int64
+	Status       string
+}
+
 type PaymentAggregate struct {
-	ID       string
-	Balance  int64 // pvz. centais
-	Currency string
+	ID        string
+	Balance   int64 // pvz. centais; the ledger balance, holds included
+	Currency  string
+	Overdraft int64 // How far the available balance may go below zero
+	Frozen    bool  // Frozen accounts take credits but no debits or holds
+	Closed    bool  // Closed accounts take no commands at all
+	Holds     map[string]*Hold
+	Spent     Spending // Money out, for the velocity rules
 
 	found   bool
 	created bool
 }
 
+// Held sums what the active holds of the account reserve.
+func (a *PaymentAggregate) Held() int64 {
+	var held int64
+	for _, h := range a.Holds {
+		if h.Status == HoldStatusActive {
+			held += h.Amount
+		}
+	}
+	return held
+}
+
+// heldAt is what holds reserve at now, leaving out those that have expired
+// but are not released yet.
+func (a *PaymentAggregate) heldAt(now int64) int64 {
+	var held int64
+	for _, h := range a.Holds {
+		if h.Status == HoldStatusActive && h.ExpiresAt > now {
+			held += h.Amount
+		}
+	}
+	return held
+}
+
+// Available is the balance that can still be debited or held.
+func (a *PaymentAggregate) Available() int64 {
+	return a.Balance - a.Held()
+}
+
 func (a *PaymentAggregate) ApplyEvent(e *gen.EventEnvelope) error {
 	ev, err := bee.UnmarshalEvent(e)
 	if err != nil {
@@ -70,11 +133,41 @@ func (a *PaymentAggregate) ApplyEvent(e *gen.EventEnvelope) error {
 			return errors.New("event does not belong to this payment aggregate")
 		}
 		a.Balance -= ev.Amount
+		a.Spent.add(ev.Timestamp, ev.Amount)
 	case *AccountCredited:
 		if a.ID != ev.AccountID {
 			return errors.New("event does not belong to this payment aggregate")
 		}
 		a.Balance += ev.Amount
+	case *AccountFrozen:
+		a.Frozen = true
+	case *AccountUnfrozen:
+		a.Frozen = false
+	case *AccountClosed:
+		a.Closed = true
+	case *OverdraftLimitSet:
+		a.Overdraft = ev.Limit
+	case *HoldAuthorized:
+		if a.Holds == nil {
+			a.Holds = map[string]*Hold{}
+		}
+		a.Holds[ev.HoldID] = &Hold{Counterparty: ev.Counterparty, Amount: ev.Amount, ExpiresAt: ev.ExpiresAt, Status: HoldStatusActive}
+	case *HoldCaptured:
+		if h := a.Holds[ev.HoldID]; h != nil {
+			h.Amount = ev.Remaining
+			h.Captured += ev.Amount
+			if h.Amount == 0 {
+				h.Status = HoldStatusCaptured
+			}
+		}
+	case *HoldReleased:
+		if h := a.Holds[ev.HoldID]; h != nil {
+			h.Amount = 0
+			h.Status = HoldStatusVoided
+			if e.EventType == HoldExpiredEvent {
+				h.Status = HoldStatusExpired
+			}
+		}
 	default:
 		return errors.New("unknown event type")
 	}
@@ -82,8 +175,53 @@ func (a *PaymentAggregate) ApplyEvent(e *gen.EventEnvelope) error {
 	return nil
 }
 
+// ApplyCommand handles c after expiring the holds that ran out by the time of
+// c, so the events of c follow a HoldExpiredEvent for each of them.
 func (a *PaymentAggregate) ApplyCommand(ctx context.Context, c *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	if a.Closed {
+		return nil, errors.New("account is closed")
+	}
+	expired, err := a.expireHolds(commandTime(c))
+	if err != nil {
+		return nil, err
+	}
+	events, err := a.applyCommand(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return append(expired, events...), nil
+}
+
+// expireHolds releases the active holds that expired by now and returns the
+// events recording it, oldest hold first.
+func (a *PaymentAggregate) expireHolds(now int64) ([]*gen.EventEnvelope, error) {
+	var ids []string
+	for id, h := range a.Holds {
+		if h.Status == HoldStatusActive && h.ExpiresAt <= now {
+			ids = append(ids, id)
+		}
+	}
+	slices.SortFunc(ids, func(x, y string) int {
+		return cmp.Or(cmp.Compare(a.Holds[x].ExpiresAt, a.Holds[y].ExpiresAt), strings.Compare(x, y))
+	})
+	var events []*gen.EventEnvelope
+	for _, id := range ids {
+		b, _ := json.Marshal(&HoldReleased{AccountID: a.ID, HoldID: id, Amount: a.Holds[id].Amount, Timestamp: now})
+		e := &gen.EventEnvelope{
+			AggregateId:   a.ID,
+			AggregateType: Aggregate,
+			EventType:     HoldExpiredEvent,
+			Payload:       b,
+		}
+		if err := a.ApplyEvent(e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
 
+func (a *PaymentAggregate) applyCommand(ctx context.Context, c *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
 	cmd, err := bee.UnmarshalCommand(c)
 	if err != nil {
 		return nil, err
@@ -105,11 +243,11 @@ func (a *PaymentAggregate) ApplyCommand(ctx context.Context, c *gen.CommandEnvel
 			Currency:  cmd.Currency,
 			Balance:   cmd.Balance,
 			Ref:       cmd.Ref,
-			Timestamp: c.Timestamp.AsTime().Unix(),
+			Timestamp: commandTime(c),
 		}
 		var event *gen.EventEnvelope = &gen.EventEnvelope{AggregateId: cmd.AccountID}
 		event.AggregateType = "payments"
-		event.EventType = "credited"
+		event.EventType = CreatedEvent
 		b, _ := json.Marshal(ev)
 		event.Payload = b
 		return []*gen.EventEnvelope{event}, nil
@@ -118,43 +256,60 @@ func (a *PaymentAggregate) ApplyCommand(ctx context.Context, c *gen.CommandEnvel
 		if cmd.Amount <= 0 {
 			return nil, errors.New("amount must be greater than zero")
 		}
-		if a.Balance < cmd.Amount {
+		if err := a.checkCurrency(cmd.Currency); err != nil {
+			return nil, err
+		}
+		if a.Frozen {
+			return nil, errors.New("account is frozen")
+		}
+		if a.Available()-cmd.Amount < -a.Overdraft {
 			return nil, errors.New("insufficient funds")
 		}
 		a.Balance -= cmd.Amount
 		ev := &AccountDebited{
-			AccountID:  cmd.FromAccountID,
-			Amount:     cmd.Amount,
-			Ref:        cmd.Ref,
-			NewBalance: a.Balance,
+			AccountID:    cmd.FromAccountID,
+			Counterparty: cmd.ToAccountID,
+			Amount:       cmd.Amount,
+			Currency:     a.Currency,
+			Ref:          cmd.Ref,
+			NewBalance:   a.Balance,
+			Timestamp:    commandTime(c),
 		}
 		var event *gen.EventEnvelope = &gen.EventEnvelope{AggregateId: cmd.FromAccountID}
 		event.AggregateType = "payments"
 		event.EventType = "debited"
 		b, _ := json.Marshal(ev)
 		event.Payload = b
-
-		var eventc *gen.EventEnvelope = &gen.EventEnvelope{AggregateId: cmd.ToAccountID}
-		eventc.AggregateType = "payments"
-		evc := &AccountCredited{
-			AccountID: cmd.ToAccountID,
-			Amount:    cmd.Amount,
-			Ref:       cmd.Ref,
-		}
-		eventc.EventType = "credited"
-		b2, _ := json.Marshal(evc)
-		eventc.Payload = b2
-		return []*gen.EventEnvelope{event, eventc}, nil
+		return []*gen.EventEnvelope{event}, nil
 	case *CreditAccountCommand:
 		if cmd.Amount <= 0 {
 			return nil, errors.New("amount must be greater than zero")
 		}
+		if err := a.checkCurrency(cmd.Currency); err != nil {
+			return nil, err
+		}
+		if fx := cmd.Conversion; fx != nil {
+			if fx.FromCurrency == a.Currency {
+				return nil, errors.New("conversion must be from another currency")
+			}
+			amount, err := Convert(fx.FromAmount, fx.Rate)
+			if err != nil {
+				return nil, err
+			}
+			if amount != cmd.Amount {
+				return nil, fmt.Errorf("%d %s at %s is %d %s, not %d", fx.FromAmount, fx.FromCurrency, fx.Rate, amount, a.Currency, cmd.Amount)
+			}
+		}
 		a.Balance += cmd.Amount
 		ev := &AccountCredited{
-			AccountID:  cmd.ToAccountID,
-			Amount:     cmd.Amount,
-			Ref:        cmd.Ref,
-			NewBalance: a.Balance,
+			AccountID:    cmd.ToAccountID,
+			Counterparty: cmd.FromAccountID,
+			Amount:       cmd.Amount,
+			Currency:     a.Currency,
+			Ref:          cmd.Ref,
+			NewBalance:   a.Balance,
+			Timestamp:    commandTime(c),
+			Conversion:   cmd.Conversion,
 		}
 		var event *gen.EventEnvelope = &gen.EventEnvelope{AggregateId: cmd.ToAccountID}
 		event.AggregateType = "payments"
@@ -162,8 +317,195 @@ func (a *PaymentAggregate) ApplyCommand(ctx context.Context, c *gen.CommandEnvel
 		b, _ := json.Marshal(ev)
 		event.Payload = b
 		return []*gen.EventEnvelope{event}, nil
+	case *FreezeAccountCommand:
+		if a.Frozen {
+			return nil, errors.New("account is already frozen")
+		}
+		b, _ := json.Marshal(&AccountFrozen{AccountID: a.ID, Reason: cmd.Reason, Timestamp: commandTime(c)})
+		return []*gen.EventEnvelope{{
+			AggregateId:   a.ID,
+			AggregateType: Aggregate,
+			EventType:     FrozenEvent,
+			Payload:       b,
+		}}, nil
+	case *UnfreezeAccountCommand:
+		if !a.Frozen {
+			return nil, errors.New("account is not frozen")
+		}
+		b, _ := json.Marshal(&AccountUnfrozen{AccountID: a.ID, Timestamp: commandTime(c)})
+		return []*gen.EventEnvelope{{
+			AggregateId:   a.ID,
+			AggregateType: Aggregate,
+			EventType:     UnfrozenEvent,
+			Payload:       b,
+		}}, nil
+	case *CloseAccountCommand:
+		if a.Frozen {
+			return nil, errors.New("account is frozen")
+		}
+		if a.Balance != 0 {
+			return nil, fmt.Errorf("balance must be zero to close the account, is %d", a.Balance)
+		}
+		if a.Held() != 0 {
+			return nil, errors.New("account has active holds")
+		}
+		if cmd.SweptTo == a.ID {
+			return nil, errors.New("cannot sweep an account into itself")
+		}
+		b, _ := json.Marshal(&AccountClosed{AccountID: a.ID, SweptTo: cmd.SweptTo, Timestamp: commandTime(c)})
+		return []*gen.EventEnvelope{{
+			AggregateId:   a.ID,
+			AggregateType: Aggregate,
+			EventType:     ClosedEvent,
+			Payload:       b,
+		}}, nil
+	case *SetOverdraftLimitCommand:
+		if cmd.Limit < 0 {
+			return nil, errors.New("overdraft limit cannot be negative")
+		}
+		if a.Available() < -cmd.Limit {
+			return nil, fmt.Errorf("available balance %d is below the new overdraft limit", a.Available())
+		}
+		b, _ := json.Marshal(&OverdraftLimitSet{AccountID: a.ID, Limit: cmd.Limit, Timestamp: commandTime(c)})
+		return []*gen.EventEnvelope{{
+			AggregateId:   a.ID,
+			AggregateType: Aggregate,
+			EventType:     OverdraftSetEvent,
+			Payload:       b,
+		}}, nil
+	case *AuthorizeHoldCommand:
+		if cmd.HoldID == "" {
+			return nil, errors.New("hold ID cannot be empty")
+		}
+		if _, ok := a.Holds[cmd.HoldID]; ok {
+			return nil, fmt.Errorf("hold already exists: %s", cmd.HoldID)
+		}
+		if cmd.Amount <= 0 {
+			return nil, errors.New("amount must be greater than zero")
+		}
+		if err := a.checkCurrency(cmd.Currency); err != nil {
+			return nil, err
+		}
+		if a.Frozen {
+			return nil, errors.New("account is frozen")
+		}
+		if a.Available()-cmd.Amount < -a.Overdraft {
+			return nil, errors.New("insufficient funds")
+		}
+		now := commandTime(c)
+		expiresAt := cmd.ExpiresAt
+		if expiresAt == 0 {
+			expiresAt = now + int64(DefaultHoldTTL/time.Second)
+		}
+		if expiresAt <= now {
+			return nil, errors.New("hold would expire immediately")
+		}
+		counterparty := cmd.ToAccountID
+		if counterparty == "" {
+			counterparty = CashAccount
+		}
+		b, _ := json.Marshal(&HoldAuthorized{
+			AccountID:    a.ID,
+			HoldID:       cmd.HoldID,
+			Counterparty: counterparty,
+			Amount:       cmd.Amount,
+			Currency:     a.Currency,
+			Ref:          cmd.Ref,
+			ExpiresAt:    expiresAt,
+			Timestamp:    now,
+		})
+		return []*gen.EventEnvelope{{
+			AggregateId:   a.ID,
+			AggregateType: Aggregate,
+			EventType:     HoldAuthorizedEvent,
+			Payload:       b,
+		}}, nil
+	case *CaptureHoldCommand:
+		h, err := a.activeHold(cmd.HoldID)
+		if err != nil {
+			return nil, err
+		}
+		if cmd.Amount <= 0 {
+			return nil, errors.New("amount must be greater than zero")
+		}
+		if cmd.Amount > h.Amount {
+			return nil, fmt.Errorf("cannot capture %d, hold %s has %d left", cmd.Amount, cmd.HoldID, h.Amount)
+		}
+		if err := a.checkCurrency(cmd.Currency); err != nil {
+			return nil, err
+		}
+		if a.Frozen {
+			return nil, errors.New("account is frozen")
+		}
+		if to := cmp.Or(cmd.ToAccountID, CashAccount); to != h.Counterparty {
+			return nil, fmt.Errorf("hold %s pays %s, not %s", cmd.HoldID, h.Counterparty, to)
+		}
+		ref := cmd.Ref
+		if ref == "" {
+			ref = cmd.HoldID
+		}
+		now := commandTime(c)
+		captured, _ := json.Marshal(&HoldCaptured{
+			AccountID: a.ID,
+			HoldID:    cmd.HoldID,
+			Amount:    cmd.Amount,
+			Remaining: h.Amount - cmd.Amount,
+			Ref:       ref,
+			Timestamp: now,
+		})
+		a.Balance -= cmd.Amount
+		debited, _ := json.Marshal(&AccountDebited{
+			AccountID:    a.ID,
+			Counterparty: h.Counterparty,
+			Amount:       cmd.Amount,
+			Currency:     a.Currency,
+			Ref:          ref,
+			NewBalance:   a.Balance,
+			Timestamp:    now,
+		})
+		return []*gen.EventEnvelope{
+			{AggregateId: a.ID, AggregateType: Aggregate, EventType: HoldCapturedEvent, Payload: captured},
+			{AggregateId: a.ID, AggregateType: Aggregate, EventType: DebitedEvent, Payload: debited},
+		}, nil
+	case *VoidHoldCommand:
+		h, err := a.activeHold(cmd.HoldID)
+		if err != nil {
+			return nil, err
+		}
+		b, _ := json.Marshal(&HoldReleased{AccountID: a.ID, HoldID: cmd.HoldID, Amount: h.Amount, Ref: cmd.Ref, Timestamp: commandTime(c)})
+		return []*gen.EventEnvelope{{
+			AggregateId:   a.ID,
+			AggregateType: Aggregate,
+			EventType:     HoldVoidedEvent,
+			Payload:       b,
+		}}, nil
+	case *ExpireHoldsCommand:
+		return nil, nil // ApplyCommand expired them already
 	default:
 		return nil, fmt.Errorf("unknown command type: %T", cmd)
 	}
 
 }
+
+func (a *PaymentAggregate) activeHold(id string) (*Hold, error) {
+	h, ok := a.Holds[id]
+	if !ok {
+		return nil, fmt.Errorf("hold does not exist: %s", id)
+	}
+	if h.Status != HoldStatusActive {
+		return nil, fmt.Errorf("hold %s is %s", id, h.Status)
+	}
+	return h, nil
+}
+
+// checkCurrency rejects money movements that do not name the currency of the
+// account; amounts in other currencies must be converted first.
+func (a *PaymentAggregate) checkCurrency(currency string) error {
+	if currency == "" {
+		return errors.New("currency cannot be empty")
+	}
+	if currency != a.Currency {
+		return fmt.Errorf("currency mismatch: account is in %s, not %s", a.Currency, currency)
+	}
+	return nil
+}
@@ -2,73 +2,73 @@ package banking_test
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/blinkinglight/bee"
 	"github.com/blinkinglight/bee/co"
+	"github.com/blinkinglight/bee/gen"
 	"github.com/blinkinglight/bee/ro"
 	"github.com/blinkinglight/gobeego/apps/banking"
+	"github.com/blinkinglight/gobeego/pkg/appctx"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/projection"
+	"github.com/blinkinglight/gobeego/pkg/registry"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/blinkinglight/gobeego/pkg/rwdb"
 	"github.com/delaneyj/toolbelt/embeddednats"
 	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-func init() {
-	bee.RegisterEvent[banking.AccountDebited](banking.Aggregate, banking.DebitedEvent)
-	bee.RegisterEvent[banking.AccountCredited](banking.Aggregate, banking.CreditedEvent)
-	bee.RegisterEvent[banking.AccountCreated](banking.Aggregate, banking.CreatedEvent)
-
-	bee.RegisterCommand[banking.DebitAccountCommand](banking.Aggregate, banking.DebitCommand)
-	bee.RegisterCommand[banking.CreditAccountCommand](banking.Aggregate, banking.CreditCommand)
-	bee.RegisterCommand[banking.CreateAccountCommand](banking.Aggregate, banking.CreateCommand)
-}
-
-func client() (*nats.Conn, func(), error) {
-	server, err := embeddednats.New(
-		context.Background(),
-		embeddednats.WithShouldClearData(true),
+// setup starts a NATS server with its own store for the test, creates the
+// events stream and returns a context carrying the connection.
+func setup(t *testing.T) (context.Context, *nats.Conn) {
+	t.Helper()
+	ns, err := embeddednats.New(context.Background(),
+		embeddednats.WithDirectory(t.TempDir()),
 		embeddednats.WithNATSServerOptions(&server.Options{
-			JetStream:    true,
-			NoLog:        false,
-			Debug:        true,
-			Trace:        true,
-			TraceVerbose: true,
-			Port:         4333,
+			JetStream: true,
+			Port:      server.RANDOM_PORT,
+			StoreDir:  t.TempDir(),
 		}),
 	)
 	if err != nil {
-		return nil, nil, err
+		t.Fatalf("failed to start NATS: %v", err)
 	}
-	server.WaitForServer()
-
-	nc, err := server.Client()
-
-	return nc, func() {
-		nc.Close()
-		server.Close()
-	}, err
-}
+	t.Cleanup(func() { ns.Close() })
+	ns.WaitForServer()
 
-func TestMain(t *testing.T) {
-	nc, cleanup, err := client()
+	nc, err := ns.Client()
 	if err != nil {
 		t.Fatalf("failed to create NATS client: %v", err)
 	}
-	defer cleanup()
-
+	t.Cleanup(nc.Close)
 	js, err := nc.JetStream()
 	if err != nil {
 		t.Fatalf("Failed to get JetStream context: %v", err)
 	}
-	js.DeleteStream("events") // Clean up any existing stream
-	js.AddStream(&nats.StreamConfig{
-		Name:     "events",
-		Subjects: []string{"events.>"},
-	})
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "events", Subjects: []string{"events.>"}}); err != nil {
+		t.Fatalf("Failed to create events stream: %v", err)
+	}
 
 	ctx := bee.WithNats(t.Context(), nc)
 	ctx = bee.WithJetStream(ctx, js)
+	return appctx.WithJetStream(ctx, js), nc
+}
+
+func TestMain(t *testing.T) {
+	ctx, _ := setup(t)
 
 	service := &banking.PaymentService{Ctx: ctx}
 	go bee.Command(ctx, service, co.WithAggreate(banking.Aggregate))
@@ -81,7 +81,7 @@ func TestMain(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond) // Wait for events to be processed
 
-	creditCmd := banking.CreditAccount("CASH", "12345", 1000, "payment-001")
+	creditCmd := banking.CreditAccount("CASH", "12345", 1000, "USD", "payment-001")
 	bee.PublishCommand(ctx, creditCmd, nil)
 
 	time.Sleep(100 * time.Millisecond) // Wait for events to be processed
@@ -93,7 +93,7 @@ func TestMain(t *testing.T) {
 		t.Errorf("Expected balance to be 1000, got %v", agg.Balance)
 	}
 
-	debitCmd := banking.DebitAccount("12345", "54321", 1000, "payment-001")
+	debitCmd := banking.DebitAccount("12345", "54321", 1000, "USD", "payment-001")
 	bee.PublishCommand(ctx, debitCmd, nil)
 
 	time.Sleep(100 * time.Millisecond) // Wait for events to be processed
@@ -105,11 +105,1283 @@ func TestMain(t *testing.T) {
 		t.Errorf("Expected balance to be 0 after debit, got %v", agg.Balance)
 	}
 
+	// A debit no longer credits the counterparty; transfers do that.
 	agg = &banking.AccountAggregate{ID: "54321"}
 	bee.Replay(ctx, agg, ro.WithAggreate(banking.Aggregate), ro.WithAggregateID("54321"))
 
-	if agg.Balance != 1000 {
-		t.Errorf("Expected balance of account 54321 to be 1000 after credit, got %v", agg.Balance)
+	if agg.Balance != 0 {
+		t.Errorf("Expected balance of account 54321 to stay 0 after the debit, got %v", agg.Balance)
 	}
 	time.Sleep(100 * time.Millisecond) // Wait for events to be processed
 }
+
+func TestConcurrentDebits(t *testing.T) {
+	ctx, _ := setup(t)
+
+	handler := &eventstore.Handler{Ctx: ctx, Handler: &banking.PaymentService{Ctx: ctx}}
+	for _, cmd := range []*gen.CommandEnvelope{
+		banking.CreateAccount("A", "USD", 0, "create-a"),
+		banking.CreateAccount("B", "USD", 0, "create-b"),
+		banking.CreditAccount("CASH", "A", 100, "USD", "deposit-a"),
+	} {
+		if _, err := handler.Handle(cmd); err != nil {
+			t.Fatalf("%s: %v", cmd.CommandType, err)
+		}
+	}
+
+	// Only one of these fits into the balance.
+	errs := make([]error, 5)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = handler.Handle(banking.DebitAccount("A", "B", 60, "USD", fmt.Sprintf("debit-%d", i)))
+		}()
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("Expected exactly one debit to succeed, got %d: %v", succeeded, errs)
+	}
+
+	agg := &banking.AccountAggregate{ID: "A"}
+	if _, err := eventstore.Replay(ctx, agg, banking.Aggregate, "A"); err != nil {
+		t.Fatal(err)
+	}
+	if agg.Balance != 40 {
+		t.Errorf("Expected balance to be 40, got %v", agg.Balance)
+	}
+}
+
+func TestDuplicateDebit(t *testing.T) {
+	ctx, _ := setup(t)
+
+	var results [][]*gen.EventEnvelope
+	handler := &eventstore.Handler{
+		Ctx:     ctx,
+		Handler: &banking.PaymentService{Ctx: ctx},
+		Dedupe:  &eventstore.Dedupe{Window: time.Minute, Key: banking.IdempotencyKey},
+		OnResult: func(m *gen.CommandEnvelope, events []*gen.EventEnvelope, err error) {
+			results = append(results, events)
+		},
+	}
+	for _, cmd := range []*gen.CommandEnvelope{
+		banking.CreateAccount("A", "USD", 0, "create-a"),
+		banking.CreateAccount("B", "USD", 0, "create-b"),
+		banking.CreditAccount("CASH", "A", 100, "USD", "payment-001"),
+		banking.DebitAccount("A", "B", 30, "USD", "payment-001"),
+		banking.DebitAccount("A", "B", 30, "USD", "payment-001"),
+	} {
+		if _, err := handler.Handle(cmd); err != nil {
+			t.Fatalf("%s: %v", cmd.CommandType, err)
+		}
+	}
+	if len(results[4]) != len(results[3]) || results[4][0].EventType != banking.DebitedEvent {
+		t.Errorf("Expected the repeat to get the original events, got %v", results[4])
+	}
+
+	if _, err := handler.Handle(banking.DebitAccount("A", "B", 50, "USD", "payment-001")); err == nil {
+		t.Errorf("Expected reusing a ref for another amount to fail")
+	}
+
+	agg := &banking.AccountAggregate{ID: "A"}
+	if _, err := eventstore.Replay(ctx, agg, banking.Aggregate, "A"); err != nil {
+		t.Fatal(err)
+	}
+	if agg.Balance != 70 {
+		t.Errorf("Expected balance to be 70, got %v", agg.Balance)
+	}
+}
+
+func TestTransferSaga(t *testing.T) {
+	ctx, nc := setup(t)
+
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.PaymentService{Ctx: ctx},
+		Dedupe:   &eventstore.Dedupe{Key: banking.IdempotencyKey},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Aggregate))
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.TransferService{Ctx: ctx},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Transfers))
+	time.Sleep(100 * time.Millisecond)
+
+	for _, cmd := range []*gen.CommandEnvelope{
+		banking.CreateAccount("A", "USD", 0, "create-a"),
+		banking.CreateAccount("B", "USD", 0, "create-b"),
+		banking.CreateAccount("C", "EUR", 0, "create-c"),
+		banking.CreditAccount("CASH", "A", 100, "USD", "deposit-a"),
+	} {
+		if _, err := reply.Send(ctx, nc, cmd, nil); err != nil {
+			t.Fatalf("%s %s: %v", cmd.CommandType, cmd.AggregateId, err)
+		}
+	}
+
+	saga := &banking.TransferSaga{Ctx: ctx, NC: nc}
+	go saga.Run(ctx)
+
+	db := rwdb.Open(filepath.Join(t.TempDir(), "banking.db"))
+	defer db.Close()
+	db.WriteTX(ctx, func(tx *rwdb.Tx) error {
+		return tx.AutoMigrate(&banking.Transfer{}, &projection.Checkpoint{})
+	})
+	go projection.Run(ctx, appctx.JetStream(ctx), db, "transfers", projection.Subject(banking.Transfers), banking.TransferProjection{})
+
+	transfers := []struct {
+		id, to string
+		amount int64
+		status string
+		reason string
+	}{
+		{"t1", "B", 40, banking.TransferCompletedEvent, ""},
+		{"t2", "C", 10, banking.TransferRefundedEvent, "currency mismatch"},
+		{"t3", "missing", 10, banking.TransferRefundedEvent, "account does not exist"},
+		{"t4", "B", 1000, banking.TransferFailedEvent, "insufficient funds"},
+	}
+	for _, tr := range transfers {
+		wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		got, err := banking.RunTransfer(wctx, nc, banking.StartTransfer(tr.id, "A", tr.to, tr.amount, "USD", ""))
+		cancel()
+		if err != nil {
+			t.Fatalf("transfer %s: %v", tr.id, err)
+		}
+		if got == nil || got.Status != tr.status || !strings.Contains(got.Reason, tr.reason) {
+			t.Fatalf("Expected transfer %s to be %s (%q), got %+v", tr.id, tr.status, tr.reason, got)
+		}
+		if len(got.History) < 2 || got.History[0].Status != banking.TransferStatusStarted {
+			t.Errorf("Expected the history of %s to start with %s, got %+v", tr.id, banking.TransferStatusStarted, got.History)
+		}
+	}
+
+	for id, want := range map[string]int64{"A": 60, "B": 40, "C": 0} {
+		agg := &banking.AccountAggregate{ID: id}
+		if _, err := eventstore.Replay(ctx, agg, banking.Aggregate, id); err != nil {
+			t.Fatal(err)
+		}
+		if agg.Balance != want {
+			t.Errorf("Expected balance of %s to be %d, got %d", id, want, agg.Balance)
+		}
+	}
+
+	var (
+		history []banking.Transfer
+		err     error
+	)
+	for range 100 {
+		history, err = banking.TransferHistory(ctx, db, "A")
+		settled := err == nil && len(history) == len(transfers)
+		for _, tr := range history {
+			settled = settled && tr.Status != banking.TransferStatusStarted && tr.Status != banking.TransferDebitedEvent
+		}
+		if settled {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(history) != len(transfers) {
+		t.Fatalf("Expected %d transfers in the history of A, got %+v", len(transfers), history)
+	}
+}
+
+// TestTransferSagaRetry checks that a credit which is still being handled
+// elsewhere is retried rather than refunded, as it may yet go through.
+func TestTransferSagaRetry(t *testing.T) {
+	ctx, nc := setup(t)
+
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.PaymentService{Ctx: ctx},
+		Dedupe:   &eventstore.Dedupe{Key: banking.IdempotencyKey},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Aggregate))
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.TransferService{Ctx: ctx},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Transfers))
+	time.Sleep(100 * time.Millisecond)
+
+	for _, cmd := range []*gen.CommandEnvelope{
+		banking.CreateAccount("A", "USD", 0, "create-a"),
+		banking.CreateAccount("B", "USD", 0, "create-b"),
+		banking.CreditAccount("CASH", "A", 100, "USD", "deposit-a"),
+	} {
+		if _, err := reply.Send(ctx, nc, cmd, nil); err != nil {
+			t.Fatalf("%s %s: %v", cmd.CommandType, cmd.AggregateId, err)
+		}
+	}
+
+	// Claim the credit of t1 as if another handler were still on it.
+	kv, err := appctx.JetStream(ctx).KeyValue(eventstore.OutcomeBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := fmt.Sprintf("%s.B.%s.%s", banking.Aggregate, banking.CreditCommand, base64.RawURLEncoding.EncodeToString([]byte("t1")))
+	claim, _ := json.Marshal(map[string]any{"pending": true, "since": time.Now()})
+	if _, err := kv.Create(key, claim); err != nil {
+		t.Fatal(err)
+	}
+
+	go (&banking.TransferSaga{Ctx: ctx, NC: nc}).Run(ctx)
+	if _, err := reply.Send(ctx, nc, banking.StartTransfer("t1", "A", "B", 40, "USD", ""), nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+	tr, err := banking.LoadTransfer(ctx, "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Status != banking.TransferDebitedEvent {
+		t.Fatalf("Expected t1 to wait for its credit, got %s (%s)", tr.Status, tr.Reason)
+	}
+
+	if err := kv.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	for range 100 {
+		if tr, err = banking.LoadTransfer(ctx, "t1"); err == nil && tr.Status != banking.TransferDebitedEvent {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if tr.Status != banking.TransferCompletedEvent {
+		t.Fatalf("Expected t1 to complete once its credit went through, got %s (%s)", tr.Status, tr.Reason)
+	}
+	for id, want := range map[string]int64{"A": 60, "B": 40} {
+		agg := &banking.AccountAggregate{ID: id}
+		if _, err := eventstore.Replay(ctx, agg, banking.Aggregate, id); err != nil {
+			t.Fatal(err)
+		}
+		if agg.Balance != want {
+			t.Errorf("Expected balance of %s to be %d, got %d", id, want, agg.Balance)
+		}
+	}
+}
+
+// credits collects the credit events of an account.
+type credits []*banking.AccountCredited
+
+func (c *credits) ApplyEvent(e *gen.EventEnvelope) error {
+	ev, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return err
+	}
+	if ev, ok := ev.(*banking.AccountCredited); ok {
+		*c = append(*c, ev)
+	}
+	return nil
+}
+
+func TestExchangeRates(t *testing.T) {
+	ctx, nc := setup(t)
+
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.PaymentService{Ctx: ctx},
+		Dedupe:   &eventstore.Dedupe{Key: banking.IdempotencyKey},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Aggregate))
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.TransferService{Ctx: ctx},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Transfers))
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.RateService{Ctx: ctx},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.RateTables))
+	time.Sleep(100 * time.Millisecond)
+
+	for _, cmd := range []*gen.CommandEnvelope{
+		banking.CreateAccount("A", "USD", 0, "create-a"),
+		banking.CreateAccount("C", "EUR", 0, "create-c"),
+		banking.CreditAccount("CASH", "A", 10000, "USD", "deposit-a"),
+	} {
+		if _, err := reply.Send(ctx, nc, cmd, nil); err != nil {
+			t.Fatalf("%s %s: %v", cmd.CommandType, cmd.AggregateId, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		cmd    *gen.CommandEnvelope
+		reason string
+	}{
+		{banking.CreditAccount("CASH", "C", 100, "USD", "deposit-usd"), "currency mismatch"},
+		{banking.CreditAccount("CASH", "C", 100, "", "deposit-none"), "currency cannot be empty"},
+		{banking.DebitAccount("A", "C", 100, "EUR", "debit-eur"), "currency mismatch"},
+		{banking.StartTransfer("fx0", "A", "C", 1000, "USD", "EUR"), "no exchange rate from USD to EUR"},
+		{banking.SetExchangeRate("USD", "EUR", "-1"), "invalid exchange rate"},
+	} {
+		_, err := reply.Send(ctx, nc, tc.cmd, nil)
+		if err == nil || !strings.Contains(err.Error(), tc.reason) {
+			t.Errorf("Expected %s %s to be rejected with %q, got %v", tc.cmd.CommandType, tc.cmd.AggregateId, tc.reason, err)
+		}
+	}
+
+	if _, err := reply.Send(ctx, nc, banking.SetExchangeRate("USD", "EUR", "0.9215"), nil); err != nil {
+		t.Fatalf("set rate: %v", err)
+	}
+
+	saga := &banking.TransferSaga{Ctx: ctx, NC: nc}
+	go saga.Run(ctx)
+
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	got, err := banking.RunTransfer(wctx, nc, banking.StartTransfer("fx1", "A", "C", 1000, "USD", "EUR"))
+	cancel()
+	if err != nil {
+		t.Fatalf("transfer fx1: %v", err)
+	}
+	if got.Status != banking.TransferCompletedEvent || got.ToAmount != 922 || got.Rate != "0.9215" {
+		t.Fatalf("Expected fx1 to complete with 922 EUR at 0.9215, got %+v", got)
+	}
+
+	// A rate set later does not change a transfer that already started.
+	if _, err := reply.Send(ctx, nc, banking.SetExchangeRate("USD", "EUR", "2"), nil); err != nil {
+		t.Fatalf("set rate: %v", err)
+	}
+	if again, err := banking.LoadTransfer(ctx, "fx1"); err != nil || again.ToAmount != 922 {
+		t.Errorf("Expected fx1 to keep 922 EUR, got %+v (%v)", again, err)
+	}
+
+	for id, want := range map[string]int64{"A": 9000, "C": 922} {
+		agg := &banking.AccountAggregate{ID: id}
+		if _, err := eventstore.Replay(ctx, agg, banking.Aggregate, id); err != nil {
+			t.Fatal(err)
+		}
+		if agg.Balance != want {
+			t.Errorf("Expected balance of %s to be %d, got %d", id, want, agg.Balance)
+		}
+	}
+
+	var c credits
+	if _, err := eventstore.Replay(ctx, &c, banking.Aggregate, "C"); err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 1 || c[0].Conversion == nil || c[0].Conversion.Rate != "0.9215" || c[0].Conversion.FromAmount != 1000 || c[0].Currency != "EUR" {
+		t.Errorf("Expected the credit of C to record 1000 USD at 0.9215, got %+v", c)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	for _, tc := range []struct {
+		amount int64
+		rate   string
+		want   int64
+	}{
+		{1000, "0.9215", 922},
+		{1000, "1", 1000},
+		{3, "0.5", 2},
+		{1, "0.4", 0},
+		{100, "1.1", 110},
+		{12345, "1/3", 4115},
+	} {
+		got, err := banking.Convert(tc.amount, tc.rate)
+		if err != nil || got != tc.want {
+			t.Errorf("Convert(%d, %q) = %d, %v; want %d", tc.amount, tc.rate, got, err, tc.want)
+		}
+	}
+	for _, rate := range []string{"", "abc", "0", "-1.5"} {
+		if _, err := banking.Convert(100, rate); err == nil {
+			t.Errorf("Expected Convert(100, %q) to fail", rate)
+		}
+	}
+}
+
+func TestAccountLifecycle(t *testing.T) {
+	ctx, _ := setup(t)
+
+	handler := &eventstore.Handler{Ctx: ctx, Handler: &banking.PaymentService{Ctx: ctx}}
+	steps := []struct {
+		cmd    *gen.CommandEnvelope
+		reason string // Expected rejection, "" if the command succeeds
+	}{
+		{banking.CreateAccount("A", "USD", 0, "create-a"), ""},
+		{banking.CreditAccount("CASH", "A", 100, "USD", "c1"), ""},
+
+		// Frozen accounts take credits but no debits.
+		{banking.UnfreezeAccount("A"), "account is not frozen"},
+		{banking.FreezeAccount("A", "suspicious activity"), ""},
+		{banking.FreezeAccount("A", "again"), "account is already frozen"},
+		{banking.DebitAccount("A", "B", 10, "USD", "d1"), "account is frozen"},
+		{banking.CreditAccount("CASH", "A", 10, "USD", "c2"), ""},
+		{banking.SetOverdraft("A", 10), ""},
+		{banking.CloseAccount("A", ""), "account is frozen"},
+		{banking.UnfreezeAccount("A"), ""},
+
+		// The overdraft limit replaces the zero floor; balance is 110.
+		{banking.DebitAccount("A", "B", 130, "USD", "d2"), "insufficient funds"},
+		{banking.SetOverdraft("A", 50), ""},
+		{banking.DebitAccount("A", "B", 150, "USD", "d3"), ""},
+		{banking.DebitAccount("A", "B", 20, "USD", "d4"), "insufficient funds"},
+		{banking.SetOverdraft("A", 30), "below the new overdraft limit"},
+		{banking.SetOverdraft("A", -1), "cannot be negative"},
+
+		// Only an account with a zero balance closes; balance is -40.
+		{banking.CloseAccount("A", ""), "balance must be zero"},
+		{banking.CloseAccount("A", "A"), "balance must be zero"},
+		{banking.CreditAccount("CASH", "A", 40, "USD", "c3"), ""},
+		{banking.CloseAccount("A", "A"), "cannot sweep an account into itself"},
+		{banking.CloseAccount("A", ""), ""},
+
+		// Closed accounts take no commands at all.
+		{banking.CreditAccount("CASH", "A", 10, "USD", "c4"), "account is closed"},
+		{banking.DebitAccount("A", "B", 10, "USD", "d5"), "account is closed"},
+		{banking.FreezeAccount("A", ""), "account is closed"},
+		{banking.UnfreezeAccount("A"), "account is closed"},
+		{banking.SetOverdraft("A", 100), "account is closed"},
+		{banking.CloseAccount("A", ""), "account is closed"},
+		{banking.CreateAccount("A", "USD", 0, "create-a-again"), "account already exists"},
+	}
+	for i, step := range steps {
+		_, err := handler.Handle(step.cmd)
+		switch {
+		case step.reason == "" && err != nil:
+			t.Fatalf("step %d: %s: %v", i, step.cmd.CommandType, err)
+		case step.reason != "" && (err == nil || !strings.Contains(err.Error(), step.reason)):
+			t.Fatalf("step %d: expected %s to be rejected with %q, got %v", i, step.cmd.CommandType, step.reason, err)
+		}
+	}
+
+	account, err := banking.LoadAccount(ctx, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !account.Closed || account.Frozen || account.Balance != 0 || account.Overdraft != 50 {
+		t.Errorf("Expected A to be closed with a zero balance and a limit of 50, got %+v", account)
+	}
+}
+
+func TestSweepAndClose(t *testing.T) {
+	ctx, nc := setup(t)
+
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.PaymentService{Ctx: ctx},
+		Dedupe:   &eventstore.Dedupe{Key: banking.IdempotencyKey},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Aggregate))
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.TransferService{Ctx: ctx},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Transfers))
+	time.Sleep(100 * time.Millisecond)
+
+	for _, cmd := range []*gen.CommandEnvelope{
+		banking.CreateAccount("A", "USD", 0, "create-a"),
+		banking.CreateAccount("B", "USD", 0, "create-b"),
+		banking.CreateAccount("E", "EUR", 0, "create-e"),
+		banking.CreditAccount("CASH", "A", 70, "USD", "deposit-a"),
+	} {
+		if _, err := reply.Send(ctx, nc, cmd, nil); err != nil {
+			t.Fatalf("%s %s: %v", cmd.CommandType, cmd.AggregateId, err)
+		}
+	}
+
+	saga := &banking.TransferSaga{Ctx: ctx, NC: nc}
+	go saga.Run(ctx)
+
+	wctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// The EUR account rejects the sweep, so A is refunded and stays open.
+	if err := banking.SweepAndClose(wctx, nc, "A", "E"); err == nil || !strings.Contains(err.Error(), "currency mismatch") {
+		t.Errorf("Expected sweeping into E to fail with a currency mismatch, got %v", err)
+	}
+	if err := banking.SweepAndClose(wctx, nc, "A", ""); err == nil || !strings.Contains(err.Error(), "balance must be zero") {
+		t.Errorf("Expected closing A without a sweep to fail, got %v", err)
+	}
+	if err := banking.SweepAndClose(wctx, nc, "A", "B"); err != nil {
+		t.Fatalf("sweep A into B: %v", err)
+	}
+
+	// Transfers into the closed account are refunded.
+	got, err := banking.RunTransfer(wctx, nc, banking.StartTransfer("back", "B", "A", 10, "USD", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != banking.TransferRefundedEvent || !strings.Contains(got.Reason, "account is closed") {
+		t.Errorf("Expected the transfer into A to be refunded, got %+v", got)
+	}
+
+	for id, want := range map[string]int64{"A": 0, "B": 70, "E": 0} {
+		account, err := banking.LoadAccount(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account.Balance != want {
+			t.Errorf("Expected balance of %s to be %d, got %d", id, want, account.Balance)
+		}
+		if account.Closed != (id == "A") {
+			t.Errorf("Expected only A to be closed, %s closed: %v", id, account.Closed)
+		}
+	}
+}
+
+func TestLedger(t *testing.T) {
+	ctx, nc := setup(t)
+
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.PaymentService{Ctx: ctx},
+		Dedupe:   &eventstore.Dedupe{Key: banking.IdempotencyKey},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Aggregate))
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.TransferService{Ctx: ctx},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Transfers))
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.RateService{Ctx: ctx},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.RateTables))
+	time.Sleep(100 * time.Millisecond)
+
+	saga := &banking.TransferSaga{Ctx: ctx, NC: nc}
+	go saga.Run(ctx)
+
+	for _, cmd := range []*gen.CommandEnvelope{
+		banking.CreateAccount("A", "USD", 0, "create-a"),
+		banking.CreateAccount("B", "USD", 0, "create-b"),
+		banking.CreateAccount("C", "EUR", 0, "create-c"),
+		banking.CreditAccount(banking.CashAccount, "A", 10000, "USD", "deposit-a"),
+		banking.SetExchangeRate("USD", "EUR", "0.9215"),
+		banking.DebitAccount("A", banking.CashAccount, 500, "USD", "withdraw-a"),
+		banking.DebitAccount("A", "B", 300, "USD", "orphan"), // B is never credited
+	} {
+		if _, err := reply.Send(ctx, nc, cmd, nil); err != nil {
+			t.Fatalf("%s %s: %v", cmd.CommandType, cmd.AggregateId, err)
+		}
+	}
+	for _, start := range []*gen.CommandEnvelope{
+		banking.StartTransfer("t1", "A", "B", 4000, "USD", ""),
+		banking.StartTransfer("t2", "A", "C", 1000, "USD", "EUR"),
+	} {
+		wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		got, err := banking.RunTransfer(wctx, nc, start)
+		cancel()
+		if err != nil || got.Status != banking.TransferCompletedEvent {
+			t.Fatalf("transfer %s: %+v, %v", start.AggregateId, got, err)
+		}
+	}
+
+	db := rwdb.Open(filepath.Join(t.TempDir(), "ledger.db"))
+	defer db.Close()
+	db.WriteTX(ctx, func(tx *rwdb.Tx) error {
+		return tx.AutoMigrate(&banking.LedgerEntry{}, &projection.Checkpoint{})
+	})
+	if _, err := projection.CatchUp(ctx, appctx.JetStream(ctx), db, "ledger", projection.Subject(banking.Aggregate), banking.LedgerProjection{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := banking.TrialBalance(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int64{}
+	totals := map[string]int64{}
+	for _, l := range lines {
+		got[l.Account+" "+l.Currency] = l.Balance
+		totals[l.Currency] += l.Balance
+		if l.Credits-l.Debits != l.Balance {
+			t.Errorf("Expected credits minus debits of %s to be its balance: %+v", l.Account, l)
+		}
+	}
+	want := map[string]int64{
+		"A USD":    4200,
+		"B USD":    4000,
+		"C EUR":    922,
+		"CASH USD": -9500,
+		"FX USD":   1000,
+		"FX EUR":   -922,
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("Expected trial balance of %s to be %d, got %d", k, v, got[k])
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("Expected %d trial balance lines, got %+v", len(want), lines)
+	}
+	// Only the orphaned debit keeps the books from balancing.
+	if totals["USD"] != -300 || totals["EUR"] != 0 {
+		t.Errorf("Expected the trial balance to be off by the orphaned debit, got %v", totals)
+	}
+
+	unbalanced, err := banking.UnbalancedRefs(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unbalanced) != 1 || unbalanced[0].Ref != "orphan" || unbalanced[0].Amount != -300 {
+		t.Errorf("Expected only the orphaned debit to be unbalanced, got %+v", unbalanced)
+	}
+
+	entries, err := banking.AccountLedger(ctx, db, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := banking.LoadAccount(ctx, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 5 || entries[len(entries)-1].Balance != account.Balance {
+		t.Errorf("Expected 5 entries for A ending at %d, got %+v", account.Balance, entries)
+	}
+}
+
+func TestStatement(t *testing.T) {
+	ctx, _ := setup(t)
+
+	day := func(month time.Month, d int) time.Time {
+		return time.Date(2026, month, d, 12, 0, 0, 0, time.UTC)
+	}
+	handler := &eventstore.Handler{Ctx: ctx, Handler: &banking.PaymentService{Ctx: ctx}}
+	for _, step := range []struct {
+		cmd *gen.CommandEnvelope
+		at  time.Time
+	}{
+		{banking.CreateAccount("A", "USD", 0, "create-a"), day(time.January, 1)},
+		{banking.CreditAccount(banking.CashAccount, "A", 10000, "USD", "salary"), day(time.January, 5)},
+		{banking.DebitAccount("A", "B", 3000, "USD", "rent"), day(time.February, 3)},
+		{banking.CreditAccount("B", "A", 500, "USD", "refund"), day(time.February, 10)},
+		{banking.DebitAccount("A", banking.CashAccount, 1000, "USD", "atm"), day(time.March, 1)},
+	} {
+		step.cmd.Timestamp = timestamppb.New(step.at)
+		if _, err := handler.Handle(step.cmd); err != nil {
+			t.Fatalf("%s: %v", step.cmd.CommandType, err)
+		}
+	}
+
+	s, err := banking.BuildStatement(ctx, "A", time.Date(2026, time.February, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Currency != "USD" || s.OpeningBalance != 10000 || s.ClosingBalance != 7500 {
+		t.Errorf("Expected February to go from 100.00 to 75.00 USD, got %+v", s)
+	}
+	if len(s.Movements) != 2 {
+		t.Fatalf("Expected 2 movements in February, got %+v", s.Movements)
+	}
+	rent := s.Movements[0]
+	if rent.Ref != "rent" || rent.Counterparty != "B" || rent.Amount != -3000 || rent.Balance != 7000 || !rent.Time.Equal(day(time.February, 3)) {
+		t.Errorf("Unexpected rent movement %+v", rent)
+	}
+	if refund := s.Movements[1]; refund.Amount != 500 || refund.Balance != 7500 {
+		t.Errorf("Unexpected refund movement %+v", refund)
+	}
+
+	if _, err := banking.BuildStatement(ctx, "missing", time.Time{}, time.Now()); !errors.Is(err, banking.ErrAccountNotFound) {
+		t.Errorf("Expected a statement of a missing account to fail, got %v", err)
+	}
+
+	for format, want := range map[string][]string{
+		banking.FormatCSV:     {"2026-02-03T12:00:00Z,debited,rent,B,-30.00,70.00,USD", "closing_balance,,,,75.00,USD"},
+		banking.FormatJSON:    {`"opening_balance": 10000`, `"ref": "refund"`},
+		banking.FormatCamt053: {"camt.053.001.08", "<Cd>OPBD</Cd>", `<Amt Ccy="USD">30.00</Amt>`, "<CdtDbtInd>DBIT</CdtDbtInd>", "<EndToEndId>rent</EndToEndId>"},
+	} {
+		var b strings.Builder
+		if err := s.Write(&b, format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		for _, w := range want {
+			if !strings.Contains(b.String(), w) {
+				t.Errorf("Expected the %s statement to contain %q:\n%s", format, w, b.String())
+			}
+		}
+	}
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestScheduler(t *testing.T) {
+	ctx, nc := setup(t)
+
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.PaymentService{Ctx: ctx},
+		Dedupe:   &eventstore.Dedupe{Key: banking.IdempotencyKey},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Aggregate))
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.TransferService{Ctx: ctx},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Transfers))
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.ScheduleService{Ctx: ctx},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Schedules))
+	time.Sleep(100 * time.Millisecond)
+
+	saga := &banking.TransferSaga{Ctx: ctx, NC: nc}
+	go saga.Run(ctx)
+
+	day := 24 * time.Hour
+	start := time.Now().Add(time.Hour).Truncate(time.Second)
+	for _, cmd := range []*gen.CommandEnvelope{
+		banking.CreateAccount("A", "USD", 0, "create-a"),
+		banking.CreateAccount("B", "USD", 0, "create-b"),
+		banking.CreateAccount("S", "USD", 0, "create-s"),
+		banking.CreditAccount(banking.CashAccount, "A", 5000, "USD", "deposit-a"),
+		banking.CreditAccount(banking.CashAccount, "S", 10000, "USD", "deposit-s"),
+		banking.CreateStandingOrder("rent", "A", "B", 1000, "USD", start, day),
+		banking.CreateInterestSchedule("savings", "S", "0.01", start, day),
+	} {
+		if _, err := reply.Send(ctx, nc, cmd, nil); err != nil {
+			t.Fatalf("%s %s: %v", cmd.CommandType, cmd.AggregateId, err)
+		}
+	}
+	if _, err := reply.Send(ctx, nc, banking.CreateStandingOrder("fast", "A", "B", 1, "USD", start, time.Second), nil); err == nil {
+		t.Error("Expected a schedule running every second to be rejected")
+	}
+
+	balances := func(want map[string]int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got := map[string]int64{}
+			for id := range want {
+				acc, err := banking.LoadAccount(ctx, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[id] = acc.Balance
+			}
+			if maps.Equal(got, want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected balances %v, got %v", want, got)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	clock := &fakeClock{now: start.Add(-time.Second)}
+	scheduler := &banking.Scheduler{NC: nc, Clock: clock}
+	if err := scheduler.Tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	balances(map[string]int64{"A": 5000, "B": 0, "S": 10000})
+
+	clock.now = start
+	if err := scheduler.Tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	balances(map[string]int64{"A": 4000, "B": 1000, "S": 10100})
+
+	clock.now = start.Add(day)
+	if err := scheduler.Tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	balances(map[string]int64{"A": 3000, "B": 2000, "S": 10201})
+
+	// A restarted scheduler picks up where the last one stopped.
+	scheduler = &banking.Scheduler{NC: nc, Clock: clock}
+	if err := scheduler.Tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run 2 was published, but the scheduler crashed before recording it.
+	interest := banking.CreditAccount(banking.CashAccount, "S", 102, "USD", "savings-2")
+	interest.Timestamp = timestamppb.New(start.Add(2 * day))
+	if _, err := reply.Send(ctx, nc, interest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reply.Send(ctx, nc, banking.StartTransfer("rent-2", "A", "B", 1000, "USD", ""), nil); err != nil {
+		t.Fatal(err)
+	}
+	balances(map[string]int64{"A": 2000, "B": 3000, "S": 10303})
+	clock.now = start.Add(2 * day)
+	if err := scheduler.Tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	balances(map[string]int64{"A": 2000, "B": 3000, "S": 10303})
+
+	rent, err := banking.LoadSchedule(ctx, "rent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rent.Runs != 3 || !rent.Next().Equal(start.Add(3*day).UTC()) {
+		t.Errorf("Expected rent to be due again on day 3, got %d runs, next %s", rent.Runs, rent.Next())
+	}
+
+	if _, err := reply.Send(ctx, nc, banking.CancelSchedule("rent"), nil); err != nil {
+		t.Fatal(err)
+	}
+	clock.now = start.Add(5 * day)
+	if err := scheduler.Tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Runs 3 to 5 of the interest are caught up, each on the balance it fell due on.
+	balances(map[string]int64{"A": 2000, "B": 3000, "S": 10303 + 103 + 104 + 105})
+}
+
+func TestStandingOrderRefund(t *testing.T) {
+	ctx, nc := setup(t)
+
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.PaymentService{Ctx: ctx},
+		Dedupe:   &eventstore.Dedupe{Key: banking.IdempotencyKey},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Aggregate))
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.TransferService{Ctx: ctx},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Transfers))
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.ScheduleService{Ctx: ctx},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Schedules))
+	time.Sleep(100 * time.Millisecond)
+
+	saga := &banking.TransferSaga{Ctx: ctx, NC: nc}
+	go saga.Run(ctx)
+
+	start := time.Now().Truncate(time.Second)
+	for _, cmd := range []*gen.CommandEnvelope{
+		banking.CreateAccount("A", "USD", 0, "create-a"),
+		banking.CreateAccount("E", "EUR", 0, "create-e"),
+		banking.CreditAccount(banking.CashAccount, "A", 5000, "USD", "deposit-a"),
+		banking.CreateStandingOrder("gift", "A", "E", 1000, "USD", start, 24*time.Hour),
+	} {
+		if _, err := reply.Send(ctx, nc, cmd, nil); err != nil {
+			t.Fatalf("%s %s: %v", cmd.CommandType, cmd.AggregateId, err)
+		}
+	}
+
+	// The credit of E is rejected as it is in another currency, which a bare
+	// debit of A would not have noticed.
+	scheduler := &banking.Scheduler{NC: nc, Clock: &fakeClock{now: start}}
+	if err := scheduler.Tick(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var tr *banking.TransferAggregate
+	for range 100 {
+		var err error
+		if tr, err = banking.LoadTransfer(ctx, "gift-0"); err != nil {
+			t.Fatal(err)
+		}
+		if tr.Status == banking.TransferRefundedEvent {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if tr.Status != banking.TransferRefundedEvent {
+		t.Fatalf("Expected the run to be refunded, got %s", tr.Status)
+	}
+	a, err := banking.LoadAccount(ctx, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Balance != 5000 {
+		t.Errorf("Expected A to get the run back, got a balance of %d", a.Balance)
+	}
+	gift, err := banking.LoadSchedule(ctx, "gift")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gift.Runs != 1 {
+		t.Errorf("Expected the refunded run to be recorded, got %d runs", gift.Runs)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx, nc := setup(t)
+
+	handler := &eventstore.Handler{Ctx: ctx, Handler: &banking.PaymentService{Ctx: ctx}}
+	for _, cmd := range []*gen.CommandEnvelope{
+		banking.CreateAccount("A", "USD", 0, "create-a"),
+		banking.CreateAccount("B", "USD", 0, "create-b"),
+		banking.CreditAccount(banking.CashAccount, "A", 500, "USD", "deposit-a"),
+		banking.CreditAccount(banking.CashAccount, "B", 300, "USD", "deposit-b"),
+	} {
+		if _, err := handler.Handle(cmd); err != nil {
+			t.Fatalf("%s %s: %v", cmd.CommandType, cmd.AggregateId, err)
+		}
+	}
+	// A credit from before credits recorded their NewBalance.
+	b, _ := json.Marshal(&banking.AccountCredited{AccountID: "A", Counterparty: banking.CashAccount, Amount: 200, Currency: "USD", Ref: "legacy"})
+	if err := eventstore.Append(ctx, appctx.JetStream(ctx), []*gen.EventEnvelope{{
+		AggregateId:   "A",
+		AggregateType: banking.Aggregate,
+		EventType:     banking.CreditedEvent,
+		Payload:       b,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.Handle(banking.DebitAccount("A", banking.CashAccount, 100, "USD", "withdraw-a")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := banking.Discrepancy{AccountID: "A", Kind: banking.DiscrepancyNewBalance, Event: 3, EventType: banking.CreditedEvent, Ref: "legacy", Recorded: 0, Computed: 700}
+	rec, err := banking.Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Accounts != 2 || rec.Events != 5 || len(rec.Discrepancies) != 1 {
+		t.Fatalf("Expected one discrepancy in 2 accounts, got %+v", rec)
+	}
+	got := rec.Discrepancies[0]
+	if got.Stored.IsZero() {
+		t.Errorf("Expected the discrepancy to carry the time its event was stored")
+	}
+	got.Stored = time.Time{}
+	if got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	if found, err := banking.ReconcileAccount(ctx, "B"); err != nil || len(found) != 0 {
+		t.Errorf("Expected B to reconcile, got %v, %v", found, err)
+	}
+	if _, err := banking.ReconcileAccount(ctx, "missing"); !errors.Is(err, banking.ErrAccountNotFound) {
+		t.Errorf("Expected reconciling a missing account to fail, got %v", err)
+	}
+
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.AlertService{Ctx: ctx},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Alerts))
+	time.Sleep(100 * time.Millisecond)
+
+	reconciler := &banking.Reconciler{Ctx: ctx, NC: nc}
+	for range 2 {
+		if _, err := reconciler.Once(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var alerts []string
+	err = eventstore.Read(ctx, banking.Alerts, "*", func(e *gen.EventEnvelope, _ time.Time) error {
+		alerts = append(alerts, e.AggregateId+" "+e.EventType)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 || alerts[0] != "A "+banking.DiscrepancyFoundEvent {
+		t.Errorf("Expected one alert for A however often it is reconciled, got %v", alerts)
+	}
+}
+
+func TestHolds(t *testing.T) {
+	ctx, nc := setup(t)
+
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.PaymentService{Ctx: ctx},
+		Dedupe:   &eventstore.Dedupe{Key: banking.IdempotencyKey},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Aggregate))
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now().Truncate(time.Second)
+	at := func(cmd *gen.CommandEnvelope, d time.Duration) *gen.CommandEnvelope {
+		cmd.Timestamp = timestamppb.New(start.Add(d))
+		return cmd
+	}
+	steps := []struct {
+		cmd    *gen.CommandEnvelope
+		reject string
+	}{
+		{banking.CreateAccount("A", "USD", 1000, "create-a"), ""},
+		{at(banking.AuthorizeHold("A", "h1", "", 600, "USD", start.Add(time.Hour), "auth-1"), 0), ""},
+		{at(banking.AuthorizeHold("A", "h1", "shop", 10, "USD", time.Time{}, "auth-1b"), 0), "hold already exists"},
+		{at(banking.DebitAccount("A", banking.CashAccount, 500, "USD", "atm-1"), 0), "insufficient funds"},
+		{at(banking.CaptureHold("A", "h1", 200, "USD", "capture-1"), time.Minute), ""},
+		{at(banking.CaptureHold("A", "h1", 500, "USD", "capture-2"), time.Minute), "has 400 left"},
+		{at(banking.CloseAccount("A", ""), time.Minute), "balance must be zero"},
+		{at(banking.VoidHold("A", "h1", "void-1"), 2*time.Minute), ""},
+		{at(banking.CaptureHold("A", "h1", 100, "USD", "capture-3"), 2*time.Minute), "hold h1 is voided"},
+		{at(banking.AuthorizeHold("A", "h2", "", 800, "USD", start.Add(time.Hour), "auth-2"), 3*time.Minute), ""},
+		{at(banking.AuthorizeHold("A", "h3", "", 10, "USD", start, "auth-3"), 3*time.Minute), "expire immediately"},
+		{at(banking.DebitAccount("A", banking.CashAccount, 700, "USD", "atm-2"), 4*time.Minute), "insufficient funds"},
+		// h2 expired an hour after it was authorized, so the debit goes through.
+		{at(banking.DebitAccount("A", banking.CashAccount, 700, "USD", "atm-3"), 2*time.Hour), ""},
+	}
+	for _, step := range steps {
+		_, err := reply.Send(ctx, nc, step.cmd, nil)
+		if step.reject == "" && err != nil {
+			t.Fatalf("%s: %v", step.cmd.CommandType, err)
+		}
+		if step.reject != "" && (err == nil || !strings.Contains(err.Error(), step.reject)) {
+			t.Fatalf("Expected %s to be rejected with %q, got %v", step.cmd.CommandType, step.reject, err)
+		}
+	}
+
+	acc, err := banking.LoadAccount(ctx, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.Balance != 100 || acc.Available() != 100 {
+		t.Errorf("Expected 1.00 USD left, got balance %d, available %d", acc.Balance, acc.Available())
+	}
+	if h := acc.Holds["h1"]; h.Status != banking.HoldStatusVoided || h.Captured != 200 {
+		t.Errorf("Expected h1 to be voided after capturing 200, got %+v", h)
+	}
+	if h := acc.Holds["h2"]; h.Status != banking.HoldStatusExpired {
+		t.Errorf("Expected h2 to have expired, got %+v", h)
+	}
+
+	s, err := banking.BuildStatement(ctx, "A", time.Time{}, start.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Movements) != 3 || s.Movements[1].Ref != "capture-1" || s.Movements[1].Counterparty != banking.CashAccount {
+		t.Errorf("Expected the capture to be a debit paid to CASH, got %+v", s.Movements)
+	}
+	if found, err := banking.ReconcileAccount(ctx, "A"); err != nil || len(found) != 0 {
+		t.Errorf("Expected A to reconcile, got %v, %v", found, err)
+	}
+
+	// The expirer releases holds without waiting for a command.
+	if _, err := reply.Send(ctx, nc, at(banking.AuthorizeHold("A", "h4", "", 100, "USD", start.Add(3*time.Hour), "auth-4"), 2*time.Hour), nil); err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: start.Add(3*time.Hour - time.Second)}
+	expirer := &banking.HoldExpirer{Ctx: ctx, NC: nc, Clock: clock}
+	if err := expirer.Tick(); err != nil {
+		t.Fatal(err)
+	}
+	if acc, _ := banking.LoadAccount(ctx, "A"); acc.Available() != 0 {
+		t.Errorf("Expected h4 to hold the rest of A, available %d", acc.Available())
+	}
+	clock.now = start.Add(3 * time.Hour)
+	if err := expirer.Tick(); err != nil {
+		t.Fatal(err)
+	}
+	if acc, _ := banking.LoadAccount(ctx, "A"); acc.Available() != 100 || acc.Holds["h4"].Status != banking.HoldStatusExpired {
+		t.Errorf("Expected h4 to have expired, got %+v", acc.Holds["h4"])
+	}
+}
+
+// TestHoldCapture captures a hold that pays another account, which must end
+// up with the money while the books stay balanced.
+func TestHoldCapture(t *testing.T) {
+	ctx, nc := setup(t)
+
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.PaymentService{Ctx: ctx},
+		Dedupe:   &eventstore.Dedupe{Key: banking.IdempotencyKey},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Aggregate))
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.TransferService{Ctx: ctx},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Transfers))
+	time.Sleep(100 * time.Millisecond)
+	go (&banking.TransferSaga{Ctx: ctx, NC: nc}).Run(ctx)
+
+	for _, cmd := range []*gen.CommandEnvelope{
+		banking.CreateAccount("A", "USD", 0, "create-a"),
+		banking.CreateAccount("SHOP", "USD", 0, "create-shop"),
+		banking.CreditAccount(banking.CashAccount, "A", 1000, "USD", "deposit-a"),
+		banking.AuthorizeHold("A", "h1", "SHOP", 600, "USD", time.Time{}, "auth-1"),
+	} {
+		if _, err := reply.Send(ctx, nc, cmd, nil); err != nil {
+			t.Fatalf("%s %s: %v", cmd.CommandType, cmd.AggregateId, err)
+		}
+	}
+
+	// A bare capture would take the money without paying SHOP.
+	if _, err := reply.Send(ctx, nc, banking.CaptureHold("A", "h1", 200, "USD", "capture-0"), nil); err == nil || !strings.Contains(err.Error(), "pays SHOP") {
+		t.Errorf("Expected a bare capture of h1 to be refused, got %v", err)
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	tr, err := banking.RunTransfer(wctx, nc, banking.StartCapture("capture-1", "A", "h1", "SHOP", 400, "USD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Status != banking.TransferCompletedEvent {
+		t.Fatalf("Expected the capture to complete, got %s (%s)", tr.Status, tr.Reason)
+	}
+
+	a, err := banking.LoadAccount(ctx, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Balance != 600 || a.Available() != 400 || a.Holds["h1"].Captured != 400 {
+		t.Errorf("Expected A to have 600 with 200 still held, got balance %d, available %d, hold %+v", a.Balance, a.Available(), a.Holds["h1"])
+	}
+	shop, err := banking.LoadAccount(ctx, "SHOP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shop.Balance != 400 {
+		t.Errorf("Expected SHOP to be paid 400, got %d", shop.Balance)
+	}
+
+	db := rwdb.Open(filepath.Join(t.TempDir(), "ledger.db"))
+	defer db.Close()
+	db.WriteTX(ctx, func(tx *rwdb.Tx) error {
+		return tx.AutoMigrate(&banking.LedgerEntry{}, &projection.Checkpoint{})
+	})
+	if _, err := projection.CatchUp(ctx, appctx.JetStream(ctx), db, "ledger", projection.Subject(banking.Aggregate), banking.LedgerProjection{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := banking.TrialBalance(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, l := range lines {
+		total += l.Balance
+	}
+	if total != 0 {
+		t.Errorf("Expected the trial balance to add up to zero, got %+v", lines)
+	}
+	if unbalanced, err := banking.UnbalancedRefs(ctx, db); err != nil || len(unbalanced) != 0 {
+		t.Errorf("Expected no unbalanced refs, got %+v, %v", unbalanced, err)
+	}
+}
+
+func TestRules(t *testing.T) {
+	ctx, nc := setup(t)
+
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.PaymentService{Ctx: ctx},
+		Dedupe:   &eventstore.Dedupe{Key: banking.IdempotencyKey},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Aggregate))
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.RuleService{Ctx: ctx},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.RuleSets))
+	time.Sleep(100 * time.Millisecond)
+
+	rules := []banking.Rule{
+		{Name: "blocked", Kind: banking.RuleBlockedCounterparty, Counterparty: "mallory"},
+		{Name: "daily", Kind: banking.RuleDailyLimit, Limit: 30000},
+		{Name: "max", Kind: banking.RuleMaxAmount, Limit: 50000},
+		{Name: "monthly", Kind: banking.RuleMonthlyLimit, Limit: 60000},
+		{Name: "round", Kind: banking.RuleRoundAmount, Limit: 10000, Multiple: 10000},
+		{Name: "other-currency", Kind: banking.RuleMaxAmount, Currency: "EUR", Limit: 1},
+	}
+	for _, rule := range rules {
+		if _, err := reply.Send(ctx, nc, banking.SetPaymentRule(rule), nil); err != nil {
+			t.Fatalf("Set rule %s: %v", rule.Name, err)
+		}
+	}
+	if _, err := reply.Send(ctx, nc, banking.SetPaymentRule(banking.Rule{Name: "bad", Kind: "nope"}), nil); err == nil {
+		t.Fatal("Expected a rule of unknown kind to be rejected")
+	}
+
+	start := time.Date(2026, 3, 10, 10, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	at := func(cmd *gen.CommandEnvelope, d time.Duration) *gen.CommandEnvelope {
+		cmd.Timestamp = timestamppb.New(start.Add(d))
+		return cmd
+	}
+	steps := []struct {
+		cmd  *gen.CommandEnvelope
+		rule string
+	}{
+		{banking.CreateAccount("A", "USD", 100000, "create-a"), ""},
+		{at(banking.DebitAccount("A", banking.CashAccount, 60000, "USD", "out-1"), 0), "daily"},
+		{at(banking.DebitAccount("A", banking.CashAccount, 19900, "USD", "out-2"), 0), ""},
+		{at(banking.AuthorizeHold("A", "h1", "shop", 9900, "USD", time.Time{}, "auth-1"), 0), ""},
+		// The hold counts towards the limits while it is active.
+		{at(banking.DebitAccount("A", banking.CashAccount, 500, "USD", "out-3"), time.Hour), "daily"},
+		{at(banking.DebitAccount("A", banking.CashAccount, 25000, "USD", "out-4"), day), "daily"},
+		{at(banking.DebitAccount("A", banking.CashAccount, 19000, "USD", "out-5"), day), ""},
+		{at(banking.DebitAccount("A", banking.CashAccount, 15000, "USD", "out-6"), 2*day), "monthly"},
+		{at(banking.DebitAccount("A", banking.CashAccount, 10000, "USD", "out-7"), 2*day), "round"},
+		{at(banking.CreditAccount("mallory", "A", 100, "USD", "in-1"), 2*day), "blocked"},
+		{at(banking.DebitAccount("A", "mallory", 100, "USD", "out-8"), 2*day), "blocked"},
+		{at(banking.CreditAccount(banking.CashAccount, "A", 100, "USD", "in-2"), 2*day), ""},
+		// A new month starts the monthly limit over.
+		{at(banking.DebitAccount("A", banking.CashAccount, 15000, "USD", "out-9"), 22*day), ""},
+	}
+	for _, step := range steps {
+		_, err := reply.Send(ctx, nc, step.cmd, nil)
+		if step.rule == "" && err != nil {
+			t.Fatalf("%s: %v", step.cmd.CommandType, err)
+		}
+		if step.rule != "" && (err == nil || !strings.Contains(err.Error(), "rejected by rule "+step.rule+":")) {
+			t.Fatalf("Expected %s to be rejected by rule %s, got %v", step.cmd.CommandType, step.rule, err)
+		}
+	}
+
+	// A rejected debit sent again is rejected again but audited once.
+	if _, err := reply.Send(ctx, nc, steps[1].cmd, nil); err == nil {
+		t.Fatal("Expected the repeated debit of out-1 to be rejected")
+	}
+
+	fired, err := banking.LoadRuleAudit(ctx, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range fired {
+		got = append(got, f.Rule)
+	}
+	want := []string{"daily", "daily", "daily", "monthly", "round", "blocked", "blocked"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Expected the audit to record %v, got %v", want, got)
+	}
+	if f := fired[0]; f.CommandType != banking.DebitCommand || f.Amount != 60000 || f.Ref != "out-1" || f.Timestamp != start.Unix() {
+		t.Errorf("Expected the first rejection to record the debit of out-1, got %+v", f)
+	}
+	if f := fired[5]; f.Counterparty != "mallory" || f.Reason != "counterparty mallory is blocked" {
+		t.Errorf("Expected the blocked credit to name mallory, got %+v", f)
+	}
+
+	// Removing a rule lets the payment it rejected through.
+	if _, err := reply.Send(ctx, nc, banking.RemovePaymentRule("round"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reply.Send(ctx, nc, banking.RemovePaymentRule("round"), nil); err == nil {
+		t.Error("Expected removing a missing rule to be rejected")
+	}
+	if _, err := reply.Send(ctx, nc, at(banking.DebitAccount("A", banking.CashAccount, 10000, "USD", "out-10"), 22*day), nil); err != nil {
+		t.Fatal(err)
+	}
+	// A debit dated the day before leaves the totals of the last day alone.
+	if _, err := reply.Send(ctx, nc, at(banking.DebitAccount("A", banking.CashAccount, 1000, "USD", "out-11"), 21*day), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	acc, err := banking.LoadAccount(ctx, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(100000 - 19900 - 19000 + 100 - 15000 - 10000 - 1000); acc.Balance != want {
+		t.Errorf("Expected balance %d, got %d", want, acc.Balance)
+	}
+	if acc.Spent.Daily(start.Add(22*day).Unix()) != 25000 {
+		t.Errorf("Expected 250.00 out on the last day, got %+v", acc.Spent)
+	}
+}
+
+func TestRegistrations(t *testing.T) {
+	if err := registry.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,6 +2,7 @@ package banking
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/blinkinglight/bee/gen"
 )
@@ -15,16 +16,142 @@ type CreateAccountCommand struct {
 
 type DebitAccountCommand struct {
 	FromAccountID string `json:"from_account_id"`
-	ToAccountID   string `json:"to_account_id"`
+	ToAccountID   string `json:"to_account_id"` // Counterparty, informational only
 	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"` // Must match the account
 	Ref           string `json:"ref"`
 }
 
 type CreditAccountCommand struct {
+	FromAccountID string      `json:"from_account_id"`
+	ToAccountID   string      `json:"to_account_id"`
+	Amount        int64       `json:"amount"`
+	Currency      string      `json:"currency"` // Must match the account
+	Ref           string      `json:"ref"`
+	Conversion    *Conversion `json:"conversion,omitempty"` // Set when Amount was converted from another currency
+}
+
+type FreezeAccountCommand struct {
+	AccountID string `json:"account_id"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type UnfreezeAccountCommand struct {
+	AccountID string `json:"account_id"`
+}
+
+// CloseAccountCommand closes an account with a zero balance. SweptTo names
+// the account its remaining balance was transferred to, if any.
+type CloseAccountCommand struct {
+	AccountID string `json:"account_id"`
+	SweptTo   string `json:"swept_to,omitempty"`
+}
+
+// SetOverdraftLimitCommand lets the balance of an account go down to -Limit.
+type SetOverdraftLimitCommand struct {
+	AccountID string `json:"account_id"`
+	Limit     int64  `json:"limit"`
+}
+
+// AuthorizeHoldCommand reserves Amount of the available balance until it is
+// captured, voided or expires at ExpiresAt, DefaultHoldTTL after the command
+// if zero. Captures pay ToAccountID, CASH if empty.
+type AuthorizeHoldCommand struct {
+	AccountID   string `json:"account_id"`
+	HoldID      string `json:"hold_id"`
+	ToAccountID string `json:"to_account_id,omitempty"`
+	Amount      int64  `json:"amount"`
+	Currency    string `json:"currency"`
+	ExpiresAt   int64  `json:"expires_at,omitempty"`
+	Ref         string `json:"ref"`
+}
+
+// CaptureHoldCommand charges part or all of what a hold still reserves. It
+// must name the counterparty of the hold as ToAccountID, CASH if empty. Like
+// a debit it only takes the money off the account, so a hold that pays
+// another account is captured by a transfer started with StartCapture,
+// which credits that account.
+type CaptureHoldCommand struct {
+	AccountID   string `json:"account_id"`
+	HoldID      string `json:"hold_id"`
+	ToAccountID string `json:"to_account_id,omitempty"`
+	Amount      int64  `json:"amount"`
+	Currency    string `json:"currency"`
+	Ref         string `json:"ref"`
+}
+
+// VoidHoldCommand releases what a hold still reserves.
+type VoidHoldCommand struct {
+	AccountID string `json:"account_id"`
+	HoldID    string `json:"hold_id"`
+	Ref       string `json:"ref"`
+}
+
+// ExpireHoldsCommand releases the holds that expired. Every other command
+// does so too before it is handled.
+type ExpireHoldsCommand struct {
+	AccountID string `json:"account_id"`
+}
+
+type StartTransferCommand struct {
+	TransferID    string `json:"transfer_id"`
 	FromAccountID string `json:"from_account_id"`
 	ToAccountID   string `json:"to_account_id"`
 	Amount        int64  `json:"amount"`
-	Ref           string `json:"ref"`
+	Currency      string `json:"currency"`
+	ToCurrency    string `json:"to_currency,omitempty"` // Converts at the current rate if it differs from Currency
+	HoldID        string `json:"hold_id,omitempty"`     // Hold of the source the money is captured from
+}
+
+// TransferStepCommand moves a transfer on to its next status.
+type TransferStepCommand struct {
+	TransferID string `json:"transfer_id"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+type SetExchangeRateCommand struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Rate string `json:"rate"` // Decimal units of To per unit of From, e.g. "0.92"
+}
+
+// CreateScheduleCommand sets up a StandingOrder, which uses FromAccountID,
+// ToAccountID, Amount and Currency, or an InterestAccrual, which uses
+// AccountID and Rate. Start defaults to the time of the command.
+type CreateScheduleCommand struct {
+	ScheduleID    string `json:"schedule_id"`
+	Kind          string `json:"kind"`
+	FromAccountID string `json:"from_account_id,omitempty"`
+	ToAccountID   string `json:"to_account_id,omitempty"`
+	AccountID     string `json:"account_id,omitempty"`
+	Amount        int64  `json:"amount,omitempty"`
+	Currency      string `json:"currency,omitempty"`
+	Rate          string `json:"rate,omitempty"` // Decimal share of the balance per run, e.g. "0.001"
+	Start         int64  `json:"start,omitempty"`
+	Every         string `json:"every"` // Go duration between runs, e.g. "720h"
+}
+
+type CancelScheduleCommand struct {
+	ScheduleID string `json:"schedule_id"`
+}
+
+type RecordScheduleRunCommand struct {
+	ScheduleID string `json:"schedule_id"`
+	Run        int64  `json:"run"`
+}
+
+// SetPaymentRuleCommand adds a rule, or replaces the one with its name.
+type SetPaymentRuleCommand struct {
+	Rule Rule `json:"rule"`
+}
+
+type RemovePaymentRuleCommand struct {
+	Name string `json:"name"`
+}
+
+type ReportDiscrepanciesCommand struct {
+	AccountID     string        `json:"account_id"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
 }
 
 func CreateAccount(accountID, currency string, balance int64, ref string) *gen.CommandEnvelope {
@@ -44,11 +171,12 @@ func CreateAccount(accountID, currency string, balance int64, ref string) *gen.C
 	return cmd
 }
 
-func DebitAccount(fromAccountID, toAccountID string, amount int64, ref string) *gen.CommandEnvelope {
+func DebitAccount(fromAccountID, toAccountID string, amount int64, currency, ref string) *gen.CommandEnvelope {
 	payload := &DebitAccountCommand{
 		FromAccountID: fromAccountID,
 		ToAccountID:   toAccountID,
 		Amount:        amount,
+		Currency:      currency,
 		Ref:           ref,
 	}
 	b, _ := json.Marshal(payload)
@@ -61,11 +189,12 @@ func DebitAccount(fromAccountID, toAccountID string, amount int64, ref string) *
 	return cmd
 }
 
-func CreditAccount(fromAccountID, toAccountID string, amount int64, ref string) *gen.CommandEnvelope {
+func CreditAccount(fromAccountID, toAccountID string, amount int64, currency, ref string) *gen.CommandEnvelope {
 	payload := &CreditAccountCommand{
 		FromAccountID: fromAccountID,
 		ToAccountID:   toAccountID,
 		Amount:        amount,
+		Currency:      currency,
 		Ref:           ref,
 	}
 	b, _ := json.Marshal(payload)
@@ -77,3 +206,252 @@ func CreditAccount(fromAccountID, toAccountID string, amount int64, ref string)
 	}
 	return cmd
 }
+
+func FreezeAccount(accountID, reason string) *gen.CommandEnvelope {
+	b, _ := json.Marshal(&FreezeAccountCommand{AccountID: accountID, Reason: reason})
+	cmd := &gen.CommandEnvelope{
+		AggregateId: accountID,
+		Aggregate:   Aggregate,
+		CommandType: FreezeCommand,
+		Payload:     b,
+	}
+	return cmd
+}
+
+func UnfreezeAccount(accountID string) *gen.CommandEnvelope {
+	b, _ := json.Marshal(&UnfreezeAccountCommand{AccountID: accountID})
+	cmd := &gen.CommandEnvelope{
+		AggregateId: accountID,
+		Aggregate:   Aggregate,
+		CommandType: UnfreezeCommand,
+		Payload:     b,
+	}
+	return cmd
+}
+
+func CloseAccount(accountID, sweptTo string) *gen.CommandEnvelope {
+	b, _ := json.Marshal(&CloseAccountCommand{AccountID: accountID, SweptTo: sweptTo})
+	cmd := &gen.CommandEnvelope{
+		AggregateId: accountID,
+		Aggregate:   Aggregate,
+		CommandType: CloseCommand,
+		Payload:     b,
+	}
+	return cmd
+}
+
+func SetOverdraft(accountID string, limit int64) *gen.CommandEnvelope {
+	b, _ := json.Marshal(&SetOverdraftLimitCommand{AccountID: accountID, Limit: limit})
+	cmd := &gen.CommandEnvelope{
+		AggregateId: accountID,
+		Aggregate:   Aggregate,
+		CommandType: SetOverdraftCommand,
+		Payload:     b,
+	}
+	return cmd
+}
+
+func AuthorizeHold(accountID, holdID, toAccountID string, amount int64, currency string, expiresAt time.Time, ref string) *gen.CommandEnvelope {
+	payload := &AuthorizeHoldCommand{
+		AccountID:   accountID,
+		HoldID:      holdID,
+		ToAccountID: toAccountID,
+		Amount:      amount,
+		Currency:    currency,
+		Ref:         ref,
+	}
+	if !expiresAt.IsZero() {
+		payload.ExpiresAt = expiresAt.Unix()
+	}
+	b, _ := json.Marshal(payload)
+	cmd := &gen.CommandEnvelope{
+		AggregateId: accountID,
+		Aggregate:   Aggregate,
+		CommandType: AuthorizeCommand,
+		Payload:     b,
+	}
+	return cmd
+}
+
+func CaptureHold(accountID, holdID string, amount int64, currency, ref string) *gen.CommandEnvelope {
+	b, _ := json.Marshal(&CaptureHoldCommand{AccountID: accountID, HoldID: holdID, Amount: amount, Currency: currency, Ref: ref})
+	cmd := &gen.CommandEnvelope{
+		AggregateId: accountID,
+		Aggregate:   Aggregate,
+		CommandType: CaptureCommand,
+		Payload:     b,
+	}
+	return cmd
+}
+
+func VoidHold(accountID, holdID, ref string) *gen.CommandEnvelope {
+	b, _ := json.Marshal(&VoidHoldCommand{AccountID: accountID, HoldID: holdID, Ref: ref})
+	cmd := &gen.CommandEnvelope{
+		AggregateId: accountID,
+		Aggregate:   Aggregate,
+		CommandType: VoidCommand,
+		Payload:     b,
+	}
+	return cmd
+}
+
+func ExpireHolds(accountID string) *gen.CommandEnvelope {
+	b, _ := json.Marshal(&ExpireHoldsCommand{AccountID: accountID})
+	cmd := &gen.CommandEnvelope{
+		AggregateId: accountID,
+		Aggregate:   Aggregate,
+		CommandType: ExpireCommand,
+		Payload:     b,
+	}
+	return cmd
+}
+
+func StartTransfer(transferID, fromAccountID, toAccountID string, amount int64, currency, toCurrency string) *gen.CommandEnvelope {
+	payload := &StartTransferCommand{
+		TransferID:    transferID,
+		FromAccountID: fromAccountID,
+		ToAccountID:   toAccountID,
+		Amount:        amount,
+		Currency:      currency,
+		ToCurrency:    toCurrency,
+	}
+	b, _ := json.Marshal(payload)
+	cmd := &gen.CommandEnvelope{
+		AggregateId: transferID,
+		Aggregate:   Transfers,
+		CommandType: StartCommand,
+		Payload:     b,
+	}
+	return cmd
+}
+
+// StartCapture starts a transfer that captures amount from hold holdID of
+// accountID and credits it to toAccountID, the counterparty of the hold.
+func StartCapture(transferID, accountID, holdID, toAccountID string, amount int64, currency string) *gen.CommandEnvelope {
+	b, _ := json.Marshal(&StartTransferCommand{
+		TransferID:    transferID,
+		FromAccountID: accountID,
+		ToAccountID:   toAccountID,
+		Amount:        amount,
+		Currency:      currency,
+		HoldID:        holdID,
+	})
+	return &gen.CommandEnvelope{
+		AggregateId: transferID,
+		Aggregate:   Transfers,
+		CommandType: StartCommand,
+		Payload:     b,
+	}
+}
+
+func AdvanceTransfer(transferID, commandType, reason string) *gen.CommandEnvelope {
+	b, _ := json.Marshal(&TransferStepCommand{TransferID: transferID, Reason: reason})
+	cmd := &gen.CommandEnvelope{
+		AggregateId: transferID,
+		Aggregate:   Transfers,
+		CommandType: commandType,
+		Payload:     b,
+	}
+	return cmd
+}
+
+func SetExchangeRate(from, to, rate string) *gen.CommandEnvelope {
+	b, _ := json.Marshal(&SetExchangeRateCommand{From: from, To: to, Rate: rate})
+	cmd := &gen.CommandEnvelope{
+		AggregateId: DefaultRateTable,
+		Aggregate:   RateTables,
+		CommandType: SetRateCommand,
+		Payload:     b,
+	}
+	return cmd
+}
+
+func CreateStandingOrder(scheduleID, fromAccountID, toAccountID string, amount int64, currency string, start time.Time, every time.Duration) *gen.CommandEnvelope {
+	return createSchedule(&CreateScheduleCommand{
+		ScheduleID:    scheduleID,
+		Kind:          StandingOrder,
+		FromAccountID: fromAccountID,
+		ToAccountID:   toAccountID,
+		Amount:        amount,
+		Currency:      currency,
+		Start:         start.Unix(),
+		Every:         every.String(),
+	})
+}
+
+func CreateInterestSchedule(scheduleID, accountID, rate string, start time.Time, every time.Duration) *gen.CommandEnvelope {
+	return createSchedule(&CreateScheduleCommand{
+		ScheduleID: scheduleID,
+		Kind:       InterestAccrual,
+		AccountID:  accountID,
+		Rate:       rate,
+		Start:      start.Unix(),
+		Every:      every.String(),
+	})
+}
+
+func createSchedule(payload *CreateScheduleCommand) *gen.CommandEnvelope {
+	b, _ := json.Marshal(payload)
+	cmd := &gen.CommandEnvelope{
+		AggregateId: payload.ScheduleID,
+		Aggregate:   Schedules,
+		CommandType: ScheduleCreateCommand,
+		Payload:     b,
+	}
+	return cmd
+}
+
+func CancelSchedule(scheduleID string) *gen.CommandEnvelope {
+	b, _ := json.Marshal(&CancelScheduleCommand{ScheduleID: scheduleID})
+	cmd := &gen.CommandEnvelope{
+		AggregateId: scheduleID,
+		Aggregate:   Schedules,
+		CommandType: ScheduleCancelCommand,
+		Payload:     b,
+	}
+	return cmd
+}
+
+func RecordScheduleRun(scheduleID string, run int64) *gen.CommandEnvelope {
+	b, _ := json.Marshal(&RecordScheduleRunCommand{ScheduleID: scheduleID, Run: run})
+	cmd := &gen.CommandEnvelope{
+		AggregateId: scheduleID,
+		Aggregate:   Schedules,
+		CommandType: ScheduleRecordRunCommand,
+		Payload:     b,
+	}
+	return cmd
+}
+
+func ReportDiscrepancies(accountID string, discrepancies []Discrepancy) *gen.CommandEnvelope {
+	b, _ := json.Marshal(&ReportDiscrepanciesCommand{AccountID: accountID, Discrepancies: discrepancies})
+	cmd := &gen.CommandEnvelope{
+		AggregateId: accountID,
+		Aggregate:   Alerts,
+		CommandType: ReportCommand,
+		Payload:     b,
+	}
+	return cmd
+}
+
+func SetPaymentRule(rule Rule) *gen.CommandEnvelope {
+	b, _ := json.Marshal(&SetPaymentRuleCommand{Rule: rule})
+	cmd := &gen.CommandEnvelope{
+		AggregateId: DefaultRuleSet,
+		Aggregate:   RuleSets,
+		CommandType: SetRuleCommand,
+		Payload:     b,
+	}
+	return cmd
+}
+
+func RemovePaymentRule(name string) *gen.CommandEnvelope {
+	b, _ := json.Marshal(&RemovePaymentRuleCommand{Name: name})
+	cmd := &gen.CommandEnvelope{
+		AggregateId: DefaultRuleSet,
+		Aggregate:   RuleSets,
+		CommandType: RemoveRuleCommand,
+		Payload:     b,
+	}
+	return cmd
+}
@@ -1,9 +1,84 @@
 package banking
 
 const Aggregate = "payments"
+
+// CashAccount is the counterparty of money entering or leaving the system,
+// and FXAccount the one that converts between currencies. Neither is a
+// payments aggregate; they only exist in the ledger.
+const CashAccount = "CASH"
+const FXAccount = "FX"
+
 const CreateCommand = "create"
 const CreatedEvent = "created"
 const CreditCommand = "credit"
 const DebitCommand = "debit"
 const DebitedEvent = "debited"
 const CreditedEvent = "credited"
+const FreezeCommand = "freeze"
+const FrozenEvent = "frozen"
+const UnfreezeCommand = "unfreeze"
+const UnfrozenEvent = "unfrozen"
+const CloseCommand = "close"
+const ClosedEvent = "closed"
+const SetOverdraftCommand = "set_overdraft"
+const OverdraftSetEvent = "overdraft_set"
+const AuthorizeCommand = "authorize_hold"
+const HoldAuthorizedEvent = "hold_authorized"
+const CaptureCommand = "capture_hold"
+const HoldCapturedEvent = "hold_captured"
+const VoidCommand = "void_hold"
+const HoldVoidedEvent = "hold_voided"
+const ExpireCommand = "expire_holds"
+const HoldExpiredEvent = "hold_expired"
+
+const Transfers = "transfers"
+const StartCommand = "start"
+const RecordDebitCommand = "record_debit"
+const CompleteCommand = "complete"
+const FailCommand = "fail"
+const RecordRefundCommand = "record_refund"
+const RecordRefundFailedCommand = "record_refund_failed"
+
+// Transfer events; every event but TransferStartedEvent names the status
+// the transfer is in afterwards.
+const TransferStartedEvent = "started"
+const TransferDebitedEvent = "debited"
+const TransferCompletedEvent = "completed"
+const TransferFailedEvent = "failed"
+const TransferRefundedEvent = "refunded"
+const TransferRefundFailedEvent = "refund_failed"
+
+const RateTables = "rates"
+const DefaultRateTable = "default"
+const SetRateCommand = "set_rate"
+const RateSetEvent = "rate_set"
+
+const Schedules = "schedules"
+const ScheduleCreateCommand = "create"
+const ScheduleCreatedEvent = "created"
+const ScheduleCancelCommand = "cancel"
+const ScheduleCancelledEvent = "cancelled"
+const ScheduleRecordRunCommand = "record_run"
+const ScheduleRanEvent = "ran"
+
+// Kinds of schedule: a standing order transfers a fixed amount between two
+// accounts, interest credits (or, on a negative balance, debits) a share of
+// the balance of one account.
+const StandingOrder = "standing_order"
+const InterestAccrual = "interest"
+
+// Alerts are kept per account, under the ID of the account.
+const Alerts = "alerts"
+const ReportCommand = "report"
+const DiscrepancyFoundEvent = "discrepancy_found"
+
+const RuleSets = "rules"
+const DefaultRuleSet = "default"
+const SetRuleCommand = "set_rule"
+const RuleSetEvent = "rule_set"
+const RemoveRuleCommand = "remove_rule"
+const RuleRemovedEvent = "rule_removed"
+
+// Rejections by rules are kept per account, under the ID of the account.
+const RuleAudit = "rule_audit"
+const RuleFiredEvent = "rule_fired"
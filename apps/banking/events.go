@@ -1,19 +1,24 @@
 package banking
 
 type AccountDebited struct {
-	AccountID  string `json:"account_id"`
-	Amount     int64  `json:"amount"`
-	Ref        string `json:"ref"` // e.g. PaymentID
-	NewBalance int64  `json:"new_balance"`
-	Timestamp  int64  `json:"timestamp"`
+	AccountID    string `json:"account_id"`
+	Counterparty string `json:"counterparty,omitempty"` // Account the money went to
+	Amount       int64  `json:"amount"`
+	Currency     string `json:"currency,omitempty"`
+	Ref          string `json:"ref"` // e.g. PaymentID
+	NewBalance   int64  `json:"new_balance"`
+	Timestamp    int64  `json:"timestamp"`
 }
 
 type AccountCredited struct {
-	AccountID  string `json:"account_id"`
-	Amount     int64  `json:"amount"`
-	Ref        string `json:"ref"` // e.g. PaymentID
-	NewBalance int64  `json:"new_balance"`
-	Timestamp  int64  `json:"timestamp"`
+	AccountID    string      `json:"account_id"`
+	Counterparty string      `json:"counterparty,omitempty"` // Account the money came from
+	Amount       int64       `json:"amount"`
+	Currency     string      `json:"currency,omitempty"`
+	Ref          string      `json:"ref"` // e.g. PaymentID
+	NewBalance   int64       `json:"new_balance"`
+	Timestamp    int64       `json:"timestamp"`
+	Conversion   *Conversion `json:"conversion,omitempty"`
 }
 
 type AccountCreated struct {
@@ -23,3 +28,134 @@ type AccountCreated struct {
 	Ref       string `json:"ref"` // e.g. PaymentID
 	Timestamp int64  `json:"timestamp"`
 }
+
+type AccountFrozen struct {
+	AccountID string `json:"account_id"`
+	Reason    string `json:"reason,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type AccountUnfrozen struct {
+	AccountID string `json:"account_id"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type AccountClosed struct {
+	AccountID string `json:"account_id"`
+	SweptTo   string `json:"swept_to,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type OverdraftLimitSet struct {
+	AccountID string `json:"account_id"`
+	Limit     int64  `json:"limit"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type HoldAuthorized struct {
+	AccountID    string `json:"account_id"`
+	HoldID       string `json:"hold_id"`
+	Counterparty string `json:"counterparty,omitempty"` // Account captures are paid to
+	Amount       int64  `json:"amount"`
+	Currency     string `json:"currency"`
+	Ref          string `json:"ref"`
+	ExpiresAt    int64  `json:"expires_at"`
+	Timestamp    int64  `json:"timestamp"`
+}
+
+// HoldCaptured is followed by the AccountDebited event that takes the
+// captured amount off the balance.
+type HoldCaptured struct {
+	AccountID string `json:"account_id"`
+	HoldID    string `json:"hold_id"`
+	Amount    int64  `json:"amount"`
+	Remaining int64  `json:"remaining"` // Still held afterwards
+	Ref       string `json:"ref"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// HoldReleased is the payload of HoldVoidedEvent and HoldExpiredEvent. The
+// rest of the hold is available again.
+type HoldReleased struct {
+	AccountID string `json:"account_id"`
+	HoldID    string `json:"hold_id"`
+	Amount    int64  `json:"amount"` // Released
+	Ref       string `json:"ref,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type TransferStarted struct {
+	TransferID    string `json:"transfer_id"`
+	FromAccountID string `json:"from_account_id"`
+	ToAccountID   string `json:"to_account_id"`
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	ToCurrency    string `json:"to_currency,omitempty"`
+	ToAmount      int64  `json:"to_amount,omitempty"` // Amount converted at Rate
+	Rate          string `json:"rate,omitempty"`
+	HoldID        string `json:"hold_id,omitempty"` // Hold the source is charged through
+	Timestamp     int64  `json:"timestamp"`
+}
+
+// TransferStepped is the payload of every transfer event after
+// TransferStarted; the event type is the new status.
+type TransferStepped struct {
+	TransferID string `json:"transfer_id"`
+	Reason     string `json:"reason,omitempty"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+type ExchangeRateSet struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Rate      string `json:"rate"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type ScheduleCreated struct {
+	ScheduleID    string `json:"schedule_id"`
+	Kind          string `json:"kind"`
+	FromAccountID string `json:"from_account_id,omitempty"`
+	ToAccountID   string `json:"to_account_id,omitempty"`
+	AccountID     string `json:"account_id,omitempty"`
+	Amount        int64  `json:"amount,omitempty"`
+	Currency      string `json:"currency,omitempty"`
+	Rate          string `json:"rate,omitempty"`
+	Start         int64  `json:"start"` // Unix time of the first run
+	Every         int64  `json:"every"` // Seconds between runs
+	Timestamp     int64  `json:"timestamp"`
+}
+
+type ScheduleCancelled struct {
+	ScheduleID string `json:"schedule_id"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// ScheduleRan records that the command of run Run was published.
+type ScheduleRan struct {
+	ScheduleID string `json:"schedule_id"`
+	Run        int64  `json:"run"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+type PaymentRuleSet struct {
+	Rule      Rule  `json:"rule"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+type PaymentRuleRemoved struct {
+	Name      string `json:"name"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// RuleFired records a payments command a rule rejected.
+type RuleFired struct {
+	AccountID    string `json:"account_id"`
+	Rule         string `json:"rule"`
+	Reason       string `json:"reason"`
+	CommandType  string `json:"command_type"`
+	Amount       int64  `json:"amount"`
+	Counterparty string `json:"counterparty,omitempty"`
+	Ref          string `json:"ref,omitempty"`
+	Timestamp    int64  `json:"timestamp"`
+}
@@ -0,0 +1,117 @@
+package banking
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultExpiryInterval is how often HoldExpirer.Run looks for expired holds
+// when Interval is zero.
+const DefaultExpiryInterval = time.Minute
+
+// accountIndex keeps every account up to date from the payments history,
+// reading only the events stored since it was last updated.
+type accountIndex struct {
+	read     uint64                       // Stream sequence of the last event read
+	accounts map[string]*PaymentAggregate // By ID
+}
+
+// update applies the payments events stored since the last update.
+func (ix *accountIndex) update(ctx context.Context) error {
+	if ix.accounts == nil {
+		ix.accounts = map[string]*PaymentAggregate{}
+	}
+	var err error
+	ix.read, err = eventstore.ReadAfter(ctx, Aggregate, "*", ix.read, func(e *gen.EventEnvelope, _ time.Time) error {
+		a, ok := ix.accounts[e.AggregateId]
+		if !ok {
+			a = &PaymentAggregate{ID: e.AggregateId}
+			ix.accounts[e.AggregateId] = a
+		}
+		if err := a.ApplyEvent(e); err != nil {
+			log.Printf("Account index: skipping %s event of %s: %v", e.EventType, e.AggregateId, err)
+		}
+		return nil
+	})
+	return err
+}
+
+// HoldExpirer releases holds once they expire, so the available balance
+// goes back up without waiting for the next command on the account.
+type HoldExpirer struct {
+	Ctx      context.Context
+	NC       *nats.Conn
+	Clock    Clock         // System clock if nil
+	Interval time.Duration // How often Run looks, DefaultExpiryInterval if zero
+
+	index accountIndex // Accounts as of the last Tick, so a Tick only reads new events
+}
+
+func (x *HoldExpirer) now() time.Time {
+	if x.Clock == nil {
+		return time.Now()
+	}
+	return x.Clock.Now()
+}
+
+// Run expires holds every Interval until ctx is cancelled.
+func (x *HoldExpirer) Run(ctx context.Context) error {
+	interval := x.Interval
+	if interval == 0 {
+		interval = DefaultExpiryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := x.Tick(); err != nil {
+			log.Printf("Hold expirer: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Tick sends ExpireHolds to every open account with a hold that expired by
+// now. It is not safe for concurrent use.
+func (x *HoldExpirer) Tick() error {
+	if err := x.index.update(x.Ctx); err != nil {
+		return err
+	}
+	now := x.now()
+	var errs []error
+	for _, id := range slices.Sorted(maps.Keys(x.index.accounts)) {
+		a := x.index.accounts[id]
+		if a.Closed || !a.hasExpired(now.Unix()) {
+			continue
+		}
+		cmd := ExpireHolds(a.ID)
+		cmd.Timestamp = timestamppb.New(now)
+		if _, err := reply.Send(x.Ctx, x.NC, cmd, nil); err != nil {
+			errs = append(errs, fmt.Errorf("expire holds of %s: %w", a.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (a *PaymentAggregate) hasExpired(now int64) bool {
+	for _, h := range a.Holds {
+		if h.Status == HoldStatusActive && h.ExpiresAt <= now {
+			return true
+		}
+	}
+	return false
+}
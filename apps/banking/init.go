@@ -1,10 +1,115 @@
 package banking
 
-import "github.com/blinkinglight/bee"
+import "github.com/blinkinglight/gobeego/pkg/registry"
 
-func init() {
-	bee.RegisterEvent[AccountDebited]("accounts", "debited")
-	bee.RegisterEvent[AccountCredited]("accounts", "credited")
+var transferSteps = []string{RecordDebitCommand, CompleteCommand, FailCommand, RecordRefundCommand, RecordRefundFailedCommand}
+
+// App declares the aggregates of banking and what its handlers and workers
+// send.
+var App = registry.App{
+	Name: "banking",
+	Aggregates: []registry.Aggregate{
+		{
+			Name: Aggregate,
+			Commands: []registry.Type{
+				registry.Of[CreateAccountCommand](CreateCommand),
+				registry.Of[DebitAccountCommand](DebitCommand),
+				registry.Of[CreditAccountCommand](CreditCommand),
+				registry.Of[FreezeAccountCommand](FreezeCommand),
+				registry.Of[UnfreezeAccountCommand](UnfreezeCommand),
+				registry.Of[CloseAccountCommand](CloseCommand),
+				registry.Of[SetOverdraftLimitCommand](SetOverdraftCommand),
+				registry.Of[AuthorizeHoldCommand](AuthorizeCommand),
+				registry.Of[CaptureHoldCommand](CaptureCommand),
+				registry.Of[VoidHoldCommand](VoidCommand),
+				registry.Of[ExpireHoldsCommand](ExpireCommand),
+			},
+			Events: []registry.Type{
+				registry.Of[AccountCreated](CreatedEvent),
+				registry.Of[AccountDebited](DebitedEvent),
+				registry.Of[AccountCredited](CreditedEvent),
+				registry.Of[AccountFrozen](FrozenEvent),
+				registry.Of[AccountUnfrozen](UnfrozenEvent),
+				registry.Of[AccountClosed](ClosedEvent),
+				registry.Of[OverdraftLimitSet](OverdraftSetEvent),
+				registry.Of[HoldAuthorized](HoldAuthorizedEvent),
+				registry.Of[HoldCaptured](HoldCapturedEvent),
+				registry.Of[HoldReleased](HoldVoidedEvent),
+				registry.Of[HoldReleased](HoldExpiredEvent),
+			},
+		},
+		{
+			Name: Transfers,
+			Commands: append(
+				[]registry.Type{registry.Of[StartTransferCommand](StartCommand)},
+				registry.Each[TransferStepCommand](transferSteps...)...,
+			),
+			Events: append(
+				[]registry.Type{registry.Of[TransferStarted](TransferStartedEvent)},
+				registry.Each[TransferStepped](TransferDebitedEvent, TransferCompletedEvent, TransferFailedEvent, TransferRefundedEvent, TransferRefundFailedEvent)...,
+			),
+		},
+		{
+			Name:     RateTables,
+			Commands: []registry.Type{registry.Of[SetExchangeRateCommand](SetRateCommand)},
+			Events:   []registry.Type{registry.Of[ExchangeRateSet](RateSetEvent)},
+		},
+		{
+			Name: Schedules,
+			Commands: []registry.Type{
+				registry.Of[CreateScheduleCommand](ScheduleCreateCommand),
+				registry.Of[CancelScheduleCommand](ScheduleCancelCommand),
+				registry.Of[RecordScheduleRunCommand](ScheduleRecordRunCommand),
+			},
+			Events: []registry.Type{
+				registry.Of[ScheduleCreated](ScheduleCreatedEvent),
+				registry.Of[ScheduleCancelled](ScheduleCancelledEvent),
+				registry.Of[ScheduleRan](ScheduleRanEvent),
+			},
+		},
+		{
+			Name:     Alerts,
+			Commands: []registry.Type{registry.Of[ReportDiscrepanciesCommand](ReportCommand)},
+			Events:   []registry.Type{registry.Of[Discrepancy](DiscrepancyFoundEvent)},
+		},
+		{
+			Name: RuleSets,
+			Commands: []registry.Type{
+				registry.Of[SetPaymentRuleCommand](SetRuleCommand),
+				registry.Of[RemovePaymentRuleCommand](RemoveRuleCommand),
+			},
+			Events: []registry.Type{
+				registry.Of[PaymentRuleSet](RuleSetEvent),
+				registry.Of[PaymentRuleRemoved](RuleRemovedEvent),
+			},
+		},
+		{
+			Name:   RuleAudit,
+			Events: []registry.Type{registry.Of[RuleFired](RuleFiredEvent)},
+		},
+	},
+	Uses: []registry.Use{
+		registry.Emits("PaymentService", Aggregate, CreatedEvent, DebitedEvent, CreditedEvent, FrozenEvent, UnfrozenEvent, ClosedEvent, OverdraftSetEvent,
+			HoldAuthorizedEvent, HoldCapturedEvent, HoldVoidedEvent, HoldExpiredEvent),
+		registry.Emits("PaymentService", RuleAudit, RuleFiredEvent),
+		registry.Emits("TransferService", Transfers, TransferStartedEvent, TransferDebitedEvent, TransferCompletedEvent, TransferFailedEvent, TransferRefundedEvent, TransferRefundFailedEvent),
+		registry.Emits("RateService", RateTables, RateSetEvent),
+		registry.Emits("ScheduleService", Schedules, ScheduleCreatedEvent, ScheduleCancelledEvent, ScheduleRanEvent),
+		registry.Emits("AlertService", Alerts, DiscrepancyFoundEvent),
+		registry.Emits("RuleService", RuleSets, RuleSetEvent, RuleRemovedEvent),
 
-	bee.RegisterCommand[DebitAccountCommand]("accounts", "debit")
+		registry.Publishes("TransferSaga", Aggregate, DebitCommand, CaptureCommand, CreditCommand),
+		registry.Publishes("TransferSaga", Transfers, transferSteps...),
+		registry.Publishes("RunTransfer", Transfers, StartCommand),
+		registry.Publishes("SweepAndClose", Aggregate, CloseCommand),
+		registry.Publishes("Scheduler", Aggregate, DebitCommand, CreditCommand),
+		registry.Publishes("Scheduler", Transfers, StartCommand),
+		registry.Publishes("Scheduler", Schedules, ScheduleRecordRunCommand),
+		registry.Publishes("Reconciler", Alerts, ReportCommand),
+		registry.Publishes("HoldExpirer", Aggregate, ExpireCommand),
+	},
+}
+
+func init() {
+	registry.Register(App)
 }
@@ -0,0 +1,145 @@
+package banking
+
+import (
+	"context"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/rwdb"
+)
+
+// LedgerEntry is one line of a journal entry. Amount is positive for money
+// going into Account and negative for money leaving it, so the lines sharing
+// a Ref add up to zero per currency once every movement behind it happened.
+type LedgerEntry struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	Ref          string    `json:"ref" gorm:"index"`
+	Account      string    `json:"account" gorm:"index"`
+	Counterparty string    `json:"counterparty"`
+	Currency     string    `json:"currency"`
+	Amount       int64     `json:"amount"`
+	Event        string    `json:"event"` // Type of the event behind the line
+	Timestamp    time.Time `json:"timestamp"`
+	Balance      int64     `json:"balance" gorm:"-"` // Running balance, set by AccountLedger
+}
+
+// LedgerProjection books payments events as journal entries. Every event
+// books the account it belongs to; the other side of a movement comes from
+// the event of the counterparty with the same Ref. Money from or to
+// CashAccount, which has no events, and currency conversions, which net out
+// on FXAccount, are booked on both sides at once.
+type LedgerProjection struct{}
+
+func (LedgerProjection) ApplyEventTx(tx *rwdb.Tx, e *gen.EventEnvelope) error {
+	ev, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return err
+	}
+
+	var lines []LedgerEntry
+	book := func(account, counterparty, currency string, amount int64) {
+		lines = append(lines, LedgerEntry{Account: account, Counterparty: counterparty, Currency: currency, Amount: amount})
+	}
+	var ref string
+	var at int64
+	switch ev := ev.(type) {
+	case *AccountCreated:
+		if ev.Balance == 0 {
+			return nil
+		}
+		ref, at = ev.Ref, ev.Timestamp
+		book(ev.AccountID, CashAccount, ev.Currency, ev.Balance)
+		book(CashAccount, ev.AccountID, ev.Currency, -ev.Balance)
+	case *AccountDebited:
+		ref, at = ev.Ref, ev.Timestamp
+		book(ev.AccountID, ev.Counterparty, ev.Currency, -ev.Amount)
+		if ev.Counterparty == CashAccount {
+			book(CashAccount, ev.AccountID, ev.Currency, ev.Amount)
+		}
+	case *AccountCredited:
+		ref, at = ev.Ref, ev.Timestamp
+		book(ev.AccountID, ev.Counterparty, ev.Currency, ev.Amount)
+		currency, amount := ev.Currency, ev.Amount
+		if fx := ev.Conversion; fx != nil {
+			book(FXAccount, ev.AccountID, ev.Currency, -ev.Amount)
+			book(FXAccount, ev.Counterparty, fx.FromCurrency, fx.FromAmount)
+			currency, amount = fx.FromCurrency, fx.FromAmount
+		}
+		if ev.Counterparty == CashAccount {
+			book(CashAccount, ev.AccountID, currency, -amount)
+		}
+	default:
+		return nil // Ignore other event types
+	}
+
+	for i := range lines {
+		lines[i].Ref = ref
+		lines[i].Event = e.EventType
+		lines[i].Timestamp = time.Unix(at, 0)
+	}
+	return tx.Create(&lines).Error
+}
+
+// TrialBalanceLine sums the ledger of one account in one currency.
+type TrialBalanceLine struct {
+	Account  string `json:"account"`
+	Currency string `json:"currency"`
+	Debits   int64  `json:"debits"`  // Money out of the account
+	Credits  int64  `json:"credits"` // Money into the account
+	Balance  int64  `json:"balance"` // Credits minus debits
+}
+
+// TrialBalance sums the ledger per account and currency. The balances of a
+// currency add up to zero unless some Ref is unbalanced.
+func TrialBalance(ctx context.Context, db *rwdb.DB) ([]TrialBalanceLine, error) {
+	var lines []TrialBalanceLine
+	err := db.ReadTX(ctx, func(tx *rwdb.Tx) error {
+		return tx.Model(&LedgerEntry{}).
+			Select("account, currency, " +
+				"SUM(CASE WHEN amount < 0 THEN -amount ELSE 0 END) AS debits, " +
+				"SUM(CASE WHEN amount > 0 THEN amount ELSE 0 END) AS credits, " +
+				"SUM(amount) AS balance").
+			Group("account, currency").
+			Order("account, currency").
+			Scan(&lines).Error
+	})
+	return lines, err
+}
+
+// AccountLedger lists the ledger lines of an account in the order they were
+// booked, each with the balance after it.
+func AccountLedger(ctx context.Context, db *rwdb.DB, account string) ([]LedgerEntry, error) {
+	var entries []LedgerEntry
+	err := db.ReadTX(ctx, func(tx *rwdb.Tx) error {
+		return tx.Where("account = ?", account).Order("id").Find(&entries).Error
+	})
+	balances := map[string]int64{}
+	for i := range entries {
+		balances[entries[i].Currency] += entries[i].Amount
+		entries[i].Balance = balances[entries[i].Currency]
+	}
+	return entries, err
+}
+
+// Imbalance is a Ref whose ledger lines in a currency do not add up to zero.
+type Imbalance struct {
+	Ref      string `json:"ref"`
+	Currency string `json:"currency"`
+	Amount   int64  `json:"amount"` // Sum of the lines
+}
+
+// UnbalancedRefs lists the Refs whose lines do not add up to zero. A transfer
+// in progress shows up here between its debit and its credit.
+func UnbalancedRefs(ctx context.Context, db *rwdb.DB) ([]Imbalance, error) {
+	var out []Imbalance
+	err := db.ReadTX(ctx, func(tx *rwdb.Tx) error {
+		return tx.Model(&LedgerEntry{}).
+			Select("ref, currency, SUM(amount) AS amount").
+			Group("ref, currency").
+			Having("SUM(amount) <> 0").
+			Order("ref, currency").
+			Scan(&out).Error
+	})
+	return out, err
+}
@@ -0,0 +1,19 @@
+package banking
+
+import "time"
+
+// Transfer is the read model row of a transfer, kept by TransferProjection.
+type Transfer struct {
+	ID            string    `json:"id" gorm:"primaryKey"`
+	FromAccountID string    `json:"from_account_id" gorm:"index"`
+	ToAccountID   string    `json:"to_account_id" gorm:"index"`
+	Amount        int64     `json:"amount"`
+	Currency      string    `json:"currency"`
+	ToAmount      int64     `json:"to_amount"` // Amount credited to the destination
+	ToCurrency    string    `json:"to_currency"`
+	Rate          string    `json:"rate"` // Exchange rate, empty if not converted
+	Status        string    `json:"status"`
+	Reason        string    `json:"reason"` // Why the transfer failed or was refunded
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
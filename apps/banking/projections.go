@@ -0,0 +1,64 @@
+package banking
+
+import (
+	"context"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/rwdb"
+	"gorm.io/gorm/clause"
+)
+
+// TransferProjection keeps the Transfer table in line with transfer events.
+type TransferProjection struct{}
+
+func (TransferProjection) ApplyEventTx(tx *rwdb.Tx, e *gen.EventEnvelope) error {
+	ev, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return err
+	}
+	switch ev := ev.(type) {
+	case *TransferStarted:
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(TransferRow(ev)).Error
+	case *TransferStepped:
+		return tx.Model(&Transfer{}).Where("id = ?", ev.TransferID).Updates(map[string]any{
+			"status":     e.EventType,
+			"reason":     ev.Reason,
+			"updated_at": time.Unix(ev.Timestamp, 0),
+		}).Error
+	}
+	return nil
+}
+
+// TransferRow is the read model row of a transfer that just started.
+func TransferRow(ev *TransferStarted) *Transfer {
+	at := time.Unix(ev.Timestamp, 0)
+	t := &Transfer{
+		ID:            ev.TransferID,
+		FromAccountID: ev.FromAccountID,
+		ToAccountID:   ev.ToAccountID,
+		Amount:        ev.Amount,
+		Currency:      ev.Currency,
+		ToAmount:      ev.Amount,
+		ToCurrency:    ev.Currency,
+		Status:        TransferStatusStarted,
+		CreatedAt:     at,
+		UpdatedAt:     at,
+	}
+	if ev.Rate != "" {
+		t.ToAmount, t.ToCurrency, t.Rate = ev.ToAmount, ev.ToCurrency, ev.Rate
+	}
+	return t
+}
+
+// TransferHistory lists the transfers from or to an account, newest first.
+func TransferHistory(ctx context.Context, db *rwdb.DB, accountID string) ([]Transfer, error) {
+	var transfers []Transfer
+	err := db.ReadTX(ctx, func(tx *rwdb.Tx) error {
+		return tx.Where("from_account_id = ? OR to_account_id = ?", accountID, accountID).
+			Order("created_at DESC").
+			Find(&transfers).Error
+	})
+	return transfers, err
+}
@@ -0,0 +1,150 @@
+package banking
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+)
+
+// Conversion records the exchange behind a converted amount, so the credit
+// it produced can be traced back to the rate in force at the time.
+type Conversion struct {
+	FromCurrency string `json:"from_currency"`
+	FromAmount   int64  `json:"from_amount"`
+	Rate         string `json:"rate"`
+}
+
+// ParseRate reads a decimal exchange rate, which must be positive.
+func ParseRate(rate string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok || r.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid exchange rate %q", rate)
+	}
+	return r, nil
+}
+
+// Convert multiplies amount by rate, rounding half away from zero to whole
+// cents.
+func Convert(amount int64, rate string) (int64, error) {
+	r, err := ParseRate(rate)
+	if err != nil {
+		return 0, err
+	}
+	v := new(big.Rat).Mul(new(big.Rat).SetInt64(amount), r)
+	q, m := new(big.Int).QuoRem(v.Num(), v.Denom(), new(big.Int))
+	if m.Abs(m).Lsh(m, 1).Cmp(v.Denom()) >= 0 {
+		if v.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	if !q.IsInt64() {
+		return 0, errors.New("converted amount out of range")
+	}
+	return q.Int64(), nil
+}
+
+func ratePair(from, to string) string {
+	return from + "/" + to
+}
+
+// RateTable holds the exchange rate of every currency pair that was set.
+// Rates are directional: USD/EUR does not imply EUR/USD.
+type RateTable struct {
+	ID    string
+	Rates map[string]string
+}
+
+// Rate returns the rate that converts from one currency into another.
+func (t *RateTable) Rate(from, to string) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+	rate, ok := t.Rates[ratePair(from, to)]
+	return rate, ok
+}
+
+func (t *RateTable) ApplyEvent(e *gen.EventEnvelope) error {
+	ev, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return err
+	}
+	switch ev := ev.(type) {
+	case *ExchangeRateSet:
+		if t.Rates == nil {
+			t.Rates = map[string]string{}
+		}
+		t.Rates[ratePair(ev.From, ev.To)] = ev.Rate
+	default:
+		return fmt.Errorf("unknown event type: %T", ev)
+	}
+	return nil
+}
+
+func (t *RateTable) ApplyCommand(c *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	cmd, err := bee.UnmarshalCommand(c)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cmd := cmd.(type) {
+	case *SetExchangeRateCommand:
+		if cmd.From == "" || cmd.To == "" {
+			return nil, errors.New("both currencies are required")
+		}
+		if cmd.From == cmd.To {
+			return nil, errors.New("cannot set a rate between the same currency")
+		}
+		if _, err := ParseRate(cmd.Rate); err != nil {
+			return nil, err
+		}
+		b, _ := json.Marshal(&ExchangeRateSet{
+			From:      cmd.From,
+			To:        cmd.To,
+			Rate:      cmd.Rate,
+			Timestamp: commandTime(c),
+		})
+		return []*gen.EventEnvelope{{
+			AggregateId:   c.AggregateId,
+			AggregateType: RateTables,
+			EventType:     RateSetEvent,
+			Payload:       b,
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unknown command type: %T", cmd)
+	}
+}
+
+type RateService struct {
+	Ctx context.Context
+}
+
+func (s *RateService) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	agg := &RateTable{ID: m.AggregateId}
+	version, err := eventstore.Replay(s.Ctx, agg, m.Aggregate, m.AggregateId)
+	if err != nil {
+		return nil, err
+	}
+	if err := eventstore.Check(m, version); err != nil {
+		return nil, err
+	}
+	events, err := agg.ApplyCommand(m)
+	return eventstore.Expect(m, version, events), reply.Refuse(err)
+}
+
+// LoadRates replays the default rate table.
+func LoadRates(ctx context.Context) (*RateTable, error) {
+	agg := &RateTable{ID: DefaultRateTable}
+	if _, err := eventstore.Replay(ctx, agg, RateTables, DefaultRateTable); err != nil {
+		return nil, err
+	}
+	return agg, nil
+}
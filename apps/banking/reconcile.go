@@ -0,0 +1,267 @@
+package banking
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultReconcileInterval is how often Reconciler.Run reconciles when
+// Interval is zero.
+const DefaultReconcileInterval = time.Hour
+
+// Kinds of discrepancy: the NewBalance recorded on a debit or credit is not
+// the balance replaying the account gives, or AccountAggregate replays the
+// account to another balance than PaymentAggregate.
+const (
+	DiscrepancyNewBalance       = "new_balance"
+	DiscrepancyAccountAggregate = "account_aggregate"
+)
+
+// Discrepancy is a balance that disagrees with the one computed by replaying
+// the account. It is also the payload of the alert events.
+type Discrepancy struct {
+	AccountID string    `json:"account_id"`
+	Kind      string    `json:"kind"`
+	Event     int       `json:"event"` // Position of the event in the account's history, from 1
+	EventType string    `json:"event_type"`
+	Ref       string    `json:"ref,omitempty"`
+	Recorded  int64     `json:"recorded"`
+	Computed  int64     `json:"computed"`
+	Stored    time.Time `json:"stored"`
+}
+
+func (d Discrepancy) key() string {
+	return d.Kind + "/" + strconv.Itoa(d.Event)
+}
+
+// Reconciliation is the outcome of reconciling every account.
+type Reconciliation struct {
+	Checked       time.Time     `json:"checked"`
+	Accounts      int           `json:"accounts"`
+	Events        int           `json:"events"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+}
+
+type reconciler struct {
+	payment PaymentAggregate
+	account AccountAggregate
+	events  int
+	found   []Discrepancy
+}
+
+func (r *reconciler) apply(e *gen.EventEnvelope, stored time.Time) {
+	r.events++
+	if err := r.payment.ApplyEvent(e); err != nil {
+		log.Printf("Reconcile %s: skipping event %d: %v", e.AggregateId, r.events, err)
+		return
+	}
+	if err := r.account.ApplyEvent(e); err != nil {
+		log.Printf("Reconcile %s: account aggregate cannot apply event %d: %v", e.AggregateId, r.events, err)
+	}
+	d := Discrepancy{AccountID: e.AggregateId, Event: r.events, EventType: e.EventType, Computed: r.payment.Balance, Stored: stored}
+	if r.account.Balance != r.payment.Balance {
+		d.Kind, d.Recorded = DiscrepancyAccountAggregate, r.account.Balance
+		r.found = append(r.found, d)
+		// Carry on from the balance PaymentAggregate decides on.
+		r.account.Balance = r.payment.Balance
+	}
+
+	ev, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return
+	}
+	switch ev := ev.(type) {
+	case *AccountDebited:
+		d.Ref, d.Recorded = ev.Ref, ev.NewBalance
+	case *AccountCredited:
+		d.Ref, d.Recorded = ev.Ref, ev.NewBalance
+	default:
+		return
+	}
+	if d.Recorded != d.Computed {
+		d.Kind = DiscrepancyNewBalance
+		r.found = append(r.found, d)
+	}
+}
+
+// ReconcileAccount replays one account and returns the balances recorded on
+// its events that disagree with the replay.
+func ReconcileAccount(ctx context.Context, id string) ([]Discrepancy, error) {
+	r := &reconciler{payment: PaymentAggregate{ID: id}, account: AccountAggregate{ID: id}}
+	err := eventstore.Read(ctx, Aggregate, id, func(e *gen.EventEnvelope, stored time.Time) error {
+		r.apply(e, stored)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if r.events == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrAccountNotFound, id)
+	}
+	return r.found, nil
+}
+
+// Reconcile replays every account in one pass over the payments history.
+func Reconcile(ctx context.Context) (*Reconciliation, error) {
+	accounts := map[string]*reconciler{}
+	events := 0
+	err := eventstore.Read(ctx, Aggregate, "*", func(e *gen.EventEnvelope, stored time.Time) error {
+		r, ok := accounts[e.AggregateId]
+		if !ok {
+			r = &reconciler{payment: PaymentAggregate{ID: e.AggregateId}, account: AccountAggregate{ID: e.AggregateId}}
+			accounts[e.AggregateId] = r
+		}
+		r.apply(e, stored)
+		events++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := &Reconciliation{Checked: time.Now().UTC(), Accounts: len(accounts), Events: events, Discrepancies: []Discrepancy{}}
+	for _, r := range accounts {
+		out.Discrepancies = append(out.Discrepancies, r.found...)
+	}
+	slices.SortFunc(out.Discrepancies, func(a, b Discrepancy) int {
+		if c := strings.Compare(a.AccountID, b.AccountID); c != 0 {
+			return c
+		}
+		return a.Event - b.Event
+	})
+	return out, nil
+}
+
+// AlertLog is the aggregate of the discrepancies reported for one account.
+// Every discrepancy becomes one DiscrepancyFoundEvent, however often it is
+// reported.
+type AlertLog struct {
+	ID       string
+	Reported map[string]bool
+}
+
+func (a *AlertLog) ApplyEvent(e *gen.EventEnvelope) error {
+	ev, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return err
+	}
+	switch ev := ev.(type) {
+	case *Discrepancy:
+		if a.Reported == nil {
+			a.Reported = map[string]bool{}
+		}
+		a.Reported[ev.key()] = true
+	default:
+		return fmt.Errorf("unknown event type: %T", ev)
+	}
+	return nil
+}
+
+func (a *AlertLog) ApplyCommand(c *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	cmd, err := bee.UnmarshalCommand(c)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cmd := cmd.(type) {
+	case *ReportDiscrepanciesCommand:
+		var events []*gen.EventEnvelope
+		for _, d := range cmd.Discrepancies {
+			if d.AccountID != c.AggregateId {
+				return nil, fmt.Errorf("discrepancy of %s reported for %s", d.AccountID, c.AggregateId)
+			}
+			if a.Reported[d.key()] {
+				continue
+			}
+			b, _ := json.Marshal(d)
+			events = append(events, &gen.EventEnvelope{
+				AggregateId:   c.AggregateId,
+				AggregateType: Alerts,
+				EventType:     DiscrepancyFoundEvent,
+				Payload:       b,
+			})
+		}
+		return events, nil
+	default:
+		return nil, fmt.Errorf("unknown command type: %T", cmd)
+	}
+}
+
+type AlertService struct {
+	Ctx context.Context
+}
+
+func (s *AlertService) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	agg := &AlertLog{ID: m.AggregateId}
+	version, err := eventstore.Replay(s.Ctx, agg, m.Aggregate, m.AggregateId)
+	if err != nil {
+		return nil, err
+	}
+	if err := eventstore.Check(m, version); err != nil {
+		return nil, err
+	}
+	events, err := agg.ApplyCommand(m)
+	return eventstore.Expect(m, version, events), reply.Refuse(err)
+}
+
+// Reconciler reconciles every account periodically and raises an alert
+// event for each discrepancy it has not reported before.
+type Reconciler struct {
+	Ctx      context.Context
+	NC       *nats.Conn
+	Interval time.Duration // How often Run reconciles, DefaultReconcileInterval if zero
+}
+
+// Run reconciles every Interval until ctx is cancelled.
+func (r *Reconciler) Run(ctx context.Context) error {
+	interval := r.Interval
+	if interval == 0 {
+		interval = DefaultReconcileInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if rec, err := r.Once(); err != nil {
+			log.Printf("Reconciler: %v", err)
+		} else if len(rec.Discrepancies) > 0 {
+			log.Printf("Reconciler: %d discrepancies in %d accounts", len(rec.Discrepancies), rec.Accounts)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Once reconciles every account and reports the discrepancies as alerts.
+func (r *Reconciler) Once() (*Reconciliation, error) {
+	rec, err := Reconcile(r.Ctx)
+	if err != nil {
+		return nil, err
+	}
+	byAccount := map[string][]Discrepancy{}
+	for _, d := range rec.Discrepancies {
+		byAccount[d.AccountID] = append(byAccount[d.AccountID], d)
+	}
+	var errs []error
+	for id, found := range byAccount {
+		if _, err := reply.Send(r.Ctx, r.NC, ReportDiscrepancies(id, found), nil); err != nil {
+			errs = append(errs, fmt.Errorf("report %s: %w", id, err))
+		}
+	}
+	return rec, errors.Join(errs...)
+}
@@ -0,0 +1,355 @@
+package banking
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/appctx"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+)
+
+// Kinds of rule. Amount rules apply to debits and holds, blocked
+// counterparties to credits as well.
+const (
+	RuleMaxAmount           = "max_amount"           // Amount over Limit
+	RuleDailyLimit          = "daily_limit"          // Money out on one UTC day over Limit
+	RuleMonthlyLimit        = "monthly_limit"        // Money out in one UTC month over Limit
+	RuleBlockedCounterparty = "blocked_counterparty" // Money to or from Counterparty
+	RuleRoundAmount         = "round_amount"         // Amount of at least Limit that is a multiple of Multiple
+)
+
+// Rule is one check PaymentService runs before it handles a debit, hold or
+// credit. AccountID and Currency narrow a rule down; empty, it applies to
+// every account.
+type Rule struct {
+	Name         string `json:"name"`
+	Kind         string `json:"kind"`
+	AccountID    string `json:"account_id,omitempty"`
+	Currency     string `json:"currency,omitempty"`
+	Limit        int64  `json:"limit,omitempty"`
+	Multiple     int64  `json:"multiple,omitempty"`
+	Counterparty string `json:"counterparty,omitempty"`
+}
+
+func (r Rule) validate() error {
+	if r.Name == "" {
+		return errors.New("rule name cannot be empty")
+	}
+	switch r.Kind {
+	case RuleMaxAmount, RuleDailyLimit, RuleMonthlyLimit:
+		if r.Limit <= 0 {
+			return errors.New("limit must be greater than zero")
+		}
+	case RuleBlockedCounterparty:
+		if r.Counterparty == "" {
+			return errors.New("counterparty cannot be empty")
+		}
+	case RuleRoundAmount:
+		if r.Limit <= 0 || r.Multiple <= 0 {
+			return errors.New("limit and multiple must be greater than zero")
+		}
+	default:
+		return fmt.Errorf("unknown rule kind %q", r.Kind)
+	}
+	return nil
+}
+
+// RuleViolation is the error a command is rejected with when a rule fires.
+type RuleViolation struct {
+	Rule   string
+	Reason string
+}
+
+func (v *RuleViolation) Error() string {
+	return fmt.Sprintf("rejected by rule %s: %s", v.Rule, v.Reason)
+}
+
+// payment is what the rules look at in a command.
+type payment struct {
+	outgoing     bool
+	amount       int64
+	counterparty string
+	ref          string
+}
+
+func paymentOf(cmd any) (payment, bool) {
+	switch cmd := cmd.(type) {
+	case *DebitAccountCommand:
+		return payment{outgoing: true, amount: cmd.Amount, counterparty: cmd.ToAccountID, ref: cmd.Ref}, true
+	case *AuthorizeHoldCommand:
+		return payment{outgoing: true, amount: cmd.Amount, counterparty: cmd.ToAccountID, ref: cmd.Ref}, true
+	case *CreditAccountCommand:
+		return payment{amount: cmd.Amount, counterparty: cmd.FromAccountID, ref: cmd.Ref}, true
+	}
+	return payment{}, false
+}
+
+// RuleSet holds every rule by name.
+type RuleSet struct {
+	ID    string
+	Rules map[string]Rule
+}
+
+// Check runs the rules that apply to account in name order and returns the
+// first violation c commits, nil if none. Money out counts towards the
+// velocity limits once debited, holds while they are active.
+func (rs *RuleSet) Check(account *PaymentAggregate, c *gen.CommandEnvelope) (*RuleViolation, error) {
+	if rs == nil || len(rs.Rules) == 0 {
+		return nil, nil
+	}
+	cmd, err := bee.UnmarshalCommand(c)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := paymentOf(cmd)
+	if !ok {
+		return nil, nil
+	}
+	now := commandTime(c)
+
+	names := make([]string, 0, len(rs.Rules))
+	for name := range rs.Rules {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		r := rs.Rules[name]
+		if r.AccountID != "" && r.AccountID != account.ID {
+			continue
+		}
+		if r.Currency != "" && r.Currency != account.Currency {
+			continue
+		}
+		if r.Kind == RuleBlockedCounterparty {
+			if p.counterparty == r.Counterparty {
+				return &RuleViolation{Rule: name, Reason: fmt.Sprintf("counterparty %s is blocked", p.counterparty)}, nil
+			}
+			continue
+		}
+		if !p.outgoing {
+			continue
+		}
+		switch r.Kind {
+		case RuleMaxAmount:
+			if p.amount > r.Limit {
+				return &RuleViolation{Rule: name, Reason: fmt.Sprintf("amount %d is over the limit of %d", p.amount, r.Limit)}, nil
+			}
+		case RuleDailyLimit:
+			if out := account.Spent.Daily(now) + account.heldAt(now) + p.amount; out > r.Limit {
+				return &RuleViolation{Rule: name, Reason: fmt.Sprintf("%d out today is over the daily limit of %d", out, r.Limit)}, nil
+			}
+		case RuleMonthlyLimit:
+			if out := account.Spent.Monthly(now) + account.heldAt(now) + p.amount; out > r.Limit {
+				return &RuleViolation{Rule: name, Reason: fmt.Sprintf("%d out this month is over the monthly limit of %d", out, r.Limit)}, nil
+			}
+		case RuleRoundAmount:
+			if p.amount >= r.Limit && p.amount%r.Multiple == 0 {
+				return &RuleViolation{Rule: name, Reason: fmt.Sprintf("round amount %d", p.amount)}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (rs *RuleSet) ApplyEvent(e *gen.EventEnvelope) error {
+	ev, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return err
+	}
+	switch ev := ev.(type) {
+	case *PaymentRuleSet:
+		if rs.Rules == nil {
+			rs.Rules = map[string]Rule{}
+		}
+		rs.Rules[ev.Rule.Name] = ev.Rule
+	case *PaymentRuleRemoved:
+		delete(rs.Rules, ev.Name)
+	default:
+		return fmt.Errorf("unknown event type: %T", ev)
+	}
+	return nil
+}
+
+func (rs *RuleSet) ApplyCommand(c *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	cmd, err := bee.UnmarshalCommand(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var eventType string
+	var event any
+	switch cmd := cmd.(type) {
+	case *SetPaymentRuleCommand:
+		if err := cmd.Rule.validate(); err != nil {
+			return nil, err
+		}
+		eventType, event = RuleSetEvent, &PaymentRuleSet{Rule: cmd.Rule, Timestamp: commandTime(c)}
+	case *RemovePaymentRuleCommand:
+		if _, ok := rs.Rules[cmd.Name]; !ok {
+			return nil, fmt.Errorf("rule does not exist: %s", cmd.Name)
+		}
+		eventType, event = RuleRemovedEvent, &PaymentRuleRemoved{Name: cmd.Name, Timestamp: commandTime(c)}
+	default:
+		return nil, fmt.Errorf("unknown command type: %T", cmd)
+	}
+	b, _ := json.Marshal(event)
+	return []*gen.EventEnvelope{{
+		AggregateId:   c.AggregateId,
+		AggregateType: RuleSets,
+		EventType:     eventType,
+		Payload:       b,
+	}}, nil
+}
+
+type RuleService struct {
+	Ctx context.Context
+}
+
+func (s *RuleService) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	agg := &RuleSet{ID: m.AggregateId}
+	version, err := eventstore.Replay(s.Ctx, agg, m.Aggregate, m.AggregateId)
+	if err != nil {
+		return nil, err
+	}
+	if err := eventstore.Check(m, version); err != nil {
+		return nil, err
+	}
+	events, err := agg.ApplyCommand(m)
+	return eventstore.Expect(m, version, events), reply.Refuse(err)
+}
+
+// LoadRules replays the default rule set.
+func LoadRules(ctx context.Context) (*RuleSet, error) {
+	agg := &RuleSet{ID: DefaultRuleSet}
+	if _, err := eventstore.Replay(ctx, agg, RuleSets, DefaultRuleSet); err != nil {
+		return nil, err
+	}
+	return agg, nil
+}
+
+// ruleAudit is the rule audit trail of an account, as far as audit needs it
+// to record every rejection once.
+type ruleAudit struct {
+	fired map[string]bool // Command type and Ref of every recorded rejection
+}
+
+func (a *ruleAudit) ApplyEvent(e *gen.EventEnvelope) error {
+	var ev RuleFired
+	if err := json.Unmarshal(e.Payload, &ev); err != nil {
+		return fmt.Errorf("decode %s event: %w", e.EventType, err)
+	}
+	a.fired[ev.CommandType+"/"+ev.Ref] = true
+	return nil
+}
+
+// audit records that v rejected m on the rule audit trail of the account. A
+// command redelivered or sent again with the same Ref is recorded once.
+func audit(ctx context.Context, m *gen.CommandEnvelope, v *RuleViolation) error {
+	cmd, err := bee.UnmarshalCommand(m)
+	if err != nil {
+		return err
+	}
+	p, _ := paymentOf(cmd)
+	b, _ := json.Marshal(&RuleFired{
+		AccountID:    m.AggregateId,
+		Rule:         v.Rule,
+		Reason:       v.Reason,
+		CommandType:  m.CommandType,
+		Amount:       p.amount,
+		Counterparty: p.counterparty,
+		Ref:          p.ref,
+		Timestamp:    commandTime(m),
+	})
+	for range eventstore.DefaultRetries {
+		trail := &ruleAudit{fired: map[string]bool{}}
+		version, err := eventstore.Replay(ctx, trail, RuleAudit, m.AggregateId)
+		if err != nil {
+			return err
+		}
+		if p.ref != "" && trail.fired[m.CommandType+"/"+p.ref] {
+			return nil
+		}
+		err = eventstore.Append(ctx, appctx.JetStream(ctx), []*gen.EventEnvelope{{
+			AggregateId:   m.AggregateId,
+			AggregateType: RuleAudit,
+			EventType:     RuleFiredEvent,
+			Payload:       b,
+			Metadata:      map[string]string{eventstore.VersionKey: strconv.FormatUint(version, 10)},
+		}})
+		if !errors.Is(err, eventstore.ErrConflict) {
+			return err
+		}
+	}
+	return fmt.Errorf("rule audit of %s keeps moving", m.AggregateId)
+}
+
+// LoadRuleAudit lists the rejections of an account, oldest first.
+func LoadRuleAudit(ctx context.Context, accountID string) ([]RuleFired, error) {
+	fired := []RuleFired{}
+	err := eventstore.Read(ctx, RuleAudit, accountID, func(e *gen.EventEnvelope, _ time.Time) error {
+		var ev RuleFired
+		if err := json.Unmarshal(e.Payload, &ev); err != nil {
+			return fmt.Errorf("decode %s event: %w", e.EventType, err)
+		}
+		fired = append(fired, ev)
+		return nil
+	})
+	return fired, err
+}
+
+// Spending sums the money that left an account on the latest UTC day and in
+// the latest UTC month it was debited in.
+type Spending struct {
+	Day         string `json:"day,omitempty"`
+	DayAmount   int64  `json:"day_amount,omitempty"`
+	Month       string `json:"month,omitempty"`
+	MonthAmount int64  `json:"month_amount,omitempty"`
+}
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+)
+
+// add counts amount on the day and in the month of at. The windows only move
+// forward: money out dated before them, e.g. a scheduled run caught up late,
+// belongs to a window that has passed and is left out.
+func (s *Spending) add(at, amount int64) {
+	t := time.Unix(at, 0).UTC()
+	switch day := t.Format(dayLayout); {
+	case day > s.Day:
+		s.Day, s.DayAmount = day, amount
+	case day == s.Day:
+		s.DayAmount += amount
+	}
+	switch month := t.Format(monthLayout); {
+	case month > s.Month:
+		s.Month, s.MonthAmount = month, amount
+	case month == s.Month:
+		s.MonthAmount += amount
+	}
+}
+
+// Daily returns the money out on the UTC day of at.
+func (s Spending) Daily(at int64) int64 {
+	if s.Day != time.Unix(at, 0).UTC().Format(dayLayout) {
+		return 0
+	}
+	return s.DayAmount
+}
+
+// Monthly returns the money out in the UTC month of at.
+func (s Spending) Monthly(at int64) int64 {
+	if s.Month != time.Unix(at, 0).UTC().Format(monthLayout) {
+		return 0
+	}
+	return s.MonthAmount
+}
@@ -0,0 +1,212 @@
+package banking
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/appctx"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
+)
+
+// SagaConsumer is the durable consumer TransferSaga reads transfer events
+// with, so it resumes where it stopped after a restart.
+const SagaConsumer = "transfer-saga"
+
+// TransferSaga is the process manager behind transfers. It debits the
+// source account, credits the destination through its own aggregate and
+// refunds the source if that credit is refused, recording every step on
+// the transfer. A transfer started with StartCapture captures the hold it
+// names instead of debiting the source. A step that fails for any other reason, e.g. a timeout or a
+// repeat of a debit still being handled, may have moved the money anyway, so
+// it is retried rather than compensated. Payment commands carry the transfer ID as Ref, so the
+// payments handler must deduplicate by IdempotencyKey for a step repeated
+// after a crash to get its original outcome instead of moving money twice.
+// A transfer between currencies credits the amount converted at the rate
+// locked in when it started, and records that rate on the credit.
+type TransferSaga struct {
+	Ctx context.Context
+	NC  *nats.Conn
+}
+
+// Run handles transfer events until ctx is cancelled. Steps that fail for
+// any reason other than a refused command are retried.
+func (s *TransferSaga) Run(ctx context.Context) error {
+	js := appctx.JetStream(s.Ctx)
+	subject := fmt.Sprintf("events.%s.>", Transfers)
+	stream, err := js.StreamNameBySubject(subject)
+	if err != nil {
+		return fmt.Errorf("find stream for %s: %w", subject, err)
+	}
+	_, err = js.AddConsumer(stream, &nats.ConsumerConfig{
+		Durable:       SagaConsumer,
+		FilterSubject: subject,
+		AckPolicy:     nats.AckExplicitPolicy,
+		DeliverPolicy: nats.DeliverAllPolicy,
+		AckWait:       30 * time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("create %s consumer: %w", SagaConsumer, err)
+	}
+	// Binding keeps Unsubscribe from deleting the durable consumer.
+	sub, err := js.PullSubscribe(subject, SagaConsumer, nats.Bind(stream, SagaConsumer))
+	if err != nil {
+		return fmt.Errorf("subscribe %s: %w", subject, err)
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		fctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		msgs, err := sub.Fetch(1, nats.Context(fctx))
+		cancel()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout) {
+				continue
+			}
+			return fmt.Errorf("fetch transfer events: %w", err)
+		}
+		for _, msg := range msgs {
+			var e gen.EventEnvelope
+			if err := proto.Unmarshal(msg.Data, &e); err != nil {
+				log.Printf("Transfer saga: dropping undecodable event: %v", err)
+				msg.Term()
+				continue
+			}
+			if err := s.Handle(&e); err != nil {
+				log.Printf("Transfer saga: %s %s: %v", e.AggregateId, e.EventType, err)
+				msg.NakWithDelay(time.Second)
+				continue
+			}
+			msg.Ack()
+		}
+	}
+}
+
+// Handle runs the step that follows a transfer event.
+func (s *TransferSaga) Handle(e *gen.EventEnvelope) error {
+	ev, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return err
+	}
+
+	switch ev := ev.(type) {
+	case *TransferStarted:
+		err := s.debit(ev)
+		if errors.Is(err, reply.ErrRefused) {
+			return s.step(ev.TransferID, FailCommand, err.Error())
+		}
+		if err != nil {
+			return fmt.Errorf("debit: %w", err)
+		}
+		return s.step(ev.TransferID, RecordDebitCommand, "")
+
+	case *TransferStepped:
+		if e.EventType != TransferDebitedEvent {
+			return nil
+		}
+		t, err := LoadTransfer(s.Ctx, ev.TransferID)
+		if err != nil {
+			return err
+		}
+		credit := &CreditAccountCommand{
+			FromAccountID: t.FromAccountID,
+			ToAccountID:   t.ToAccountID,
+			Amount:        t.ToAmount,
+			Currency:      t.ToCurrency,
+			Ref:           t.ID,
+		}
+		if t.Rate != "" {
+			credit.Conversion = &Conversion{FromCurrency: t.Currency, FromAmount: t.Amount, Rate: t.Rate}
+		}
+		err = s.send(&gen.CommandEnvelope{
+			Aggregate:   Aggregate,
+			AggregateId: t.ToAccountID,
+			CommandType: CreditCommand,
+		}, credit)
+		if errors.Is(err, reply.ErrRefused) {
+			return s.refund(t, err.Error())
+		}
+		if err != nil {
+			return fmt.Errorf("credit: %w", err)
+		}
+		return s.step(t.ID, CompleteCommand, "")
+	}
+	return nil
+}
+
+// debit takes the money of a transfer off the source, captured from its
+// hold if it names one.
+func (s *TransferSaga) debit(ev *TransferStarted) error {
+	if ev.HoldID != "" {
+		return s.send(&gen.CommandEnvelope{
+			Aggregate:   Aggregate,
+			AggregateId: ev.FromAccountID,
+			CommandType: CaptureCommand,
+		}, &CaptureHoldCommand{
+			AccountID:   ev.FromAccountID,
+			HoldID:      ev.HoldID,
+			ToAccountID: ev.ToAccountID,
+			Amount:      ev.Amount,
+			Currency:    ev.Currency,
+			Ref:         ev.TransferID,
+		})
+	}
+	return s.send(&gen.CommandEnvelope{
+		Aggregate:   Aggregate,
+		AggregateId: ev.FromAccountID,
+		CommandType: DebitCommand,
+	}, &DebitAccountCommand{
+		FromAccountID: ev.FromAccountID,
+		ToAccountID:   ev.ToAccountID,
+		Amount:        ev.Amount,
+		Currency:      ev.Currency,
+		Ref:           ev.TransferID,
+	})
+}
+
+// refund is the compensation for a refused credit: it puts the money back
+// on the source account.
+func (s *TransferSaga) refund(t *TransferAggregate, reason string) error {
+	err := s.send(&gen.CommandEnvelope{
+		Aggregate:   Aggregate,
+		AggregateId: t.FromAccountID,
+		CommandType: CreditCommand,
+	}, &CreditAccountCommand{
+		FromAccountID: t.ToAccountID,
+		ToAccountID:   t.FromAccountID,
+		Amount:        t.Amount,
+		Currency:      t.Currency,
+		Ref:           t.ID,
+	})
+	if errors.Is(err, reply.ErrRefused) {
+		return s.step(t.ID, RecordRefundFailedCommand, fmt.Sprintf("credit: %s; refund: %s", reason, err))
+	}
+	if err != nil {
+		return fmt.Errorf("refund: %w", err)
+	}
+	return s.step(t.ID, RecordRefundCommand, reason)
+}
+
+func (s *TransferSaga) step(transferID, commandType, reason string) error {
+	_, err := reply.Send(s.Ctx, s.NC, AdvanceTransfer(transferID, commandType, reason), nil)
+	if errors.Is(err, reply.ErrRefused) {
+		// The transfer moved on already, e.g. when an event is redelivered.
+		log.Printf("Transfer saga: %s %s: %v", transferID, commandType, err)
+		return nil
+	}
+	return err
+}
+
+func (s *TransferSaga) send(cmd *gen.CommandEnvelope, payload any) error {
+	_, err := reply.Send(s.Ctx, s.NC, cmd, payload)
+	return err
+}
@@ -0,0 +1,143 @@
+package banking
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultSchedulerInterval is how often Scheduler.Run checks for due runs
+// when Interval is zero.
+const DefaultSchedulerInterval = 30 * time.Second
+
+// Clock tells the Scheduler what time it is, so tests can move time on.
+type Clock interface {
+	Now() time.Time
+}
+
+// Scheduler publishes the payments of schedules as they fall due and waits
+// for each to be handled, so the next interest run sees the balance the last
+// one left. A run is published first and recorded on its schedule
+// afterwards. A run published but not recorded before a crash is published
+// again with the same Ref, which the payments deduplication or the existing
+// transfer turns away, so runs are never lost and never fire twice. Runs
+// missed while the scheduler was down are caught up in order.
+//
+// A standing order starts a transfer rather than publishing a bare debit
+// and credit, so the saga refunds the source when the credit is rejected.
+type Scheduler struct {
+	NC       *nats.Conn
+	Clock    Clock         // System clock if nil
+	Interval time.Duration // How often Run checks, DefaultSchedulerInterval if zero
+}
+
+func (s *Scheduler) now() time.Time {
+	if s.Clock == nil {
+		return time.Now()
+	}
+	return s.Clock.Now()
+}
+
+// Run checks for due runs every Interval until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) error {
+	interval := s.Interval
+	if interval == 0 {
+		interval = DefaultSchedulerInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Tick(ctx); err != nil {
+			log.Printf("Scheduler: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Tick publishes every run that fell due by now and was not recorded yet.
+// A schedule whose run fails is left for the next tick.
+func (s *Scheduler) Tick(ctx context.Context) error {
+	schedules, err := LoadSchedules(ctx)
+	if err != nil {
+		return err
+	}
+	now := s.now()
+	var errs []error
+	for _, sc := range schedules {
+		for !sc.Cancelled && !sc.Next().After(now) {
+			if err := s.fire(ctx, sc, sc.Runs); err != nil {
+				errs = append(errs, fmt.Errorf("%s run %d: %w", sc.ID, sc.Runs, err))
+				break
+			}
+			sc.Runs++
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Scheduler) fire(ctx context.Context, sc *Schedule, run int64) error {
+	var cmd *gen.CommandEnvelope
+	switch sc.Kind {
+	case StandingOrder:
+		cmd = StartTransfer(sc.RunRef(run), sc.FromAccountID, sc.ToAccountID, sc.Amount, sc.Currency, "")
+	case InterestAccrual:
+		var err error
+		if cmd, err = s.interest(ctx, sc, run); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown schedule kind %q", sc.Kind)
+	}
+	if cmd != nil {
+		// Payments are dated when they fell due, not when they were published.
+		cmd.Timestamp = timestamppb.New(sc.Due(run))
+		_, err := reply.Send(ctx, s.NC, cmd, nil)
+		if errors.Is(err, reply.ErrRefused) {
+			// A refused payment still used up its run, e.g. when the account
+			// is closed or the run was published before.
+			log.Printf("Scheduler: %s run %d: %v", sc.ID, run, err)
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", cmd.CommandType, err)
+		}
+	}
+	_, err := reply.Send(ctx, s.NC, RecordScheduleRun(sc.ID, run), nil)
+	return err
+}
+
+// interest returns the payment of an interest run: a credit from CASH for a
+// positive balance, a debit to CASH for a negative one, nothing when the
+// interest rounds to zero. The balance is taken when the run fell due, so a
+// repeated run asks for the same amount.
+func (s *Scheduler) interest(ctx context.Context, sc *Schedule, run int64) (*gen.CommandEnvelope, error) {
+	due := sc.Due(run)
+	st, err := BuildStatement(ctx, sc.AccountID, due, due)
+	if errors.Is(err, ErrAccountNotFound) {
+		log.Printf("Scheduler: %s run %d: %v", sc.ID, run, err)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	amount, err := Convert(st.ClosingBalance, sc.Rate)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case amount > 0:
+		return CreditAccount(CashAccount, sc.AccountID, amount, st.Currency, sc.RunRef(run)), nil
+	case amount < 0:
+		return DebitAccount(sc.AccountID, CashAccount, -amount, st.Currency, sc.RunRef(run)), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,241 @@
+package banking
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+)
+
+// minScheduleEvery keeps a schedule from firing faster than the scheduler
+// can sensibly check it.
+const minScheduleEvery = time.Minute
+
+// Schedule is a payment that repeats every Every seconds from Start on. Runs
+// counts the runs whose command was published; run n falls due at Due(n).
+type Schedule struct {
+	ID            string
+	Kind          string
+	FromAccountID string
+	ToAccountID   string
+	AccountID     string
+	Amount        int64
+	Currency      string
+	Rate          string
+	Start         int64
+	Every         int64
+	Runs          int64
+	Cancelled     bool
+
+	found bool
+}
+
+// Due returns the time run n of the schedule falls due.
+func (s *Schedule) Due(n int64) time.Time {
+	return time.Unix(s.Start+n*s.Every, 0).UTC()
+}
+
+// Next returns the time the next unrecorded run falls due.
+func (s *Schedule) Next() time.Time {
+	return s.Due(s.Runs)
+}
+
+// RunRef is the Ref of the payment of run n, and the ID of its transfer. It
+// stays the same however often the run is published, so repeats are caught
+// by the payments deduplication or by the transfer that already exists.
+func (s *Schedule) RunRef(n int64) string {
+	return fmt.Sprintf("%s-%d", s.ID, n)
+}
+
+func (s *Schedule) ApplyEvent(e *gen.EventEnvelope) error {
+	ev, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return err
+	}
+	s.found = true
+	switch ev := ev.(type) {
+	case *ScheduleCreated:
+		s.ID = ev.ScheduleID
+		s.Kind = ev.Kind
+		s.FromAccountID, s.ToAccountID = ev.FromAccountID, ev.ToAccountID
+		s.AccountID = ev.AccountID
+		s.Amount, s.Currency, s.Rate = ev.Amount, ev.Currency, ev.Rate
+		s.Start, s.Every = ev.Start, ev.Every
+	case *ScheduleCancelled:
+		s.Cancelled = true
+	case *ScheduleRan:
+		s.Runs = ev.Run + 1
+	default:
+		return fmt.Errorf("unknown event type: %T", ev)
+	}
+	return nil
+}
+
+func (s *Schedule) ApplyCommand(c *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	cmd, err := bee.UnmarshalCommand(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var eventType string
+	var event any
+	switch cmd := cmd.(type) {
+	case *CreateScheduleCommand:
+		if s.found {
+			return nil, fmt.Errorf("schedule already exists: %s", c.AggregateId)
+		}
+		every, err := time.ParseDuration(cmd.Every)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval %q: %w", cmd.Every, err)
+		}
+		if every < minScheduleEvery {
+			return nil, fmt.Errorf("interval must be at least %s", minScheduleEvery)
+		}
+		switch cmd.Kind {
+		case StandingOrder:
+			if cmd.Amount <= 0 {
+				return nil, errors.New("amount must be greater than zero")
+			}
+			if cmd.Currency == "" {
+				return nil, errors.New("currency cannot be empty")
+			}
+			if cmd.FromAccountID == "" || cmd.ToAccountID == "" {
+				return nil, errors.New("both accounts are required")
+			}
+			if cmd.FromAccountID == cmd.ToAccountID {
+				return nil, errors.New("cannot transfer to the same account")
+			}
+		case InterestAccrual:
+			if cmd.AccountID == "" {
+				return nil, errors.New("account is required")
+			}
+			if _, err := ParseRate(cmd.Rate); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown schedule kind %q", cmd.Kind)
+		}
+		start := cmd.Start
+		if start == 0 {
+			start = commandTime(c)
+		}
+		eventType, event = ScheduleCreatedEvent, &ScheduleCreated{
+			ScheduleID:    c.AggregateId,
+			Kind:          cmd.Kind,
+			FromAccountID: cmd.FromAccountID,
+			ToAccountID:   cmd.ToAccountID,
+			AccountID:     cmd.AccountID,
+			Amount:        cmd.Amount,
+			Currency:      cmd.Currency,
+			Rate:          cmd.Rate,
+			Start:         start,
+			Every:         int64(every / time.Second),
+			Timestamp:     commandTime(c),
+		}
+
+	case *CancelScheduleCommand:
+		if !s.found {
+			return nil, fmt.Errorf("schedule does not exist: %s", c.AggregateId)
+		}
+		if s.Cancelled {
+			return nil, nil
+		}
+		eventType, event = ScheduleCancelledEvent, &ScheduleCancelled{
+			ScheduleID: c.AggregateId,
+			Timestamp:  commandTime(c),
+		}
+
+	case *RecordScheduleRunCommand:
+		if !s.found {
+			return nil, fmt.Errorf("schedule does not exist: %s", c.AggregateId)
+		}
+		if cmd.Run < s.Runs {
+			return nil, nil // Repeated run, already recorded
+		}
+		if cmd.Run > s.Runs {
+			return nil, fmt.Errorf("schedule %s is at run %d, cannot record run %d", s.ID, s.Runs, cmd.Run)
+		}
+		if s.Cancelled {
+			return nil, fmt.Errorf("schedule %s is cancelled", s.ID)
+		}
+		eventType, event = ScheduleRanEvent, &ScheduleRan{
+			ScheduleID: c.AggregateId,
+			Run:        cmd.Run,
+			Timestamp:  commandTime(c),
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown command type: %T", cmd)
+	}
+
+	b, _ := json.Marshal(event)
+	return []*gen.EventEnvelope{{
+		AggregateId:   c.AggregateId,
+		AggregateType: Schedules,
+		EventType:     eventType,
+		Payload:       b,
+	}}, nil
+}
+
+type ScheduleService struct {
+	Ctx context.Context
+}
+
+func (s *ScheduleService) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	agg := &Schedule{ID: m.AggregateId}
+	version, err := eventstore.Replay(s.Ctx, agg, m.Aggregate, m.AggregateId)
+	if err != nil {
+		return nil, err
+	}
+	if err := eventstore.Check(m, version); err != nil {
+		return nil, err
+	}
+	events, err := agg.ApplyCommand(m)
+	return eventstore.Expect(m, version, events), reply.Refuse(err)
+}
+
+// LoadSchedule replays one schedule.
+func LoadSchedule(ctx context.Context, id string) (*Schedule, error) {
+	agg := &Schedule{ID: id}
+	if _, err := eventstore.Replay(ctx, agg, Schedules, id); err != nil {
+		return nil, err
+	}
+	if !agg.found {
+		return nil, fmt.Errorf("schedule does not exist: %s", id)
+	}
+	return agg, nil
+}
+
+// LoadSchedules replays every schedule, ordered by ID.
+func LoadSchedules(ctx context.Context) ([]*Schedule, error) {
+	byID := map[string]*Schedule{}
+	err := eventstore.Read(ctx, Schedules, "*", func(e *gen.EventEnvelope, _ time.Time) error {
+		s, ok := byID[e.AggregateId]
+		if !ok {
+			s = &Schedule{ID: e.AggregateId}
+			byID[e.AggregateId] = s
+		}
+		if err := s.ApplyEvent(e); err != nil {
+			log.Printf("Load schedules: skipping %s event of %s: %v", e.EventType, e.AggregateId, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	schedules := make([]*Schedule, 0, len(byID))
+	for _, s := range byID {
+		schedules = append(schedules, s)
+	}
+	slices.SortFunc(schedules, func(a, b *Schedule) int { return strings.Compare(a.ID, b.ID) })
+	return schedules, nil
+}
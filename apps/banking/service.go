@@ -2,26 +2,110 @@ package banking
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"time"
 
-	"github.com/blinkinglight/bee"
 	"github.com/blinkinglight/bee/gen"
-	"github.com/blinkinglight/bee/ro"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/nats-io/nats.go"
 )
 
+var ErrAccountNotFound = errors.New("account does not exist")
+
 type PaymentService struct {
 	Ctx context.Context
 }
 
 func (s *PaymentService) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
 	agg := &PaymentAggregate{ID: m.AggregateId}
-	bee.Replay(s.Ctx, agg, ro.WithAggreate(m.Aggregate), ro.WithAggregateID(m.AggregateId))
+	version, err := eventstore.Replay(s.Ctx, agg, m.Aggregate, m.AggregateId)
+	if err != nil {
+		return nil, err
+	}
+	if err := eventstore.Check(m, version); err != nil {
+		return nil, err
+	}
 
 	if agg.found && m.CommandType == CreateCommand {
-		return nil, errors.New("account already exists")
+		return nil, reply.Refuse(errors.New("account already exists"))
 	} else if !agg.found && m.CommandType != CreateCommand {
-		return nil, errors.New("account does not exist")
+		return nil, reply.Refuse(ErrAccountNotFound)
+	}
+
+	if !agg.Closed {
+		if err := s.checkRules(agg, m); err != nil {
+			return nil, err
+		}
+	}
+
+	events, err := agg.ApplyCommand(s.Ctx, m)
+	return eventstore.Expect(m, version, events), reply.Refuse(err)
+}
+
+// checkRules refuses m with a *RuleViolation if one of the payment rules
+// fires, after recording which one on the rule audit trail of the account.
+func (s *PaymentService) checkRules(agg *PaymentAggregate, m *gen.CommandEnvelope) error {
+	rules, err := LoadRules(s.Ctx)
+	if err != nil {
+		return err
+	}
+	violation, err := rules.Check(agg, m)
+	if err != nil || violation == nil {
+		return err
+	}
+	if err := audit(s.Ctx, m, violation); err != nil {
+		return fmt.Errorf("record rule audit: %w", err)
 	}
+	return reply.Refuse(violation)
+}
+
+// IdempotencyKey identifies repeats of a banking command: the idempotency key
+// of the envelope if it has one, otherwise the Ref of the command.
+func IdempotencyKey(m *gen.CommandEnvelope) string {
+	if key := m.Metadata[eventstore.IdempotencyKey]; key != "" {
+		return key
+	}
+	var cmd struct {
+		Ref string `json:"ref"`
+	}
+	json.Unmarshal(m.Payload, &cmd)
+	return cmd.Ref
+}
 
-	return agg.ApplyCommand(s.Ctx, m)
+// LoadAccount replays the current state of an account.
+func LoadAccount(ctx context.Context, id string) (*PaymentAggregate, error) {
+	agg := &PaymentAggregate{ID: id}
+	if _, err := eventstore.Replay(ctx, agg, Aggregate, id); err != nil {
+		return nil, err
+	}
+	if !agg.found {
+		return nil, fmt.Errorf("%w: %s", ErrAccountNotFound, id)
+	}
+	return agg, nil
+}
+
+// SweepAndClose closes an account, first transferring its balance to the
+// account sweepTo if it is not zero. The balance can only be swept into an
+// account in the same currency. If money arrives between the sweep and the
+// close, the close is rejected and the account stays open.
+func SweepAndClose(ctx context.Context, nc *nats.Conn, id, sweepTo string) error {
+	account, err := LoadAccount(ctx, id)
+	if err != nil {
+		return err
+	}
+	if account.Balance > 0 && sweepTo != "" {
+		transferID := fmt.Sprintf("sweep-%s-%d", id, time.Now().UnixNano())
+		t, err := RunTransfer(ctx, nc, StartTransfer(transferID, id, sweepTo, account.Balance, account.Currency, ""))
+		if err != nil {
+			return fmt.Errorf("sweep: %w", err)
+		}
+		if t.Status != TransferCompletedEvent {
+			return fmt.Errorf("sweep %s: %s", t.Status, t.Reason)
+		}
+	}
+	_, err = reply.Send(ctx, nc, CloseAccount(id, sweepTo), nil)
+	return err
 }
@@ -0,0 +1,32 @@
+package banking
+
+import "github.com/blinkinglight/gobeego/pkg/eventstore"
+
+// Bump paymentSnapshotVersion whenever the fields of PaymentAggregate change,
+// so snapshots of the old layout are replayed from scratch instead.
+const (
+	paymentSnapshotVersion = 5
+	paymentSnapshotEvery   = 50
+)
+
+// paymentPrivate is the unexported state of PaymentAggregate a snapshot keeps.
+type paymentPrivate struct {
+	Found   bool `json:"found"`
+	Created bool `json:"created"`
+}
+
+func (a *PaymentAggregate) SnapshotVersion() int { return paymentSnapshotVersion }
+func (a *PaymentAggregate) SnapshotEvery() int   { return paymentSnapshotEvery }
+
+func (a *PaymentAggregate) MarshalSnapshot() ([]byte, error) {
+	return eventstore.MarshalState(a, paymentPrivate{Found: a.found, Created: a.created})
+}
+
+func (a *PaymentAggregate) UnmarshalSnapshot(b []byte) error {
+	var p paymentPrivate
+	if err := eventstore.UnmarshalState(b, a, &p); err != nil {
+		return err
+	}
+	a.found, a.created = p.Found, p.Created
+	return nil
+}
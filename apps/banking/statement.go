@@ -0,0 +1,316 @@
+package banking
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+)
+
+// Statement formats, as accepted by Statement.Write.
+const (
+	FormatCSV     = "csv"
+	FormatJSON    = "json"
+	FormatCamt053 = "camt053"
+)
+
+// Movement is one booking on a statement. Amount is positive for money in.
+type Movement struct {
+	Time         time.Time `json:"time"`
+	Type         string    `json:"type"` // Event type, e.g. credited
+	Ref          string    `json:"ref"`
+	Counterparty string    `json:"counterparty"`
+	Amount       int64     `json:"amount"`
+	Balance      int64     `json:"balance"` // Running balance after the movement
+}
+
+// Statement lists the movements of an account in [From, To).
+type Statement struct {
+	AccountID      string     `json:"account_id"`
+	Currency       string     `json:"currency"`
+	From           time.Time  `json:"from"`
+	To             time.Time  `json:"to"`
+	OpeningBalance int64      `json:"opening_balance"`
+	ClosingBalance int64      `json:"closing_balance"`
+	Movements      []Movement `json:"movements"`
+	Generated      time.Time  `json:"generated"`
+}
+
+// BuildStatement reads the payments history of an account into a statement
+// for [from, to). Events are dated by their Timestamp, or by the time they
+// were stored if they were written before events carried one.
+func BuildStatement(ctx context.Context, id string, from, to time.Time) (*Statement, error) {
+	s := &Statement{AccountID: id, From: from, To: to, Generated: time.Now().UTC()}
+	found := false
+	balance := int64(0)
+	err := eventstore.Read(ctx, Aggregate, id, func(e *gen.EventEnvelope, stored time.Time) error {
+		ev, err := bee.UnmarshalEvent(e)
+		if err != nil {
+			return err
+		}
+		m := Movement{Type: e.EventType, Time: stored}
+		switch ev := ev.(type) {
+		case *AccountCreated:
+			found = true
+			s.Currency = ev.Currency
+			m.Time, m.Ref, m.Counterparty, m.Amount = eventTime(ev.Timestamp, stored), ev.Ref, CashAccount, ev.Balance
+		case *AccountDebited:
+			m.Time, m.Ref, m.Counterparty, m.Amount = eventTime(ev.Timestamp, stored), ev.Ref, ev.Counterparty, -ev.Amount
+		case *AccountCredited:
+			m.Time, m.Ref, m.Counterparty, m.Amount = eventTime(ev.Timestamp, stored), ev.Ref, ev.Counterparty, ev.Amount
+		default:
+			return nil // Not a movement
+		}
+		if !m.Time.Before(to) {
+			return nil
+		}
+		balance += m.Amount
+		if m.Time.Before(from) {
+			s.OpeningBalance = balance
+			return nil
+		}
+		if m.Amount == 0 {
+			return nil
+		}
+		m.Balance = balance
+		s.Movements = append(s.Movements, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrAccountNotFound, id)
+	}
+	s.ClosingBalance = balance
+	return s, nil
+}
+
+func eventTime(unix int64, stored time.Time) time.Time {
+	if unix == 0 {
+		return stored.UTC()
+	}
+	return time.Unix(unix, 0).UTC()
+}
+
+// Write encodes the statement in one of the statement formats.
+func (s *Statement) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatCSV:
+		return s.WriteCSV(w)
+	case FormatJSON:
+		return s.WriteJSON(w)
+	case FormatCamt053:
+		return s.WriteCamt053(w)
+	}
+	return fmt.Errorf("unknown statement format %q", format)
+}
+
+// ContentType is the media type of a statement format.
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv"
+	case FormatJSON:
+		return "application/json"
+	case FormatCamt053:
+		return "application/xml"
+	}
+	return "application/octet-stream"
+}
+
+// Decimal formats cents as a plain decimal, e.g. -1050 as "-10.50".
+func Decimal(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// WriteCSV writes a header row, an opening balance row, one row per
+// movement and a closing balance row.
+func (s *Statement) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "type", "ref", "counterparty", "amount", "balance", "currency"})
+	cw.Write([]string{s.From.UTC().Format(time.RFC3339), "opening_balance", "", "", "", Decimal(s.OpeningBalance), s.Currency})
+	for _, m := range s.Movements {
+		cw.Write([]string{m.Time.Format(time.RFC3339), m.Type, m.Ref, m.Counterparty, Decimal(m.Amount), Decimal(m.Balance), s.Currency})
+	}
+	cw.Write([]string{s.To.UTC().Format(time.RFC3339), "closing_balance", "", "", "", Decimal(s.ClosingBalance), s.Currency})
+	cw.Flush()
+	return cw.Error()
+}
+
+func (s *Statement) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// camt.053.001.08 bank to customer statement, reduced to the elements this
+// app has data for.
+type camtDocument struct {
+	XMLName xml.Name `xml:"urn:iso:std:iso:20022:tech:xsd:camt.053.001.08 Document"`
+	Stmt    struct {
+		GrpHdr struct {
+			MsgId   string `xml:"MsgId"`
+			CreDtTm string `xml:"CreDtTm"`
+		} `xml:"GrpHdr"`
+		Stmt struct {
+			Id      string `xml:"Id"`
+			CreDtTm string `xml:"CreDtTm"`
+			FrToDt  struct {
+				FrDtTm string `xml:"FrDtTm"`
+				ToDtTm string `xml:"ToDtTm"`
+			} `xml:"FrToDt"`
+			Acct struct {
+				Id  camtAccountID `xml:"Id"`
+				Ccy string        `xml:"Ccy"`
+			} `xml:"Acct"`
+			Bal  []camtBalance `xml:"Bal"`
+			Ntry []camtEntry   `xml:"Ntry"`
+		} `xml:"Stmt"`
+	} `xml:"BkToCstmrStmt"`
+}
+
+type camtAccountID struct {
+	Othr struct {
+		Id string `xml:"Id"`
+	} `xml:"Othr"`
+}
+
+type camtAmount struct {
+	Ccy   string `xml:"Ccy,attr"`
+	Value string `xml:",chardata"`
+}
+
+type camtBalance struct {
+	Tp struct {
+		CdOrPrtry struct {
+			Cd string `xml:"Cd"`
+		} `xml:"CdOrPrtry"`
+	} `xml:"Tp"`
+	Amt       camtAmount `xml:"Amt"`
+	CdtDbtInd string     `xml:"CdtDbtInd"`
+	Dt        struct {
+		DtTm string `xml:"DtTm"`
+	} `xml:"Dt"`
+}
+
+type camtEntry struct {
+	NtryRef   string     `xml:"NtryRef,omitempty"`
+	Amt       camtAmount `xml:"Amt"`
+	CdtDbtInd string     `xml:"CdtDbtInd"`
+	Sts       struct {
+		Cd string `xml:"Cd"`
+	} `xml:"Sts"`
+	BookgDt struct {
+		DtTm string `xml:"DtTm"`
+	} `xml:"BookgDt"`
+	AcctSvcrRef string `xml:"AcctSvcrRef,omitempty"`
+	BkTxCd      struct {
+		Prtry struct {
+			Cd string `xml:"Cd"`
+		} `xml:"Prtry"`
+	} `xml:"BkTxCd"`
+	NtryDtls struct {
+		TxDtls struct {
+			Refs struct {
+				EndToEndId string `xml:"EndToEndId"`
+			} `xml:"Refs"`
+			RltdPties *camtParties `xml:"RltdPties,omitempty"`
+		} `xml:"TxDtls"`
+	} `xml:"NtryDtls"`
+}
+
+type camtParties struct {
+	DbtrAcct *camtAccount `xml:"DbtrAcct,omitempty"`
+	CdtrAcct *camtAccount `xml:"CdtrAcct,omitempty"`
+}
+
+type camtAccount struct {
+	Id camtAccountID `xml:"Id"`
+}
+
+// creditDebit splits a signed amount into a camt amount and indicator.
+func creditDebit(currency string, cents int64) (camtAmount, string) {
+	if cents < 0 {
+		return camtAmount{Ccy: currency, Value: Decimal(-cents)}, "DBIT"
+	}
+	return camtAmount{Ccy: currency, Value: Decimal(cents)}, "CRDT"
+}
+
+// WriteCamt053 writes the statement as an ISO 20022 camt.053 document with
+// an opening (OPBD) and closing (CLBD) booked balance and one booked entry
+// per movement.
+func (s *Statement) WriteCamt053(w io.Writer) error {
+	var doc camtDocument
+	created := s.Generated.Format(time.RFC3339)
+	id := fmt.Sprintf("%s-%s-%s", s.AccountID, s.From.UTC().Format("20060102"), s.To.UTC().Format("20060102"))
+	doc.Stmt.GrpHdr.MsgId = id
+	doc.Stmt.GrpHdr.CreDtTm = created
+	st := &doc.Stmt.Stmt
+	st.Id = id
+	st.CreDtTm = created
+	st.FrToDt.FrDtTm = s.From.UTC().Format(time.RFC3339)
+	st.FrToDt.ToDtTm = s.To.UTC().Format(time.RFC3339)
+	st.Acct.Id.Othr.Id = s.AccountID
+	st.Acct.Ccy = s.Currency
+
+	for _, b := range []struct {
+		code    string
+		balance int64
+		at      time.Time
+	}{{"OPBD", s.OpeningBalance, s.From}, {"CLBD", s.ClosingBalance, s.To}} {
+		var bal camtBalance
+		bal.Tp.CdOrPrtry.Cd = b.code
+		bal.Amt, bal.CdtDbtInd = creditDebit(s.Currency, b.balance)
+		bal.Dt.DtTm = b.at.UTC().Format(time.RFC3339)
+		st.Bal = append(st.Bal, bal)
+	}
+
+	for i, m := range s.Movements {
+		var e camtEntry
+		e.NtryRef = strconv.Itoa(i + 1)
+		e.Amt, e.CdtDbtInd = creditDebit(s.Currency, m.Amount)
+		e.Sts.Cd = "BOOK"
+		e.BookgDt.DtTm = m.Time.Format(time.RFC3339)
+		e.AcctSvcrRef = m.Ref
+		e.BkTxCd.Prtry.Cd = m.Type
+		e.NtryDtls.TxDtls.Refs.EndToEndId = m.Ref
+		if e.NtryDtls.TxDtls.Refs.EndToEndId == "" {
+			e.NtryDtls.TxDtls.Refs.EndToEndId = "NOTPROVIDED"
+		}
+		if m.Counterparty != "" {
+			party := &camtAccount{}
+			party.Id.Othr.Id = m.Counterparty
+			if m.Amount < 0 {
+				e.NtryDtls.TxDtls.RltdPties = &camtParties{CdtrAcct: party}
+			} else {
+				e.NtryDtls.TxDtls.RltdPties = &camtParties{DbtrAcct: party}
+			}
+		}
+		st.Ntry = append(st.Ntry, e)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
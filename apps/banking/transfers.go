@@ -0,0 +1,251 @@
+package banking
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/nats-io/nats.go"
+)
+
+// TransferStatusStarted is the status of a transfer before its source
+// account was debited; every later status is named after its event.
+const TransferStatusStarted = TransferStartedEvent
+
+type transition struct {
+	from, to string
+}
+
+// transitions maps each step command to the status it moves a transfer from
+// and the status (and event type) it moves it to.
+var transitions = map[string]transition{
+	RecordDebitCommand:        {TransferStatusStarted, TransferDebitedEvent},
+	FailCommand:               {TransferStatusStarted, TransferFailedEvent},
+	CompleteCommand:           {TransferDebitedEvent, TransferCompletedEvent},
+	RecordRefundCommand:       {TransferDebitedEvent, TransferRefundedEvent},
+	RecordRefundFailedCommand: {TransferDebitedEvent, TransferRefundFailedEvent},
+}
+
+type TransferStep struct {
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// TransferAggregate tracks where a transfer is. The money itself moves on
+// the PaymentAggregates of both accounts, driven by TransferSaga.
+type TransferAggregate struct {
+	ID            string
+	FromAccountID string
+	ToAccountID   string
+	Amount        int64
+	Currency      string
+	ToCurrency    string // Currency the destination is credited in
+	ToAmount      int64  // Amount the destination is credited with
+	Rate          string // Exchange rate locked in at the start, if converted
+	HoldID        string // Hold the source is captured from instead of debited
+	Status        string
+	Reason        string
+	History       []TransferStep
+
+	found bool
+	rates *RateTable // Consulted when a transfer between currencies starts
+}
+
+// Done reports whether the transfer reached a final status.
+func (t *TransferAggregate) Done() bool {
+	switch t.Status {
+	case TransferCompletedEvent, TransferFailedEvent, TransferRefundedEvent, TransferRefundFailedEvent:
+		return true
+	}
+	return false
+}
+
+func (t *TransferAggregate) ApplyEvent(e *gen.EventEnvelope) error {
+	ev, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return err
+	}
+	t.found = true
+	switch ev := ev.(type) {
+	case *TransferStarted:
+		t.ID = ev.TransferID
+		t.FromAccountID = ev.FromAccountID
+		t.ToAccountID = ev.ToAccountID
+		t.Amount = ev.Amount
+		t.Currency = ev.Currency
+		t.ToCurrency, t.ToAmount, t.Rate = ev.ToCurrency, ev.ToAmount, ev.Rate
+		t.HoldID = ev.HoldID
+		if t.ToCurrency == "" {
+			t.ToCurrency, t.ToAmount = ev.Currency, ev.Amount
+		}
+		t.Status = TransferStatusStarted
+		t.History = append(t.History, TransferStep{Status: t.Status, Timestamp: ev.Timestamp})
+	case *TransferStepped:
+		t.Status = e.EventType
+		t.Reason = ev.Reason
+		t.History = append(t.History, TransferStep{Status: t.Status, Reason: ev.Reason, Timestamp: ev.Timestamp})
+	default:
+		return fmt.Errorf("unknown event type: %T", ev)
+	}
+	return nil
+}
+
+func (t *TransferAggregate) ApplyCommand(c *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	cmd, err := bee.UnmarshalCommand(c)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cmd := cmd.(type) {
+	case *StartTransferCommand:
+		if t.found {
+			return nil, fmt.Errorf("transfer already exists: %s", c.AggregateId)
+		}
+		if cmd.Amount <= 0 {
+			return nil, errors.New("amount must be greater than zero")
+		}
+		if cmd.Currency == "" {
+			return nil, errors.New("currency cannot be empty")
+		}
+		if cmd.FromAccountID == "" || cmd.ToAccountID == "" {
+			return nil, errors.New("both accounts are required")
+		}
+		if cmd.FromAccountID == cmd.ToAccountID {
+			return nil, errors.New("cannot transfer to the same account")
+		}
+		ev := &TransferStarted{
+			TransferID:    c.AggregateId,
+			FromAccountID: cmd.FromAccountID,
+			ToAccountID:   cmd.ToAccountID,
+			Amount:        cmd.Amount,
+			Currency:      cmd.Currency,
+			HoldID:        cmd.HoldID,
+			Timestamp:     commandTime(c),
+		}
+		if cmd.ToCurrency != "" && cmd.ToCurrency != cmd.Currency {
+			rate, ok := t.rates.Rate(cmd.Currency, cmd.ToCurrency)
+			if !ok {
+				return nil, fmt.Errorf("no exchange rate from %s to %s", cmd.Currency, cmd.ToCurrency)
+			}
+			amount, err := Convert(cmd.Amount, rate)
+			if err != nil {
+				return nil, err
+			}
+			if amount <= 0 {
+				return nil, errors.New("converted amount must be greater than zero")
+			}
+			ev.ToCurrency, ev.ToAmount, ev.Rate = cmd.ToCurrency, amount, rate
+		}
+		b, _ := json.Marshal(ev)
+		return []*gen.EventEnvelope{{
+			AggregateId:   c.AggregateId,
+			AggregateType: Transfers,
+			EventType:     TransferStartedEvent,
+			Payload:       b,
+		}}, nil
+
+	case *TransferStepCommand:
+		if !t.found {
+			return nil, fmt.Errorf("transfer does not exist: %s", c.AggregateId)
+		}
+		tr := transitions[c.CommandType]
+		if t.Status == tr.to {
+			return nil, nil // Repeated step, already recorded
+		}
+		if t.Status != tr.from {
+			return nil, fmt.Errorf("transfer %s is %s, cannot %s", t.ID, t.Status, c.CommandType)
+		}
+		b, _ := json.Marshal(&TransferStepped{
+			TransferID: c.AggregateId,
+			Reason:     cmd.Reason,
+			Timestamp:  commandTime(c),
+		})
+		return []*gen.EventEnvelope{{
+			AggregateId:   c.AggregateId,
+			AggregateType: Transfers,
+			EventType:     tr.to,
+			Payload:       b,
+		}}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown command type: %T", cmd)
+	}
+}
+
+func commandTime(c *gen.CommandEnvelope) int64 {
+	if c.Timestamp != nil {
+		return c.Timestamp.AsTime().Unix()
+	}
+	return time.Now().Unix()
+}
+
+type TransferService struct {
+	Ctx context.Context
+}
+
+func (s *TransferService) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	agg := &TransferAggregate{ID: m.AggregateId}
+	version, err := eventstore.Replay(s.Ctx, agg, m.Aggregate, m.AggregateId)
+	if err != nil {
+		return nil, err
+	}
+	if m.CommandType == StartCommand {
+		if agg.rates, err = LoadRates(s.Ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := eventstore.Check(m, version); err != nil {
+		return nil, err
+	}
+	events, err := agg.ApplyCommand(m)
+	return eventstore.Expect(m, version, events), reply.Refuse(err)
+}
+
+// LoadTransfer replays a transfer, including the history of its steps.
+func LoadTransfer(ctx context.Context, id string) (*TransferAggregate, error) {
+	agg := &TransferAggregate{ID: id}
+	if _, err := eventstore.Replay(ctx, agg, Transfers, id); err != nil {
+		return nil, err
+	}
+	if !agg.found {
+		return nil, fmt.Errorf("transfer does not exist: %s", id)
+	}
+	return agg, nil
+}
+
+// RunTransfer sends start, a StartTransfer command, and waits until
+// TransferSaga has taken the transfer to a final status. A transfer the saga
+// rejects is returned with its Reason rather than as an error; ctx bounds the
+// wait.
+func RunTransfer(ctx context.Context, nc *nats.Conn, start *gen.CommandEnvelope) (*TransferAggregate, error) {
+	id := start.AggregateId
+	// Subscribe first so no step published after the start is missed.
+	sub, err := nc.SubscribeSync(eventstore.Subject(Transfers, id))
+	if err != nil {
+		return nil, fmt.Errorf("subscribe transfer %s: %w", id, err)
+	}
+	defer sub.Unsubscribe()
+
+	if _, err := reply.Send(ctx, nc, start, nil); err != nil {
+		return nil, err
+	}
+	for {
+		t, err := LoadTransfer(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if t.Done() {
+			return t, nil
+		}
+		if _, err := sub.NextMsgWithContext(ctx); err != nil {
+			return t, fmt.Errorf("wait for transfer %s: %w", id, err)
+		}
+	}
+}
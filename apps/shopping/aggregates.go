@@ -1,6 +1,7 @@
 package shopping
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/blinkinglight/bee"
@@ -9,12 +10,15 @@ import (
 )
 
 type ShoppingCartAggregate struct {
-	ID       string
-	Items    []Product
-	Total    float64
-	Discount float64
+	ID string
+	Basket
+	OrderID string       // Order the cart was checked out as, which locks it
+	Payment *CartPayment // Latest payment, which locks the cart while pending or once paid
 
-	found bool
+	found  bool
+	coupon *Coupon               // Set by CartService for apply_coupon and the checkout of a cart with a coupon
+	order  *OrderAggregate       // Set by CartService for a repeated checkout, nil if the order does not exist
+	stock  map[string]*Inventory // Set by CartService for the products a command changes, by ID
 }
 
 func (s *ShoppingCartAggregate) ApplyEvent(e *gen.EventEnvelope) error {
@@ -24,19 +28,14 @@ func (s *ShoppingCartAggregate) ApplyEvent(e *gen.EventEnvelope) error {
 	}
 	s.found = true
 	switch evt := ev.(type) {
-	case *CartItemAdded:
-		s.Items = append(s.Items, evt.Product)
-		s.Total += evt.Product.Price
-	case *CartItemRemoved:
-		for i, item := range s.Items {
-			if item.ID == evt.ProductID {
-				s.Total -= item.Price
-				s.Items = append(s.Items[:i], s.Items[i+1:]...)
-				break
-			}
-		}
-	case *CartDiscountApplied:
-		s.Discount = evt.Discount
+	case *CartCreated:
+		s.Basket = Basket{Items: Lines{}}
+	case *CartItemAdded, *CartItemRemoved, *CartItemQuantitySet, *CartDiscountApplied, *CartCouponApplied:
+		s.Basket.Apply(evt)
+	case *CartCheckedOut:
+		s.OrderID = evt.OrderID
+	case *CartPaymentStarted, *CartPaid, *CartPaymentFailed:
+		s.Payment = s.Payment.Apply(evt)
 	default:
 		return fmt.Errorf("unknown event type: %T", ev)
 	}
@@ -53,15 +52,23 @@ func (s *ShoppingCartAggregate) ApplyCommand(m *gen.CommandEnvelope) ([]*gen.Eve
 
 	cmd, _ := bee.UnmarshalCommand(m)
 
-	switch cmd.(type) {
+	if s.OrderID != "" {
+		if checkout, ok := cmd.(*CartCheckout); ok && checkout.OrderID == s.OrderID {
+			return s.finishCheckout(m, checkout) // Repeated checkout
+		}
+		return nil, fmt.Errorf("shopping cart %s is checked out as order %s", s.ID, s.OrderID)
+	}
+	if err := s.locked(cmd); err != nil {
+		return nil, err
+	}
+
+	switch cmd := cmd.(type) {
 	case *CartCreate:
 		if s.found {
 			return nil, fmt.Errorf("shopping cart already exists: %s", m.AggregateId)
 		}
 		s.ID = m.AggregateId
-		s.Items = []Product{}
-		s.Total = 0
-		s.Discount = 0
+		s.Basket = Basket{Items: Lines{}}
 		return []*gen.EventEnvelope{{
 			AggregateId: m.AggregateId,
 			EventType:   "created",
@@ -70,26 +77,178 @@ func (s *ShoppingCartAggregate) ApplyCommand(m *gen.CommandEnvelope) ([]*gen.Eve
 		}}, nil
 
 	case *CartItemAdd:
-		return []*gen.EventEnvelope{{
+		if cmd.Product.ID == "" {
+			return nil, errors.New("product ID cannot be empty")
+		}
+		quantity := cmd.Quantity
+		if quantity == 0 {
+			quantity = 1
+		}
+		if quantity < 0 {
+			return nil, fmt.Errorf("invalid quantity %d", cmd.Quantity)
+		}
+		held := quantity
+		if i := s.Items.Find(cmd.Product.ID); i >= 0 {
+			held += s.Items[i].Quantity
+		}
+		events, err := s.reserve(cmd.Product.ID, held, commandTime(m))
+		if err != nil {
+			return nil, err
+		}
+		return append(events, &gen.EventEnvelope{
 			AggregateId: m.AggregateId,
 			EventType:   "item_added",
-			Payload:     m.Payload,
+			Payload:     utils.MustMarshal(&CartItemAdded{Product: cmd.Product, Quantity: quantity}),
 			Metadata:    m.Metadata,
-		}}, nil
+		}), nil
 	case *CartItemRemove:
-		input := m.ExtraMetadata.AsMap()
-		var product Product
-		utils.FromStructpbMap(input["product"].(utils.M), &product)
-
-		return []*gen.EventEnvelope{{
+		i := s.Items.Find(cmd.ProductID)
+		if i < 0 {
+			return nil, fmt.Errorf("product %s is not in the cart", cmd.ProductID)
+		}
+		line := s.Items[i]
+		events, err := s.reserve(line.Product.ID, 0, commandTime(m))
+		if err != nil {
+			return nil, err
+		}
+		return append(events, &gen.EventEnvelope{
 			AggregateId: m.AggregateId,
 			EventType:   "item_removed",
 			Payload: utils.MustMarshal(&CartItemRemoved{
-				ProductID: product.ID,
-				Product:   product,
+				ProductID: line.Product.ID,
+				Product:   line.Product,
+				Quantity:  line.Quantity,
 			}),
 			Metadata: m.Metadata,
-		}}, nil
+		}), nil
+	case *CartItemSetQuantity:
+		i := s.Items.Find(cmd.ProductID)
+		if i < 0 {
+			return nil, fmt.Errorf("product %s is not in the cart", cmd.ProductID)
+		}
+		if cmd.Quantity < 0 {
+			return nil, fmt.Errorf("invalid quantity %d", cmd.Quantity)
+		}
+		if s.Items[i].Quantity == cmd.Quantity {
+			return nil, nil
+		}
+		events, err := s.reserve(cmd.ProductID, cmd.Quantity, commandTime(m))
+		if err != nil {
+			return nil, err
+		}
+		return append(events, &gen.EventEnvelope{
+			AggregateId: m.AggregateId,
+			EventType:   "quantity_set",
+			Payload:     utils.MustMarshal(&CartItemQuantitySet{ProductID: cmd.ProductID, Quantity: cmd.Quantity}),
+			Metadata:    m.Metadata,
+		}), nil
+	case *CartCouponApply:
+		if s.coupon == nil {
+			return nil, errors.New("coupon was not loaded")
+		}
+		if s.Coupon != nil && s.Coupon.Code != s.coupon.ID {
+			return nil, fmt.Errorf("shopping cart already has coupon %s", s.Coupon.Code)
+		}
+		redeemed, err := s.coupon.redeem(m.AggregateId, s.Subtotal(), commandTime(m))
+		if err != nil {
+			return nil, err
+		}
+		// The cart takes the coupon first, guarded by its version, so a
+		// cart that changed meanwhile uses nothing up. Applying the coupon
+		// again counts a use that was not stored, and so does checkout.
+		var events []*gen.EventEnvelope
+		if s.Coupon == nil {
+			events = append(events, &gen.EventEnvelope{
+				AggregateId: m.AggregateId,
+				EventType:   "coupon_applied",
+				Payload: utils.MustMarshal(&CartCouponApplied{Coupon: AppliedCoupon{
+					Code:      s.coupon.ID,
+					Kind:      s.coupon.Kind,
+					Value:     s.coupon.Value,
+					MinBasket: s.coupon.MinBasket,
+				}}),
+				Metadata: m.Metadata,
+			})
+		}
+		if redeemed != nil {
+			events = append(events, redeemed)
+		}
+		return events, nil
+	case *CartCheckout:
+		if cmd.OrderID == "" {
+			return nil, errors.New("order ID cannot be empty")
+		}
+		if len(s.Items) == 0 {
+			return nil, fmt.Errorf("shopping cart %s is empty", s.ID)
+		}
+		// The use of the coupon and the stock are taken first, which a
+		// retry does not take twice. The cart is locked next, guarded by its
+		// version, so a cart that changed while it was checked out is
+		// checked out again instead.
+		now := commandTime(m)
+		events, err := s.redeemed()
+		if err != nil {
+			return nil, err
+		}
+		committed, err := s.commit(cmd.OrderID, now)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, committed...)
+		events = append(events, []*gen.EventEnvelope{{
+			AggregateId: m.AggregateId,
+			EventType:   "checked_out",
+			Payload:     utils.MustMarshal(&CartCheckedOut{OrderID: cmd.OrderID}),
+			Metadata:    m.Metadata,
+		}, placeOrder(cmd.OrderID, m.AggregateId, cmd.CustomerID, s.Basket, now)}...)
+		if s.Payment.Paid() {
+			events = append(events, payOrder(cmd.OrderID, s.Payment.ID, now))
+		}
+		return events, nil
+	case *CartPay:
+		switch {
+		case s.Payment != nil && s.Payment.ID == cmd.PaymentID:
+			return nil, nil // Repeated payment
+		case cmd.PaymentID == "":
+			return nil, errors.New("payment ID cannot be empty")
+		case cmd.AccountID == "" || cmd.Merchant == "" || cmd.Currency == "":
+			return nil, errors.New("payment needs an account, a merchant and a currency")
+		case cmd.AccountID == cmd.Merchant:
+			return nil, errors.New("shopping cart cannot be paid by the merchant")
+		case s.Total() <= 0:
+			return nil, fmt.Errorf("shopping cart %s has nothing to pay", s.ID)
+		}
+		// The stock is pinned before the money is taken, so the cart can
+		// still be checked out however long the payment takes.
+		events, err := s.pin(commandTime(m))
+		if err != nil {
+			return nil, err
+		}
+		return append(events, &gen.EventEnvelope{
+			AggregateId: m.AggregateId,
+			EventType:   PaymentStarted,
+			Payload: utils.MustMarshal(&CartPaymentStarted{
+				PaymentID: cmd.PaymentID,
+				AccountID: cmd.AccountID,
+				Merchant:  cmd.Merchant,
+				Amount:    cents(s.Total()),
+				Currency:  cmd.Currency,
+				Timestamp: commandTime(m),
+			}),
+			Metadata: m.Metadata,
+		}), nil
+	case *CartRecordPayment:
+		return s.settle(m, cmd.PaymentID, PaymentPaid, &CartPaid{PaymentID: cmd.PaymentID, Timestamp: commandTime(m)})
+	case *CartFailPayment:
+		failed, err := s.settle(m, cmd.PaymentID, PaymentFailed, &CartPaymentFailed{PaymentID: cmd.PaymentID, Reason: cmd.Reason, Timestamp: commandTime(m)})
+		if err != nil || len(failed) == 0 {
+			return failed, err
+		}
+		events, err := s.unpin(commandTime(m))
+		if err != nil {
+			return nil, err
+		}
+		return append(events, failed...), nil
 	case *CartDiscountApply:
 		return []*gen.EventEnvelope{{
 			AggregateId: m.AggregateId,
@@ -102,6 +261,38 @@ func (s *ShoppingCartAggregate) ApplyCommand(m *gen.CommandEnvelope) ([]*gen.Eve
 	}
 }
 
+// redeemed returns the coupon event that counts the use of the coupon of
+// the cart if applying it did not store one, none if it has no coupon.
+func (s *ShoppingCartAggregate) redeemed() ([]*gen.EventEnvelope, error) {
+	if s.Coupon == nil {
+		return nil, nil
+	}
+	if s.coupon == nil {
+		return nil, errors.New("coupon was not loaded")
+	}
+	e, err := s.coupon.use(s.ID)
+	if err != nil || e == nil {
+		return nil, err
+	}
+	return []*gen.EventEnvelope{e}, nil
+}
+
+// finishCheckout completes a checkout that locked the cart but stopped
+// before its order was stored, by placing (and paying) the order again. A
+// checkout whose order exists is repeated without events, unless the order
+// still misses the payment of the cart.
+func (s *ShoppingCartAggregate) finishCheckout(m *gen.CommandEnvelope, cmd *CartCheckout) ([]*gen.EventEnvelope, error) {
+	now := commandTime(m)
+	var events []*gen.EventEnvelope
+	if s.order == nil {
+		events = append(events, placeOrder(s.OrderID, m.AggregateId, cmd.CustomerID, s.Basket, now))
+	}
+	if s.Payment.Paid() && (s.order == nil || s.order.Status == OrderStatusPlaced) {
+		events = append(events, payOrder(s.OrderID, s.Payment.ID, now))
+	}
+	return events, nil
+}
+
 type UserAggregate struct {
 	ID    string
 	Name  string
@@ -5,17 +5,48 @@ type CartCreate struct {
 }
 
 type CartItemAdd struct {
-	Product Product // Product being added to the cart
+	Product  Product // Product being added to the cart
+	Quantity int     // Units to add, 1 if zero
 }
 
 type CartItemRemove struct {
-	ProductID string // ID of the product being removed from the cart
+	ProductID string // ID of the product whose line is removed from the cart
+}
+
+type CartItemSetQuantity struct {
+	ProductID string // ID of the product whose line changes
+	Quantity  int    // New number of units, 0 removes the line
 }
 
 type CartDiscountApply struct {
 	Discount float64 // Discount amount applied to the cart
 }
 
+type CartCouponApply struct {
+	Code string // Code of the coupon, as typed in
+}
+
+type CartCheckout struct {
+	OrderID    string // ID of the order to place
+	CustomerID string // Customer the order belongs to
+}
+
+type CartPay struct {
+	PaymentID string // ID of the payment, the Ref of its debit and credit
+	AccountID string // Payments account of the shopper
+	Merchant  string // Payments account credited
+	Currency  string // Currency of both accounts
+}
+
+type CartRecordPayment struct {
+	PaymentID string // Payment that was debited and credited
+}
+
+type CartFailPayment struct {
+	PaymentID string // Payment that failed
+	Reason    string // Why banking rejected it
+}
+
 type UserCreate struct {
 	ID    string // Unique identifier for the user
 	Name  string // Name of the user
@@ -43,3 +74,32 @@ type ProductUpdatePrice struct {
 type ProductDelete struct {
 	ID string // Unique identifier for the product to be deleted
 }
+
+type CouponCreate struct {
+	Kind      string  // CouponPercent or CouponFixed
+	Value     float64 // Percentage or amount off
+	MinBasket float64 // Subtotal the cart needs for the coupon to apply
+	ExpiresAt int64   // Unix time the coupon expires at, never if zero
+	MaxUses   int     // Number of carts it can be applied to, unlimited if zero
+}
+
+type OrderPay struct {
+	Ref string // Reference of the payment
+}
+
+type OrderShip struct {
+	Carrier  string // Carrier the order is handed to
+	Tracking string // Tracking number of the parcel
+}
+
+type OrderDeliver struct{}
+
+type OrderCancel struct {
+	Reason string // Why the order is cancelled
+}
+
+type InventoryReceive struct {
+	Quantity int // Units added to the stock
+}
+
+type InventoryExpire struct{}
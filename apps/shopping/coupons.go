@@ -0,0 +1,212 @@
+package shopping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/blinkinglight/gobeego/pkg/utils"
+)
+
+// Kinds of coupon: Value is a percentage of the basket or an amount off it.
+const (
+	CouponPercent = "percent"
+	CouponFixed   = "fixed"
+)
+
+// CouponCode normalizes a code as typed in by a customer into the ID of its
+// coupon aggregate.
+func CouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Coupon is the aggregate of one coupon code. Every cart it is applied to
+// counts once towards MaxUses.
+type Coupon struct {
+	ID        string
+	Kind      string
+	Value     float64
+	MinBasket float64
+	ExpiresAt int64
+	MaxUses   int
+	Uses      int
+	Carts     map[string]bool
+
+	found   bool
+	version uint64 // Version LoadCoupon replayed, which guards redeem
+}
+
+func (c *Coupon) ApplyEvent(e *gen.EventEnvelope) error {
+	ev, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return err
+	}
+	c.found = true
+	switch evt := ev.(type) {
+	case *CouponCreated:
+		c.ID = e.AggregateId
+		c.Kind = evt.Kind
+		c.Value = evt.Value
+		c.MinBasket = evt.MinBasket
+		c.ExpiresAt = evt.ExpiresAt
+		c.MaxUses = evt.MaxUses
+	case *CouponRedeemed:
+		if c.Carts == nil {
+			c.Carts = map[string]bool{}
+		}
+		if !c.Carts[evt.CartID] {
+			c.Carts[evt.CartID] = true
+			c.Uses++
+		}
+	default:
+		return fmt.Errorf("unknown event type: %T", ev)
+	}
+	return nil
+}
+
+func (c *Coupon) ApplyCommand(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	cmd, err := bee.UnmarshalCommand(m)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cmd := cmd.(type) {
+	case *CouponCreate:
+		if c.found {
+			return nil, fmt.Errorf("coupon already exists: %s", m.AggregateId)
+		}
+		if m.AggregateId == "" || CouponCode(m.AggregateId) != m.AggregateId {
+			return nil, fmt.Errorf("invalid coupon code %q", m.AggregateId)
+		}
+		switch cmd.Kind {
+		case CouponPercent:
+			if cmd.Value <= 0 || cmd.Value > 100 {
+				return nil, errors.New("percentage must be between 0 and 100")
+			}
+		case CouponFixed:
+			if cmd.Value <= 0 {
+				return nil, errors.New("amount must be greater than zero")
+			}
+		default:
+			return nil, fmt.Errorf("unknown coupon kind %q", cmd.Kind)
+		}
+		if cmd.MinBasket < 0 || cmd.MaxUses < 0 {
+			return nil, errors.New("minimum basket and usage limit cannot be negative")
+		}
+		return []*gen.EventEnvelope{{
+			AggregateId: m.AggregateId,
+			EventType:   "created",
+			Payload: utils.MustMarshal(&CouponCreated{
+				Code:      m.AggregateId,
+				Kind:      cmd.Kind,
+				Value:     cmd.Value,
+				MinBasket: cmd.MinBasket,
+				ExpiresAt: cmd.ExpiresAt,
+				MaxUses:   cmd.MaxUses,
+			}),
+			Metadata: m.Metadata,
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unknown command type: %T %v", cmd, m.CommandType)
+	}
+}
+
+// redeem checks that the coupon can be applied to a cart with the subtotal
+// at now and returns the event that counts the use, nil if the cart already
+// used it.
+func (c *Coupon) redeem(cartID string, subtotal float64, now int64) (*gen.EventEnvelope, error) {
+	switch {
+	case !c.found:
+		return nil, fmt.Errorf("coupon does not exist: %s", c.ID)
+	case c.ExpiresAt != 0 && now >= c.ExpiresAt:
+		return nil, fmt.Errorf("coupon %s has expired", c.ID)
+	case subtotal < c.MinBasket:
+		return nil, fmt.Errorf("coupon %s needs a basket of at least %.2f", c.ID, c.MinBasket)
+	}
+	return c.use(cartID)
+}
+
+// use returns the event that counts the use of the coupon by a cart, nil if
+// it was counted already.
+func (c *Coupon) use(cartID string) (*gen.EventEnvelope, error) {
+	switch {
+	case c.Carts[cartID]:
+		return nil, nil
+	case c.MaxUses > 0 && c.Uses >= c.MaxUses:
+		return nil, fmt.Errorf("coupon %s has been used up", c.ID)
+	}
+	// Guarded by the version the coupon was replayed at, so two carts
+	// cannot take its last use.
+	return &gen.EventEnvelope{
+		AggregateId:   c.ID,
+		AggregateType: "coupon",
+		EventType:     "redeemed",
+		Payload:       utils.MustMarshal(&CouponRedeemed{CartID: cartID}),
+		Metadata:      map[string]string{eventstore.VersionKey: strconv.FormatUint(c.version, 10)},
+	}, nil
+}
+
+type CouponService struct {
+	Ctx context.Context
+}
+
+func (s *CouponService) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	agg := &Coupon{ID: m.AggregateId}
+	version, err := eventstore.Replay(s.Ctx, agg, m.Aggregate, m.AggregateId)
+	if err != nil {
+		return nil, err
+	}
+	if err := eventstore.Check(m, version); err != nil {
+		return nil, err
+	}
+	events, err := agg.ApplyCommand(m)
+	return eventstore.Expect(m, version, events), reply.Refuse(err)
+}
+
+// LoadCoupon replays a coupon.
+func LoadCoupon(ctx context.Context, code string) (*Coupon, error) {
+	agg := &Coupon{ID: CouponCode(code)}
+	version, err := eventstore.Replay(ctx, agg, "coupon", agg.ID)
+	if err != nil {
+		return nil, err
+	}
+	agg.version = version
+	return agg, nil
+}
+
+// commandTime is the time m was sent at, now if it has no timestamp.
+func commandTime(m *gen.CommandEnvelope) int64 {
+	if m.Timestamp != nil {
+		return m.Timestamp.AsTime().Unix()
+	}
+	return time.Now().Unix()
+}
+
+// AppliedCoupon is the part of a coupon a cart keeps to price itself.
+type AppliedCoupon struct {
+	Code      string  `json:"code"`
+	Kind      string  `json:"kind"`
+	Value     float64 `json:"value"`
+	MinBasket float64 `json:"min_basket"`
+}
+
+// Off is what the coupon takes off subtotal. A cart that drops below the
+// minimum basket after the coupon was applied gets nothing off until it is
+// back above it.
+func (c *AppliedCoupon) Off(subtotal float64) float64 {
+	if c == nil || subtotal < c.MinBasket {
+		return 0
+	}
+	if c.Kind == CouponPercent {
+		return math.Round(subtotal*c.Value) / 100
+	}
+	return c.Value
+}
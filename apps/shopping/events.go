@@ -5,18 +5,53 @@ type CartCreated struct {
 }
 
 type CartItemAdded struct {
-	Product Product // Product being added to the cart
+	Product  Product // Product being added to the cart
+	Quantity int     // Units added, 1 if zero
 }
 
 type CartItemRemoved struct {
 	ProductID string  // ID of the product being removed from the cart
 	Product   Product // Product being removed from the cart
+	Quantity  int     // Units removed, the whole line; 1 if zero
+}
+
+type CartItemQuantitySet struct {
+	ProductID string // ID of the product whose line changes
+	Quantity  int    // New number of units, 0 removes the line
 }
 
 type CartDiscountApplied struct {
 	Discount float64 // Discount amount applied to the cart
 }
 
+type CartCouponApplied struct {
+	Coupon AppliedCoupon // Coupon applied to the cart
+}
+
+type CartCheckedOut struct {
+	OrderID string // Order the cart was checked out as
+}
+
+type CartPaymentStarted struct {
+	PaymentID string // Ref of the debit and credit
+	AccountID string // Payments account of the shopper
+	Merchant  string // Payments account credited
+	Amount    int64  // Total of the cart in cents
+	Currency  string // Currency of both accounts
+	Timestamp int64  // Unix time the payment started
+}
+
+type CartPaid struct {
+	PaymentID string // Payment that was debited and credited
+	Timestamp int64  // Unix time the payment completed
+}
+
+type CartPaymentFailed struct {
+	PaymentID string // Payment that failed
+	Reason    string // Why banking rejected it, e.g. insufficient funds
+	Timestamp int64  // Unix time the payment failed
+}
+
 type UserCreated struct {
 	ID    string // Unique identifier for the user
 	Name  string // Name of the user
@@ -44,3 +79,72 @@ type ProductPriceUpdated struct {
 type ProductDeleted struct {
 	ID string // Unique identifier for the product
 }
+
+type CouponCreated struct {
+	Code      string  // Code of the coupon, its aggregate ID
+	Kind      string  // CouponPercent or CouponFixed
+	Value     float64 // Percentage or amount off
+	MinBasket float64 // Subtotal the cart needs for the coupon to apply
+	ExpiresAt int64   // Unix time the coupon expires at, never if zero
+	MaxUses   int     // Number of carts it can be applied to, unlimited if zero
+}
+
+type CouponRedeemed struct {
+	CartID string // Cart the coupon was applied to
+}
+
+type OrderPlaced struct {
+	OrderID    string  // Unique identifier for the order
+	CartID     string  // Cart the order was checked out from
+	CustomerID string  // Customer the order belongs to
+	Items      Lines   // Lines of the cart at checkout
+	Subtotal   float64 // Price of the lines before discounts
+	Discount   float64 // Amount the discounts took off
+	Coupon     string  // Code of the coupon applied to the cart, if any
+	Total      float64 // Amount to pay
+	Timestamp  int64   // Unix time of the checkout
+}
+
+type OrderPaid struct {
+	Ref       string // Reference of the payment
+	Timestamp int64  // Unix time the order was paid
+}
+
+type OrderShipped struct {
+	Carrier   string // Carrier the order was handed to
+	Tracking  string // Tracking number of the parcel
+	Timestamp int64  // Unix time the order was shipped
+}
+
+type OrderDelivered struct {
+	Timestamp int64 // Unix time the order was delivered
+}
+
+type OrderCancelled struct {
+	Reason    string // Why the order was cancelled
+	Timestamp int64  // Unix time the order was cancelled
+}
+
+type StockReceived struct {
+	Quantity int // Units added to the stock
+}
+
+type StockReserved struct {
+	CartID    string // Cart the units are held for
+	Quantity  int    // Units the cart holds, its whole line of the product
+	ExpiresAt int64  // Unix time the reservation lapses at
+}
+
+type StockReleased struct {
+	CartID string // Cart that gave its units back
+}
+
+type ReservationExpired struct {
+	CartID string // Cart whose reservation lapsed
+}
+
+type StockCommitted struct {
+	CartID   string // Cart that was checked out
+	OrderID  string // Order the cart was checked out as
+	Quantity int    // Units taken from the stock, all the cart took if it was committed before
+}
@@ -1,30 +1,123 @@
 package shopping
 
-import "github.com/blinkinglight/bee"
+import (
+	"github.com/blinkinglight/gobeego/apps/banking"
+	"github.com/blinkinglight/gobeego/pkg/registry"
+)
 
-func init() {
-	bee.RegisterEvent[CartCreated]("cart", "created")
-	bee.RegisterEvent[CartItemAdded]("cart", "item_added")
-	bee.RegisterEvent[CartItemRemoved]("cart", "item_removed")
-	bee.RegisterEvent[CartDiscountApplied]("cart", "discount_applied")
-
-	bee.RegisterCommand[CartCreate]("cart", "create")
-	bee.RegisterCommand[CartItemAdd]("cart", "add_item")
-	bee.RegisterCommand[CartItemRemove]("cart", "remove_item")
-	bee.RegisterCommand[CartDiscountApply]("cart", "apply_discount")
-
-	bee.RegisterEvent[UserCreated]("user", "created")
-	bee.RegisterCommand[UserCreate]("user", "create")
-	bee.RegisterCommand[CartAddToUser]("user", "add_cart")
-	bee.RegisterEvent[CartAddedToUser]("user", "cart_added")
+// App declares the aggregates of shopping and what its handlers send.
+var App = registry.App{
+	Name: "shopping",
+	Aggregates: []registry.Aggregate{
+		{
+			Name: "cart",
+			Commands: []registry.Type{
+				registry.Of[CartCreate]("create"),
+				registry.Of[CartItemAdd]("add_item"),
+				registry.Of[CartItemRemove]("remove_item"),
+				registry.Of[CartItemSetQuantity]("set_quantity"),
+				registry.Of[CartDiscountApply]("apply_discount"),
+				registry.Of[CartCouponApply]("apply_coupon"),
+				registry.Of[CartCheckout]("checkout"),
+				registry.Of[CartPay]("pay"),
+				registry.Of[CartRecordPayment]("record_payment"),
+				registry.Of[CartFailPayment]("fail_payment"),
+			},
+			Events: []registry.Type{
+				registry.Of[CartCreated]("created"),
+				registry.Of[CartItemAdded]("item_added"),
+				registry.Of[CartItemRemoved]("item_removed"),
+				registry.Of[CartItemQuantitySet]("quantity_set"),
+				registry.Of[CartDiscountApplied]("discount_applied"),
+				registry.Of[CartCouponApplied]("coupon_applied"),
+				registry.Of[CartCheckedOut]("checked_out"),
+				registry.Of[CartPaymentStarted](PaymentStarted),
+				registry.Of[CartPaid](PaymentPaid),
+				registry.Of[CartPaymentFailed](PaymentFailed),
+			},
+		},
+		{
+			Name: "order",
+			Commands: []registry.Type{
+				registry.Of[OrderPay]("pay"),
+				registry.Of[OrderShip]("ship"),
+				registry.Of[OrderDeliver]("deliver"),
+				registry.Of[OrderCancel]("cancel"),
+			},
+			Events: []registry.Type{
+				registry.Of[OrderPlaced](OrderStatusPlaced),
+				registry.Of[OrderPaid](OrderStatusPaid),
+				registry.Of[OrderShipped](OrderStatusShipped),
+				registry.Of[OrderDelivered](OrderStatusDelivered),
+				registry.Of[OrderCancelled](OrderStatusCancelled),
+			},
+		},
+		{
+			Name: "user",
+			Commands: []registry.Type{
+				registry.Of[UserCreate]("create"),
+				registry.Of[CartAddToUser]("add_cart"),
+			},
+			Events: []registry.Type{
+				registry.Of[UserCreated]("created"),
+				registry.Of[CartAddedToUser]("cart_added"),
+			},
+		},
+		{
+			Name:     "coupon",
+			Commands: []registry.Type{registry.Of[CouponCreate]("create")},
+			Events: []registry.Type{
+				registry.Of[CouponCreated]("created"),
+				registry.Of[CouponRedeemed]("redeemed"),
+			},
+		},
+		{
+			Name: "inventory",
+			Commands: []registry.Type{
+				registry.Of[InventoryReceive]("receive"),
+				registry.Of[InventoryExpire]("expire"),
+			},
+			Events: []registry.Type{
+				registry.Of[StockReceived]("received"),
+				registry.Of[StockReserved]("reserved"),
+				registry.Of[StockReleased]("released"),
+				registry.Of[ReservationExpired]("expired"),
+				registry.Of[StockCommitted]("committed"),
+			},
+		},
+		{
+			Name: "product",
+			Commands: []registry.Type{
+				registry.Of[ProductCreate]("create"),
+				registry.Of[ProductUpdateName]("update_name"),
+				registry.Of[ProductUpdatePrice]("update_price"),
+				registry.Of[ProductDelete]("delete"),
+			},
+			Events: []registry.Type{
+				registry.Of[ProductCreated]("created"),
+				registry.Of[ProductNameUpdated]("name_updated"),
+				registry.Of[ProductPriceUpdated]("price_updated"),
+				registry.Of[ProductDeleted]("deleted"),
+			},
+		},
+	},
+	Uses: []registry.Use{
+		registry.Emits("CartService", "cart", "created", "item_added", "item_removed", "quantity_set", "discount_applied", "coupon_applied", "checked_out",
+			PaymentStarted, PaymentPaid, PaymentFailed),
+		registry.Emits("CartService", "coupon", "redeemed"),
+		registry.Emits("CartService", "order", OrderStatusPlaced, OrderStatusPaid),
+		registry.Emits("CartService", "inventory", "reserved", "released", "committed"),
+		registry.Emits("InventoryService", "inventory", "received", "expired"),
+		registry.Emits("OrderService", "order", OrderStatusPaid, OrderStatusShipped, OrderStatusDelivered, OrderStatusCancelled),
+		registry.Emits("CouponService", "coupon", "created"),
+		registry.Emits("UserService", "user", "created", "cart_added"),
 
-	bee.RegisterEvent[ProductCreated]("product", "created")
-	bee.RegisterEvent[ProductNameUpdated]("product", "name_updated")
-	bee.RegisterEvent[ProductPriceUpdated]("product", "price_updated")
-	bee.RegisterEvent[ProductDeleted]("product", "deleted")
+		registry.Publishes("CartPaymentSaga", banking.Aggregate, banking.DebitCommand, banking.CreditCommand),
+		registry.Publishes("CartPaymentSaga", "cart", "record_payment", "fail_payment"),
+		registry.Publishes("ReservationExpirer", "inventory", "expire"),
+	},
+}
 
-	bee.RegisterCommand[ProductCreate]("product", "create")
-	bee.RegisterCommand[ProductUpdateName]("product", "update_name")
-	bee.RegisterCommand[ProductUpdatePrice]("product", "update_price")
-	bee.RegisterCommand[ProductDelete]("product", "delete")
+func init() {
+	registry.Register(App)
 }
@@ -0,0 +1,441 @@
+package shopping
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/blinkinglight/gobeego/pkg/utils"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ReservationTTL is how long a cart keeps stock of a product reserved after
+// it last changed its line of the product. A cart that is being paid for or
+// is paid keeps its stock until it is checked out.
+const ReservationTTL = 30 * time.Minute
+
+// DefaultReservationInterval is how often ReservationExpirer.Run looks for
+// expired reservations when Interval is zero.
+const DefaultReservationInterval = time.Minute
+
+type Reservation struct {
+	Quantity  int   `json:"quantity"`
+	ExpiresAt int64 `json:"expires_at"` // Unix time the reservation lapses at, 0 while the cart is paid for
+}
+
+// Inventory is the stock of one product, its aggregate ID being the product
+// ID. Carts reserve units while they hold the product and commit them at
+// checkout. A product without an inventory has no stock, so none of it can
+// be added to a cart until stock is received.
+type Inventory struct {
+	ID        string
+	OnHand    int                    // Units in stock, reserved ones included
+	Reserved  map[string]Reservation // By cart ID
+	Committed map[string]int         // Units taken by each checked out cart
+
+	found   bool
+	version uint64 // Version LoadInventory replayed, which guards reservations
+}
+
+func (i *Inventory) ApplyEvent(e *gen.EventEnvelope) error {
+	ev, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return err
+	}
+	i.found = true
+	if i.Reserved == nil {
+		i.Reserved = map[string]Reservation{}
+	}
+	switch evt := ev.(type) {
+	case *StockReceived:
+		i.OnHand += evt.Quantity
+	case *StockReserved:
+		i.Reserved[evt.CartID] = Reservation{Quantity: evt.Quantity, ExpiresAt: evt.ExpiresAt}
+	case *StockReleased:
+		delete(i.Reserved, evt.CartID)
+	case *ReservationExpired:
+		delete(i.Reserved, evt.CartID)
+	case *StockCommitted:
+		if i.Committed == nil {
+			i.Committed = map[string]int{}
+		}
+		i.OnHand -= evt.Quantity - i.Committed[evt.CartID]
+		i.Committed[evt.CartID] = evt.Quantity
+		delete(i.Reserved, evt.CartID)
+	default:
+		return fmt.Errorf("unknown event type: %T", ev)
+	}
+	return nil
+}
+
+func (i *Inventory) ApplyCommand(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	cmd, err := bee.UnmarshalCommand(m)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cmd := cmd.(type) {
+	case *InventoryReceive:
+		if cmd.Quantity <= 0 {
+			return nil, errors.New("quantity must be greater than zero")
+		}
+		return []*gen.EventEnvelope{{
+			AggregateId: m.AggregateId,
+			EventType:   "received",
+			Payload:     utils.MustMarshal(&StockReceived{Quantity: cmd.Quantity}),
+			Metadata:    m.Metadata,
+		}}, nil
+	case *InventoryExpire:
+		var events []*gen.EventEnvelope
+		for _, cartID := range i.expired(commandTime(m)) {
+			events = append(events, &gen.EventEnvelope{
+				AggregateId: m.AggregateId,
+				EventType:   "expired",
+				Payload:     utils.MustMarshal(&ReservationExpired{CartID: cartID}),
+				Metadata:    m.Metadata,
+			})
+		}
+		return events, nil
+	default:
+		return nil, fmt.Errorf("unknown command type: %T %v", cmd, m.CommandType)
+	}
+}
+
+// lapsed reports whether r ran out by now. Pinned reservations never do.
+func (r Reservation) lapsed(now int64) bool {
+	return r.ExpiresAt != 0 && r.ExpiresAt <= now
+}
+
+// reserved is what cartID holds at now, nothing once its reservation lapsed.
+func (i *Inventory) reserved(cartID string, now int64) int {
+	r, ok := i.Reserved[cartID]
+	if !ok || r.lapsed(now) {
+		return 0
+	}
+	return r.Quantity
+}
+
+// Left is the stock no cart holds at now.
+func (i *Inventory) Left(now int64) int {
+	left := i.OnHand
+	for cartID := range i.Reserved {
+		left -= i.reserved(cartID, now)
+	}
+	return max(left, 0)
+}
+
+// expired lists the carts whose reservation lapsed by now, ordered by ID.
+func (i *Inventory) expired(now int64) []string {
+	var carts []string
+	for cartID, r := range i.Reserved {
+		if r.lapsed(now) {
+			carts = append(carts, cartID)
+		}
+	}
+	slices.Sort(carts)
+	return carts
+}
+
+// reserve returns the event that has cartID hold quantity units, its whole
+// line of the product, or release them all for a quantity of zero.
+func (i *Inventory) reserve(cartID string, quantity int, now int64) (*gen.EventEnvelope, error) {
+	if quantity <= 0 {
+		if _, ok := i.Reserved[cartID]; !ok {
+			return nil, nil
+		}
+		return i.event("released", &StockReleased{CartID: cartID}), nil
+	}
+	if err := i.check(cartID, quantity, now); err != nil {
+		return nil, err
+	}
+	return i.event("reserved", &StockReserved{
+		CartID:    cartID,
+		Quantity:  quantity,
+		ExpiresAt: now + int64(ReservationTTL/time.Second),
+	}), nil
+}
+
+// pin returns the event that has cartID hold quantity units until it is
+// checked out, as it is paid for.
+func (i *Inventory) pin(cartID string, quantity int, now int64) (*gen.EventEnvelope, error) {
+	if err := i.check(cartID, quantity, now); err != nil {
+		return nil, err
+	}
+	return i.event("reserved", &StockReserved{CartID: cartID, Quantity: quantity}), nil
+}
+
+// unpin returns the event that lets the units pinned for cartID lapse after
+// ReservationTTL again, nil if it has none pinned.
+func (i *Inventory) unpin(cartID string, now int64) *gen.EventEnvelope {
+	r, ok := i.Reserved[cartID]
+	if !ok || r.ExpiresAt != 0 {
+		return nil
+	}
+	return i.event("reserved", &StockReserved{
+		CartID:    cartID,
+		Quantity:  r.Quantity,
+		ExpiresAt: now + int64(ReservationTTL/time.Second),
+	})
+}
+
+// commit returns the event that takes the quantity units cartID checks out
+// as orderID from the stock, nil if they were taken already. Units whose
+// reservation lapsed are taken from the stock left, if there is enough. A
+// checkout retried after the line changed takes the units it added or puts
+// back the ones it dropped.
+func (i *Inventory) commit(cartID, orderID string, quantity int, now int64) (*gen.EventEnvelope, error) {
+	committed, ok := i.Committed[cartID]
+	if ok && committed == quantity {
+		return nil, nil // Repeated checkout
+	}
+	if err := i.check(cartID, quantity-committed, now); err != nil {
+		return nil, err
+	}
+	return i.event("committed", &StockCommitted{CartID: cartID, OrderID: orderID, Quantity: quantity}), nil
+}
+
+// check rejects quantity units for cartID when they exceed what it holds
+// and what is left.
+func (i *Inventory) check(cartID string, quantity int, now int64) error {
+	available := i.Left(now) + i.reserved(cartID, now)
+	switch {
+	case quantity <= available:
+		return nil
+	case available == 0:
+		return fmt.Errorf("product %s is out of stock", i.ID)
+	default:
+		return fmt.Errorf("only %d of product %s left", available, i.ID)
+	}
+}
+
+// event is an inventory event emitted by a cart command. It is guarded by
+// the version the inventory was replayed at, so two carts cannot take the
+// same units.
+func (i *Inventory) event(eventType string, payload any) *gen.EventEnvelope {
+	return &gen.EventEnvelope{
+		AggregateId:   i.ID,
+		AggregateType: "inventory",
+		EventType:     eventType,
+		Payload:       utils.MustMarshal(payload),
+		Metadata:      map[string]string{eventstore.VersionKey: strconv.FormatUint(i.version, 10)},
+	}
+}
+
+// reserve returns the inventory event that has the cart hold quantity units
+// of productID, none if it releases units it does not hold. Inventory events
+// go before the events of the cart: they hold the whole line, so a cart
+// command retried after a conflict on the cart sets them again rather than
+// adding to them.
+func (s *ShoppingCartAggregate) reserve(productID string, quantity int, now int64) ([]*gen.EventEnvelope, error) {
+	inventory, ok := s.stock[productID]
+	if !ok {
+		return nil, fmt.Errorf("stock of product %s was not loaded", productID)
+	}
+	e, err := inventory.reserve(s.ID, quantity, now)
+	if err != nil || e == nil {
+		return nil, err
+	}
+	return []*gen.EventEnvelope{e}, nil
+}
+
+// commit returns the inventory events that take the lines of the cart from
+// the stock when it is checked out as orderID.
+func (s *ShoppingCartAggregate) commit(orderID string, now int64) ([]*gen.EventEnvelope, error) {
+	return s.lines(func(inventory *Inventory, line LineItem) (*gen.EventEnvelope, error) {
+		return inventory.commit(s.ID, orderID, line.Quantity, now)
+	})
+}
+
+// pin returns the inventory events that keep the lines of the cart reserved
+// while it is paid for, so they are still there when it is checked out after
+// the money was taken.
+func (s *ShoppingCartAggregate) pin(now int64) ([]*gen.EventEnvelope, error) {
+	return s.lines(func(inventory *Inventory, line LineItem) (*gen.EventEnvelope, error) {
+		return inventory.pin(s.ID, line.Quantity, now)
+	})
+}
+
+// unpin returns the inventory events that let the lines of the cart lapse
+// again after its payment failed.
+func (s *ShoppingCartAggregate) unpin(now int64) ([]*gen.EventEnvelope, error) {
+	return s.lines(func(inventory *Inventory, line LineItem) (*gen.EventEnvelope, error) {
+		return inventory.unpin(s.ID, now), nil
+	})
+}
+
+// lines collects the inventory events fn returns for each line of the cart.
+func (s *ShoppingCartAggregate) lines(fn func(inventory *Inventory, line LineItem) (*gen.EventEnvelope, error)) ([]*gen.EventEnvelope, error) {
+	var events []*gen.EventEnvelope
+	for _, line := range s.Items {
+		inventory, ok := s.stock[line.Product.ID]
+		if !ok {
+			return nil, fmt.Errorf("stock of product %s was not loaded", line.Product.ID)
+		}
+		e, err := fn(inventory, line)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+// stocked lists the products whose stock command m changes.
+func (s *ShoppingCartAggregate) stocked(m *gen.CommandEnvelope) ([]string, error) {
+	var productID string
+	switch m.CommandType {
+	case "checkout", "pay", "fail_payment":
+		ids := make([]string, 0, len(s.Items))
+		for _, line := range s.Items {
+			ids = append(ids, line.Product.ID)
+		}
+		return ids, nil
+	case "add_item":
+		var cmd CartItemAdd
+		if err := json.Unmarshal(m.Payload, &cmd); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command: %w", err)
+		}
+		productID = cmd.Product.ID
+	case "remove_item":
+		var cmd CartItemRemove
+		if err := json.Unmarshal(m.Payload, &cmd); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command: %w", err)
+		}
+		productID = cmd.ProductID
+	case "set_quantity":
+		var cmd CartItemSetQuantity
+		if err := json.Unmarshal(m.Payload, &cmd); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal command: %w", err)
+		}
+		productID = cmd.ProductID
+	default:
+		return nil, nil
+	}
+	if productID == "" {
+		return nil, nil
+	}
+	return []string{productID}, nil
+}
+
+type InventoryService struct {
+	Ctx context.Context
+}
+
+func (s *InventoryService) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	agg := &Inventory{ID: m.AggregateId}
+	version, err := eventstore.Replay(s.Ctx, agg, m.Aggregate, m.AggregateId)
+	if err != nil {
+		return nil, err
+	}
+	if err := eventstore.Check(m, version); err != nil {
+		return nil, err
+	}
+	events, err := agg.ApplyCommand(m)
+	return eventstore.Expect(m, version, events), reply.Refuse(err)
+}
+
+// LoadInventory replays the inventory of a product.
+func LoadInventory(ctx context.Context, productID string) (*Inventory, error) {
+	agg := &Inventory{ID: productID}
+	version, err := eventstore.Replay(ctx, agg, "inventory", productID)
+	if err != nil {
+		return nil, err
+	}
+	agg.version = version
+	return agg, nil
+}
+
+// inventoryIndex keeps every inventory up to date from the inventory
+// history, reading only the events stored since it was last updated.
+type inventoryIndex struct {
+	read        uint64                // Stream sequence of the last event read
+	inventories map[string]*Inventory // By product ID
+}
+
+// update applies the inventory events stored since the last update.
+func (ix *inventoryIndex) update(ctx context.Context) error {
+	if ix.inventories == nil {
+		ix.inventories = map[string]*Inventory{}
+	}
+	var err error
+	ix.read, err = eventstore.ReadAfter(ctx, "inventory", "*", ix.read, func(e *gen.EventEnvelope, _ time.Time) error {
+		i, ok := ix.inventories[e.AggregateId]
+		if !ok {
+			i = &Inventory{ID: e.AggregateId}
+			ix.inventories[e.AggregateId] = i
+		}
+		if err := i.ApplyEvent(e); err != nil {
+			log.Printf("Inventory index: skipping %s event of %s: %v", e.EventType, e.AggregateId, err)
+		}
+		return nil
+	})
+	return err
+}
+
+// ReservationExpirer releases the stock of carts that left a product alone
+// for ReservationTTL, so other carts can have it.
+type ReservationExpirer struct {
+	Ctx      context.Context
+	NC       *nats.Conn
+	Interval time.Duration // How often Run looks, DefaultReservationInterval if zero
+
+	index inventoryIndex // Inventories as of the last Tick, so a Tick only reads new events
+}
+
+// Run expires reservations every Interval until ctx is cancelled.
+func (x *ReservationExpirer) Run(ctx context.Context) error {
+	interval := x.Interval
+	if interval == 0 {
+		interval = DefaultReservationInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := x.Tick(time.Now()); err != nil {
+			log.Printf("Reservation expirer: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Tick sends expire to every inventory with a reservation that lapsed by
+// now. It is not safe for concurrent use.
+func (x *ReservationExpirer) Tick(now time.Time) error {
+	if err := x.index.update(x.Ctx); err != nil {
+		return err
+	}
+	var errs []error
+	for _, id := range slices.Sorted(maps.Keys(x.index.inventories)) {
+		i := x.index.inventories[id]
+		if len(i.expired(now.Unix())) == 0 {
+			continue
+		}
+		_, err := reply.Send(x.Ctx, x.NC, &gen.CommandEnvelope{
+			Aggregate:   "inventory",
+			AggregateId: i.ID,
+			CommandType: "expire",
+			Timestamp:   timestamppb.New(now),
+		}, InventoryExpire{})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("expire reservations of %s: %w", i.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
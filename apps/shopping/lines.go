@@ -0,0 +1,119 @@
+package shopping
+
+import "slices"
+
+// LineItem is one product in a cart and how many of it.
+type LineItem struct {
+	Product  Product `json:"product"`
+	Quantity int     `json:"quantity"`
+}
+
+// Total is the price of the line.
+func (l LineItem) Total() float64 {
+	return l.Product.Price * float64(l.Quantity)
+}
+
+// Lines are the line items of a cart in the order their products were first
+// added. Adding a product that is already in the cart raises the quantity of
+// its line, which keeps the price it was first added at.
+type Lines []LineItem
+
+// Apply applies a cart event to the lines and ignores the events that do not
+// change them.
+func (l *Lines) Apply(event any) {
+	switch ev := event.(type) {
+	case *CartItemAdded:
+		quantity := ev.Quantity
+		if quantity == 0 {
+			quantity = 1 // Added before carts had quantities
+		}
+		if i := l.Find(ev.Product.ID); i >= 0 {
+			(*l)[i].Quantity += quantity
+		} else {
+			*l = append(*l, LineItem{Product: ev.Product, Quantity: quantity})
+		}
+	case *CartItemRemoved:
+		i := l.Find(ev.ProductID)
+		if i < 0 {
+			return
+		}
+		quantity := ev.Quantity
+		if quantity == 0 {
+			quantity = 1 // Removed one entry before carts had quantities
+		}
+		l.set(i, (*l)[i].Quantity-quantity)
+	case *CartItemQuantitySet:
+		if i := l.Find(ev.ProductID); i >= 0 {
+			l.set(i, ev.Quantity)
+		}
+	}
+}
+
+func (l *Lines) set(i, quantity int) {
+	if quantity <= 0 {
+		*l = slices.Delete(*l, i, i+1)
+		return
+	}
+	(*l)[i].Quantity = quantity
+}
+
+// Find returns the index of the line of a product, -1 if it is not in the
+// cart.
+func (l Lines) Find(productID string) int {
+	return slices.IndexFunc(l, func(item LineItem) bool { return item.Product.ID == productID })
+}
+
+// Count is the number of units in the cart.
+func (l Lines) Count() int {
+	n := 0
+	for _, item := range l {
+		n += item.Quantity
+	}
+	return n
+}
+
+// Total is the price of every line.
+func (l Lines) Total() float64 {
+	total := 0.0
+	for _, item := range l {
+		total += item.Total()
+	}
+	return total
+}
+
+// Basket prices a cart: its lines less the discounts on them.
+type Basket struct {
+	Items    Lines          `json:"items"`
+	Discount float64        `json:"discount"` // Amount off set by apply_discount
+	Coupon   *AppliedCoupon `json:"coupon,omitempty"`
+}
+
+// Apply applies a cart event to the basket and ignores the events that do
+// not change it.
+func (b *Basket) Apply(event any) {
+	switch ev := event.(type) {
+	case *CartDiscountApplied:
+		b.Discount = ev.Discount
+	case *CartCouponApplied:
+		coupon := ev.Coupon
+		b.Coupon = &coupon
+	default:
+		b.Items.Apply(event)
+	}
+}
+
+// Subtotal is the price of every line before discounts.
+func (b Basket) Subtotal() float64 {
+	return b.Items.Total()
+}
+
+// Off is what the discounts take off the subtotal, never more than it.
+func (b Basket) Off() float64 {
+	subtotal := b.Subtotal()
+	return min(subtotal, b.Discount+b.Coupon.Off(subtotal))
+}
+
+// Total is the subtotal less the discounts.
+func (b Basket) Total() float64 {
+	return b.Subtotal() - b.Off()
+}
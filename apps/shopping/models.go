@@ -1,5 +1,7 @@
 package shopping
 
+import "time"
+
 type Product struct {
 	ID     string  `json:"id"`      // Unique identifier for the product
 	CartID string  `json:"cart_id"` // ID of the cart this product belongs to
@@ -13,3 +15,18 @@ type Cart struct {
 	Total    float64   // Total price of the cart
 	Discount float64   // Discount applied to the cart
 }
+
+// Order is the read model row of an order, kept by OrderProjection.
+type Order struct {
+	ID         string    `json:"id" gorm:"primaryKey"`
+	CartID     string    `json:"cart_id" gorm:"index"`
+	CustomerID string    `json:"customer_id" gorm:"index"`
+	Status     string    `json:"status"`
+	Count      int       `json:"count"` // Number of units ordered
+	Subtotal   float64   `json:"subtotal"`
+	Discount   float64   `json:"discount"`
+	Coupon     string    `json:"coupon"`
+	Total      float64   `json:"total"`
+	PlacedAt   time.Time `json:"placed_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
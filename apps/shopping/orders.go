@@ -0,0 +1,210 @@
+package shopping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/blinkinglight/gobeego/pkg/utils"
+)
+
+// Statuses of an order, each named after the event that moves an order
+// into it.
+const (
+	OrderStatusPlaced    = "placed"
+	OrderStatusPaid      = "paid"
+	OrderStatusShipped   = "shipped"
+	OrderStatusDelivered = "delivered"
+	OrderStatusCancelled = "cancelled"
+)
+
+type orderTransition struct {
+	from []string
+	to   string
+}
+
+// orderTransitions maps each order command to the statuses it moves an
+// order from and the status (and event type) it moves it to. A paid order
+// cannot be cancelled, as cancelling returns neither the money nor the
+// stock.
+var orderTransitions = map[string]orderTransition{
+	"pay":     {[]string{OrderStatusPlaced}, OrderStatusPaid},
+	"ship":    {[]string{OrderStatusPaid}, OrderStatusShipped},
+	"deliver": {[]string{OrderStatusShipped}, OrderStatusDelivered},
+	"cancel":  {[]string{OrderStatusPlaced}, OrderStatusCancelled},
+}
+
+type OrderStep struct {
+	Status    string `json:"status"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// OrderAggregate is an order placed by checking out a cart. It keeps the
+// lines and prices of the cart as they were at checkout.
+type OrderAggregate struct {
+	ID         string
+	CartID     string
+	CustomerID string
+	Items      Lines
+	Subtotal   float64
+	Discount   float64
+	Coupon     string
+	Total      float64
+	Status     string
+	PaidRef    string
+	Carrier    string
+	Tracking   string
+	Reason     string
+	History    []OrderStep
+
+	found bool
+}
+
+func (o *OrderAggregate) ApplyEvent(e *gen.EventEnvelope) error {
+	ev, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return err
+	}
+	o.found = true
+	var at int64
+	switch evt := ev.(type) {
+	case *OrderPlaced:
+		o.ID = evt.OrderID
+		o.CartID, o.CustomerID = evt.CartID, evt.CustomerID
+		o.Items = evt.Items
+		o.Subtotal, o.Discount, o.Coupon, o.Total = evt.Subtotal, evt.Discount, evt.Coupon, evt.Total
+		at = evt.Timestamp
+	case *OrderPaid:
+		o.PaidRef = evt.Ref
+		at = evt.Timestamp
+	case *OrderShipped:
+		o.Carrier, o.Tracking = evt.Carrier, evt.Tracking
+		at = evt.Timestamp
+	case *OrderDelivered:
+		at = evt.Timestamp
+	case *OrderCancelled:
+		o.Reason = evt.Reason
+		at = evt.Timestamp
+	default:
+		return fmt.Errorf("unknown event type: %T", ev)
+	}
+	o.Status = e.EventType
+	o.History = append(o.History, OrderStep{Status: e.EventType, Timestamp: at})
+	return nil
+}
+
+func (o *OrderAggregate) ApplyCommand(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	if !o.found {
+		return nil, fmt.Errorf("order does not exist: %s", m.AggregateId)
+	}
+	tr, ok := orderTransitions[m.CommandType]
+	if !ok {
+		return nil, fmt.Errorf("unknown command type: %s", m.CommandType)
+	}
+	if o.Status == tr.to {
+		return nil, nil // Repeated command
+	}
+	if !slices.Contains(tr.from, o.Status) {
+		return nil, fmt.Errorf("order %s is %s, cannot %s it", o.ID, o.Status, m.CommandType)
+	}
+
+	cmd, err := bee.UnmarshalCommand(m)
+	if err != nil {
+		return nil, err
+	}
+	now := commandTime(m)
+	var event any
+	switch cmd := cmd.(type) {
+	case *OrderPay:
+		if cmd.Ref == "" {
+			return nil, errors.New("payment reference cannot be empty")
+		}
+		event = &OrderPaid{Ref: cmd.Ref, Timestamp: now}
+	case *OrderShip:
+		event = &OrderShipped{Carrier: cmd.Carrier, Tracking: cmd.Tracking, Timestamp: now}
+	case *OrderDeliver:
+		event = &OrderDelivered{Timestamp: now}
+	case *OrderCancel:
+		event = &OrderCancelled{Reason: cmd.Reason, Timestamp: now}
+	default:
+		return nil, fmt.Errorf("unknown command type: %T %v", cmd, m.CommandType)
+	}
+	return []*gen.EventEnvelope{{
+		AggregateId: m.AggregateId,
+		EventType:   tr.to,
+		Payload:     utils.MustMarshal(event),
+		Metadata:    m.Metadata,
+	}}, nil
+}
+
+// placeOrder is the event that opens order orderID for the basket of cart
+// cartID. It only appends if the order does not exist yet.
+func placeOrder(orderID, cartID, customerID string, basket Basket, now int64) *gen.EventEnvelope {
+	placed := &OrderPlaced{
+		OrderID:    orderID,
+		CartID:     cartID,
+		CustomerID: customerID,
+		Items:      basket.Items,
+		Subtotal:   basket.Subtotal(),
+		Discount:   basket.Off(),
+		Total:      basket.Total(),
+		Timestamp:  now,
+	}
+	if basket.Coupon != nil {
+		placed.Coupon = basket.Coupon.Code
+	}
+	return &gen.EventEnvelope{
+		AggregateId:   orderID,
+		AggregateType: "order",
+		EventType:     OrderStatusPlaced,
+		Payload:       utils.MustMarshal(placed),
+		Metadata:      map[string]string{eventstore.VersionKey: "0"},
+	}
+}
+
+// payOrder is the event that marks order orderID paid by the payment ref of
+// the cart it is checked out from.
+func payOrder(orderID, ref string, now int64) *gen.EventEnvelope {
+	return &gen.EventEnvelope{
+		AggregateId:   orderID,
+		AggregateType: "order",
+		EventType:     OrderStatusPaid,
+		Payload:       utils.MustMarshal(&OrderPaid{Ref: ref, Timestamp: now}),
+	}
+}
+
+type OrderService struct {
+	Ctx context.Context
+}
+
+func (s *OrderService) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	agg := &OrderAggregate{ID: m.AggregateId}
+	version, err := eventstore.Replay(s.Ctx, agg, m.Aggregate, m.AggregateId)
+	if err != nil {
+		return nil, err
+	}
+	if err := eventstore.Check(m, version); err != nil {
+		return nil, err
+	}
+	events, err := agg.ApplyCommand(m)
+	return eventstore.Expect(m, version, events), reply.Refuse(err)
+}
+
+// LoadOrder replays an order.
+func LoadOrder(ctx context.Context, id string) (*OrderAggregate, error) {
+	agg := &OrderAggregate{ID: id}
+	if _, err := eventstore.Replay(ctx, agg, "order", id); err != nil {
+		return nil, err
+	}
+	if !agg.found {
+		return nil, fmt.Errorf("%w: %s", ErrOrderNotFound, id)
+	}
+	return agg, nil
+}
+
+var ErrOrderNotFound = errors.New("order does not exist")
@@ -0,0 +1,341 @@
+package shopping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/apps/banking"
+	"github.com/blinkinglight/gobeego/pkg/appctx"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/blinkinglight/gobeego/pkg/utils"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
+)
+
+// Statuses of a cart payment, each named after its event.
+const (
+	PaymentStarted = "payment_started"
+	PaymentPaid    = "paid"
+	PaymentFailed  = "payment_failed"
+)
+
+// PaymentSagaConsumer is the durable consumer CartPaymentSaga reads cart
+// events with, so it resumes where it stopped after a restart.
+const PaymentSagaConsumer = "cart-payment-saga"
+
+// WalletAccount is the payments account customerID pays for carts from.
+// Carts are only paid from the account of their customer.
+func WalletAccount(customerID string) string {
+	return "wallet-" + customerID
+}
+
+// CartPayment is the latest payment of a cart.
+type CartPayment struct {
+	ID        string `json:"id"`
+	AccountID string `json:"account_id"`
+	Merchant  string `json:"merchant"`
+	Amount    int64  `json:"amount"` // Cents
+	Currency  string `json:"currency"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"` // Why the payment failed
+}
+
+// Apply returns the latest payment after a cart event. Events that are not
+// about payments leave it as it is.
+func (p *CartPayment) Apply(event any) *CartPayment {
+	switch ev := event.(type) {
+	case *CartPaymentStarted:
+		return &CartPayment{
+			ID:        ev.PaymentID,
+			AccountID: ev.AccountID,
+			Merchant:  ev.Merchant,
+			Amount:    ev.Amount,
+			Currency:  ev.Currency,
+			Status:    PaymentStarted,
+		}
+	case *CartPaid:
+		if p != nil && p.ID == ev.PaymentID {
+			paid := *p
+			paid.Status = PaymentPaid
+			return &paid
+		}
+	case *CartPaymentFailed:
+		if p != nil && p.ID == ev.PaymentID {
+			failed := *p
+			failed.Status, failed.Reason = PaymentFailed, ev.Reason
+			return &failed
+		}
+	}
+	return p
+}
+
+// Pending reports whether the payment was started but neither paid nor
+// failed yet.
+func (p *CartPayment) Pending() bool {
+	return p != nil && p.Status == PaymentStarted
+}
+
+// Paid reports whether the payment went through.
+func (p *CartPayment) Paid() bool {
+	return p != nil && p.Status == PaymentPaid
+}
+
+// cents is an amount of a cart in whole cents, rounding halves away from
+// zero.
+func cents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// locked rejects the commands a cart no longer takes while a payment is
+// pending or once it is paid. A paid cart can still be checked out, and the
+// payment commands check the payment themselves.
+func (s *ShoppingCartAggregate) locked(cmd any) error {
+	switch cmd := cmd.(type) {
+	case *CartRecordPayment, *CartFailPayment:
+		return nil
+	case *CartPay:
+		if s.Payment != nil && s.Payment.ID == cmd.PaymentID {
+			return nil
+		}
+	case *CartCheckout:
+		if s.Payment.Paid() {
+			return nil
+		}
+	}
+	switch {
+	case s.Payment.Pending():
+		return fmt.Errorf("payment %s of shopping cart %s is in progress", s.Payment.ID, s.ID)
+	case s.Payment.Paid():
+		return fmt.Errorf("shopping cart %s is paid", s.ID)
+	}
+	return nil
+}
+
+// settle records the outcome of the pending payment paymentID as an event
+// of type status.
+func (s *ShoppingCartAggregate) settle(m *gen.CommandEnvelope, paymentID, status string, event any) ([]*gen.EventEnvelope, error) {
+	switch {
+	case s.Payment == nil || s.Payment.ID != paymentID:
+		return nil, fmt.Errorf("payment %s is not the payment of shopping cart %s", paymentID, s.ID)
+	case s.Payment.Status == status:
+		return nil, nil // Repeated outcome
+	case !s.Payment.Pending():
+		return nil, fmt.Errorf("payment %s of shopping cart %s is settled already", paymentID, s.ID)
+	}
+	return []*gen.EventEnvelope{{
+		AggregateId: m.AggregateId,
+		EventType:   status,
+		Payload:     utils.MustMarshal(event),
+		Metadata:    m.Metadata,
+	}}, nil
+}
+
+// CartPaymentSaga pays for carts through banking. For every payment_started
+// event it debits the account of the shopper and credits the merchant
+// through PaymentService, with the payment ID as Ref, and records the
+// outcome on the cart: paid once the debited and credited events are
+// stored, payment_failed with the reason banking gave when it refused the
+// debit. A credit the merchant account refuses is refunded to the shopper.
+// Like TransferSaga it relies on the payments handler deduplicating by Ref,
+// so a payment redelivered after a crash does not move money twice, and it
+// retries every step that failed without a refusal instead of compensating
+// it.
+type CartPaymentSaga struct {
+	Ctx context.Context
+	NC  *nats.Conn
+}
+
+// Run handles payment_started events until ctx is cancelled. Payments that
+// fail for any reason other than a refused command are retried.
+func (s *CartPaymentSaga) Run(ctx context.Context) error {
+	js := appctx.JetStream(s.Ctx)
+	subject := "events.cart.*." + PaymentStarted
+	stream, err := js.StreamNameBySubject(subject)
+	if err != nil {
+		return fmt.Errorf("find stream for %s: %w", subject, err)
+	}
+	_, err = js.AddConsumer(stream, &nats.ConsumerConfig{
+		Durable:       PaymentSagaConsumer,
+		FilterSubject: subject,
+		AckPolicy:     nats.AckExplicitPolicy,
+		DeliverPolicy: nats.DeliverAllPolicy,
+		AckWait:       30 * time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("create %s consumer: %w", PaymentSagaConsumer, err)
+	}
+	// Binding keeps Unsubscribe from deleting the durable consumer.
+	sub, err := js.PullSubscribe(subject, PaymentSagaConsumer, nats.Bind(stream, PaymentSagaConsumer))
+	if err != nil {
+		return fmt.Errorf("subscribe %s: %w", subject, err)
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		fctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		msgs, err := sub.Fetch(1, nats.Context(fctx))
+		cancel()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout) {
+				continue
+			}
+			return fmt.Errorf("fetch cart payments: %w", err)
+		}
+		for _, msg := range msgs {
+			var e gen.EventEnvelope
+			if err := proto.Unmarshal(msg.Data, &e); err != nil {
+				log.Printf("Cart payment saga: dropping undecodable event: %v", err)
+				msg.Term()
+				continue
+			}
+			if err := s.Handle(&e); err != nil {
+				log.Printf("Cart payment saga: %s %s: %v", e.AggregateId, e.EventType, err)
+				msg.NakWithDelay(time.Second)
+				continue
+			}
+			msg.Ack()
+		}
+	}
+}
+
+// Handle moves the money of a started payment and records the outcome.
+func (s *CartPaymentSaga) Handle(e *gen.EventEnvelope) error {
+	ev, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return err
+	}
+	p, ok := ev.(*CartPaymentStarted)
+	if !ok {
+		return nil
+	}
+	cartID := e.AggregateId
+
+	err = s.send(&gen.CommandEnvelope{
+		Aggregate:   banking.Aggregate,
+		AggregateId: p.AccountID,
+		CommandType: banking.DebitCommand,
+	}, &banking.DebitAccountCommand{
+		FromAccountID: p.AccountID,
+		ToAccountID:   p.Merchant,
+		Amount:        p.Amount,
+		Currency:      p.Currency,
+		Ref:           p.PaymentID,
+	}, banking.DebitedEvent)
+	if errors.Is(err, reply.ErrRefused) {
+		return s.record(cartID, "fail_payment", &CartFailPayment{PaymentID: p.PaymentID, Reason: err.Error()})
+	}
+	if err != nil {
+		return fmt.Errorf("debit: %w", err)
+	}
+
+	err = s.send(&gen.CommandEnvelope{
+		Aggregate:   banking.Aggregate,
+		AggregateId: p.Merchant,
+		CommandType: banking.CreditCommand,
+	}, &banking.CreditAccountCommand{
+		FromAccountID: p.AccountID,
+		ToAccountID:   p.Merchant,
+		Amount:        p.Amount,
+		Currency:      p.Currency,
+		Ref:           p.PaymentID,
+	}, banking.CreditedEvent)
+	if errors.Is(err, reply.ErrRefused) {
+		return s.refund(cartID, p, err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("credit: %w", err)
+	}
+	return s.record(cartID, "record_payment", &CartRecordPayment{PaymentID: p.PaymentID})
+}
+
+// refund is the compensation for a credit the merchant account refused: it
+// puts the money back on the account of the shopper.
+func (s *CartPaymentSaga) refund(cartID string, p *CartPaymentStarted, reason string) error {
+	err := s.send(&gen.CommandEnvelope{
+		Aggregate:   banking.Aggregate,
+		AggregateId: p.AccountID,
+		CommandType: banking.CreditCommand,
+	}, &banking.CreditAccountCommand{
+		FromAccountID: p.Merchant,
+		ToAccountID:   p.AccountID,
+		Amount:        p.Amount,
+		Currency:      p.Currency,
+		Ref:           p.PaymentID,
+	}, banking.CreditedEvent)
+	if errors.Is(err, reply.ErrRefused) {
+		reason = fmt.Sprintf("credit: %s; refund: %s", reason, err)
+	} else if err != nil {
+		return fmt.Errorf("refund: %w", err)
+	}
+	return s.record(cartID, "fail_payment", &CartFailPayment{PaymentID: p.PaymentID, Reason: reason})
+}
+
+// send sends a payments command and checks that it stored an event of type
+// want.
+func (s *CartPaymentSaga) send(cmd *gen.CommandEnvelope, payload any, want string) error {
+	events, err := reply.Send(s.Ctx, s.NC, cmd, payload)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(events, func(e reply.Event) bool { return e.EventType == want }) {
+		return fmt.Errorf("%s %s stored no %s event", cmd.CommandType, cmd.AggregateId, want)
+	}
+	return nil
+}
+
+func (s *CartPaymentSaga) record(cartID, commandType string, payload any) error {
+	_, err := reply.Send(s.Ctx, s.NC, &gen.CommandEnvelope{
+		Aggregate:   "cart",
+		AggregateId: cartID,
+		CommandType: commandType,
+	}, payload)
+	if errors.Is(err, reply.ErrRefused) {
+		// The payment was recorded already, e.g. when an event is redelivered.
+		log.Printf("Cart payment saga: %s %s: %v", cartID, commandType, err)
+		return nil
+	}
+	return err
+}
+
+// PayCart sends pay, a CartPay command for cart cartID, and waits until
+// CartPaymentSaga has recorded its outcome. A payment banking rejects is
+// returned with its Reason rather than as an error; ctx bounds the wait.
+func PayCart(ctx context.Context, nc *nats.Conn, cartID string, pay CartPay) (*CartPayment, error) {
+	// Subscribe first so the outcome published after the start is not missed.
+	sub, err := nc.SubscribeSync(eventstore.Subject("cart", cartID))
+	if err != nil {
+		return nil, fmt.Errorf("subscribe cart %s: %w", cartID, err)
+	}
+	defer sub.Unsubscribe()
+
+	if _, err := reply.Send(ctx, nc, &gen.CommandEnvelope{
+		Aggregate:   "cart",
+		AggregateId: cartID,
+		CommandType: "pay",
+	}, pay); err != nil {
+		return nil, err
+	}
+	for {
+		cart := &ShoppingCartAggregate{ID: cartID}
+		if _, err := eventstore.Replay(ctx, cart, "cart", cartID); err != nil {
+			return nil, err
+		}
+		if p := cart.Payment; p != nil && p.ID == pay.PaymentID && !p.Pending() {
+			return p, nil
+		}
+		if _, err := sub.NextMsgWithContext(ctx); err != nil {
+			return cart.Payment, fmt.Errorf("wait for payment %s: %w", pay.PaymentID, err)
+		}
+	}
+}
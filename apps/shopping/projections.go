@@ -0,0 +1,62 @@
+package shopping
+
+import (
+	"context"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/rwdb"
+	"gorm.io/gorm/clause"
+)
+
+// OrderProjection keeps the Order table in line with order events.
+type OrderProjection struct{}
+
+func (OrderProjection) ApplyEventTx(tx *rwdb.Tx, e *gen.EventEnvelope) error {
+	ev, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return err
+	}
+	var at int64
+	switch ev := ev.(type) {
+	case *OrderPlaced:
+		placed := time.Unix(ev.Timestamp, 0)
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&Order{
+			ID:         ev.OrderID,
+			CartID:     ev.CartID,
+			CustomerID: ev.CustomerID,
+			Status:     OrderStatusPlaced,
+			Count:      ev.Items.Count(),
+			Subtotal:   ev.Subtotal,
+			Discount:   ev.Discount,
+			Coupon:     ev.Coupon,
+			Total:      ev.Total,
+			PlacedAt:   placed,
+			UpdatedAt:  placed,
+		}).Error
+	case *OrderPaid:
+		at = ev.Timestamp
+	case *OrderShipped:
+		at = ev.Timestamp
+	case *OrderDelivered:
+		at = ev.Timestamp
+	case *OrderCancelled:
+		at = ev.Timestamp
+	default:
+		return nil
+	}
+	return tx.Model(&Order{}).Where("id = ?", e.AggregateId).Updates(map[string]any{
+		"status":     e.EventType,
+		"updated_at": time.Unix(at, 0),
+	}).Error
+}
+
+// ListOrders lists the orders of a customer, newest first.
+func ListOrders(ctx context.Context, db *rwdb.DB, customerID string) ([]Order, error) {
+	var orders []Order
+	err := db.ReadTX(ctx, func(tx *rwdb.Tx) error {
+		return tx.Where("customer_id = ?", customerID).Order("placed_at DESC").Find(&orders).Error
+	})
+	return orders, err
+}
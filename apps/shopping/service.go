@@ -2,14 +2,13 @@ package shopping
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 
-	"github.com/blinkinglight/bee"
 	"github.com/blinkinglight/bee/gen"
-	"github.com/blinkinglight/bee/ro"
-	"github.com/blinkinglight/gobeego/pkg/utils"
-	"google.golang.org/protobuf/types/known/structpb"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/reply"
 )
 
 type CartService struct {
@@ -18,33 +17,52 @@ type CartService struct {
 
 func (s *CartService) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
 	agg := &ShoppingCartAggregate{ID: m.AggregateId}
-	bee.Replay(s.Ctx, agg, ro.WithAggreate(m.Aggregate), ro.WithAggregateID(m.AggregateId))
-
-	evt, err := bee.UnmarshalCommand(m)
+	version, err := eventstore.Replay(s.Ctx, agg, m.Aggregate, m.AggregateId)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal event: %w", err)
+		return nil, err
+	}
+	if err := eventstore.Check(m, version); err != nil {
+		return nil, err
 	}
 
-	switch evt := evt.(type) {
-	case *CartItemRemove:
-		productAgg := &ProductAggregate{ID: evt.ProductID}
-		bee.Replay(s.Ctx, productAgg, ro.WithAggreate("product"), ro.WithAggregateID(evt.ProductID))
+	if m.CommandType == "apply_coupon" {
+		var cmd CartCouponApply
+		if err := json.Unmarshal(m.Payload, &cmd); err != nil {
+			return nil, reply.Refuse(fmt.Errorf("failed to unmarshal command: %w", err))
+		}
+		if agg.coupon, err = LoadCoupon(s.Ctx, cmd.Code); err != nil {
+			return nil, err
+		}
+	}
+	if m.CommandType == "checkout" && agg.OrderID == "" && agg.Coupon != nil {
+		if agg.coupon, err = LoadCoupon(s.Ctx, agg.Coupon.Code); err != nil {
+			return nil, err
+		}
+	}
 
-		m.ExtraMetadata, err = structpb.NewStruct(map[string]any{
-			"product": utils.ToStructpbMap(&Product{
-				ID:    productAgg.ID,
-				Name:  productAgg.Name,
-				Price: productAgg.Price,
-			}),
-		})
+	if m.CommandType == "checkout" && agg.OrderID != "" {
+		agg.order, err = LoadOrder(s.Ctx, agg.OrderID)
+		if errors.Is(err, ErrOrderNotFound) {
+			agg.order, err = nil, nil
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to create extra metadata for product: %w", err)
+			return nil, err
 		}
-	default:
-		log.Printf("Unhandled command type: %T", evt)
 	}
 
-	return agg.ApplyCommand(m)
+	products, err := agg.stocked(m)
+	if err != nil {
+		return nil, reply.Refuse(err)
+	}
+	agg.stock = map[string]*Inventory{}
+	for _, id := range products {
+		if agg.stock[id], err = LoadInventory(s.Ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	events, err := agg.ApplyCommand(m)
+	return eventstore.Expect(m, version, events), reply.Refuse(err)
 }
 
 type UserService struct {
@@ -53,12 +71,18 @@ type UserService struct {
 
 func (s *UserService) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
 	agg := &UserAggregate{ID: m.AggregateId}
-	bee.Replay(s.Ctx, agg, ro.WithAggreate(m.Aggregate), ro.WithAggregateID(m.AggregateId))
+	version, err := eventstore.Replay(s.Ctx, agg, m.Aggregate, m.AggregateId)
+	if err != nil {
+		return nil, err
+	}
+	if err := eventstore.Check(m, version); err != nil {
+		return nil, err
+	}
 
 	if agg.found && m.CommandType == "create" {
-		return nil, fmt.Errorf("aggregate already exists: %s", m.AggregateId)
+		return nil, reply.Refuse(fmt.Errorf("aggregate already exists: %s", m.AggregateId))
 	} else if !agg.found && m.CommandType != "create" {
-		return nil, fmt.Errorf("aggregate does not exist: %s", m.AggregateId)
+		return nil, reply.Refuse(fmt.Errorf("aggregate does not exist: %s", m.AggregateId))
 	}
 
 	events := []*gen.EventEnvelope{}
@@ -67,7 +91,7 @@ func (s *UserService) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, erro
 
 	if m.CommandType == "create" {
 		if agg.found {
-			return nil, fmt.Errorf("user already exists: %s", m.AggregateId)
+			return nil, reply.Refuse(fmt.Errorf("user already exists: %s", m.AggregateId))
 		}
 		events = append(events, &gen.EventEnvelope{
 			EventType: "cart_added",
@@ -76,5 +100,5 @@ func (s *UserService) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, erro
 		})
 	}
 
-	return events, err
+	return eventstore.Expect(m, version, events), reply.Refuse(err)
 }
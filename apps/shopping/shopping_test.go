@@ -2,6 +2,12 @@ package shopping_test
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -9,60 +15,98 @@ import (
 	"github.com/blinkinglight/bee/co"
 	"github.com/blinkinglight/bee/gen"
 	"github.com/blinkinglight/bee/ro"
+	"github.com/blinkinglight/gobeego/apps/banking"
 	"github.com/blinkinglight/gobeego/apps/shopping"
+	"github.com/blinkinglight/gobeego/pkg/appctx"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/blinkinglight/gobeego/pkg/utils"
 	"github.com/delaneyj/toolbelt/embeddednats"
 	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-func client() (*nats.Conn, func(), error) {
-	server, err := embeddednats.New(
-		context.Background(),
-		embeddednats.WithShouldClearData(true),
+// setup starts a NATS server with its own store for the test, creates the
+// events stream and returns a context carrying the connection.
+func setup(t *testing.T) (context.Context, *nats.Conn) {
+	t.Helper()
+	ns, err := embeddednats.New(context.Background(),
+		embeddednats.WithDirectory(t.TempDir()),
 		embeddednats.WithNATSServerOptions(&server.Options{
-			JetStream:    true,
-			NoLog:        false,
-			Debug:        true,
-			Trace:        true,
-			TraceVerbose: true,
-			Port:         4333,
-			StoreDir:     "./data/nats",
+			JetStream: true,
+			Port:      server.RANDOM_PORT,
+			StoreDir:  t.TempDir(),
 		}),
 	)
 	if err != nil {
-		return nil, nil, err
+		t.Fatalf("failed to start NATS: %v", err)
 	}
-	server.WaitForServer()
+	t.Cleanup(func() { ns.Close() })
+	ns.WaitForServer()
 
-	nc, err := server.Client()
-
-	return nc, func() {
-		nc.Close()
-		server.Close()
-	}, err
-}
-
-func TestCore(t *testing.T) {
-	nc, cleanup, err := client()
+	nc, err := ns.Client()
 	if err != nil {
 		t.Fatalf("failed to create NATS client: %v", err)
 	}
-	defer cleanup()
-
+	t.Cleanup(nc.Close)
 	js, err := nc.JetStream()
 	if err != nil {
 		t.Fatalf("Failed to get JetStream context: %v", err)
 	}
-	js.DeleteStream("events")          // Clean up any existing stream
-	time.Sleep(100 * time.Millisecond) // Ensure stream deletion is processed
-	js.AddStream(&nats.StreamConfig{
-		Name:     "events",
-		Subjects: []string{"events.>"},
-	})
-	time.Sleep(100 * time.Millisecond) // Ensure stream deletion is processed
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "events", Subjects: []string{"events.>"}}); err != nil {
+		t.Fatalf("Failed to create events stream: %v", err)
+	}
 
 	ctx := bee.WithNats(t.Context(), nc)
 	ctx = bee.WithJetStream(ctx, js)
+	return appctx.WithJetStream(ctx, js), nc
+}
+
+// receive stocks quantity units of each of productIDs, so carts can take
+// them.
+func receive(t *testing.T, ctx context.Context, quantity int, productIDs ...string) {
+	t.Helper()
+	var events []*gen.EventEnvelope
+	for _, id := range productIDs {
+		events = append(events, &gen.EventEnvelope{
+			AggregateId:   id,
+			AggregateType: "inventory",
+			EventType:     "received",
+			Payload:       utils.MustMarshal(&shopping.StockReceived{Quantity: quantity}),
+		})
+	}
+	if err := eventstore.Append(ctx, appctx.JetStream(ctx), events); err != nil {
+		t.Fatalf("Failed to receive stock: %v", err)
+	}
+}
+
+// step is a command a test sends, and the error it is rejected with, empty
+// if it must succeed.
+type step struct {
+	aggregate, id, command string
+	payload                any
+	reject                 string
+}
+
+// run sends steps in order and stops the test at the first one that does
+// not end as expected.
+func run(t *testing.T, ctx context.Context, nc *nats.Conn, steps ...step) {
+	t.Helper()
+	for _, s := range steps {
+		_, err := reply.Send(ctx, nc, &gen.CommandEnvelope{Aggregate: s.aggregate, AggregateId: s.id, CommandType: s.command}, s.payload)
+		if s.reject == "" && err != nil {
+			t.Fatalf("%s %s: %v", s.command, s.id, err)
+		}
+		if s.reject != "" && (err == nil || !strings.Contains(err.Error(), s.reject)) {
+			t.Fatalf("Expected %s %s to be rejected with %q, got %v", s.command, s.id, s.reject, err)
+		}
+	}
+}
+
+func TestCore(t *testing.T) {
+	ctx, _ := setup(t)
+	receive(t, ctx, 10, "item1")
 
 	service := &shopping.CartService{Ctx: ctx}
 	go bee.Command(ctx, service, co.WithAggreate("cart"))
@@ -117,11 +161,27 @@ func TestCore(t *testing.T) {
 	cart := &shopping.ShoppingCartAggregate{ID: "cart-1"}
 	bee.Replay(ctx, cart, ro.WithAggreate("cart"), ro.WithAggregateID("cart-1"))
 
-	if len(cart.Items) != 2 {
-		t.Errorf("Expected 2 items in cart, got %d", len(cart.Items))
+	if len(cart.Items) != 1 || cart.Items[0].Quantity != 2 {
+		t.Errorf("Expected one line of 2 items in cart, got %+v", cart.Items)
+	}
+	if cart.Total() != 20.0 {
+		t.Errorf("Expected total to be 20.0, got %f", cart.Total())
 	}
-	if cart.Total != 20.0 {
-		t.Errorf("Expected total to be 20.0, got %f", cart.Total)
+
+	setQuantityCmd := gen.CommandEnvelope{
+		Aggregate:   "cart",
+		AggregateId: "cart-1",
+		CommandType: "set_quantity",
+	}
+	bee.PublishCommand(ctx, &setQuantityCmd, shopping.CartItemSetQuantity{ProductID: "item1", Quantity: 5})
+
+	time.Sleep(100 * time.Millisecond)
+
+	cart = &shopping.ShoppingCartAggregate{ID: "cart-1"}
+	bee.Replay(ctx, cart, ro.WithAggreate("cart"), ro.WithAggregateID("cart-1"))
+
+	if cart.Items.Count() != 5 || cart.Total() != 50.0 {
+		t.Errorf("Expected 5 items costing 50.0, got %d costing %f", cart.Items.Count(), cart.Total())
 	}
 
 	removeItemPayload := shopping.CartItemRemove{
@@ -142,11 +202,11 @@ func TestCore(t *testing.T) {
 	cart = &shopping.ShoppingCartAggregate{ID: "cart-1"}
 	bee.Replay(ctx, cart, ro.WithAggreate("cart"), ro.WithAggregateID("cart-1"))
 
-	if len(cart.Items) != 1 {
-		t.Errorf("Expected 1 item in cart after removal, got %d", len(cart.Items))
+	if len(cart.Items) != 0 {
+		t.Errorf("Expected the whole line to be removed, got %+v", cart.Items)
 	}
-	if cart.Total != 10.0 {
-		t.Errorf("Expected total to be 10.0 after removal, got %f", cart.Total)
+	if cart.Total() != 0 {
+		t.Errorf("Expected total to be 0 after removal, got %f", cart.Total())
 	}
 
 	createUserCmd := gen.CommandEnvelope{
@@ -176,3 +236,547 @@ func TestCore(t *testing.T) {
 		t.Errorf("Expected user to have 1 cart, got %d", len(user.Carts))
 	}
 }
+
+// Carts written before line items had quantities added one entry per
+// item_added event and removed one per item_removed event.
+func TestFlatCartEvents(t *testing.T) {
+	ctx, _ := setup(t)
+
+	event := func(eventType, payload string) *gen.EventEnvelope {
+		return &gen.EventEnvelope{AggregateId: "cart-old", AggregateType: "cart", EventType: eventType, Payload: []byte(payload)}
+	}
+	err := eventstore.Append(ctx, appctx.JetStream(ctx), []*gen.EventEnvelope{
+		event("created", `{}`),
+		event("item_added", `{"Product":{"id":"a","name":"A","price":2}}`),
+		event("item_added", `{"Product":{"id":"b","name":"B","price":5}}`),
+		event("item_added", `{"Product":{"id":"a","name":"A","price":2}}`),
+		event("item_added", `{"Product":{"id":"a","name":"A","price":2}}`),
+		event("item_removed", `{"ProductID":"a","Product":{"id":"a","name":"A","price":2}}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&shopping.ShoppingCartAggregate{ID: "cart-old"}).ApplyEvent(event("created", `{}`)); err != nil {
+		t.Errorf("Expected created to apply, got %v", err)
+	}
+	cart := &shopping.ShoppingCartAggregate{ID: "cart-old"}
+	bee.Replay(ctx, cart, ro.WithAggreate("cart"), ro.WithAggregateID("cart-old"))
+
+	want := shopping.Lines{
+		{Product: shopping.Product{ID: "a", Name: "A", Price: 2}, Quantity: 2},
+		{Product: shopping.Product{ID: "b", Name: "B", Price: 5}, Quantity: 1},
+	}
+	if !slices.Equal(cart.Items, want) {
+		t.Errorf("Expected lines %+v, got %+v", want, cart.Items)
+	}
+	if cart.Total() != 9 {
+		t.Errorf("Expected total to be 9, got %f", cart.Total())
+	}
+}
+
+func TestCoupons(t *testing.T) {
+	ctx, nc := setup(t)
+	receive(t, ctx, 10, "a")
+
+	go bee.Command(ctx, &eventstore.Handler{Ctx: ctx, Handler: &shopping.CartService{Ctx: ctx}, OnResult: reply.Publisher(nc)}, co.WithAggreate("cart"))
+	go bee.Command(ctx, &eventstore.Handler{Ctx: ctx, Handler: &shopping.CouponService{Ctx: ctx}, OnResult: reply.Publisher(nc)}, co.WithAggreate("coupon"))
+	time.Sleep(100 * time.Millisecond)
+
+	run(t, ctx, nc, []step{
+		{"coupon", "TEN", "create", shopping.CouponCreate{Kind: shopping.CouponPercent, Value: 10, MinBasket: 20, MaxUses: 1}, ""},
+		{"coupon", "OLD", "create", shopping.CouponCreate{Kind: shopping.CouponFixed, Value: 5, ExpiresAt: 1}, ""},
+		{"coupon", "BAD", "create", shopping.CouponCreate{Kind: shopping.CouponPercent, Value: 150}, "percentage"},
+		{"cart", "cart-a", "create", shopping.CartCreate{}, ""},
+		{"cart", "cart-a", "add_item", shopping.CartItemAdd{Product: shopping.Product{ID: "a", Price: 10}, Quantity: 3}, ""},
+		{"cart", "cart-a", "apply_coupon", shopping.CartCouponApply{Code: " ten "}, ""},
+		{"cart", "cart-a", "apply_coupon", shopping.CartCouponApply{Code: "OLD"}, "already has coupon TEN"},
+		{"cart", "cart-a", "apply_coupon", shopping.CartCouponApply{Code: "TEN"}, ""},
+		{"cart", "cart-b", "create", shopping.CartCreate{}, ""},
+		{"cart", "cart-b", "add_item", shopping.CartItemAdd{Product: shopping.Product{ID: "a", Price: 10}}, ""},
+		{"cart", "cart-b", "apply_coupon", shopping.CartCouponApply{Code: "TEN"}, "needs a basket of at least 20.00"},
+		{"cart", "cart-b", "set_quantity", shopping.CartItemSetQuantity{ProductID: "a", Quantity: 3}, ""},
+		{"cart", "cart-b", "apply_coupon", shopping.CartCouponApply{Code: "TEN"}, "has been used up"},
+		{"cart", "cart-b", "apply_coupon", shopping.CartCouponApply{Code: "OLD"}, "has expired"},
+		{"cart", "cart-b", "apply_coupon", shopping.CartCouponApply{Code: "NOPE"}, "coupon does not exist"},
+	}...)
+
+	cart := &shopping.ShoppingCartAggregate{ID: "cart-a"}
+	bee.Replay(ctx, cart, ro.WithAggreate("cart"), ro.WithAggregateID("cart-a"))
+	if cart.Subtotal() != 30 || cart.Off() != 3 || cart.Total() != 27 {
+		t.Errorf("Expected 30.00 less 3.00, got %f less %f", cart.Subtotal(), cart.Off())
+	}
+	// Below the minimum basket the coupon stays on the cart but takes nothing off.
+	run(t, ctx, nc, step{"cart", "cart-a", "set_quantity", shopping.CartItemSetQuantity{ProductID: "a", Quantity: 1}, ""})
+	cart = &shopping.ShoppingCartAggregate{ID: "cart-a"}
+	bee.Replay(ctx, cart, ro.WithAggreate("cart"), ro.WithAggregateID("cart-a"))
+	if cart.Coupon == nil || cart.Total() != 10 {
+		t.Errorf("Expected the coupon to take nothing off 10.00, got %+v", cart.Basket)
+	}
+
+	coupon, err := shopping.LoadCoupon(ctx, "ten")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coupon.Uses != 1 || !coupon.Carts["cart-a"] {
+		t.Errorf("Expected TEN to be used once by cart-a, got %+v", coupon)
+	}
+
+	// A cart that took a coupon whose use was not stored counts it at
+	// checkout.
+	run(t, ctx, nc, step{"coupon", "ONCE", "create", shopping.CouponCreate{Kind: shopping.CouponFixed, Value: 1, MaxUses: 1}, ""})
+	event := func(eventType, payload string) *gen.EventEnvelope {
+		return &gen.EventEnvelope{AggregateId: "cart-c", AggregateType: "cart", EventType: eventType, Payload: []byte(payload)}
+	}
+	err = eventstore.Append(ctx, appctx.JetStream(ctx), []*gen.EventEnvelope{
+		event("created", `{}`),
+		event("item_added", `{"Product":{"id":"a","name":"A","price":10}}`),
+		event("coupon_applied", `{"Coupon":{"code":"ONCE","kind":"fixed","value":1}}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, ctx, nc, step{"cart", "cart-c", "checkout", shopping.CartCheckout{OrderID: "order-c"}, ""})
+	if coupon, err = shopping.LoadCoupon(ctx, "ONCE"); err != nil {
+		t.Fatal(err)
+	}
+	if coupon.Uses != 1 || !coupon.Carts["cart-c"] {
+		t.Errorf("Expected ONCE to be used once by cart-c, got %+v", coupon)
+	}
+}
+
+func TestOrders(t *testing.T) {
+	ctx, nc := setup(t)
+	receive(t, ctx, 10, "a", "b")
+
+	go bee.Command(ctx, &eventstore.Handler{Ctx: ctx, Handler: &shopping.CartService{Ctx: ctx}, OnResult: reply.Publisher(nc)}, co.WithAggreate("cart"))
+	go bee.Command(ctx, &eventstore.Handler{Ctx: ctx, Handler: &shopping.OrderService{Ctx: ctx}, OnResult: reply.Publisher(nc)}, co.WithAggreate("order"))
+	time.Sleep(100 * time.Millisecond)
+
+	run(t, ctx, nc, []step{
+		{"cart", "cart-a", "create", shopping.CartCreate{}, ""},
+		{"cart", "cart-a", "checkout", shopping.CartCheckout{OrderID: "order-a"}, "is empty"},
+		{"cart", "cart-a", "add_item", shopping.CartItemAdd{Product: shopping.Product{ID: "a", Price: 10}, Quantity: 2}, ""},
+		{"cart", "cart-a", "apply_discount", shopping.CartDiscountApply{Discount: 5}, ""},
+		{"cart", "cart-a", "checkout", shopping.CartCheckout{OrderID: "order-a", CustomerID: "customer-a"}, ""},
+		{"cart", "cart-a", "checkout", shopping.CartCheckout{OrderID: "order-a", CustomerID: "customer-a"}, ""},
+		{"cart", "cart-a", "checkout", shopping.CartCheckout{OrderID: "order-b"}, "checked out as order order-a"},
+		{"cart", "cart-a", "add_item", shopping.CartItemAdd{Product: shopping.Product{ID: "b", Price: 1}}, "checked out as order order-a"},
+		{"order", "order-a", "ship", shopping.OrderShip{Carrier: "DHL"}, "order order-a is placed, cannot ship it"},
+		{"order", "order-a", "pay", shopping.OrderPay{}, "payment reference"},
+		{"order", "order-a", "pay", shopping.OrderPay{Ref: "pay-1"}, ""},
+		{"order", "order-a", "pay", shopping.OrderPay{Ref: "pay-1"}, ""},
+		{"order", "order-a", "cancel", shopping.OrderCancel{Reason: "changed my mind"}, "order order-a is paid, cannot cancel it"},
+		{"order", "order-a", "ship", shopping.OrderShip{Carrier: "DHL", Tracking: "123"}, ""},
+		{"order", "order-a", "cancel", shopping.OrderCancel{Reason: "too late"}, "order order-a is shipped, cannot cancel it"},
+		{"order", "order-a", "deliver", shopping.OrderDeliver{}, ""},
+		{"order", "order-x", "pay", shopping.OrderPay{Ref: "pay-2"}, "order does not exist"},
+	}...)
+
+	order, err := shopping.LoadOrder(ctx, "order-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.CartID != "cart-a" || order.CustomerID != "customer-a" || order.Items.Count() != 2 || order.Subtotal != 20 || order.Total != 15 {
+		t.Errorf("Expected cart-a of customer-a with 2 units for 20.00 less 5.00, got %+v", order)
+	}
+	var statuses []string
+	for _, step := range order.History {
+		statuses = append(statuses, step.Status)
+	}
+	if want := []string{"placed", "paid", "shipped", "delivered"}; !slices.Equal(statuses, want) {
+		t.Errorf("Expected history %v, got %v", want, statuses)
+	}
+	if _, err := shopping.LoadOrder(ctx, "order-b"); !errors.Is(err, shopping.ErrOrderNotFound) {
+		t.Errorf("Expected order-b not to exist, got %v", err)
+	}
+}
+
+// racingCart adds a unit to the cart of the first checkout after
+// CartService decided on its events and before they are appended, as a
+// command handled at the same time would.
+type racingCart struct {
+	ctx   context.Context
+	cart  *shopping.CartService
+	raced atomic.Bool
+}
+
+func (r *racingCart) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	events, err := r.cart.Handle(m)
+	if err != nil || m.CommandType != "checkout" || !r.raced.CompareAndSwap(false, true) {
+		return events, err
+	}
+	return events, eventstore.Append(r.ctx, appctx.JetStream(r.ctx), []*gen.EventEnvelope{{
+		AggregateId:   m.AggregateId,
+		AggregateType: "cart",
+		EventType:     "item_added",
+		Payload:       utils.MustMarshal(&shopping.CartItemAdded{Product: shopping.Product{ID: "a", Price: 10}}),
+	}})
+}
+
+// TestCheckoutConflict checks out a cart that changes while it is checked
+// out. The stock is taken before the cart conflicts, and the checkout
+// handled again takes the unit added too.
+func TestCheckoutConflict(t *testing.T) {
+	ctx, nc := setup(t)
+	receive(t, ctx, 10, "a")
+
+	cart := &racingCart{ctx: ctx, cart: &shopping.CartService{Ctx: ctx}}
+	go bee.Command(ctx, &eventstore.Handler{Ctx: ctx, Handler: cart, OnResult: reply.Publisher(nc)}, co.WithAggreate("cart"))
+	time.Sleep(100 * time.Millisecond)
+
+	run(t, ctx, nc, []step{
+		{"cart", "cart-a", "create", shopping.CartCreate{}, ""},
+		{"cart", "cart-a", "add_item", shopping.CartItemAdd{Product: shopping.Product{ID: "a", Price: 10}, Quantity: 2}, ""},
+		{"cart", "cart-a", "checkout", shopping.CartCheckout{OrderID: "order-a", CustomerID: "customer-a"}, ""},
+	}...)
+	if !cart.raced.Load() {
+		t.Fatal("Expected the checkout to race a change of the cart")
+	}
+
+	order, err := shopping.LoadOrder(ctx, "order-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Items.Count() != 3 || order.Total != 30 || len(order.History) != 1 {
+		t.Errorf("Expected order-a placed once with 3 units for 30.00, got %+v", order)
+	}
+	inventory, err := shopping.LoadInventory(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inventory.Committed["cart-a"] != 3 || inventory.OnHand != 7 || len(inventory.Reserved) != 0 {
+		t.Errorf("Expected cart-a to take 3 of a, leaving 7, got %+v", inventory)
+	}
+}
+
+// TestCheckoutLostOrder checks out a cart whose checkout stopped after
+// the cart was locked, as when the order append fails, and expects the
+// repeated checkout to place the order.
+func TestCheckoutLostOrder(t *testing.T) {
+	ctx, nc := setup(t)
+
+	go bee.Command(ctx, &eventstore.Handler{Ctx: ctx, Handler: &shopping.CartService{Ctx: ctx}, OnResult: reply.Publisher(nc)}, co.WithAggreate("cart"))
+	time.Sleep(100 * time.Millisecond)
+
+	event := func(eventType, payload string) *gen.EventEnvelope {
+		return &gen.EventEnvelope{AggregateId: "cart-a", AggregateType: "cart", EventType: eventType, Payload: []byte(payload)}
+	}
+	err := eventstore.Append(ctx, appctx.JetStream(ctx), []*gen.EventEnvelope{
+		event("created", `{}`),
+		event("item_added", `{"Product":{"id":"a","name":"A","price":10},"Quantity":2}`),
+		event("checked_out", `{"OrderID":"order-a"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shopping.LoadOrder(ctx, "order-a"); !errors.Is(err, shopping.ErrOrderNotFound) {
+		t.Fatalf("Expected order-a not to exist, got %v", err)
+	}
+
+	checkout := func(orderID string) error {
+		_, err := reply.Send(ctx, nc, &gen.CommandEnvelope{Aggregate: "cart", AggregateId: "cart-a", CommandType: "checkout"},
+			shopping.CartCheckout{OrderID: orderID, CustomerID: "customer-a"})
+		return err
+	}
+	if err := checkout("order-b"); err == nil || !strings.Contains(err.Error(), "checked out as order order-a") {
+		t.Fatalf("Expected a checkout as another order to be rejected, got %v", err)
+	}
+	for range 2 {
+		if err := checkout("order-a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	order, err := shopping.LoadOrder(ctx, "order-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.CartID != "cart-a" || order.CustomerID != "customer-a" || order.Total != 20 || len(order.History) != 1 {
+		t.Errorf("Expected cart-a of customer-a placed once for 20.00, got %+v", order)
+	}
+}
+
+func TestCartPayment(t *testing.T) {
+	ctx, nc := setup(t)
+
+	go bee.Command(ctx, &eventstore.Handler{Ctx: ctx, Handler: &shopping.CartService{Ctx: ctx}, OnResult: reply.Publisher(nc)}, co.WithAggreate("cart"))
+	go bee.Command(ctx, &eventstore.Handler{Ctx: ctx, Handler: &shopping.OrderService{Ctx: ctx}, OnResult: reply.Publisher(nc)}, co.WithAggreate("order"))
+	go bee.Command(ctx, &eventstore.Handler{Ctx: ctx, Handler: &shopping.InventoryService{Ctx: ctx}, OnResult: reply.Publisher(nc)}, co.WithAggreate("inventory"))
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.PaymentService{Ctx: ctx},
+		Dedupe:   &eventstore.Dedupe{Key: banking.IdempotencyKey},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Aggregate))
+	time.Sleep(100 * time.Millisecond)
+
+	saga := &shopping.CartPaymentSaga{Ctx: ctx, NC: nc}
+	go saga.Run(ctx)
+
+	for _, cmd := range []*gen.CommandEnvelope{
+		banking.CreateAccount("SHOPPER", "EUR", 0, "create-shopper"),
+		banking.CreateAccount("POOR", "EUR", 0, "create-poor"),
+		banking.CreateAccount("MERCHANT", "EUR", 0, "create-merchant"),
+		banking.CreditAccount(banking.CashAccount, "SHOPPER", 2500, "EUR", "deposit-shopper"),
+		banking.CreditAccount(banking.CashAccount, "POOR", 500, "EUR", "deposit-poor"),
+	} {
+		if _, err := reply.Send(ctx, nc, cmd, nil); err != nil {
+			t.Fatalf("%s %s: %v", cmd.CommandType, cmd.AggregateId, err)
+		}
+	}
+	send := func(commandType string, payload any) error {
+		_, err := reply.Send(ctx, nc, &gen.CommandEnvelope{Aggregate: "cart", AggregateId: "cart-a", CommandType: commandType}, payload)
+		return err
+	}
+	if _, err := reply.Send(ctx, nc, &gen.CommandEnvelope{Aggregate: "inventory", AggregateId: "a", CommandType: "receive"}, shopping.InventoryReceive{Quantity: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := send("create", shopping.CartCreate{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := send("add_item", shopping.CartItemAdd{Product: shopping.Product{ID: "a", Price: 10.25}, Quantity: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	pay := func(paymentID, accountID string) *shopping.CartPayment {
+		t.Helper()
+		wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		payment, err := shopping.PayCart(wctx, nc, "cart-a", shopping.CartPay{
+			PaymentID: paymentID,
+			AccountID: accountID,
+			Merchant:  "MERCHANT",
+			Currency:  "EUR",
+		})
+		if err != nil {
+			t.Fatalf("pay %s: %v", paymentID, err)
+		}
+		return payment
+	}
+
+	// A rejected debit fails the payment and leaves the cart open.
+	if p := pay("pay-1", "POOR"); p.Status != shopping.PaymentFailed || !strings.Contains(p.Reason, "insufficient funds") {
+		t.Fatalf("Expected pay-1 to fail with insufficient funds, got %+v", p)
+	}
+	if err := send("set_quantity", shopping.CartItemSetQuantity{ProductID: "a", Quantity: 1}); err != nil {
+		t.Fatalf("Expected the cart to stay open after a failed payment, got %v", err)
+	}
+	inventory, err := shopping.LoadInventory(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := inventory.Reserved["cart-a"]; r.Quantity != 1 || r.ExpiresAt == 0 {
+		t.Errorf("Expected the stock of cart-a to lapse again after pay-1 failed, got %+v", r)
+	}
+
+	if p := pay("pay-2", "SHOPPER"); !p.Paid() || p.Amount != 1025 {
+		t.Fatalf("Expected pay-2 to pay 1025, got %+v", p)
+	}
+	for id, want := range map[string]int64{"SHOPPER": 1475, "POOR": 500, "MERCHANT": 1025} {
+		account, err := banking.LoadAccount(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account.Balance != want {
+			t.Errorf("Expected %s to hold %d, got %d", id, want, account.Balance)
+		}
+	}
+
+	if err := send("add_item", shopping.CartItemAdd{Product: shopping.Product{ID: "b", Price: 1}}); err == nil || !strings.Contains(err.Error(), "is paid") {
+		t.Errorf("Expected a paid cart to be locked, got %v", err)
+	}
+	if err := send("pay", shopping.CartPay{PaymentID: "pay-3", AccountID: "SHOPPER", Merchant: "MERCHANT", Currency: "EUR"}); err == nil {
+		t.Errorf("Expected a paid cart not to be paid again")
+	}
+
+	// The stock of a paid cart is kept past ReservationTTL, so another cart
+	// cannot take it before the paid one is checked out.
+	later := time.Now().Add(shopping.ReservationTTL + time.Minute)
+	expirer := &shopping.ReservationExpirer{Ctx: ctx, NC: nc}
+	if err := expirer.Tick(later); err != nil {
+		t.Fatal(err)
+	}
+	at := func(id, commandType string, payload any) error {
+		_, err := reply.Send(ctx, nc, &gen.CommandEnvelope{Aggregate: "cart", AggregateId: id, CommandType: commandType, Timestamp: timestamppb.New(later)}, payload)
+		return err
+	}
+	if err := at("cart-b", "create", shopping.CartCreate{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := at("cart-b", "add_item", shopping.CartItemAdd{Product: shopping.Product{ID: "a", Price: 10.25}, Quantity: 2}); err == nil || !strings.Contains(err.Error(), "only 1 of product a left") {
+		t.Errorf("Expected the unit paid for by cart-a to stay reserved, got %v", err)
+	}
+
+	// Checking out a paid cart places an order that is paid already.
+	if err := at("cart-a", "checkout", shopping.CartCheckout{OrderID: "order-a"}); err != nil {
+		t.Fatal(err)
+	}
+	if inventory, err = shopping.LoadInventory(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if inventory.Committed["cart-a"] != 1 || inventory.OnHand != 1 {
+		t.Errorf("Expected cart-a to take 1 of a, got %+v", inventory)
+	}
+	order, err := shopping.LoadOrder(ctx, "order-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != shopping.OrderStatusPaid || order.PaidRef != "pay-2" {
+		t.Errorf("Expected order-a to be paid by pay-2, got %s %q", order.Status, order.PaidRef)
+	}
+}
+
+// TestCartPaymentRetry checks that a debit which is still being handled
+// elsewhere leaves the payment pending until it goes through, rather than
+// failing it while the money may already be taken.
+func TestCartPaymentRetry(t *testing.T) {
+	ctx, nc := setup(t)
+
+	go bee.Command(ctx, &eventstore.Handler{Ctx: ctx, Handler: &shopping.CartService{Ctx: ctx}, OnResult: reply.Publisher(nc)}, co.WithAggreate("cart"))
+	go bee.Command(ctx, &eventstore.Handler{Ctx: ctx, Handler: &shopping.InventoryService{Ctx: ctx}, OnResult: reply.Publisher(nc)}, co.WithAggreate("inventory"))
+	go bee.Command(ctx, &eventstore.Handler{
+		Ctx:      ctx,
+		Handler:  &banking.PaymentService{Ctx: ctx},
+		Dedupe:   &eventstore.Dedupe{Key: banking.IdempotencyKey},
+		OnResult: reply.Publisher(nc),
+	}, co.WithAggreate(banking.Aggregate))
+	time.Sleep(100 * time.Millisecond)
+	go (&shopping.CartPaymentSaga{Ctx: ctx, NC: nc}).Run(ctx)
+
+	for _, cmd := range []*gen.CommandEnvelope{
+		banking.CreateAccount("SHOPPER", "EUR", 0, "create-shopper"),
+		banking.CreateAccount("MERCHANT", "EUR", 0, "create-merchant"),
+		banking.CreditAccount(banking.CashAccount, "SHOPPER", 2500, "EUR", "deposit-shopper"),
+		{Aggregate: "inventory", AggregateId: "a", CommandType: "receive", Payload: utils.MustMarshal(shopping.InventoryReceive{Quantity: 1})},
+		{Aggregate: "cart", AggregateId: "cart-a", CommandType: "create", Payload: utils.MustMarshal(shopping.CartCreate{})},
+		{Aggregate: "cart", AggregateId: "cart-a", CommandType: "add_item", Payload: utils.MustMarshal(shopping.CartItemAdd{Product: shopping.Product{ID: "a", Price: 10}, Quantity: 1})},
+	} {
+		if _, err := reply.Send(ctx, nc, cmd, nil); err != nil {
+			t.Fatalf("%s %s: %v", cmd.CommandType, cmd.AggregateId, err)
+		}
+	}
+
+	// Claim the debit of pay-1 as if another handler were still on it.
+	kv, err := appctx.JetStream(ctx).KeyValue(eventstore.OutcomeBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := fmt.Sprintf("%s.SHOPPER.%s.%s", banking.Aggregate, banking.DebitCommand, base64.RawURLEncoding.EncodeToString([]byte("pay-1")))
+	if _, err := kv.Create(key, utils.MustMarshal(map[string]any{"pending": true, "since": time.Now()})); err != nil {
+		t.Fatal(err)
+	}
+
+	pay := shopping.CartPay{PaymentID: "pay-1", AccountID: "SHOPPER", Merchant: "MERCHANT", Currency: "EUR"}
+	if _, err := reply.Send(ctx, nc, &gen.CommandEnvelope{Aggregate: "cart", AggregateId: "cart-a", CommandType: "pay"}, pay); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+	cart := &shopping.ShoppingCartAggregate{ID: "cart-a"}
+	if _, err := eventstore.Replay(ctx, cart, "cart", "cart-a"); err != nil {
+		t.Fatal(err)
+	}
+	if !cart.Payment.Pending() {
+		t.Fatalf("Expected pay-1 to wait for its debit, got %+v", cart.Payment)
+	}
+
+	if err := kv.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	p, err := shopping.PayCart(wctx, nc, "cart-a", pay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Paid() {
+		t.Fatalf("Expected pay-1 to go through once its debit did, got %+v", p)
+	}
+	for id, want := range map[string]int64{"SHOPPER": 1500, "MERCHANT": 1000} {
+		account, err := banking.LoadAccount(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if account.Balance != want {
+			t.Errorf("Expected %s to hold %d, got %d", id, want, account.Balance)
+		}
+	}
+}
+
+func TestInventory(t *testing.T) {
+	ctx, nc := setup(t)
+
+	go bee.Command(ctx, &eventstore.Handler{Ctx: ctx, Handler: &shopping.CartService{Ctx: ctx}, OnResult: reply.Publisher(nc)}, co.WithAggreate("cart"))
+	go bee.Command(ctx, &eventstore.Handler{Ctx: ctx, Handler: &shopping.InventoryService{Ctx: ctx}, OnResult: reply.Publisher(nc)}, co.WithAggreate("inventory"))
+	go bee.Command(ctx, &eventstore.Handler{Ctx: ctx, Handler: &shopping.OrderService{Ctx: ctx}, OnResult: reply.Publisher(nc)}, co.WithAggreate("order"))
+	time.Sleep(100 * time.Millisecond)
+
+	tracked := shopping.Product{ID: "p", Price: 10}
+	run(t, ctx, nc, []step{
+		{"inventory", "p", "receive", shopping.InventoryReceive{Quantity: 3}, ""},
+		{"inventory", "p", "receive", shopping.InventoryReceive{}, "greater than zero"},
+		{"cart", "cart-a", "create", shopping.CartCreate{}, ""},
+		{"cart", "cart-a", "add_item", shopping.CartItemAdd{Product: tracked, Quantity: 2}, ""},
+		{"cart", "cart-b", "create", shopping.CartCreate{}, ""},
+		{"cart", "cart-b", "add_item", shopping.CartItemAdd{Product: tracked, Quantity: 2}, "only 1 of product p left"},
+		// A product without an inventory has no stock.
+		{"cart", "cart-b", "add_item", shopping.CartItemAdd{Product: shopping.Product{ID: "free", Price: 1}}, "product free is out of stock"},
+		{"cart", "cart-a", "set_quantity", shopping.CartItemSetQuantity{ProductID: "p", Quantity: 1}, ""},
+		{"cart", "cart-b", "add_item", shopping.CartItemAdd{Product: tracked, Quantity: 2}, ""},
+		{"cart", "cart-a", "set_quantity", shopping.CartItemSetQuantity{ProductID: "p", Quantity: 2}, "only 1 of product p left"},
+		{"cart", "cart-a", "remove_item", shopping.CartItemRemove{ProductID: "p"}, ""},
+		{"cart", "cart-b", "checkout", shopping.CartCheckout{OrderID: "order-b"}, ""},
+		{"cart", "cart-a", "add_item", shopping.CartItemAdd{Product: tracked, Quantity: 2}, "only 1 of product p left"},
+	}...)
+
+	inventory, err := shopping.LoadInventory(ctx, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if inventory.OnHand != 1 || inventory.Committed["cart-b"] != 2 || inventory.Left(now.Unix()) != 1 {
+		t.Errorf("Expected 1 of p left after cart-b took 2, got %+v", inventory)
+	}
+
+	// Once cart-a leaves p alone for ReservationTTL its unit is back in stock.
+	run(t, ctx, nc, step{"cart", "cart-a", "add_item", shopping.CartItemAdd{Product: tracked}, ""})
+	expirer := &shopping.ReservationExpirer{Ctx: ctx, NC: nc}
+	if err := expirer.Tick(now.Add(shopping.ReservationTTL + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	inventory, err = shopping.LoadInventory(ctx, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := inventory.Reserved["cart-a"]; ok || inventory.Left(now.Unix()) != 1 {
+		t.Errorf("Expected the reservation of cart-a to expire, got %+v", inventory)
+	}
+
+	// cart-c took its unit at checkout, but the checkout stopped before the
+	// cart was locked. Checking it out after it took one more unit takes
+	// only that one.
+	run(t, ctx, nc, []step{
+		{"cart", "cart-c", "create", shopping.CartCreate{}, ""},
+		{"cart", "cart-c", "add_item", shopping.CartItemAdd{Product: tracked}, ""},
+	}...)
+	err = eventstore.Append(ctx, appctx.JetStream(ctx), []*gen.EventEnvelope{{
+		AggregateId:   "p",
+		AggregateType: "inventory",
+		EventType:     "committed",
+		Payload:       utils.MustMarshal(&shopping.StockCommitted{CartID: "cart-c", OrderID: "order-c", Quantity: 1}),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, ctx, nc, []step{
+		{"inventory", "p", "receive", shopping.InventoryReceive{Quantity: 2}, ""},
+		{"cart", "cart-c", "set_quantity", shopping.CartItemSetQuantity{ProductID: "p", Quantity: 2}, ""},
+		{"cart", "cart-c", "checkout", shopping.CartCheckout{OrderID: "order-c"}, ""},
+	}...)
+	inventory, err = shopping.LoadInventory(ctx, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inventory.Committed["cart-c"] != 2 || inventory.OnHand != 1 || len(inventory.Reserved) != 0 {
+		t.Errorf("Expected cart-c to take 2 of p, leaving 1, got %+v", inventory)
+	}
+}
@@ -0,0 +1,48 @@
+package shopping
+
+import "github.com/blinkinglight/gobeego/pkg/eventstore"
+
+// Bump a snapshot version whenever the fields of its aggregate change, so
+// snapshots of the old layout are replayed from scratch instead.
+const (
+	cartSnapshotVersion = 6
+	userSnapshotVersion = 2
+	snapshotEvery       = 50
+)
+
+// private is the unexported state of an aggregate a snapshot keeps.
+type private struct {
+	Found bool `json:"found"`
+}
+
+func (s *ShoppingCartAggregate) SnapshotVersion() int { return cartSnapshotVersion }
+func (s *ShoppingCartAggregate) SnapshotEvery() int   { return snapshotEvery }
+
+func (s *ShoppingCartAggregate) MarshalSnapshot() ([]byte, error) {
+	return eventstore.MarshalState(s, private{Found: s.found})
+}
+
+func (s *ShoppingCartAggregate) UnmarshalSnapshot(b []byte) error {
+	var p private
+	if err := eventstore.UnmarshalState(b, s, &p); err != nil {
+		return err
+	}
+	s.found = p.Found
+	return nil
+}
+
+func (u *UserAggregate) SnapshotVersion() int { return userSnapshotVersion }
+func (u *UserAggregate) SnapshotEvery() int   { return snapshotEvery }
+
+func (u *UserAggregate) MarshalSnapshot() ([]byte, error) {
+	return eventstore.MarshalState(u, private{Found: u.found})
+}
+
+func (u *UserAggregate) UnmarshalSnapshot(b []byte) error {
+	var p private
+	if err := eventstore.UnmarshalState(b, u, &p); err != nil {
+		return err
+	}
+	u.found = p.Found
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/ro"
+	"github.com/blinkinglight/gobeego/apps/banking"
+	"github.com/blinkinglight/gobeego/pkg/appctx"
+	"github.com/blinkinglight/gobeego/pkg/collection"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/blinkinglight/gobeego/web/pages"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	datastar "github.com/starfederation/datastar/sdk/go"
+)
+
+// transferTimeout bounds how long a transfer request waits for the saga.
+const transferTimeout = 15 * time.Second
+
+// accountSignals are the datastar signals of the accounts page forms.
+type accountSignals struct {
+	Account      string `json:"account"`
+	Currency     string `json:"currency"`
+	Credit       string `json:"credit"`
+	CreditAmount string `json:"creditamount"`
+	From         string `json:"from"`
+	To           string `json:"to"`
+	Amount       string `json:"amount"`
+	Convert      bool   `json:"convert"`
+}
+
+func bankingRoutes(r chi.Router, streamCtx context.Context, js nats.JetStreamContext, nc *nats.Conn) {
+	r.Get("/accounts", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		pages.Accounts(collection.Accounts{}).Render(r.Context(), w)
+	})
+
+	r.MethodFunc("DS_GET", "/accounts/live", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		sse := datastar.NewSSE(w, r)
+		defer notifyShutdown(streamCtx, sse)
+		lctx := requestCtx(r, js, nc)
+
+		accounts := &AccountsLiveView{}
+		accountUpdates := bee.ReplayAndSubscribe(lctx, accounts, ro.WithAggreate(banking.Aggregate), ro.WithAggregateID("*"))
+		transfers := &TransfersLiveView{}
+		transferUpdates := bee.ReplayAndSubscribe(lctx, transfers, ro.WithAggreate(banking.Transfers), ro.WithAggregateID("*"))
+		for {
+			select {
+			case <-lctx.Done():
+				log.Println("Context done, stopping account updates")
+				return
+			case update := <-accountUpdates:
+				if update == nil {
+					log.Println("No updates received, stopping account updates")
+					return
+				}
+				sse.MergeFragmentTempl(pages.AccountList(collection.Accounts{Accounts: update.Accounts}))
+			case update := <-transferUpdates:
+				if update == nil {
+					log.Println("No updates received, stopping transfer updates")
+					return
+				}
+				sse.MergeFragmentTempl(pages.TransferList(collection.Accounts{Transfers: update.Transfers}))
+			}
+		}
+	})
+
+	r.MethodFunc("DS_POST", "/accounts", func(w http.ResponseWriter, r *http.Request) {
+		var signals accountSignals
+		if err := datastar.ReadSignals(r, &signals); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read signals: %v", err), http.StatusBadRequest)
+			return
+		}
+		id := strings.TrimSpace(signals.Account)
+		if id == "" {
+			id = uuid.NewString()
+		}
+		currency := strings.ToUpper(strings.TrimSpace(signals.Currency))
+
+		_, err := reply.Send(requestCtx(r, js, nc), nc, banking.CreateAccount(id, currency, 0, uuid.NewString()), nil)
+		w.WriteHeader(200)
+		sse := datastar.NewSSE(w, r)
+		renderResult(sse, err, fmt.Sprintf("Opened account %s in %s", id, currency))
+	})
+
+	r.MethodFunc("DS_POST", "/accounts/credit", func(w http.ResponseWriter, r *http.Request) {
+		var signals accountSignals
+		if err := datastar.ReadSignals(r, &signals); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read signals: %v", err), http.StatusBadRequest)
+			return
+		}
+		id := strings.TrimSpace(signals.Credit)
+		err := credit(requestCtx(r, js, nc), nc, id, signals.CreditAmount)
+		w.WriteHeader(200)
+		sse := datastar.NewSSE(w, r)
+		renderResult(sse, err, fmt.Sprintf("Credited %s to %s", signals.CreditAmount, id))
+	})
+
+	r.MethodFunc("DS_POST", "/transfers", func(w http.ResponseWriter, r *http.Request) {
+		var signals accountSignals
+		if err := datastar.ReadSignals(r, &signals); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read signals: %v", err), http.StatusBadRequest)
+			return
+		}
+		from := strings.TrimSpace(signals.From)
+		to := strings.TrimSpace(signals.To)
+
+		lctx, cancel := context.WithTimeout(requestCtx(r, js, nc), transferTimeout)
+		defer cancel()
+		err := transfer(lctx, nc, from, to, signals.Amount, signals.Convert)
+		w.WriteHeader(200)
+		sse := datastar.NewSSE(w, r)
+		renderResult(sse, err, fmt.Sprintf("Transferred %s from %s to %s", signals.Amount, from, to))
+	})
+}
+
+// requestCtx carries what sending commands and replaying events need from
+// the context of a request.
+func requestCtx(r *http.Request, js nats.JetStreamContext, nc *nats.Conn) context.Context {
+	ctx := bee.WithJetStream(r.Context(), js)
+	ctx = bee.WithNats(ctx, nc)
+	return appctx.WithJetStream(ctx, js)
+}
+
+// credit pays amount into an account in the currency of that account.
+func credit(ctx context.Context, nc *nats.Conn, id, amount string) error {
+	cents, err := parseAmount(amount)
+	if err != nil {
+		return err
+	}
+	account, err := banking.LoadAccount(ctx, id)
+	if err != nil {
+		return err
+	}
+	_, err = reply.Send(ctx, nc, banking.CreditAccount(banking.CashAccount, id, cents, account.Currency, uuid.NewString()), nil)
+	return err
+}
+
+// transfer moves amount from one account to another in the currency of the
+// source account, converted into the currency of the destination if convert
+// is set, and turns a transfer that did not complete into an error.
+func transfer(ctx context.Context, nc *nats.Conn, from, to, amount string, convert bool) error {
+	cents, err := parseAmount(amount)
+	if err != nil {
+		return err
+	}
+	source, err := banking.LoadAccount(ctx, from)
+	if err != nil {
+		return err
+	}
+	toCurrency := ""
+	if convert {
+		dest, err := banking.LoadAccount(ctx, to)
+		if err != nil {
+			return err
+		}
+		toCurrency = dest.Currency
+	}
+	t, err := banking.RunTransfer(ctx, nc, banking.StartTransfer(uuid.NewString(), from, to, cents, source.Currency, toCurrency))
+	if err != nil {
+		return err
+	}
+	if t.Status != banking.TransferCompletedEvent {
+		return fmt.Errorf("transfer %s: %s", t.Status, t.Reason)
+	}
+	return nil
+}
+
+// parseAmount reads a decimal amount such as "10.50" into cents.
+func parseAmount(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	units, frac, _ := strings.Cut(s, ".")
+	if units == "" || len(frac) > 2 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+	n, err := strconv.ParseUint(units+frac, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if n == 0 {
+		return 0, errors.New("amount must be greater than zero")
+	}
+	return int64(n), nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/apps/banking"
+	"github.com/blinkinglight/gobeego/apps/shopping"
+	"github.com/blinkinglight/gobeego/pkg/appctx"
+	"github.com/blinkinglight/gobeego/pkg/config"
+	"github.com/blinkinglight/gobeego/pkg/projection"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/blinkinglight/gobeego/pkg/rwdb"
+	"github.com/blinkinglight/gobeego/pkg/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// RequireToken guards the admin routes with a static bearer token.
+func RequireToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				http.Error(w, "admin endpoints are disabled", http.StatusForbidden)
+				return
+			}
+			got := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func adminRoutes(r chi.Router, db *rwdb.DB, js nats.JetStreamContext, nc *nats.Conn, projections *projection.Manager, reconciler *banking.Reconciler) {
+	r.Get("/projections", func(w http.ResponseWriter, r *http.Request) {
+		var out []projection.Progress
+		for _, name := range projections.Names() {
+			seq, err := projection.Load(r.Context(), db, name)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to load checkpoint: %v", err), http.StatusInternalServerError)
+				return
+			}
+			out = append(out, projection.Progress{Name: name, Phase: "live", Sequence: seq})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+
+	r.Post("/projections/{name}/rebuild", func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+		shadow, _ := strconv.ParseBool(r.URL.Query().Get("shadow"))
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		err := projections.Rebuild(r.Context(), name, shadow, func(p projection.Progress) {
+			fmt.Fprintln(w, p)
+			rc.Flush()
+		})
+		if err != nil {
+			log.Printf("Rebuild of %s failed: %v", name, err)
+			fmt.Fprintf(w, "error: %v\n", err)
+		}
+	})
+
+	r.Get("/ledger/trial-balance", func(w http.ResponseWriter, r *http.Request) {
+		lines, err := banking.TrialBalance(r.Context(), db)
+		writeJSON(w, lines, err)
+	})
+
+	r.Get("/ledger/unbalanced", func(w http.ResponseWriter, r *http.Request) {
+		refs, err := banking.UnbalancedRefs(r.Context(), db)
+		writeJSON(w, refs, err)
+	})
+
+	r.Get("/ledger/accounts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		entries, err := banking.AccountLedger(r.Context(), db, chi.URLParam(r, "id"))
+		writeJSON(w, entries, err)
+	})
+
+	r.Post("/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		rec, err := reconciler.Once()
+		writeJSON(w, rec, err)
+	})
+
+	r.Get("/rules", func(w http.ResponseWriter, r *http.Request) {
+		rules, err := banking.LoadRules(appctx.WithJetStream(r.Context(), js))
+		if err != nil {
+			writeJSON(w, nil, err)
+			return
+		}
+		writeJSON(w, rules.Rules, nil)
+	})
+
+	r.Put("/rules", func(w http.ResponseWriter, r *http.Request) {
+		var rule banking.Rule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid rule: %v", err), http.StatusBadRequest)
+			return
+		}
+		sendCommand(w, r, js, nc, banking.SetPaymentRule(rule))
+	})
+
+	r.Delete("/rules/{name}", func(w http.ResponseWriter, r *http.Request) {
+		sendCommand(w, r, js, nc, banking.RemovePaymentRule(chi.URLParam(r, "name")))
+	})
+
+	r.Post("/accounts/{id}/freeze", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, fmt.Sprintf("Invalid freeze: %v", err), http.StatusBadRequest)
+			return
+		}
+		sendCommand(w, r, js, nc, banking.FreezeAccount(chi.URLParam(r, "id"), body.Reason))
+	})
+
+	r.Post("/accounts/{id}/unfreeze", func(w http.ResponseWriter, r *http.Request) {
+		sendCommand(w, r, js, nc, banking.UnfreezeAccount(chi.URLParam(r, "id")))
+	})
+
+	// A positive balance is transferred to sweep_to before the account is
+	// closed, e.g. {"sweep_to":"acc-2"}.
+	r.Post("/accounts/{id}/close", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			SweepTo string `json:"sweep_to"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, fmt.Sprintf("Invalid close: %v", err), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(requestCtx(r, js, nc), transferTimeout)
+		defer cancel()
+		err := banking.SweepAndClose(ctx, nc, chi.URLParam(r, "id"), strings.TrimSpace(body.SweepTo))
+		if errors.Is(err, banking.ErrAccountNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Put("/rates/{from}/{to}", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Rate string `json:"rate"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid rate: %v", err), http.StatusBadRequest)
+			return
+		}
+		from := strings.ToUpper(chi.URLParam(r, "from"))
+		to := strings.ToUpper(chi.URLParam(r, "to"))
+		sendCommand(w, r, js, nc, banking.SetExchangeRate(from, to, strings.TrimSpace(body.Rate)))
+	})
+
+	r.Put("/coupons/{code}", func(w http.ResponseWriter, r *http.Request) {
+		var coupon shopping.CouponCreate
+		if err := json.NewDecoder(r.Body).Decode(&coupon); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid coupon: %v", err), http.StatusBadRequest)
+			return
+		}
+		sendCommand(w, r, js, nc, &gen.CommandEnvelope{
+			Aggregate:   "coupon",
+			AggregateId: shopping.CouponCode(chi.URLParam(r, "code")),
+			CommandType: "create",
+			Payload:     utils.MustMarshal(&coupon),
+		})
+	})
+
+	r.Post("/inventory/{id}/receive", func(w http.ResponseWriter, r *http.Request) {
+		var receive shopping.InventoryReceive
+		if err := json.NewDecoder(r.Body).Decode(&receive); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid stock: %v", err), http.StatusBadRequest)
+			return
+		}
+		sendCommand(w, r, js, nc, &gen.CommandEnvelope{
+			Aggregate:   "inventory",
+			AggregateId: chi.URLParam(r, "id"),
+			CommandType: "receive",
+			Payload:     utils.MustMarshal(&receive),
+		})
+	})
+
+	// Orders are paid, shipped, delivered and cancelled by posting the
+	// command to /orders/{id}/{command}, e.g. {"Carrier":"DHL","Tracking":"..."}
+	// to ship.
+	r.Post("/orders/{id}/{command}", func(w http.ResponseWriter, r *http.Request) {
+		command := chi.URLParam(r, "command")
+		var cmd any
+		switch command {
+		case "pay":
+			cmd = &shopping.OrderPay{}
+		case "ship":
+			cmd = &shopping.OrderShip{}
+		case "deliver":
+			cmd = &shopping.OrderDeliver{}
+		case "cancel":
+			cmd = &shopping.OrderCancel{}
+		default:
+			http.Error(w, fmt.Sprintf("Unknown order command %q", command), http.StatusNotFound)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(cmd); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, fmt.Sprintf("Invalid %s command: %v", command, err), http.StatusBadRequest)
+			return
+		}
+		sendCommand(w, r, js, nc, &gen.CommandEnvelope{
+			Aggregate:   "order",
+			AggregateId: chi.URLParam(r, "id"),
+			CommandType: command,
+			Payload:     utils.MustMarshal(cmd),
+		})
+	})
+
+	r.Get("/rules/audit/{id}", func(w http.ResponseWriter, r *http.Request) {
+		fired, err := banking.LoadRuleAudit(appctx.WithJetStream(r.Context(), js), chi.URLParam(r, "id"))
+		writeJSON(w, fired, err)
+	})
+
+	r.Get("/reconcile/accounts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		found, err := banking.ReconcileAccount(appctx.WithJetStream(r.Context(), js), chi.URLParam(r, "id"))
+		if errors.Is(err, banking.ErrAccountNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, found, err)
+	})
+}
+
+// writeJSON answers with v, or with a server error if the query behind it
+// failed.
+func writeJSON(w http.ResponseWriter, v any, err error) {
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Query failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// sendCommand sends cmd and answers with its events, or with a bad request
+// if its handler refused it.
+func sendCommand(w http.ResponseWriter, r *http.Request, js nats.JetStreamContext, nc *nats.Conn, cmd *gen.CommandEnvelope) {
+	events, err := reply.Send(requestCtx(r, js, nc), nc, cmd, nil)
+	if errors.Is(err, reply.ErrRefused) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, events, err)
+}
+
+// rebuildCommand is the "rebuild" CLI subcommand. It asks a running server
+// to rebuild a projection and prints the progress it streams back.
+func rebuildCommand(args []string) int {
+	fs := flag.NewFlagSet("rebuild", flag.ExitOnError)
+	addr := fs.String("url", "http://localhost:4321", "base URL of the running server")
+	token := fs.String("token", os.Getenv(config.EnvPrefix+"ADMIN_TOKEN"), "admin token")
+	shadow := fs.Bool("shadow", false, "rebuild into shadow tables and swap them in when caught up")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: site rebuild [flags] <projection>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	u := fmt.Sprintf("%s/admin/projections/%s/rebuild?shadow=%t", *addr, url.PathEscape(fs.Arg(0)), *shadow)
+	req, err := http.NewRequest(http.MethodPost, u, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "%s: %s", resp.Status, b)
+		return 1
+	}
+
+	failed := false
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		fmt.Println(line)
+		if strings.HasPrefix(line, "error:") {
+			failed = true
+		}
+	}
+	if failed || sc.Err() != nil {
+		return 1
+	}
+	return 0
+}
+
+// reconcileCommand is the "reconcile" CLI subcommand. It asks a running
+// server to reconcile every account and prints the report as JSON. It exits
+// with 3 if there are discrepancies.
+func reconcileCommand(args []string) int {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	addr := fs.String("url", "http://localhost:4321", "base URL of the running server")
+	token := fs.String("token", os.Getenv(config.EnvPrefix+"ADMIN_TOKEN"), "admin token")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: site reconcile [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	req, err := http.NewRequest(http.MethodPost, *addr+"/admin/reconcile", nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "%s: %s", resp.Status, b)
+		return 1
+	}
+
+	var rec banking.Reconciliation
+	if err := json.NewDecoder(resp.Body).Decode(&rec); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(rec)
+	if len(rec.Discrepancies) > 0 {
+		return 3
+	}
+	return 0
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/bee/ro"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/blinkinglight/gobeego/pkg/session"
+	"github.com/nats-io/nats.go"
+)
+
+// cartExists only records whether a cart stream has any events.
+type cartExists struct {
+	found bool
+}
+
+func (c *cartExists) ApplyEvent(e *gen.EventEnvelope) error {
+	c.found = true
+	return nil
+}
+
+// cartSweepInterval is how often Ensure forgets carts whose cookie expired.
+const cartSweepInterval = time.Hour
+
+// Carts lazily creates per-visitor carts the first time they are changed.
+type Carts struct {
+	Ctx context.Context
+	NC  *nats.Conn
+
+	created   sync.Map     // Cart ID to the time it was last ensured
+	lastSweep atomic.Int64 // Unix time of the last sweep
+}
+
+// Ensure publishes the create command for cart id unless it already exists.
+func (c *Carts) Ensure(ctx context.Context, id string) error {
+	now := time.Now()
+	c.sweep(now)
+	if _, ok := c.created.Load(id); ok {
+		c.created.Store(id, now)
+		return nil
+	}
+	if !c.exists(id) {
+		_, err := reply.Send(ctx, c.NC, &gen.CommandEnvelope{
+			Aggregate:   "cart",
+			AggregateId: id,
+			CommandType: "create",
+			Payload:     []byte(`{"items":[],"total":0,"discount":0}`),
+		}, nil)
+		// A concurrent request may have created the cart in the meantime,
+		// which is the only refusal that leaves the cart in place.
+		if err != nil && !(errors.Is(err, reply.ErrRefused) && c.exists(id)) {
+			return err
+		}
+	}
+	c.created.Store(id, now)
+	return nil
+}
+
+// exists reports whether cart id has any events.
+func (c *Carts) exists(id string) bool {
+	agg := &cartExists{}
+	bee.Replay(c.Ctx, agg, ro.WithAggreate("cart"), ro.WithAggregateID(id))
+	return agg.found
+}
+
+// sweep forgets the carts not ensured for as long as their cookie lives, at
+// most once every cartSweepInterval.
+func (c *Carts) sweep(now time.Time) {
+	last := c.lastSweep.Load()
+	if now.Unix()-last < int64(cartSweepInterval/time.Second) || !c.lastSweep.CompareAndSwap(last, now.Unix()) {
+		return
+	}
+	c.created.Range(func(id, seen any) bool {
+		if now.Sub(seen.(time.Time)) > session.MaxAge {
+			c.created.Delete(id)
+		}
+		return true
+	})
+}
@@ -6,20 +6,31 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/blinkinglight/bee"
 	"github.com/blinkinglight/bee/co"
 	"github.com/blinkinglight/bee/gen"
-	"github.com/blinkinglight/bee/po"
 	"github.com/blinkinglight/bee/ro"
+	"github.com/blinkinglight/gobeego/apps/banking"
 	"github.com/blinkinglight/gobeego/apps/shopping"
 	"github.com/blinkinglight/gobeego/pkg/appctx"
 	"github.com/blinkinglight/gobeego/pkg/collection"
+	"github.com/blinkinglight/gobeego/pkg/config"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/graceful"
+	"github.com/blinkinglight/gobeego/pkg/projection"
+	"github.com/blinkinglight/gobeego/pkg/registry"
+	"github.com/blinkinglight/gobeego/pkg/reply"
 	"github.com/blinkinglight/gobeego/pkg/rwdb"
+	"github.com/blinkinglight/gobeego/pkg/session"
 	"github.com/blinkinglight/gobeego/web/pages"
 	"github.com/delaneyj/toolbelt/embeddednats"
 	"github.com/go-chi/chi/v5"
@@ -31,34 +42,77 @@ import (
 	"gorm.io/gorm"
 )
 
+const shutdownTimeout = 15 * time.Second
+
+// seedStock is how many units of each seeded or created product are in
+// stock.
+const seedStock = 10
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "rebuild" {
+		os.Exit(rebuildCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		os.Exit(reconcileCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "statement" {
+		os.Exit(statementCommand(os.Args[2:]))
+	}
+
+	if err := registry.Check(); err != nil {
+		log.Fatalf("registry: %v", err)
+	}
+
 	ctx := context.Background()
 	// datastar.WithGzip(datastar.WithGzipLevel(9))
 	datastar.WithBrotli()
 
-	ex, err := os.Executable()
+	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	log.Printf("Effective config: %s", cfg)
+
+	if !cfg.KeepData {
+		if err := os.Remove(cfg.SQLitePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			panic(err)
+		}
+	}
+	if err := os.MkdirAll(cfg.DataDir, 0o700); err != nil {
 		panic(err)
 	}
-	exPath := filepath.Dir(ex)
-	fmt.Println(exPath)
-
-	fp, _ := toolbox.FreePort()
-	ns, err := embeddednats.New(ctx, embeddednats.WithNATSServerOptions(&server.Options{
-		JetStream: true,
-		StoreDir:  exPath + "/data",
-		Port:      fp,
-	}), embeddednats.WithShouldClearData(true), embeddednats.WithDirectory(exPath+"/data"))
-	if err != nil {
+	if err := os.MkdirAll(filepath.Dir(cfg.SQLitePath), 0o755); err != nil {
 		panic(err)
 	}
-	log.Printf("NATS server started on port %d", fp)
 
-	ns.WaitForServer()
-	nc, err := ns.Client()
-	// nc, err := nats.Connect("nats://localhost:4222", nats.Name("gobeego shopping app"))
-	if err != nil {
-		panic(err)
+	var nc *nats.Conn
+	var ns *embeddednats.Server
+	if cfg.Embedded() {
+		port := cfg.NATSPort
+		if port == 0 {
+			port, _ = toolbox.FreePort()
+		}
+		ns, err = embeddednats.New(ctx, embeddednats.WithNATSServerOptions(&server.Options{
+			JetStream: true,
+			StoreDir:  cfg.NATSDir(),
+			Port:      port,
+		}), embeddednats.WithShouldClearData(!cfg.KeepData), embeddednats.WithDirectory(cfg.NATSDir()))
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("NATS server started on port %d", port)
+
+		ns.WaitForServer()
+		nc, err = ns.Client()
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		nc, err = nats.Connect(cfg.NATSURL, nats.Name("gobeego shopping app"))
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("Connected to NATS at %s", cfg.NATSURL)
 	}
 	defer nc.Close()
 
@@ -73,11 +127,11 @@ func main() {
 		Storage:  nats.FileStorage,
 	})
 
-	db := rwdb.Open("./data/shopping.db")
+	db := rwdb.Open(cfg.SQLitePath)
 	ctx = appctx.WithDB(ctx, db)
 
 	db.WriteTX(ctx, func(tx *rwdb.Tx) error {
-		if err := tx.AutoMigrate(&shopping.Cart{}, &shopping.Product{}); err != nil {
+		if err := tx.AutoMigrate(&shopping.Cart{}, &shopping.Product{}, &shopping.Order{}, &banking.Transfer{}, &banking.LedgerEntry{}, &projection.Checkpoint{}); err != nil {
 			return fmt.Errorf("migrate: %w", err)
 		}
 		return nil
@@ -85,19 +139,151 @@ func main() {
 
 	ctx = bee.WithNats(ctx, nc)
 	ctx = bee.WithJetStream(ctx, js)
+	ctx = appctx.WithJetStream(ctx, js)
+
+	// Handlers keep using ctx while consumeCtx only controls intake, so
+	// in-flight commands can finish after consumers are stopped.
+	consumeCtx, stopConsuming := context.WithCancel(ctx)
+	handlers := &graceful.Group{}
+
+	handlers.Go(func() {
+		bee.Command(consumeCtx, handlers.Command(&eventstore.Handler{Ctx: ctx, Handler: &shopping.CartService{Ctx: ctx}, OnResult: reply.Publisher(nc)}), co.WithAggreate("cart"))
+	})
+	handlers.Go(func() {
+		bee.Command(consumeCtx, handlers.Command(&eventstore.Handler{Ctx: ctx, Handler: &shopping.UserService{Ctx: ctx}, OnResult: reply.Publisher(nc)}), co.WithAggreate("user"))
+	})
 
-	go bee.Command(ctx, &shopping.CartService{Ctx: ctx}, co.WithAggreate("cart"))
-	go bee.Command(ctx, &shopping.UserService{Ctx: ctx}, co.WithAggreate("user"))
+	handlers.Go(func() {
+		bee.Command(consumeCtx, handlers.Command(reply.Handler(nc, &ProductService{Ctx: ctx})), co.WithAggreate("product"))
+	})
+	handlers.Go(func() {
+		bee.Command(consumeCtx, handlers.Command(&eventstore.Handler{Ctx: ctx, Handler: &shopping.CouponService{Ctx: ctx}, OnResult: reply.Publisher(nc)}), co.WithAggreate("coupon"))
+	})
+	handlers.Go(func() {
+		bee.Command(consumeCtx, handlers.Command(&eventstore.Handler{Ctx: ctx, Handler: &shopping.OrderService{Ctx: ctx}, OnResult: reply.Publisher(nc)}), co.WithAggreate("order"))
+	})
+	handlers.Go(func() {
+		bee.Command(consumeCtx, handlers.Command(&eventstore.Handler{Ctx: ctx, Handler: &shopping.InventoryService{Ctx: ctx}, OnResult: reply.Publisher(nc)}), co.WithAggreate("inventory"))
+	})
+
+	// Saga steps reuse the transfer ID as Ref, so payments must be deduplicated.
+	dedupe := &eventstore.Dedupe{Window: time.Duration(cfg.DedupeWindow), Key: banking.IdempotencyKey}
+	if err := dedupe.Open(ctx); err != nil {
+		log.Fatalf("dedupe: %v", err)
+	}
+	handlers.Go(func() {
+		bee.Command(consumeCtx, handlers.Command(&eventstore.Handler{Ctx: ctx, Handler: &banking.PaymentService{Ctx: ctx}, Dedupe: dedupe, OnResult: reply.Publisher(nc)}), co.WithAggreate(banking.Aggregate))
+	})
+	handlers.Go(func() {
+		bee.Command(consumeCtx, handlers.Command(&eventstore.Handler{Ctx: ctx, Handler: &banking.TransferService{Ctx: ctx}, OnResult: reply.Publisher(nc)}), co.WithAggreate(banking.Transfers))
+	})
+	handlers.Go(func() {
+		bee.Command(consumeCtx, handlers.Command(&eventstore.Handler{Ctx: ctx, Handler: &banking.RateService{Ctx: ctx}, OnResult: reply.Publisher(nc)}), co.WithAggreate(banking.RateTables))
+	})
+	handlers.Go(func() {
+		bee.Command(consumeCtx, handlers.Command(&eventstore.Handler{Ctx: ctx, Handler: &banking.RuleService{Ctx: ctx}, OnResult: reply.Publisher(nc)}), co.WithAggreate(banking.RuleSets))
+	})
+	handlers.Go(func() {
+		bee.Command(consumeCtx, handlers.Command(&eventstore.Handler{Ctx: ctx, Handler: &banking.ScheduleService{Ctx: ctx}, OnResult: reply.Publisher(nc)}), co.WithAggreate(banking.Schedules))
+	})
+	handlers.Go(func() {
+		scheduler := &banking.Scheduler{NC: nc}
+		if err := scheduler.Run(consumeCtx); err != nil {
+			log.Printf("Scheduler stopped: %v", err)
+		}
+	})
+	handlers.Go(func() {
+		bee.Command(consumeCtx, handlers.Command(&eventstore.Handler{Ctx: ctx, Handler: &banking.AlertService{Ctx: ctx}, OnResult: reply.Publisher(nc)}), co.WithAggreate(banking.Alerts))
+	})
+	handlers.Go(func() {
+		expirer := &banking.HoldExpirer{Ctx: ctx, NC: nc}
+		if err := expirer.Run(consumeCtx); err != nil {
+			log.Printf("Hold expirer stopped: %v", err)
+		}
+	})
+	handlers.Go(func() {
+		expirer := &shopping.ReservationExpirer{Ctx: ctx, NC: nc}
+		if err := expirer.Run(consumeCtx); err != nil {
+			log.Printf("Reservation expirer stopped: %v", err)
+		}
+	})
+	reconciler := &banking.Reconciler{Ctx: ctx, NC: nc}
+	handlers.Go(func() {
+		if err := reconciler.Run(consumeCtx); err != nil {
+			log.Printf("Reconciler stopped: %v", err)
+		}
+	})
+	handlers.Go(func() {
+		saga := &banking.TransferSaga{Ctx: ctx, NC: nc}
+		if err := saga.Run(consumeCtx); err != nil {
+			log.Printf("Transfer saga stopped: %v", err)
+		}
+	})
+	handlers.Go(func() {
+		saga := &shopping.CartPaymentSaga{Ctx: ctx, NC: nc}
+		if err := saga.Run(consumeCtx); err != nil {
+			log.Printf("Cart payment saga stopped: %v", err)
+		}
+	})
+	projections := &projection.Manager{JS: js, DB: db}
+	projections.Register(projection.Definition{
+		Name:    "products",
+		Subject: projection.Subject("product"),
+		Models:  []any{&shopping.Product{}},
+		Handler: &ProductProjection{Ctx: ctx},
+	})
+	projections.Register(projection.Definition{
+		Name:    "transfers",
+		Subject: projection.Subject(banking.Transfers),
+		Models:  []any{&banking.Transfer{}},
+		Handler: banking.TransferProjection{},
+	})
+	projections.Register(projection.Definition{
+		Name:    "ledger",
+		Subject: projection.Subject(banking.Aggregate),
+		Models:  []any{&banking.LedgerEntry{}},
+		Handler: banking.LedgerProjection{},
+	})
+	projections.Register(projection.Definition{
+		Name:    "orders",
+		Subject: projection.Subject("order"),
+		Models:  []any{&shopping.Order{}},
+		Handler: shopping.OrderProjection{},
+	})
+	handlers.Go(func() {
+		projections.Run(consumeCtx)
+	})
 
-	go bee.Command(ctx, &ProductService{Ctx: ctx}, co.WithAggreate("product"))
-	go bee.Project(ctx, &ProductProjection{Ctx: ctx}, po.WithAggreate("product"))
+	// streamCtx is the base context of every request; cancelling it ends
+	// the open SSE loops.
+	streamCtx, closeStreams := context.WithCancel(context.Background())
 
 	chi.RegisterMethod("DS_GET")
 	chi.RegisterMethod("DS_POST")
 
+	secret := []byte(cfg.SessionSecret)
+	if len(secret) == 0 {
+		secret, err = session.LoadOrCreateSecret(filepath.Join(cfg.DataDir, "session.key"))
+		if err != nil {
+			panic(err)
+		}
+	}
+	sessions := session.New(secret)
+	carts := &Carts{Ctx: ctx, NC: nc}
+
 	router := chi.NewRouter()
 
 	router.Use(OverrideMethodByHeader)
+	router.Use(sessions.Middleware)
+
+	router.Route("/admin", func(r chi.Router) {
+		r.Use(RequireToken(cfg.AdminToken))
+		adminRoutes(r, db, js, nc, projections, reconciler)
+		statementRoutes(r, js)
+	})
+
+	bankingRoutes(router, streamCtx, js, nc)
+	orderRoutes(router, cfg, db, js, nc, sessions)
 
 	router.Get("/products", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
@@ -114,16 +300,31 @@ func main() {
 	})
 
 	router.MethodFunc("DS_GET", "/products/seed", func(w http.ResponseWriter, r *http.Request) {
+		lctx := bee.WithJetStream(r.Context(), js)
+		lctx = bee.WithNats(lctx, nc)
+		var errs []error
 		for i := range 10 {
-			bee.PublishCommand(ctx, &gen.CommandEnvelope{
+			id := fmt.Sprintf("prod-%d", time.Now().UnixNano())
+			_, err := reply.Send(lctx, nc, &gen.CommandEnvelope{
 				Aggregate:   "product",
-				AggregateId: fmt.Sprintf("prod-%d", time.Now().UnixNano()),
+				AggregateId: id,
 				CommandType: "create",
 				Payload:     []byte(fmt.Sprintf(`{"name":"I: %d then - Product %d","price":10.0}`, i, time.Now().UnixNano())),
 			}, nil)
+			if err == nil {
+				_, err = reply.Send(lctx, nc, &gen.CommandEnvelope{
+					Aggregate:   "inventory",
+					AggregateId: id,
+					CommandType: "receive",
+				}, shopping.InventoryReceive{Quantity: seedStock})
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
 		}
 		w.WriteHeader(200)
-		datastar.NewSSE(w, r)
+		sse := datastar.NewSSE(w, r)
+		renderResult(sse, errors.Join(errs...), "Seeded 10 products")
 	})
 
 	router.MethodFunc("DS_GET", "/product/{id}/live", func(w http.ResponseWriter, r *http.Request) {
@@ -135,11 +336,14 @@ func main() {
 
 		w.WriteHeader(200)
 		sse := datastar.NewSSE(w, r)
+		defer notifyShutdown(streamCtx, sse)
 		lctx := bee.WithJetStream(r.Context(), js)
 		lctx = bee.WithNats(lctx, nc)
 
-		agg := &ProductLiveView{}
+		agg := &ProductLiveView{Product: shopping.Product{ID: id}}
 		updates := bee.ReplayAndSubscribe(lctx, agg, ro.WithAggreate("product"), ro.WithAggregateID(id))
+		stock := &StockLiveView{}
+		updatesStock := bee.ReplayAndSubscribe(lctx, stock, ro.WithAggreate("inventory"), ro.WithAggregateID(id))
 		for {
 			select {
 			case <-lctx.Done():
@@ -151,26 +355,42 @@ func main() {
 					return
 				}
 
-				sse.MergeFragmentTempl(pages.ProductSingleItem(update.Product))
+				sse.MergeFragmentTempl(pages.ProductSingleItem(update.Current(), stock.Stock(time.Now())))
+			case update := <-updatesStock:
+				if update == nil {
+					log.Println("No updates received, stopping stock updates")
+					return
+				}
+				sse.MergeFragmentTempl(pages.ProductSingleItem(agg.Current(), update.Stock(time.Now())))
 			}
 		}
 	})
 
+	// A product has no stock until it is received, so a new one comes with
+	// seedStock units.
 	router.Get("/product/create", func(w http.ResponseWriter, r *http.Request) {
 		id := uuid.NewString()
-		if id == "" {
-			http.Error(w, "Missing product ID", http.StatusBadRequest)
-			return
-		}
-		bee.PublishCommand(ctx, &gen.CommandEnvelope{
+		lctx := requestCtx(r, js, nc)
+		_, err := reply.Send(lctx, nc, &gen.CommandEnvelope{
 			Aggregate:   "product",
 			AggregateId: id,
 			CommandType: "create",
-		}, &shopping.Product{
+		}, &shopping.ProductCreate{
 			ID:    id,
 			Name:  fmt.Sprintf("Product %s", id),
 			Price: 10.0,
 		})
+		if err == nil {
+			_, err = reply.Send(lctx, nc, &gen.CommandEnvelope{
+				Aggregate:   "inventory",
+				AggregateId: id,
+				CommandType: "receive",
+			}, shopping.InventoryReceive{Quantity: seedStock})
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create product: %v", err), http.StatusInternalServerError)
+			return
+		}
 		http.Redirect(w, r, fmt.Sprintf("/product/%s", id), http.StatusSeeOther)
 	})
 
@@ -196,7 +416,10 @@ func main() {
 
 	router.Get("/cart", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
-		pages.Cart(collection.Cart{}).Render(r.Context(), w)
+		pages.Cart(collection.Cart{
+			CartID:  session.CartID(r.Context()),
+			Account: shopping.WalletAccount(session.CustomerID(r.Context())),
+		}).Render(r.Context(), w)
 	})
 
 	router.MethodFunc("DS_POST", "/cart/remove/{id}", func(w http.ResponseWriter, r *http.Request) {
@@ -222,17 +445,80 @@ func main() {
 			ProductID: id,
 		}
 
-		err = bee.PublishCommand(lctx, &gen.CommandEnvelope{
+		cartID := session.CartID(r.Context())
+		if err := carts.Ensure(lctx, cartID); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create cart: %v", err), http.StatusInternalServerError)
+			return
+		}
+		_, err = reply.Send(lctx, nc, &gen.CommandEnvelope{
 			Aggregate:   "cart",
-			AggregateId: "cart-1",
+			AggregateId: cartID,
 			CommandType: "remove_item",
 		}, cir)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to remove item: %v", err), http.StatusInternalServerError)
+		w.WriteHeader(200)
+		sse := datastar.NewSSE(w, r)
+		name := product.Name
+		if name == "" {
+			name = id
+		}
+		renderResult(sse, err, fmt.Sprintf("Removed %s from cart", name))
+	})
+
+	router.MethodFunc("DS_POST", "/cart/quantity/{id}/{quantity}", func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		quantity, err := strconv.Atoi(chi.URLParam(r, "quantity"))
+		if id == "" || err != nil {
+			http.Error(w, "Missing product ID or quantity", http.StatusBadRequest)
 			return
 		}
+
+		lctx := bee.WithJetStream(r.Context(), js)
+		lctx = bee.WithNats(lctx, nc)
+
+		cartID := session.CartID(r.Context())
+		if err := carts.Ensure(lctx, cartID); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create cart: %v", err), http.StatusInternalServerError)
+			return
+		}
+		_, err = reply.Send(lctx, nc, &gen.CommandEnvelope{
+			Aggregate:   "cart",
+			AggregateId: cartID,
+			CommandType: "set_quantity",
+		}, shopping.CartItemSetQuantity{
+			ProductID: id,
+			Quantity:  quantity,
+		})
 		w.WriteHeader(200)
-		datastar.NewSSE(w, r)
+		sse := datastar.NewSSE(w, r)
+		renderResult(sse, err, fmt.Sprintf("Set quantity of %s to %d", id, quantity))
+	})
+
+	router.MethodFunc("DS_POST", "/cart/coupon", func(w http.ResponseWriter, r *http.Request) {
+		var signals struct {
+			Coupon string `json:"coupon"`
+		}
+		if err := datastar.ReadSignals(r, &signals); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read signals: %v", err), http.StatusBadRequest)
+			return
+		}
+		code := shopping.CouponCode(signals.Coupon)
+
+		lctx := bee.WithJetStream(r.Context(), js)
+		lctx = bee.WithNats(lctx, nc)
+
+		cartID := session.CartID(r.Context())
+		if err := carts.Ensure(lctx, cartID); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create cart: %v", err), http.StatusInternalServerError)
+			return
+		}
+		_, err := reply.Send(lctx, nc, &gen.CommandEnvelope{
+			Aggregate:   "cart",
+			AggregateId: cartID,
+			CommandType: "apply_coupon",
+		}, shopping.CartCouponApply{Code: code})
+		w.WriteHeader(200)
+		sse := datastar.NewSSE(w, r)
+		renderResult(sse, err, fmt.Sprintf("Applied coupon %s", code))
 	})
 
 	router.MethodFunc("DS_POST", "/cart/add-product-id/{id}", func(w http.ResponseWriter, r *http.Request) {
@@ -254,89 +540,111 @@ func main() {
 			return
 		}
 
-		err = bee.PublishCommand(lctx, &gen.CommandEnvelope{
+		cartID := session.CartID(r.Context())
+		if err := carts.Ensure(lctx, cartID); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create cart: %v", err), http.StatusInternalServerError)
+			return
+		}
+		_, err = reply.Send(lctx, nc, &gen.CommandEnvelope{
 			Aggregate:   "cart",
-			AggregateId: "cart-1",
+			AggregateId: cartID,
 			CommandType: "add_item",
 			Payload:     []byte(fmt.Sprintf(`{"product":{"ID":"%s","name":"%s","price":%.02f}}`, product.ID, product.Name, product.Price)),
 		}, nil)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to add item: %v", err), http.StatusInternalServerError)
-			return
-		}
 		w.WriteHeader(200)
-		datastar.NewSSE(w, r)
+		sse := datastar.NewSSE(w, r)
+		renderResult(sse, err, fmt.Sprintf("Added %s to cart", product.Name))
 	})
 	router.MethodFunc("DS_POST", "/cart/add-product", func(w http.ResponseWriter, r *http.Request) {
 		lctx := bee.WithJetStream(r.Context(), js)
 		lctx = bee.WithNats(lctx, nc)
-		bee.PublishCommand(lctx, &gen.CommandEnvelope{
+		cartID := session.CartID(r.Context())
+		if err := carts.Ensure(lctx, cartID); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create cart: %v", err), http.StatusInternalServerError)
+			return
+		}
+		_, err := reply.Send(lctx, nc, &gen.CommandEnvelope{
 			Aggregate:   "cart",
-			AggregateId: "cart-1",
+			AggregateId: cartID,
 			CommandType: "add_item",
 			Payload:     []byte(fmt.Sprintf(`{"product":{"ID":"prod-%d","name":"Product %d","price":%d}}`, time.Now().UnixNano(), time.Now().UnixNano(), rand.Intn(100))),
 		}, nil)
 		w.WriteHeader(200)
-		datastar.NewSSE(w, r)
+		sse := datastar.NewSSE(w, r)
+		renderResult(sse, err, "Added a random product to cart")
 	})
 
 	router.MethodFunc("DS_GET", "/cart/count", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
 		sse := datastar.NewSSE(w, r)
+		defer notifyShutdown(streamCtx, sse)
 		lctx := bee.WithJetStream(r.Context(), js)
 		lctx = bee.WithNats(lctx, nc)
 
 		aggProduct := &UpdateProductLiveProjection{}
 		updatesProducts := bee.ReplayAndSubscribe(lctx, aggProduct, ro.WithAggreate("product"), ro.WithAggregateID("*"))
 
+		stock := &StockLiveView{}
+		updatesStock := bee.ReplayAndSubscribe(lctx, stock, ro.WithAggreate("inventory"), ro.WithAggregateID("*"))
+
 		agg := &CartCounterLiveProjection{}
-		updates := bee.ReplayAndSubscribe(lctx, agg, ro.WithAggreate("cart"), ro.WithAggregateID("cart-1"))
-		go func() {
-			for {
-				select {
-				case <-lctx.Done():
-					log.Println("Context done, stopping cart count updates")
+		updates := bee.ReplayAndSubscribe(lctx, agg, ro.WithAggreate("cart"), ro.WithAggregateID(session.CartID(r.Context())))
+		for {
+			select {
+			case <-lctx.Done():
+				log.Println("Context done, stopping cart count updates")
+				return
+			case update1 := <-updatesProducts:
+				if update1 == nil {
+					log.Println("No updates received, stopping product updates")
+					return
+				}
+				products, err := update1.List()
+				if err != nil {
+					log.Printf("Error in UpdateProductLiveProjection: %v", err)
+					continue
+				}
+
+				// db.ReadTX(r.Context(), func(tx *rwdb.Tx) error {
+				// 	if err := tx.Model(shopping.Product{}).Find(&products).Error; err != nil {
+				// 		log.Printf("Failed to fetch products: %v", err)
+				// 		return err
+				// 	}
+				// 	return nil
+				// })
+				sse.MergeFragmentTempl(pages.ProductItem(collection.Product{
+					Products: products,
+					Stock:    stock.Stock(time.Now()),
+				}))
+			case update := <-updatesStock:
+				if update == nil {
+					log.Println("No updates received, stopping stock updates")
+					return
+				}
+				products, _ := aggProduct.List()
+				sse.MergeFragmentTempl(pages.ProductItem(collection.Product{
+					Products: products,
+					Stock:    update.Stock(time.Now()),
+				}))
+			case update := <-updates:
+				if update == nil {
+					log.Println("No updates received, stopping cart count updates")
 					return
-				case update1 := <-updatesProducts:
-					if update1 == nil {
-						log.Println("No updates received, stopping product updates")
-						return
-					}
-					if update1.err != nil {
-						log.Printf("Error in UpdateProductLiveProjection: %v", update1.err)
-						continue
-					}
-
-					// db.ReadTX(r.Context(), func(tx *rwdb.Tx) error {
-					// 	if err := tx.Model(shopping.Product{}).Find(&products).Error; err != nil {
-					// 		log.Printf("Failed to fetch products: %v", err)
-					// 		return err
-					// 	}
-					// 	return nil
-					// })
-					sse.MergeFragmentTempl(pages.ProductItem(collection.Product{
-						Products: update1.Products,
-					}))
-				case update := <-updates:
-					if update == nil {
-						log.Println("No updates received, stopping cart count updates")
-						return
-					}
-					sse.MergeFragmentTempl(pages.CartCount(agg.Count, agg.Total))
 				}
+				sse.MergeFragmentTempl(pages.CartCount(agg.Count, agg.Total))
 			}
-		}()
-		<-lctx.Done() // Wait for context to be done
+		}
 	})
 
 	router.MethodFunc("DS_GET", "/cart/live", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
 		sse := datastar.NewSSE(w, r)
+		defer notifyShutdown(streamCtx, sse)
 		lctx := bee.WithJetStream(r.Context(), js)
 		lctx = bee.WithNats(lctx, nc)
 
 		agg := &CartProjection{}
-		updates := bee.ReplayAndSubscribe(lctx, agg, ro.WithAggreate("cart"), ro.WithAggregateID("cart-1"))
+		updates := bee.ReplayAndSubscribe(lctx, agg, ro.WithAggreate("cart"), ro.WithAggregateID(session.CartID(r.Context())))
 		for {
 			select {
 			case <-lctx.Done():
@@ -347,24 +655,72 @@ func main() {
 					log.Println("No updates received, stopping live updates")
 					return
 				}
-				sse.MergeFragmentTempl(pages.CartItems(collection.Cart{
-					Products: update.Items,
-				}))
+				cart := collection.NewCart(session.CartID(r.Context()), update.Basket)
+				cart.Payment = update.Payment
+				sse.MergeFragmentTempl(pages.CartItems(cart))
 			}
 		}
 
 	})
 
-	bee.PublishCommand(ctx, &gen.CommandEnvelope{
-		Aggregate:   "cart",
-		AggregateId: "cart-1",
-		CommandType: "create",
-		Payload:     []byte(`{"items":[],"total":0,"discount":0}`),
-	}, nil)
+	srv := &http.Server{
+		Addr:        cfg.HTTPAddr,
+		Handler:     router,
+		BaseContext: func(net.Listener) context.Context { return streamCtx },
+	}
+	go func() {
+		log.Printf("Starting server on %s", cfg.HTTPAddr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-sigCtx.Done()
+	stop()
 
-	log.Printf("Starting server on http://localhost:4321")
-	log.Fatal(http.ListenAndServe(":4321", router))
+	log.Printf("Shutting down, waiting up to %s", shutdownTimeout)
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
 
+	closeStreams()
+	if err := srv.Shutdown(sctx); err != nil {
+		log.Printf("HTTP shutdown: %v", err)
+	}
+	stopConsuming()
+	if err := handlers.Wait(sctx); err != nil {
+		log.Printf("Waiting for in-flight handlers: %v", err)
+	}
+	if err := graceful.DrainNATS(sctx, nc); err != nil {
+		log.Printf("Draining NATS: %v", err)
+	}
+	if ns != nil {
+		ns.Close()
+	}
+	if err := db.Close(); err != nil {
+		log.Printf("Closing database: %v", err)
+	}
+	log.Println("Shutdown complete")
+}
+
+// renderResult shows the outcome of a synchronous command on the page.
+func renderResult(sse *datastar.ServerSentEventGenerator, err error, success string) {
+	if err != nil {
+		sse.MergeFragmentTempl(pages.CommandResult(false, err.Error()))
+		return
+	}
+	sse.MergeFragmentTempl(pages.CommandResult(true, success))
+}
+
+// notifyShutdown tells a live SSE client that the server is going away when
+// the stream ended because of shutdown rather than a client disconnect.
+func notifyShutdown(streamCtx context.Context, sse *datastar.ServerSentEventGenerator) {
+	if streamCtx.Err() == nil {
+		return
+	}
+	sse.MergeFragmentTempl(pages.ServerNotice("Server is restarting, live updates paused."),
+		datastar.WithSelector("body"), datastar.WithMergePrepend())
 }
 
 func OverrideMethodByHeader(next http.Handler) http.Handler {
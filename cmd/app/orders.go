@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/apps/shopping"
+	"github.com/blinkinglight/gobeego/pkg/appctx"
+	"github.com/blinkinglight/gobeego/pkg/collection"
+	"github.com/blinkinglight/gobeego/pkg/config"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/blinkinglight/gobeego/pkg/rwdb"
+	"github.com/blinkinglight/gobeego/pkg/session"
+	"github.com/blinkinglight/gobeego/web/pages"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	datastar "github.com/starfederation/datastar/sdk/go"
+)
+
+func orderRoutes(r chi.Router, cfg *config.Config, db *rwdb.DB, js nats.JetStreamContext, nc *nats.Conn, sessions *session.Manager) {
+	// Paying waits for the payment saga like a transfer does, so that a
+	// rejection such as insufficient funds is shown right away. The money
+	// comes from the wallet of the customer of the session, never from an
+	// account the browser names.
+	r.MethodFunc("DS_POST", "/cart/pay", func(w http.ResponseWriter, r *http.Request) {
+		account := shopping.WalletAccount(session.CustomerID(r.Context()))
+
+		lctx, cancel := context.WithTimeout(requestCtx(r, js, nc), transferTimeout)
+		defer cancel()
+		payment, err := shopping.PayCart(lctx, nc, session.CartID(r.Context()), shopping.CartPay{
+			PaymentID: "pay-" + uuid.NewString(),
+			AccountID: account,
+			Merchant:  cfg.MerchantAccount,
+			Currency:  cfg.ShopCurrency,
+		})
+		if err == nil && !payment.Paid() {
+			err = fmt.Errorf("payment failed: %s", payment.Reason)
+		}
+		w.WriteHeader(200)
+		sse := datastar.NewSSE(w, r)
+		renderResult(sse, err, fmt.Sprintf("Paid from %s, check out to place the order", account))
+	})
+
+	// Checking out locks the cart, so the browser gets a new one for its
+	// next order.
+	r.MethodFunc("DS_POST", "/cart/checkout", func(w http.ResponseWriter, r *http.Request) {
+		orderID := "order-" + uuid.NewString()
+		_, err := reply.Send(requestCtx(r, js, nc), nc, &gen.CommandEnvelope{
+			Aggregate:   "cart",
+			AggregateId: session.CartID(r.Context()),
+			CommandType: "checkout",
+		}, shopping.CartCheckout{OrderID: orderID, CustomerID: session.CustomerID(r.Context())})
+		if err == nil {
+			sessions.Renew(w, r)
+		}
+		w.WriteHeader(200)
+		sse := datastar.NewSSE(w, r)
+		if err != nil {
+			renderResult(sse, err, "")
+			return
+		}
+		sse.Redirect("/orders/" + orderID)
+	})
+
+	r.Get("/orders", func(w http.ResponseWriter, r *http.Request) {
+		orders, err := shopping.ListOrders(r.Context(), db, session.CustomerID(r.Context()))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to fetch orders: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(200)
+		pages.Orders(collection.Orders{Orders: orders}).Render(r.Context(), w)
+	})
+
+	r.Get("/orders/{id}", func(w http.ResponseWriter, r *http.Request) {
+		order, err := customerOrder(r, js, chi.URLParam(r, "id"))
+		if errors.Is(err, shopping.ErrOrderNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to load order: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(200)
+		pages.Order(*order).Render(r.Context(), w)
+	})
+
+	r.MethodFunc("DS_POST", "/orders/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		_, err := customerOrder(r, js, id)
+		if err == nil {
+			_, err = reply.Send(requestCtx(r, js, nc), nc, &gen.CommandEnvelope{
+				Aggregate:   "order",
+				AggregateId: id,
+				CommandType: "cancel",
+			}, shopping.OrderCancel{Reason: "cancelled by the customer"})
+		}
+		w.WriteHeader(200)
+		sse := datastar.NewSSE(w, r)
+		if err != nil {
+			renderResult(sse, err, "")
+			return
+		}
+		sse.Redirect("/orders/" + id)
+	})
+}
+
+// customerOrder loads order id if the customer of the request placed it.
+// Orders of other customers are reported as missing.
+func customerOrder(r *http.Request, js nats.JetStreamContext, id string) (*shopping.OrderAggregate, error) {
+	order, err := shopping.LoadOrder(appctx.WithJetStream(r.Context(), js), id)
+	if err != nil {
+		return nil, err
+	}
+	if order.CustomerID != session.CustomerID(r.Context()) {
+		return nil, fmt.Errorf("%w: %s", shopping.ErrOrderNotFound, id)
+	}
+	return order, nil
+}
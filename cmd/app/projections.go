@@ -4,13 +4,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/blinkinglight/bee"
 	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/apps/banking"
 	"github.com/blinkinglight/gobeego/apps/shopping"
 	"github.com/blinkinglight/gobeego/pkg/appctx"
+	"github.com/blinkinglight/gobeego/pkg/collection"
 	"github.com/blinkinglight/gobeego/pkg/rwdb"
 	"github.com/blinkinglight/gobeego/pkg/utils"
+	"gorm.io/gorm/clause"
 )
 
 type ProductService struct {
@@ -58,46 +64,48 @@ type ProductProjection struct {
 }
 
 func (p *ProductProjection) ApplyEvent(e *gen.EventEnvelope) error {
+	db := appctx.DB(p.Ctx)
+	return db.WriteTX(p.Ctx, func(tx *rwdb.Tx) error {
+		return p.ApplyEventTx(tx, e)
+	})
+}
+
+// ApplyEventTx applies e to the products table. Every write is idempotent so
+// replaying the stream over an existing database converges to the same state.
+func (p *ProductProjection) ApplyEventTx(tx *rwdb.Tx, e *gen.EventEnvelope) error {
 	event, err := bee.UnmarshalEvent(e)
 	if err != nil {
 		return err
 	}
-	db := appctx.DB(p.Ctx)
 	switch event := event.(type) {
 	case *shopping.ProductCreated:
-		return db.WriteTX(p.Ctx, func(tx *rwdb.Tx) error {
-			product := &shopping.Product{
-				ID:    e.AggregateId,
-				Name:  event.Name,
-				Price: event.Price,
-			}
-			return tx.Create(product).Error
-		})
+		product := &shopping.Product{
+			ID:    e.AggregateId,
+			Name:  event.Name,
+			Price: event.Price,
+		}
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(product).Error
 	case *shopping.ProductNameUpdated:
-		return db.WriteTX(p.Ctx, func(tx *rwdb.Tx) error {
-			product := &shopping.Product{
-				Name: event.Name,
-			}
-			return tx.Model(&shopping.Product{}).Select("name").Where("id = ?", e.AggregateId).Updates(product).Error
-		})
+		product := &shopping.Product{
+			Name: event.Name,
+		}
+		return tx.Model(&shopping.Product{}).Select("name").Where("id = ?", e.AggregateId).Updates(product).Error
 	case *shopping.ProductPriceUpdated:
-		return db.WriteTX(p.Ctx, func(tx *rwdb.Tx) error {
-			product := &shopping.Product{
-				Price: event.Price,
-			}
-			return tx.Model(&shopping.Product{}).Select("price").Where("id = ?", e.AggregateId).Updates(product).Error
-		})
+		product := &shopping.Product{
+			Price: event.Price,
+		}
+		return tx.Model(&shopping.Product{}).Select("price").Where("id = ?", e.AggregateId).Updates(product).Error
 	case *shopping.ProductDeleted:
-		return db.WriteTX(p.Ctx, func(tx *rwdb.Tx) error {
-			return tx.Where("id = ?", e.AggregateId).Delete(&shopping.Product{}).Error
-		})
+		return tx.Where("id = ?", e.AggregateId).Delete(&shopping.Product{}).Error
 	default:
 		return nil // Ignore other event types
 	}
-	return nil
 }
 
+// ProductLiveView keeps one product from its events. The SSE handler reads
+// it while the stock of the product changes too, so both go through mu.
 type ProductLiveView struct {
+	mu      sync.Mutex
 	err     error
 	Product shopping.Product `json:"product"` // Current state of the product
 }
@@ -107,6 +115,8 @@ func (p *ProductLiveView) ApplyEvent(e *gen.EventEnvelope) error {
 	if err != nil {
 		return fmt.Errorf("unmarshal event: %w", err)
 	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	p.err = nil                  // Reset error on each event
 	p.Product.ID = e.AggregateId // Set the product ID from the event
 	switch event := event.(type) {
@@ -129,7 +139,17 @@ func (p *ProductLiveView) ApplyEvent(e *gen.EventEnvelope) error {
 	return nil
 }
 
+// Current is a copy of the product as it is now.
+func (p *ProductLiveView) Current() shopping.Product {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Product
+}
+
+// UpdateProductLiveProjection keeps the products from their events. The SSE
+// handler reads them while the stock changes too, so both go through mu.
 type UpdateProductLiveProjection struct {
+	mu       sync.Mutex
 	err      error
 	Products []shopping.Product `json:"products"` // List of products in the projection
 }
@@ -139,6 +159,8 @@ func (p *UpdateProductLiveProjection) ApplyEvent(e *gen.EventEnvelope) error {
 	if err != nil {
 		return fmt.Errorf("unmarshal event: %w", err)
 	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	p.err = nil // Reset error on each event
 	switch event := event.(type) {
 	case *shopping.ProductCreated:
@@ -154,50 +176,174 @@ func (p *UpdateProductLiveProjection) ApplyEvent(e *gen.EventEnvelope) error {
 	return nil
 }
 
+// List is a copy of the products as they are now, and the error of the
+// last event applied.
+func (p *UpdateProductLiveProjection) List() ([]shopping.Product, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.Products), p.err
+}
+
+// StockLiveView keeps the inventories of products from inventory events.
+// Events are applied on the goroutine of the subscription while the SSE
+// handler reads the stock, so both go through mu.
+type StockLiveView struct {
+	mu          sync.Mutex
+	inventories map[string]*shopping.Inventory
+}
+
+func (s *StockLiveView) ApplyEvent(e *gen.EventEnvelope) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inventories == nil {
+		s.inventories = map[string]*shopping.Inventory{}
+	}
+	i, ok := s.inventories[e.AggregateId]
+	if !ok {
+		i = &shopping.Inventory{ID: e.AggregateId}
+		s.inventories[e.AggregateId] = i
+	}
+	return i.ApplyEvent(e)
+}
+
+// Stock is what is left of each product at now.
+func (s *StockLiveView) Stock(now time.Time) collection.Stock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stock := collection.Stock{}
+	for id, i := range s.inventories {
+		stock[id] = i.Left(now.Unix())
+	}
+	return stock
+}
+
 type CartCounterLiveProjection struct {
-	Count int     `json:"count"` // Count of items in the cart
-	Total float64 `json:"total"` // Total price of items in the cart
+	Count  int             `json:"count"` // Count of units in the cart
+	Total  float64         `json:"total"` // Total price of items in the cart, less discounts
+	basket shopping.Basket // Lines and discounts of the cart, which the total needs
 }
 
 // ApplyEvent applies an event to the CartCounterLiveProjection
 func (c *CartCounterLiveProjection) ApplyEvent(e *gen.EventEnvelope) error {
+	event, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return fmt.Errorf("unmarshal event: %w", err)
+	}
+	c.basket.Apply(event)
+	c.Count = c.basket.Items.Count()
+	c.Total = c.basket.Total()
+	return nil
+}
+
+type CartProjection struct {
+	shopping.Basket
+	Payment *shopping.CartPayment
+}
+
+func (a *CartProjection) ApplyEvent(e *gen.EventEnvelope) error {
+	event, err := bee.UnmarshalEvent(e)
+	if err != nil {
+		return fmt.Errorf("unmarshal event: %w", err)
+	}
+	a.Apply(event)
+	a.Payment = a.Payment.Apply(event)
+	return nil
+}
+
+// AccountsLiveView keeps the balance of every account from payments events.
+type AccountsLiveView struct {
+	Accounts []collection.Account `json:"accounts"` // In the order they were opened
+}
+
+func (a *AccountsLiveView) ApplyEvent(e *gen.EventEnvelope) error {
 	event, err := bee.UnmarshalEvent(e)
 	if err != nil {
 		return fmt.Errorf("unmarshal event: %w", err)
 	}
 	switch event := event.(type) {
-	case *shopping.CartItemAdded:
-		c.Count++
-		c.Total += event.Product.Price
-	case *shopping.CartItemRemoved:
-		c.Count--
-		c.Total -= event.Product.Price
+	case *banking.AccountCreated:
+		a.Accounts = append(a.Accounts, collection.Account{
+			ID:       e.AggregateId,
+			Currency: event.Currency,
+			Balance:  event.Balance,
+		})
+	case *banking.AccountDebited:
+		if acc := a.account(e.AggregateId); acc != nil {
+			acc.Balance -= event.Amount
+		}
+	case *banking.AccountCredited:
+		if acc := a.account(e.AggregateId); acc != nil {
+			acc.Balance += event.Amount
+		}
+	case *banking.AccountFrozen:
+		if acc := a.account(e.AggregateId); acc != nil {
+			acc.Frozen = true
+		}
+	case *banking.AccountUnfrozen:
+		if acc := a.account(e.AggregateId); acc != nil {
+			acc.Frozen = false
+		}
+	case *banking.AccountClosed:
+		if acc := a.account(e.AggregateId); acc != nil {
+			acc.Closed = true
+		}
+	case *banking.OverdraftLimitSet:
+		if acc := a.account(e.AggregateId); acc != nil {
+			acc.Overdraft = event.Limit
+		}
+	case *banking.HoldAuthorized:
+		if acc := a.account(e.AggregateId); acc != nil {
+			acc.Held += event.Amount
+		}
+	case *banking.HoldCaptured:
+		// The debited event that follows lowers the balance.
+		if acc := a.account(e.AggregateId); acc != nil {
+			acc.Held -= event.Amount
+		}
+	case *banking.HoldReleased:
+		if acc := a.account(e.AggregateId); acc != nil {
+			acc.Held -= event.Amount
+		}
 	default:
 		return nil // Ignore other event types
 	}
 	return nil
 }
 
-type CartProjection struct {
-	Items []shopping.Product `json:"history"` // History of events applied to the aggregate
+func (a *AccountsLiveView) account(id string) *collection.Account {
+	for i := range a.Accounts {
+		if a.Accounts[i].ID == id {
+			return &a.Accounts[i]
+		}
+	}
+	return nil
 }
 
-func (a *CartProjection) ApplyEvent(e *gen.EventEnvelope) error {
+// TransfersLiveView keeps the latest transfers from transfers events.
+type TransfersLiveView struct {
+	Transfers []banking.Transfer `json:"transfers"` // Newest first
+}
+
+// transfersShown is how many transfers TransfersLiveView keeps.
+const transfersShown = 20
+
+func (t *TransfersLiveView) ApplyEvent(e *gen.EventEnvelope) error {
 	event, err := bee.UnmarshalEvent(e)
 	if err != nil {
 		return fmt.Errorf("unmarshal event: %w", err)
 	}
 	switch event := event.(type) {
-	case *shopping.CartItemAdded:
-		a.Items = append(a.Items, shopping.Product{
-			ID:    event.Product.ID,
-			Name:  event.Product.Name,
-			Price: event.Product.Price,
-		})
-	case *shopping.CartItemRemoved:
-		for i, p := range a.Items {
-			if p.ID == event.ProductID {
-				a.Items = append(a.Items[:i], a.Items[i+1:]...)
+	case *banking.TransferStarted:
+		t.Transfers = append([]banking.Transfer{*banking.TransferRow(event)}, t.Transfers...)
+		if len(t.Transfers) > transfersShown {
+			t.Transfers = t.Transfers[:transfersShown]
+		}
+	case *banking.TransferStepped:
+		for i := range t.Transfers {
+			if t.Transfers[i].ID == event.TransferID {
+				t.Transfers[i].Status = e.EventType
+				t.Transfers[i].Reason = event.Reason
+				t.Transfers[i].UpdatedAt = time.Unix(event.Timestamp, 0)
 				break
 			}
 		}
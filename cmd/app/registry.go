@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/blinkinglight/gobeego/apps/banking"
+	"github.com/blinkinglight/gobeego/pkg/registry"
+)
+
+// site declares what the routes of the site and ProductService send.
+var site = registry.App{
+	Name: "site",
+	Uses: []registry.Use{
+		registry.Emits("ProductService", "product", "created", "name_updated", "price_updated", "deleted"),
+
+		registry.Publishes("product routes", "product", "create"),
+		registry.Publishes("product routes", "inventory", "receive"),
+		registry.Publishes("cart routes", "cart", "create", "add_item", "remove_item", "set_quantity", "apply_coupon", "checkout", "pay"),
+		registry.Publishes("order routes", "order", "cancel"),
+		registry.Publishes("account routes", banking.Aggregate, banking.CreateCommand, banking.CreditCommand),
+		registry.Publishes("account routes", banking.Transfers, banking.StartCommand),
+		registry.Publishes("admin routes", banking.Aggregate, banking.FreezeCommand, banking.UnfreezeCommand, banking.CloseCommand),
+		registry.Publishes("admin routes", banking.RateTables, banking.SetRateCommand),
+		registry.Publishes("admin routes", banking.Transfers, banking.StartCommand),
+		registry.Publishes("admin routes", banking.RuleSets, banking.SetRuleCommand, banking.RemoveRuleCommand),
+		registry.Publishes("admin routes", "coupon", "create"),
+		registry.Publishes("admin routes", "inventory", "receive"),
+		registry.Publishes("admin routes", "order", "pay", "ship", "deliver", "cancel"),
+	},
+}
+
+func init() {
+	registry.Register(site)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/blinkinglight/gobeego/apps/banking"
+	"github.com/blinkinglight/gobeego/pkg/appctx"
+	"github.com/blinkinglight/gobeego/pkg/config"
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+)
+
+const dateLayout = "2006-01-02"
+
+// statementRange reads the from and to query parameters. Either is a date or
+// an RFC 3339 time; a date in to includes that whole day. from defaults to
+// the beginning of the history and to to now.
+func statementRange(q url.Values) (from, to time.Time, err error) {
+	to = time.Now().UTC()
+	if v := q.Get("from"); v != "" {
+		if from, err = parseTime(v, false); err != nil {
+			return from, to, err
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = parseTime(v, true); err != nil {
+			return from, to, err
+		}
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from %s is not before to %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+	return from, to, nil
+}
+
+func parseTime(v string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(dateLayout, v); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q, want %s or RFC 3339", v, dateLayout)
+	}
+	return t, nil
+}
+
+func statementRoutes(r chi.Router, js nats.JetStreamContext) {
+	r.Get("/accounts/{id}/statement", func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = banking.FormatCSV
+		}
+		ext := format
+		switch format {
+		case banking.FormatCSV, banking.FormatJSON:
+		case banking.FormatCamt053:
+			ext = "xml"
+		default:
+			http.Error(w, fmt.Sprintf("unknown statement format %q", format), http.StatusBadRequest)
+			return
+		}
+		from, to, err := statementRange(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s, err := banking.BuildStatement(appctx.WithJetStream(r.Context(), js), id, from, to)
+		if errors.Is(err, banking.ErrAccountNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to build statement: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", banking.ContentType(format))
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statement-%s-%s-%s.%s"`,
+			url.PathEscape(id), from.Format(dateLayout), to.Format(dateLayout), ext))
+		// The headers are sent already, so a failed write can only be logged.
+		if err := s.Write(w, format); err != nil {
+			log.Printf("Statement of %s failed part way: %v", id, err)
+		}
+	})
+}
+
+// statementCommand is the "statement" CLI subcommand. It downloads the
+// statement of an account from a running server.
+func statementCommand(args []string) int {
+	fs := flag.NewFlagSet("statement", flag.ExitOnError)
+	addr := fs.String("url", "http://localhost:4321", "base URL of the running server")
+	token := fs.String("token", os.Getenv(config.EnvPrefix+"ADMIN_TOKEN"), "admin token")
+	from := fs.String("from", "", "first day or time of the statement, "+dateLayout+" or RFC 3339")
+	to := fs.String("to", "", "last day (inclusive) or end time (exclusive) of the statement")
+	format := fs.String("format", banking.FormatCSV, "csv, json or camt053")
+	out := fs.String("o", "", "output file, stdout if empty")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: site statement [flags] <account>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	q := url.Values{"format": {*format}}
+	if *from != "" {
+		q.Set("from", *from)
+	}
+	if *to != "" {
+		q.Set("to", *to)
+	}
+	u := fmt.Sprintf("%s/admin/accounts/%s/statement?%s", *addr, url.PathEscape(fs.Arg(0)), q.Encode())
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "%s: %s", resp.Status, b)
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/blinkinglight/gobeego/pkg/rwdb"
 	"github.com/ituoga/appcontext"
+	"github.com/nats-io/nats.go"
 )
 
 var dbKey = appcontext.Key[*rwdb.DB]("rwdb")
@@ -19,3 +20,16 @@ func DB(ctx context.Context) *rwdb.DB {
 	}
 	panic("rwdb not found in context")
 }
+
+var jsKey = appcontext.Key[nats.JetStreamContext]("jetstream")
+
+func WithJetStream(ctx context.Context, js nats.JetStreamContext) context.Context {
+	return appcontext.With(ctx, jsKey, js)
+}
+
+func JetStream(ctx context.Context) nats.JetStreamContext {
+	if js, ok := appcontext.Get(ctx, jsKey); ok {
+		return js
+	}
+	panic("jetstream not found in context")
+}
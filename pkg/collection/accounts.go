@@ -0,0 +1,23 @@
+package collection
+
+import "github.com/blinkinglight/gobeego/apps/banking"
+
+type Account struct {
+	ID        string `json:"id"`        // Account identifier
+	Currency  string `json:"currency"`  // Currency the account is kept in
+	Balance   int64  `json:"balance"`   // Ledger balance in cents, holds included
+	Held      int64  `json:"held"`      // Reserved by active holds
+	Overdraft int64  `json:"overdraft"` // How far the balance may go below zero
+	Frozen    bool   `json:"frozen"`
+	Closed    bool   `json:"closed"`
+}
+
+// Available is the balance that is not reserved by holds.
+func (a Account) Available() int64 {
+	return a.Balance - a.Held
+}
+
+type Accounts struct {
+	Accounts  []Account          `json:"accounts"`  // Every account, including closed ones
+	Transfers []banking.Transfer `json:"transfers"` // Latest transfers, newest first
+}
@@ -3,9 +3,30 @@ package collection
 import "github.com/blinkinglight/gobeego/apps/shopping"
 
 type Cart struct {
-	Count    int                `json:"count"`    // Number of products in the cart
-	CartID   string             `json:"cart_id"`  // Unique identifier for the shopping cart
-	Products []shopping.Product `json:"products"` // List of products in the cart
-	Total    float64            `json:"total"`    // Total price of the cart
-	Discount float64            `json:"discount"` // Discount applied to the cart
+	Count    int            `json:"count"`    // Number of units in the cart
+	CartID   string         `json:"cart_id"`  // Unique identifier for the shopping cart
+	Items    shopping.Lines `json:"items"`    // Line items of the cart
+	Subtotal float64        `json:"subtotal"` // Price of the lines before discounts
+	Discount float64        `json:"discount"` // Discount applied to the cart
+	Coupon   string         `json:"coupon"`   // Code of the coupon applied to the cart
+	Total    float64        `json:"total"`    // Total price of the cart, less the discount
+
+	Payment *shopping.CartPayment `json:"payment,omitempty"` // Latest payment of the cart
+	Account string                `json:"account,omitempty"` // Payments account the cart is paid from
+}
+
+// NewCart is the page model of a cart priced by basket.
+func NewCart(cartID string, basket shopping.Basket) Cart {
+	c := Cart{
+		Count:    basket.Items.Count(),
+		CartID:   cartID,
+		Items:    basket.Items,
+		Subtotal: basket.Subtotal(),
+		Discount: basket.Off(),
+		Total:    basket.Total(),
+	}
+	if basket.Coupon != nil {
+		c.Coupon = basket.Coupon.Code
+	}
+	return c
 }
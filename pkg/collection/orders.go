@@ -0,0 +1,7 @@
+package collection
+
+import "github.com/blinkinglight/gobeego/apps/shopping"
+
+type Orders struct {
+	Orders []shopping.Order `json:"orders"` // Every order, newest first
+}
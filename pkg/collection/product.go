@@ -4,4 +4,9 @@ import "github.com/blinkinglight/gobeego/apps/shopping"
 
 type Product struct {
 	Products []shopping.Product `json:"products"` // List of products in the collection
+	Stock    Stock              `json:"stock"`    // Units left of the products
 }
+
+// Stock is how many units of each product no cart holds, by product ID.
+// Products without an inventory are not in it and have none.
+type Stock map[string]int
@@ -0,0 +1,267 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is the prefix of every environment variable read by Load.
+const EnvPrefix = "GOBEEGO_"
+
+// Duration is a time.Duration written like "24h" in config files.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type Config struct {
+	HTTPAddr   string `json:"http_addr"`   // Address the HTTP server listens on
+	DataDir    string `json:"data_dir"`    // Directory for JetStream and SQLite files
+	SQLitePath string `json:"sqlite_path"` // Path of the read model database, defaults to DataDir/shopping.db
+	KeepData   bool   `json:"keep_data"`   // Keep local data between restarts
+	NATSURL    string `json:"nats_url"`    // External NATS server, empty starts an embedded one
+	NATSPort   int    `json:"nats_port"`   // Port of the embedded NATS server, 0 picks a free one
+
+	SessionSecret string `json:"session_secret"` // Cart cookie signing key, generated into DataDir when empty
+	AdminToken    string `json:"admin_token"`    // Bearer token for /admin routes, empty disables them
+
+	DedupeWindow Duration `json:"dedupe_window"` // How long repeats of a payments command are answered from its first outcome
+
+	MerchantAccount string `json:"merchant_account"` // Payments account credited when a cart is paid
+	ShopCurrency    string `json:"shop_currency"`    // Currency cart prices are charged in
+}
+
+func Default() *Config {
+	return &Config{
+		HTTPAddr: ":4321",
+		DataDir:  "./data",
+		KeepData: true,
+
+		DedupeWindow: Duration(24 * time.Hour),
+
+		MerchantAccount: "MERCHANT",
+		ShopCurrency:    "EUR",
+	}
+}
+
+// Embedded reports whether the app should start its own NATS server.
+func (c *Config) Embedded() bool {
+	return c.NATSURL == ""
+}
+
+// NATSDir is the JetStream store directory of the embedded server.
+func (c *Config) NATSDir() string {
+	return filepath.Join(c.DataDir, "nats")
+}
+
+// Load builds the config from defaults, an optional JSON config file,
+// environment variables and command line flags, in that order of precedence.
+func Load(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("gobeego", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(EnvPrefix+"CONFIG"), "path to a JSON config file")
+	httpAddr := fs.String("http-addr", "", "HTTP listen address")
+	dataDir := fs.String("data-dir", "", "data directory")
+	sqlitePath := fs.String("sqlite-path", "", "SQLite read model path")
+	keepData := fs.String("keep-data", "", "keep data between restarts (true/false)")
+	natsURL := fs.String("nats-url", "", "external NATS URL, empty starts an embedded server")
+	natsPort := fs.Int("nats-port", -1, "embedded NATS port, 0 picks a free one")
+	sessionSecret := fs.String("session-secret", "", "cart cookie signing key")
+	adminToken := fs.String("admin-token", "", "bearer token for the admin endpoints")
+	dedupeWindow := fs.Duration("dedupe-window", 0, "how long repeated payments commands are answered from their first outcome")
+	merchantAccount := fs.String("merchant-account", "", "payments account credited when a cart is paid")
+	shopCurrency := fs.String("shop-currency", "", "currency cart prices are charged in")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	if *httpAddr != "" {
+		cfg.HTTPAddr = *httpAddr
+	}
+	if *dataDir != "" {
+		cfg.DataDir = *dataDir
+	}
+	if *sqlitePath != "" {
+		cfg.SQLitePath = *sqlitePath
+	}
+	if *keepData != "" {
+		v, err := strconv.ParseBool(*keepData)
+		if err != nil {
+			return nil, fmt.Errorf("keep-data: %w", err)
+		}
+		cfg.KeepData = v
+	}
+	if *natsURL != "" {
+		cfg.NATSURL = *natsURL
+	}
+	if *natsPort >= 0 {
+		cfg.NATSPort = *natsPort
+	}
+	if *sessionSecret != "" {
+		cfg.SessionSecret = *sessionSecret
+	}
+	if *adminToken != "" {
+		cfg.AdminToken = *adminToken
+	}
+	if *dedupeWindow != 0 {
+		cfg.DedupeWindow = Duration(*dedupeWindow)
+	}
+	if *merchantAccount != "" {
+		cfg.MerchantAccount = *merchantAccount
+	}
+	if *shopCurrency != "" {
+		cfg.ShopCurrency = *shopCurrency
+	}
+
+	if cfg.SQLitePath == "" {
+		cfg.SQLitePath = filepath.Join(cfg.DataDir, "shopping.db")
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	if v, ok := os.LookupEnv(EnvPrefix + "HTTP_ADDR"); ok {
+		c.HTTPAddr = v
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "DATA_DIR"); ok {
+		c.DataDir = v
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "SQLITE_PATH"); ok {
+		c.SQLitePath = v
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "KEEP_DATA"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%sKEEP_DATA: %w", EnvPrefix, err)
+		}
+		c.KeepData = b
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "NATS_URL"); ok {
+		c.NATSURL = v
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "NATS_PORT"); ok {
+		p, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%sNATS_PORT: %w", EnvPrefix, err)
+		}
+		c.NATSPort = p
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "SESSION_SECRET"); ok {
+		c.SessionSecret = v
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "ADMIN_TOKEN"); ok {
+		c.AdminToken = v
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "DEDUPE_WINDOW"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%sDEDUPE_WINDOW: %w", EnvPrefix, err)
+		}
+		c.DedupeWindow = Duration(d)
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "MERCHANT_ACCOUNT"); ok {
+		c.MerchantAccount = v
+	}
+	if v, ok := os.LookupEnv(EnvPrefix + "SHOP_CURRENCY"); ok {
+		c.ShopCurrency = v
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.HTTPAddr); err != nil {
+		errs = append(errs, fmt.Errorf("http_addr %q: %w", c.HTTPAddr, err))
+	}
+	if strings.TrimSpace(c.DataDir) == "" {
+		errs = append(errs, errors.New("data_dir cannot be empty"))
+	}
+	if strings.TrimSpace(c.SQLitePath) == "" {
+		errs = append(errs, errors.New("sqlite_path cannot be empty"))
+	}
+	if c.NATSPort < 0 || c.NATSPort > 65535 {
+		errs = append(errs, fmt.Errorf("nats_port %d out of range", c.NATSPort))
+	}
+	if c.SessionSecret != "" && len(c.SessionSecret) < 32 {
+		errs = append(errs, errors.New("session_secret must be at least 32 characters"))
+	}
+	if c.DedupeWindow <= 0 {
+		errs = append(errs, fmt.Errorf("dedupe_window %s must be positive", time.Duration(c.DedupeWindow)))
+	}
+	if strings.TrimSpace(c.MerchantAccount) == "" {
+		errs = append(errs, errors.New("merchant_account cannot be empty"))
+	}
+	if strings.TrimSpace(c.ShopCurrency) == "" {
+		errs = append(errs, errors.New("shop_currency cannot be empty"))
+	}
+	if !c.Embedded() {
+		u, err := url.Parse(c.NATSURL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("nats_url %q: %w", c.NATSURL, err))
+		} else if u.Scheme != "nats" && u.Scheme != "tls" && u.Scheme != "ws" && u.Scheme != "wss" {
+			errs = append(errs, fmt.Errorf("nats_url %q: unsupported scheme %q", c.NATSURL, u.Scheme))
+		}
+		if c.NATSPort != 0 {
+			errs = append(errs, errors.New("nats_port only applies to the embedded server"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Config) String() string {
+	nats := "embedded"
+	if !c.Embedded() {
+		nats = c.NATSURL
+	} else if c.NATSPort != 0 {
+		nats = fmt.Sprintf("embedded (port %d)", c.NATSPort)
+	}
+	return fmt.Sprintf("http_addr=%s data_dir=%s sqlite_path=%s keep_data=%t nats=%s admin=%t dedupe_window=%s merchant=%s/%s",
+		c.HTTPAddr, c.DataDir, c.SQLitePath, c.KeepData, nats, c.AdminToken != "", time.Duration(c.DedupeWindow), c.MerchantAccount, c.ShopCurrency)
+}
@@ -0,0 +1,86 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blinkinglight/gobeego/pkg/config"
+)
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := config.Load(nil)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.HTTPAddr != ":4321" {
+		t.Errorf("Expected default http addr :4321, got %s", cfg.HTTPAddr)
+	}
+	if !cfg.KeepData {
+		t.Errorf("Expected data to be kept by default")
+	}
+	if !cfg.Embedded() {
+		t.Errorf("Expected embedded NATS by default")
+	}
+	if cfg.SQLitePath != filepath.Join("data", "shopping.db") {
+		t.Errorf("Expected sqlite path to default into data dir, got %s", cfg.SQLitePath)
+	}
+	if time.Duration(cfg.DedupeWindow) != 24*time.Hour {
+		t.Errorf("Expected a dedupe window of 24h by default, got %s", time.Duration(cfg.DedupeWindow))
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(file, []byte(`{"http_addr":":1000","data_dir":"/var/lib/file","keep_data":false,"dedupe_window":"1h"}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(config.EnvPrefix+"DATA_DIR", "/var/lib/env")
+	t.Setenv(config.EnvPrefix+"NATS_URL", "nats://env:4222")
+
+	cfg, err := config.Load([]string{"-config", file, "-nats-url", "nats://flag:4222"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.HTTPAddr != ":1000" {
+		t.Errorf("Expected http addr from file, got %s", cfg.HTTPAddr)
+	}
+	if cfg.KeepData {
+		t.Errorf("Expected keep_data from file to be false")
+	}
+	if time.Duration(cfg.DedupeWindow) != time.Hour {
+		t.Errorf("Expected dedupe window from file, got %s", time.Duration(cfg.DedupeWindow))
+	}
+	if cfg.DataDir != "/var/lib/env" {
+		t.Errorf("Expected data dir from env, got %s", cfg.DataDir)
+	}
+	if cfg.NATSURL != "nats://flag:4222" {
+		t.Errorf("Expected nats url from flag, got %s", cfg.NATSURL)
+	}
+	if cfg.SQLitePath != "/var/lib/env/shopping.db" {
+		t.Errorf("Expected sqlite path inside env data dir, got %s", cfg.SQLitePath)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"bad http addr", []string{"-http-addr", "4321"}},
+		{"bad nats scheme", []string{"-nats-url", "http://localhost:4222"}},
+		{"port with external nats", []string{"-nats-url", "nats://localhost:4222", "-nats-port", "4222"}},
+		{"port out of range", []string{"-nats-port", "70000"}},
+		{"bad keep data", []string{"-keep-data", "maybe"}},
+		{"negative dedupe window", []string{"-dedupe-window", "-1h"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := config.Load(tt.args); err == nil {
+				t.Errorf("Expected error for %v", tt.args)
+			}
+		})
+	}
+}
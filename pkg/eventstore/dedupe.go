@@ -0,0 +1,177 @@
+package eventstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/appctx"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
+)
+
+// IdempotencyKey is the command metadata entry that marks repeats of the
+// same command.
+const IdempotencyKey = "idempotency_key"
+
+// OutcomeBucket is the KV bucket holding the outcomes Dedupe remembers.
+const OutcomeBucket = "outcomes"
+
+// DefaultDedupeWindow applies when Dedupe.Window is zero.
+const DefaultDedupeWindow = 24 * time.Hour
+
+// claimTimeout is how long a command may be in progress before a repeat of
+// it is assumed to belong to a crashed handler and is handled again.
+const claimTimeout = time.Minute
+
+// Dedupe remembers the events of every command with an idempotency key that
+// succeeded for Window and answers repeats with them instead of handling
+// them again. A command that failed, e.g. on insufficient funds, is handled
+// again when repeated, as the state it was rejected on may have changed.
+// Keys are scoped to the aggregate instance and command type.
+type Dedupe struct {
+	Window time.Duration
+	// Key returns the idempotency key of a command, "" if repeats of it are
+	// not detected. It defaults to the IdempotencyKey metadata entry.
+	Key func(m *gen.CommandEnvelope) string
+}
+
+type outcome struct {
+	Pending bool      `json:"pending,omitempty"`
+	Since   time.Time `json:"since"`
+	Hash    string    `json:"hash"` // Of the command type and payload
+	Events  [][]byte  `json:"events,omitempty"`
+}
+
+// Open creates the outcome bucket, or gives an existing one the TTL of the
+// window if it was created with another, so outcomes are neither forgotten
+// early nor kept past the window. Call it at startup; Do creates a missing
+// bucket but leaves an existing one as it is.
+func (d *Dedupe) Open(ctx context.Context) error {
+	js := appctx.JetStream(ctx)
+	if _, err := keyValue(js, d.bucket()); err != nil {
+		return err
+	}
+	old, err := setTTL(js, OutcomeBucket, d.window())
+	if err != nil {
+		return err
+	}
+	if old != d.window() {
+		log.Printf("Changed the TTL of the %s bucket from %s to %s", OutcomeBucket, old, d.window())
+	}
+	return nil
+}
+
+func (d *Dedupe) bucket() *nats.KeyValueConfig {
+	return &nats.KeyValueConfig{Bucket: OutcomeBucket, History: 1, TTL: d.window()}
+}
+
+func (d *Dedupe) window() time.Duration {
+	if d.Window > 0 {
+		return d.Window
+	}
+	return DefaultDedupeWindow
+}
+
+func (d *Dedupe) key(m *gen.CommandEnvelope) string {
+	if d.Key != nil {
+		return d.Key(m)
+	}
+	return m.Metadata[IdempotencyKey]
+}
+
+func commandHash(m *gen.CommandEnvelope) string {
+	h := sha256.New()
+	h.Write([]byte(m.CommandType))
+	h.Write([]byte{0})
+	h.Write(m.Payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Do runs handle unless m repeats a command that succeeded within the
+// window, in which case it returns that command's events.
+func (d *Dedupe) Do(ctx context.Context, m *gen.CommandEnvelope, handle func(*gen.CommandEnvelope) ([]*gen.EventEnvelope, error)) ([]*gen.EventEnvelope, error) {
+	idem := d.key(m)
+	if idem == "" {
+		return handle(m)
+	}
+	kv, err := keyValue(appctx.JetStream(ctx), d.bucket())
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s.%s.%s.%s", m.Aggregate, m.AggregateId, m.CommandType, base64.RawURLEncoding.EncodeToString([]byte(idem)))
+	hash := commandHash(m)
+
+	claim, _ := json.Marshal(outcome{Pending: true, Since: time.Now(), Hash: hash})
+	rev, err := kv.Create(key, claim)
+	if errors.Is(err, nats.ErrKeyExists) {
+		entry, gerr := kv.Get(key)
+		if gerr != nil {
+			return nil, fmt.Errorf("load outcome of %s: %w", idem, gerr)
+		}
+		var prev outcome
+		if err := json.Unmarshal(entry.Value(), &prev); err != nil {
+			return nil, fmt.Errorf("decode outcome of %s: %w", idem, err)
+		}
+		age := time.Since(prev.Since)
+		switch {
+		case prev.Pending && age < claimTimeout:
+			return nil, fmt.Errorf("command %s is already being handled", idem)
+		case !prev.Pending && age < d.window():
+			if prev.Hash != hash {
+				return nil, reply.Refuse(fmt.Errorf("idempotency key %s was used for a different command", idem))
+			}
+			return prev.result()
+		}
+		// The previous attempt expired or was abandoned; take it over.
+		rev, err = kv.Update(key, claim, entry.Revision())
+		if errors.Is(err, nats.ErrKeyExists) {
+			return nil, fmt.Errorf("command %s is already being handled", idem)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claim %s: %w", idem, err)
+	}
+
+	events, err := handle(m)
+	if err != nil {
+		if derr := kv.Delete(key, nats.LastRevision(rev)); derr != nil {
+			log.Printf("Failed to release %s: %v", idem, derr)
+		}
+		return events, err
+	}
+	done := outcome{Since: time.Now(), Hash: hash}
+	for _, e := range events {
+		b, merr := proto.Marshal(e)
+		if merr != nil {
+			log.Printf("Failed to record outcome of %s: %v", idem, merr)
+			break
+		}
+		done.Events = append(done.Events, b)
+	}
+	b, _ := json.Marshal(done)
+	if _, perr := kv.Update(key, b, rev); perr != nil {
+		log.Printf("Failed to record outcome of %s: %v", idem, perr)
+	}
+	return events, nil
+}
+
+func (o outcome) result() ([]*gen.EventEnvelope, error) {
+	events := make([]*gen.EventEnvelope, 0, len(o.Events))
+	for _, b := range o.Events {
+		var e gen.EventEnvelope
+		if err := proto.Unmarshal(b, &e); err != nil {
+			return nil, fmt.Errorf("decode recorded event: %w", err)
+		}
+		events = append(events, &e)
+	}
+	return events, nil
+}
@@ -0,0 +1,312 @@
+package eventstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"strconv"
+	"time"
+
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/appctx"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
+)
+
+// VersionKey is the command metadata entry holding the aggregate version a
+// command was based on, and the event metadata entry holding the version a
+// handler decided on.
+const VersionKey = "expected_version"
+
+// ExpectedSubjectHdr makes the expected last subject sequence apply to every
+// subject matching the given filter rather than to the published subject.
+const ExpectedSubjectHdr = "Nats-Expected-Last-Subject-Sequence-Subject"
+
+// DefaultRetries is how often Handler re-runs a command whose aggregate
+// moved on while the command was being handled.
+const DefaultRetries = 3
+
+var ErrConflict = errors.New("aggregate was modified concurrently")
+
+type EventApplier interface {
+	ApplyEvent(e *gen.EventEnvelope) error
+}
+
+type CommandHandler interface {
+	Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error)
+}
+
+// Subject is the filter for every event of one aggregate instance.
+func Subject(aggregate, id string) string {
+	return fmt.Sprintf("events.%s.%s.>", aggregate, id)
+}
+
+// Replay applies every stored event of an aggregate to agg and returns its
+// version: the stream sequence of its last event, 0 if it has none. If agg
+// implements Snapshotter, replay starts from its latest snapshot.
+func Replay(ctx context.Context, agg EventApplier, aggregate, id string) (uint64, error) {
+	js := appctx.JetStream(ctx)
+
+	var version uint64
+	snap, snapshotting := agg.(Snapshotter)
+	if snapshotting {
+		version = loadSnapshot(js, snap, aggregate, id)
+	}
+
+	start := nats.DeliverAll()
+	if version > 0 {
+		start = nats.StartSequence(version + 1)
+	}
+	sub, err := js.SubscribeSync(Subject(aggregate, id), nats.OrderedConsumer(), start)
+	if err != nil {
+		return 0, fmt.Errorf("subscribe %s %s: %w", aggregate, id, err)
+	}
+	defer sub.Unsubscribe()
+
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return 0, fmt.Errorf("consumer info %s %s: %w", aggregate, id, err)
+	}
+	if info.NumPending == 0 {
+		return version, nil
+	}
+
+	applied := 0
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			return version, fmt.Errorf("replay %s %s: %w", aggregate, id, err)
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return version, fmt.Errorf("event metadata: %w", err)
+		}
+		var e gen.EventEnvelope
+		if err := proto.Unmarshal(msg.Data, &e); err != nil {
+			return version, fmt.Errorf("unmarshal event %d: %w", meta.Sequence.Stream, err)
+		}
+		if err := agg.ApplyEvent(&e); err != nil {
+			log.Printf("Replay %s %s: skipping event %d: %v", aggregate, id, meta.Sequence.Stream, err)
+		}
+		version = meta.Sequence.Stream
+		applied++
+		if meta.NumPending == 0 {
+			break
+		}
+	}
+
+	if snapshotting && applied >= snap.SnapshotEvery() {
+		saveSnapshot(js, snap, aggregate, id, version)
+	}
+	return version, nil
+}
+
+// Read calls fn with every stored event of an aggregate in order, together
+// with the time JetStream stored it at. It stops at the first error fn
+// returns. Unlike Replay it never uses snapshots.
+func Read(ctx context.Context, aggregate, id string, fn func(e *gen.EventEnvelope, stored time.Time) error) error {
+	_, err := ReadAfter(ctx, aggregate, id, 0, fn)
+	return err
+}
+
+// ReadAfter is Read for the events stored after stream sequence after, so a
+// reader that keeps its own state only reads what is new. It returns the
+// sequence of the last event fn took, after if there was none.
+func ReadAfter(ctx context.Context, aggregate, id string, after uint64, fn func(e *gen.EventEnvelope, stored time.Time) error) (uint64, error) {
+	js := appctx.JetStream(ctx)
+	start := nats.DeliverAll()
+	if after > 0 {
+		start = nats.StartSequence(after + 1)
+	}
+	sub, err := js.SubscribeSync(Subject(aggregate, id), nats.OrderedConsumer(), start)
+	if err != nil {
+		return after, fmt.Errorf("subscribe %s %s: %w", aggregate, id, err)
+	}
+	defer sub.Unsubscribe()
+
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return after, fmt.Errorf("consumer info %s %s: %w", aggregate, id, err)
+	}
+	if info.NumPending == 0 {
+		return after, nil
+	}
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			return after, fmt.Errorf("read %s %s: %w", aggregate, id, err)
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return after, fmt.Errorf("event metadata: %w", err)
+		}
+		var e gen.EventEnvelope
+		if err := proto.Unmarshal(msg.Data, &e); err != nil {
+			return after, fmt.Errorf("unmarshal event %d: %w", meta.Sequence.Stream, err)
+		}
+		if err := fn(&e, meta.Timestamp); err != nil {
+			return after, err
+		}
+		after = meta.Sequence.Stream
+		if meta.NumPending == 0 {
+			return after, nil
+		}
+	}
+}
+
+// Expected returns the version m was based on, if its sender set one.
+func Expected(m *gen.CommandEnvelope) (uint64, bool, error) {
+	v, ok := m.Metadata[VersionKey]
+	if !ok {
+		return 0, false, nil
+	}
+	version, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid %s %q: %w", VersionKey, v, err)
+	}
+	return version, true, nil
+}
+
+// Check rejects m when it expects a version other than the replayed one.
+func Check(m *gen.CommandEnvelope, version uint64) error {
+	expected, ok, err := Expected(m)
+	if err != nil {
+		return err
+	}
+	if ok && expected != version {
+		return fmt.Errorf("%w: %s %s is at version %d, expected %d", ErrConflict, m.Aggregate, m.AggregateId, version, expected)
+	}
+	return nil
+}
+
+// Expect marks the events emitted for the aggregate m targets with the
+// version they were decided on, so they are only appended if no other event
+// of that aggregate was stored in the meantime.
+func Expect(m *gen.CommandEnvelope, version uint64, events []*gen.EventEnvelope) []*gen.EventEnvelope {
+	for _, e := range events {
+		if e.AggregateId != "" && e.AggregateId != m.AggregateId {
+			continue
+		}
+		if e.AggregateType != "" && e.AggregateType != m.Aggregate {
+			continue
+		}
+		md := maps.Clone(e.Metadata)
+		if md == nil {
+			md = map[string]string{}
+		}
+		md[VersionKey] = strconv.FormatUint(version, 10)
+		e.Metadata = md
+	}
+	return events
+}
+
+// Append stores events in order. An event marked by Expect is rejected with
+// ErrConflict unless the last event of its aggregate still has the expected
+// sequence; further events of the same aggregate are chained onto the one
+// stored before them. JetStream cannot store several messages atomically, so
+// a conflict part way through leaves the events before it in place.
+func Append(ctx context.Context, js nats.JetStreamContext, events []*gen.EventEnvelope) error {
+	last := map[string]uint64{}
+	for _, e := range events {
+		b, err := proto.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("marshal %s event: %w", e.EventType, err)
+		}
+		msg := nats.NewMsg(fmt.Sprintf("events.%s.%s.%s", e.AggregateType, e.AggregateId, e.EventType))
+		msg.Data = b
+
+		filter := Subject(e.AggregateType, e.AggregateId)
+		expected, guarded := last[filter]
+		if !guarded {
+			if v, ok := e.Metadata[VersionKey]; ok {
+				if expected, err = strconv.ParseUint(v, 10, 64); err != nil {
+					return fmt.Errorf("invalid %s %q: %w", VersionKey, v, err)
+				}
+				guarded = true
+			}
+		}
+		if guarded {
+			msg.Header.Set(nats.ExpectedLastSubjSeqHdr, strconv.FormatUint(expected, 10))
+			msg.Header.Set(ExpectedSubjectHdr, filter)
+		}
+
+		ack, err := js.PublishMsg(msg, nats.Context(ctx))
+		if err != nil {
+			var apiErr *nats.APIError
+			if errors.As(err, &apiErr) && apiErr.ErrorCode == nats.JSErrCodeStreamWrongLastSequence {
+				return fmt.Errorf("%w: %s %s moved past version %d", ErrConflict, e.AggregateType, e.AggregateId, expected)
+			}
+			return fmt.Errorf("append %s: %w", msg.Subject, err)
+		}
+		if guarded {
+			last[filter] = ack.Sequence
+		}
+	}
+	return nil
+}
+
+// Handler runs commands through Handler and appends their events itself,
+// guarded by the versions set with Expect. On a conflict a command that
+// carries an expected version is rejected, any other is handled again
+// against the fresh state. The events are not handed back to bee, which
+// would publish them a second time; OnResult sees the outcome instead. With
+// Dedupe set, repeated commands get the outcome of the first one.
+type Handler struct {
+	Ctx      context.Context
+	Handler  CommandHandler
+	Retries  int
+	Dedupe   *Dedupe
+	OnResult func(m *gen.CommandEnvelope, events []*gen.EventEnvelope, err error)
+}
+
+func (h *Handler) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	var events []*gen.EventEnvelope
+	var err error
+	if h.Dedupe != nil {
+		events, err = h.Dedupe.Do(h.Ctx, m, h.handle)
+	} else {
+		events, err = h.handle(m)
+	}
+	if h.OnResult != nil {
+		h.OnResult(m, events, err)
+	}
+	return nil, err
+}
+
+func (h *Handler) handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	_, pinned, err := Expected(m)
+	if err != nil {
+		return nil, err
+	}
+	retries := h.Retries
+	if retries == 0 {
+		retries = DefaultRetries
+	}
+	js := appctx.JetStream(h.Ctx)
+
+	for attempt := 0; ; attempt++ {
+		events, err := h.Handler.Handle(m)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range events {
+			if e.AggregateType == "" {
+				e.AggregateType = m.Aggregate
+			}
+			if e.AggregateId == "" {
+				e.AggregateId = m.AggregateId
+			}
+		}
+		err = Append(h.Ctx, js, events)
+		if errors.Is(err, ErrConflict) && !pinned && attempt < retries {
+			log.Printf("Retrying %s %s %s: %v", m.Aggregate, m.AggregateId, m.CommandType, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return events, nil
+	}
+}
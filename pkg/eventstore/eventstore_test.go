@@ -0,0 +1,375 @@
+package eventstore_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/appctx"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/delaneyj/toolbelt/embeddednats"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func setup(t *testing.T) context.Context {
+	t.Helper()
+	ns, err := embeddednats.New(context.Background(),
+		embeddednats.WithDirectory(t.TempDir()),
+		embeddednats.WithNATSServerOptions(&server.Options{
+			JetStream: true,
+			Port:      server.RANDOM_PORT,
+			StoreDir:  t.TempDir(),
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ns.Close() })
+	ns.WaitForServer()
+	nc, err := ns.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "events", Subjects: []string{"events.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	return appctx.WithJetStream(t.Context(), js)
+}
+
+type counter struct {
+	n int
+}
+
+func (c *counter) ApplyEvent(e *gen.EventEnvelope) error {
+	c.n++
+	return nil
+}
+
+// incrementer emits one event per command. Its hook runs between replay and
+// append, where a concurrent writer could sneak in.
+type incrementer struct {
+	ctx      context.Context
+	attempts int
+	hook     func()
+	reject   error // Returned instead of the event while set
+}
+
+func (h *incrementer) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	h.attempts++
+	if h.reject != nil {
+		return nil, h.reject
+	}
+	version, err := eventstore.Replay(h.ctx, &counter{}, m.Aggregate, m.AggregateId)
+	if err != nil {
+		return nil, err
+	}
+	if err := eventstore.Check(m, version); err != nil {
+		return nil, err
+	}
+	if h.hook != nil {
+		h.hook()
+	}
+	return eventstore.Expect(m, version, []*gen.EventEnvelope{{EventType: "incremented"}}), nil
+}
+
+func event(id string) *gen.EventEnvelope {
+	return &gen.EventEnvelope{AggregateType: "counter", AggregateId: id, EventType: "incremented"}
+}
+
+func TestAppendConflict(t *testing.T) {
+	ctx := setup(t)
+	js := appctx.JetStream(ctx)
+	m := &gen.CommandEnvelope{Aggregate: "counter", AggregateId: "c1"}
+
+	if err := eventstore.Append(ctx, js, eventstore.Expect(m, 0, []*gen.EventEnvelope{event("c1"), event("c1")})); err != nil {
+		t.Fatalf("Expected first append to succeed, got %v", err)
+	}
+	err := eventstore.Append(ctx, js, eventstore.Expect(m, 0, []*gen.EventEnvelope{event("c1")}))
+	if !errors.Is(err, eventstore.ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+	// Other aggregates are not affected.
+	other := &gen.CommandEnvelope{Aggregate: "counter", AggregateId: "c2"}
+	if err := eventstore.Append(ctx, js, eventstore.Expect(other, 0, []*gen.EventEnvelope{event("c2")})); err != nil {
+		t.Fatalf("Expected append to c2 to succeed, got %v", err)
+	}
+
+	c := &counter{}
+	version, err := eventstore.Replay(ctx, c, "counter", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.n != 2 || version != 2 {
+		t.Errorf("Expected 2 events at version 2, got %d at version %d", c.n, version)
+	}
+	if err := eventstore.Append(ctx, js, eventstore.Expect(m, version, []*gen.EventEnvelope{event("c1")})); err != nil {
+		t.Errorf("Expected append at current version to succeed, got %v", err)
+	}
+}
+
+func TestReadAfter(t *testing.T) {
+	ctx := setup(t)
+	js := appctx.JetStream(ctx)
+	if err := eventstore.Append(ctx, js, []*gen.EventEnvelope{event("c1"), event("c2")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	read := func(e *gen.EventEnvelope, _ time.Time) error {
+		ids = append(ids, e.AggregateId)
+		return nil
+	}
+	last, err := eventstore.ReadAfter(ctx, "counter", "*", 0, read)
+	if err != nil || last != 2 {
+		t.Fatalf("Expected to read up to 2, got %d: %v", last, err)
+	}
+	if last, err = eventstore.ReadAfter(ctx, "counter", "*", last, read); err != nil || last != 2 {
+		t.Fatalf("Expected nothing new after 2, got %d: %v", last, err)
+	}
+	if err := eventstore.Append(ctx, js, []*gen.EventEnvelope{event("c1")}); err != nil {
+		t.Fatal(err)
+	}
+	if last, err = eventstore.ReadAfter(ctx, "counter", "*", last, read); err != nil || last != 3 {
+		t.Fatalf("Expected to read up to 3, got %d: %v", last, err)
+	}
+	if want := []string{"c1", "c2", "c1"}; !slices.Equal(ids, want) {
+		t.Errorf("Expected %v, got %v", want, ids)
+	}
+}
+
+func TestHandlerRetries(t *testing.T) {
+	ctx := setup(t)
+	js := appctx.JetStream(ctx)
+
+	inner := &incrementer{ctx: ctx}
+	inner.hook = func() {
+		if inner.attempts == 1 {
+			if err := eventstore.Append(ctx, js, []*gen.EventEnvelope{event("c1")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	h := &eventstore.Handler{Ctx: ctx, Handler: inner}
+	events, err := h.Handle(&gen.CommandEnvelope{Aggregate: "counter", AggregateId: "c1", CommandType: "increment"})
+	if err != nil {
+		t.Fatalf("Expected the retry to succeed, got %v", err)
+	}
+	if events != nil {
+		t.Errorf("Expected no events to be handed back, got %d", len(events))
+	}
+	if inner.attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %d", inner.attempts)
+	}
+
+	c := &counter{}
+	if _, err := eventstore.Replay(ctx, c, "counter", "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if c.n != 2 {
+		t.Errorf("Expected 2 stored events, got %d", c.n)
+	}
+}
+
+func TestHandlerRejectsStaleExpectedVersion(t *testing.T) {
+	ctx := setup(t)
+	js := appctx.JetStream(ctx)
+	if err := eventstore.Append(ctx, js, []*gen.EventEnvelope{event("c1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	inner := &incrementer{ctx: ctx}
+	var result error
+	h := &eventstore.Handler{Ctx: ctx, Handler: inner, OnResult: func(m *gen.CommandEnvelope, events []*gen.EventEnvelope, err error) {
+		result = err
+	}}
+	_, err := h.Handle(&gen.CommandEnvelope{
+		Aggregate:   "counter",
+		AggregateId: "c1",
+		CommandType: "increment",
+		Metadata:    map[string]string{eventstore.VersionKey: "0"},
+	})
+	if !errors.Is(err, eventstore.ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+	if !errors.Is(result, eventstore.ErrConflict) {
+		t.Errorf("Expected OnResult to see ErrConflict, got %v", result)
+	}
+	if inner.attempts != 1 {
+		t.Errorf("Expected no retry, got %d attempts", inner.attempts)
+	}
+}
+
+// snapshotCounter counts all events but only tracks those it replayed
+// itself in applied, which snapshots leave out.
+type snapshotCounter struct {
+	N       int `json:"n"`
+	version int
+	applied int
+}
+
+func (c *snapshotCounter) ApplyEvent(e *gen.EventEnvelope) error {
+	c.N++
+	c.applied++
+	return nil
+}
+
+func (c *snapshotCounter) SnapshotVersion() int { return c.version }
+func (c *snapshotCounter) SnapshotEvery() int   { return 3 }
+
+func (c *snapshotCounter) MarshalSnapshot() ([]byte, error) { return json.Marshal(c) }
+
+func (c *snapshotCounter) UnmarshalSnapshot(b []byte) error { return json.Unmarshal(b, c) }
+
+// brokenSnapshot restores its count from a snapshot and then fails.
+type brokenSnapshot struct {
+	snapshotCounter
+}
+
+func (c *brokenSnapshot) UnmarshalSnapshot(b []byte) error {
+	if err := json.Unmarshal(b, &c.snapshotCounter); err != nil {
+		return err
+	}
+	return errors.New("broken snapshot")
+}
+
+func TestReplaySnapshots(t *testing.T) {
+	ctx := setup(t)
+	js := appctx.JetStream(ctx)
+	replay := func(version int) *snapshotCounter {
+		t.Helper()
+		c := &snapshotCounter{version: version}
+		if _, err := eventstore.Replay(ctx, c, "counter", "c1"); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	appendN := func(n int) {
+		t.Helper()
+		for range n {
+			if err := eventstore.Append(ctx, js, []*gen.EventEnvelope{event("c1")}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	appendN(2)
+	if c := replay(1); c.N != 2 || c.applied != 2 {
+		t.Fatalf("Expected 2 events without a snapshot, got %+v", c)
+	}
+	appendN(2)
+	if c := replay(1); c.N != 4 || c.applied != 4 {
+		t.Fatalf("Expected a full replay of 4 events, got %+v", c)
+	}
+
+	kv, err := js.KeyValue(eventstore.SnapshotBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Get("counter.c1"); err != nil {
+		t.Fatalf("Expected a snapshot after 4 events, got %v", err)
+	}
+
+	appendN(1)
+	if c := replay(1); c.N != 5 || c.applied != 1 {
+		t.Errorf("Expected replay to resume after the snapshot, got %+v", c)
+	}
+	if c := replay(2); c.N != 5 || c.applied != 5 {
+		t.Errorf("Expected a snapshot of another version to be ignored, got %+v", c)
+	}
+
+	broken := &brokenSnapshot{snapshotCounter{version: 1}}
+	if _, err := eventstore.Replay(ctx, broken, "counter", "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if broken.N != 5 || broken.applied != 5 {
+		t.Errorf("Expected a snapshot that failed to decode to be replayed from scratch, got %+v", broken.snapshotCounter)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	ctx := setup(t)
+	inner := &incrementer{ctx: ctx}
+	h := &eventstore.Handler{Ctx: ctx, Handler: inner, Dedupe: &eventstore.Dedupe{Window: 500 * time.Millisecond}}
+	cmd := func(key string) *gen.CommandEnvelope {
+		return &gen.CommandEnvelope{
+			Aggregate:   "counter",
+			AggregateId: "c1",
+			CommandType: "increment",
+			Metadata:    map[string]string{eventstore.IdempotencyKey: key},
+		}
+	}
+
+	for range 3 {
+		if _, err := h.Handle(cmd("k1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if inner.attempts != 1 {
+		t.Errorf("Expected repeats to be answered from the first outcome, got %d attempts", inner.attempts)
+	}
+	if _, err := h.Handle(cmd("k2")); err != nil {
+		t.Fatal(err)
+	}
+	if inner.attempts != 2 {
+		t.Errorf("Expected a new key to be handled, got %d attempts", inner.attempts)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	if _, err := h.Handle(cmd("k1")); err != nil {
+		t.Fatal(err)
+	}
+	if inner.attempts != 3 {
+		t.Errorf("Expected a repeat after the window to be handled again, got %d attempts", inner.attempts)
+	}
+
+	inner.reject = errors.New("insufficient funds")
+	if _, err := h.Handle(cmd("k3")); err == nil {
+		t.Fatal("Expected the rejection")
+	}
+	inner.reject = nil
+	if _, err := h.Handle(cmd("k3")); err != nil {
+		t.Fatalf("Expected a rejected command to be handled again, got %v", err)
+	}
+	if inner.attempts != 5 {
+		t.Errorf("Expected a rejection not to be remembered, got %d attempts", inner.attempts)
+	}
+}
+
+func TestDedupeOpen(t *testing.T) {
+	ctx := setup(t)
+	ttl := func() time.Duration {
+		t.Helper()
+		kv, err := appctx.JetStream(ctx).KeyValue(eventstore.OutcomeBucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := kv.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status.TTL()
+	}
+
+	if err := (&eventstore.Dedupe{Window: time.Hour}).Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := ttl(); got != time.Hour {
+		t.Errorf("Expected a new bucket to keep outcomes for 1h, got %s", got)
+	}
+	if err := (&eventstore.Dedupe{Window: 2 * time.Hour}).Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := ttl(); got != 2*time.Hour {
+		t.Errorf("Expected a changed window to be applied to the bucket, got %s", got)
+	}
+}
@@ -0,0 +1,57 @@
+package eventstore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type bucketKey struct {
+	js     nats.JetStreamContext
+	bucket string
+}
+
+var buckets sync.Map // bucketKey -> nats.KeyValue
+
+// keyValue opens a bucket, creating it from cfg if it does not exist yet. An
+// existing bucket is used as it is.
+func keyValue(js nats.JetStreamContext, cfg *nats.KeyValueConfig) (nats.KeyValue, error) {
+	key := bucketKey{js, cfg.Bucket}
+	if kv, ok := buckets.Load(key); ok {
+		return kv.(nats.KeyValue), nil
+	}
+	kv, err := js.KeyValue(cfg.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s bucket: %w", cfg.Bucket, err)
+	}
+	buckets.Store(key, kv)
+	return kv, nil
+}
+
+// setTTL makes the entries of an existing bucket live for ttl. It returns the
+// TTL the bucket had before.
+func setTTL(js nats.JetStreamContext, bucket string, ttl time.Duration) (time.Duration, error) {
+	info, err := js.StreamInfo("KV_" + bucket)
+	if err != nil {
+		return 0, fmt.Errorf("%s bucket: %w", bucket, err)
+	}
+	cfg := info.Config
+	old := cfg.MaxAge
+	if old == ttl {
+		return old, nil
+	}
+	cfg.MaxAge = ttl
+	if cfg.Duplicates > ttl {
+		cfg.Duplicates = ttl
+	}
+	if _, err := js.UpdateStream(&cfg); err != nil {
+		return old, fmt.Errorf("set TTL of %s bucket: %w", bucket, err)
+	}
+	return old, nil
+}
@@ -0,0 +1,129 @@
+package eventstore
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"reflect"
+
+	"github.com/nats-io/nats.go"
+)
+
+// SnapshotBucket is the KV bucket holding aggregate snapshots.
+const SnapshotBucket = "snapshots"
+
+// Snapshotter is implemented by aggregates whose state Replay may store in
+// and restore from the snapshot bucket.
+type Snapshotter interface {
+	// SnapshotVersion identifies the layout of the serialized state.
+	// Snapshots taken with another version are ignored.
+	SnapshotVersion() int
+	// SnapshotEvery is how many events Replay applies on top of the latest
+	// snapshot before it stores a new one.
+	SnapshotEvery() int
+	MarshalSnapshot() ([]byte, error)
+	UnmarshalSnapshot(b []byte) error
+}
+
+type snapshot struct {
+	Version  int             `json:"version"`
+	Sequence uint64          `json:"sequence"` // Stream sequence of the last event in State
+	State    json.RawMessage `json:"state"`
+}
+
+// jsonState is the snapshot layout of MarshalState: the exported fields of
+// an aggregate next to the unexported ones it lists in Private.
+type jsonState[T, P any] struct {
+	State   T `json:"state"`
+	Private P `json:"private"`
+}
+
+// MarshalState is a MarshalSnapshot for aggregates kept as JSON. private
+// holds the unexported fields the aggregate needs back.
+func MarshalState[T, P any](agg *T, private P) ([]byte, error) {
+	return json.Marshal(jsonState[*T, P]{State: agg, Private: private})
+}
+
+// UnmarshalState is the UnmarshalSnapshot of MarshalState. It decodes into
+// fresh values and only stores them in agg and private once b decoded, so a
+// broken snapshot leaves both as they were.
+func UnmarshalState[T, P any](b []byte, agg *T, private *P) error {
+	var v jsonState[T, P]
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*agg, *private = v.State, v.Private
+	return nil
+}
+
+func snapshots(js nats.JetStreamContext) (nats.KeyValue, error) {
+	return keyValue(js, &nats.KeyValueConfig{Bucket: SnapshotBucket, History: 1})
+}
+
+func snapshotKey(aggregate, id string) string {
+	return aggregate + "." + id
+}
+
+// loadSnapshot restores s from its latest usable snapshot and returns the
+// sequence it covers, 0 if there is none.
+func loadSnapshot(js nats.JetStreamContext, s Snapshotter, aggregate, id string) uint64 {
+	kv, err := snapshots(js)
+	if err != nil {
+		log.Printf("Snapshot of %s %s: %v", aggregate, id, err)
+		return 0
+	}
+	entry, err := kv.Get(snapshotKey(aggregate, id))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return 0
+	}
+	if err != nil {
+		log.Printf("Snapshot of %s %s: %v", aggregate, id, err)
+		return 0
+	}
+	var snap snapshot
+	if err := json.Unmarshal(entry.Value(), &snap); err != nil {
+		log.Printf("Snapshot of %s %s: %v", aggregate, id, err)
+		return 0
+	}
+	if snap.Version != s.SnapshotVersion() {
+		return 0
+	}
+	// A snapshot that fails part way must not leave fields behind for the
+	// full replay, so the aggregate goes back to the state replay started
+	// from.
+	restore := keep(s)
+	if err := s.UnmarshalSnapshot(snap.State); err != nil {
+		log.Printf("Snapshot of %s %s: %v", aggregate, id, err)
+		restore()
+		return 0
+	}
+	return snap.Sequence
+}
+
+// keep copies the value s points to and returns what puts the copy back.
+func keep(s Snapshotter) func() {
+	v := reflect.ValueOf(s)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return func() {}
+	}
+	saved := reflect.New(v.Elem().Type()).Elem()
+	saved.Set(v.Elem())
+	return func() { v.Elem().Set(saved) }
+}
+
+func saveSnapshot(js nats.JetStreamContext, s Snapshotter, aggregate, id string, seq uint64) {
+	kv, err := snapshots(js)
+	if err != nil {
+		log.Printf("Snapshot of %s %s: %v", aggregate, id, err)
+		return
+	}
+	state, err := s.MarshalSnapshot()
+	if err != nil {
+		log.Printf("Snapshot of %s %s: %v", aggregate, id, err)
+		return
+	}
+	b, _ := json.Marshal(snapshot{Version: s.SnapshotVersion(), Sequence: seq, State: state})
+	if _, err := kv.Put(snapshotKey(aggregate, id), b); err != nil {
+		log.Printf("Snapshot of %s %s: %v", aggregate, id, err)
+	}
+}
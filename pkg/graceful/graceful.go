@@ -0,0 +1,122 @@
+package graceful
+
+import (
+	"context"
+	"sync"
+
+	"github.com/blinkinglight/bee/gen"
+	"github.com/nats-io/nats.go"
+)
+
+type CommandHandler interface {
+	Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error)
+}
+
+type EventApplier interface {
+	ApplyEvent(e *gen.EventEnvelope) error
+}
+
+// Group tracks in-flight command handlers and projection writes so that
+// shutdown can wait for them to finish.
+type Group struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{}
+}
+
+func (g *Group) add() {
+	g.mu.Lock()
+	g.n++
+	g.mu.Unlock()
+}
+
+func (g *Group) done() {
+	g.mu.Lock()
+	g.n--
+	if g.n == 0 && g.idle != nil {
+		close(g.idle)
+		g.idle = nil
+	}
+	g.mu.Unlock()
+}
+
+// Wait blocks until nothing tracked by the group is running or ctx expires.
+func (g *Group) Wait(ctx context.Context) error {
+	g.mu.Lock()
+	if g.n == 0 {
+		g.mu.Unlock()
+		return nil
+	}
+	if g.idle == nil {
+		g.idle = make(chan struct{})
+	}
+	idle := g.idle
+	g.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Go runs fn in a goroutine tracked by the group. It is meant for the
+// bee.Command and bee.Project loops, which return once their context is
+// cancelled and the message at hand has been handled.
+func (g *Group) Go(fn func()) {
+	g.add()
+	go func() {
+		defer g.done()
+		fn()
+	}()
+}
+
+func (g *Group) Command(h CommandHandler) CommandHandler {
+	return &trackedCommand{g: g, h: h}
+}
+
+func (g *Group) Projection(p EventApplier) EventApplier {
+	return &trackedProjection{g: g, p: p}
+}
+
+type trackedCommand struct {
+	g *Group
+	h CommandHandler
+}
+
+func (t *trackedCommand) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	t.g.add()
+	defer t.g.done()
+	return t.h.Handle(m)
+}
+
+type trackedProjection struct {
+	g *Group
+	p EventApplier
+}
+
+func (t *trackedProjection) ApplyEvent(e *gen.EventEnvelope) error {
+	t.g.add()
+	defer t.g.done()
+	return t.p.ApplyEvent(e)
+}
+
+// DrainNATS drains all subscriptions of nc, flushes pending publishes and
+// waits until the connection is closed or ctx expires.
+func DrainNATS(ctx context.Context, nc *nats.Conn) error {
+	closed := make(chan struct{})
+	nc.SetClosedHandler(func(*nats.Conn) {
+		close(closed)
+	})
+	if err := nc.Drain(); err != nil {
+		return err
+	}
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		nc.Close()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,201 @@
+package graceful_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/co"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/bee/ro"
+	"github.com/blinkinglight/gobeego/apps/shopping"
+	"github.com/blinkinglight/gobeego/pkg/appctx"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/graceful"
+	"github.com/blinkinglight/gobeego/pkg/utils"
+	"github.com/delaneyj/toolbelt/embeddednats"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func start(t *testing.T, dir string) (*embeddednats.Server, *nats.Conn, nats.JetStreamContext) {
+	t.Helper()
+	ns, err := embeddednats.New(
+		context.Background(),
+		embeddednats.WithDirectory(dir),
+		embeddednats.WithNATSServerOptions(&server.Options{
+			JetStream: true,
+			Port:      server.RANDOM_PORT,
+			StoreDir:  dir,
+		}),
+	)
+	if err != nil {
+		t.Fatalf("failed to start NATS: %v", err)
+	}
+	ns.WaitForServer()
+
+	nc, err := ns.Client()
+	if err != nil {
+		t.Fatalf("failed to create NATS client: %v", err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("Failed to get JetStream context: %v", err)
+	}
+	return ns, nc, js
+}
+
+type slowHandler struct {
+	h       graceful.CommandHandler
+	started chan struct{}
+	events  atomic.Int64
+}
+
+func (s *slowHandler) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	select {
+	case s.started <- struct{}{}:
+	default:
+	}
+	time.Sleep(200 * time.Millisecond)
+	events, err := s.h.Handle(m)
+	if err == nil {
+		// Count the events of the cart, not the stock it reserves.
+		for _, e := range events {
+			if e.AggregateType == "" {
+				s.events.Add(1)
+			}
+		}
+	}
+	return events, err
+}
+
+type eventCounter struct {
+	n int
+}
+
+func (c *eventCounter) ApplyEvent(e *gen.EventEnvelope) error {
+	c.n++
+	return nil
+}
+
+func TestNoEventsLostAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	ns, nc, js := start(t, dir)
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "EVENTS",
+		Subjects: []string{"events.>"},
+		Storage:  nats.FileStorage,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create stream: %v", err)
+	}
+
+	ctx := bee.WithNats(context.Background(), nc)
+	ctx = bee.WithJetStream(ctx, js)
+	ctx = appctx.WithJetStream(ctx, js)
+	consumeCtx, stopConsuming := context.WithCancel(ctx)
+	err = eventstore.Append(ctx, js, []*gen.EventEnvelope{{
+		AggregateId:   "item1",
+		AggregateType: "inventory",
+		EventType:     "received",
+		Payload:       utils.MustMarshal(&shopping.StockReceived{Quantity: 10}),
+	}})
+	if err != nil {
+		t.Fatalf("Failed to receive stock: %v", err)
+	}
+
+	handlers := &graceful.Group{}
+	slow := &slowHandler{h: &shopping.CartService{Ctx: ctx}, started: make(chan struct{}, 1)}
+	handlers.Go(func() {
+		bee.Command(consumeCtx, handlers.Command(slow), co.WithAggreate("cart"))
+	})
+
+	bee.PublishCommand(ctx, &gen.CommandEnvelope{
+		Aggregate:   "cart",
+		AggregateId: "cart-1",
+		CommandType: "create",
+		Payload:     []byte(`{"items":[],"total":0,"discount":0}`),
+	}, nil)
+	for range 3 {
+		bee.PublishCommand(ctx, &gen.CommandEnvelope{
+			Aggregate:   "cart",
+			AggregateId: "cart-1",
+			CommandType: "add_item",
+		}, shopping.CartItemAdd{Product: shopping.Product{ID: "item1", Name: "Test Item", Price: 10.0}})
+	}
+
+	select {
+	case <-slow.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command handler never started")
+	}
+
+	// Shut down while a command is still being handled.
+	sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stopConsuming()
+	if err := handlers.Wait(sctx); err != nil {
+		t.Fatalf("Waiting for handlers: %v", err)
+	}
+	if err := graceful.DrainNATS(sctx, nc); err != nil {
+		t.Fatalf("Draining NATS: %v", err)
+	}
+	ns.Close()
+
+	handled := slow.events.Load()
+	if handled == 0 {
+		t.Fatal("Expected the in-flight command to finish before shutdown")
+	}
+
+	ns, nc, js = start(t, dir)
+	defer func() {
+		nc.Close()
+		ns.Close()
+	}()
+	ctx = bee.WithNats(context.Background(), nc)
+	ctx = bee.WithJetStream(ctx, js)
+	ctx = appctx.WithJetStream(ctx, js)
+
+	counter := &eventCounter{}
+	bee.Replay(ctx, counter, ro.WithAggreate("cart"), ro.WithAggregateID("cart-1"))
+	if int64(counter.n) != handled {
+		t.Errorf("Expected %d events after restart, got %d", handled, counter.n)
+	}
+}
+
+type blockingHandler struct {
+	release chan struct{}
+}
+
+func (b *blockingHandler) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	<-b.release
+	return nil, nil
+}
+
+func TestGroupWait(t *testing.T) {
+	handlers := &graceful.Group{}
+	h := &blockingHandler{release: make(chan struct{})}
+	cmd := handlers.Command(h)
+
+	done := make(chan struct{})
+	go func() {
+		cmd.Handle(&gen.CommandEnvelope{})
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := handlers.Wait(ctx); err == nil {
+		t.Fatal("Expected Wait to time out while a handler is running")
+	}
+
+	close(h.release)
+	<-done
+	if err := handlers.Wait(context.Background()); err != nil {
+		t.Errorf("Expected Wait to return once idle, got %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package projection
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/blinkinglight/gobeego/pkg/rwdb"
+	"github.com/nats-io/nats.go"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// ShadowSuffix is appended to table names during a blue/green rebuild.
+const ShadowSuffix = "_shadow"
+
+// Definition describes a projection the Manager can run and rebuild.
+type Definition struct {
+	Name    string
+	Subject string
+	Models  []any // Read model tables owned by the projection
+	Handler Handler
+}
+
+type runner struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Manager runs the registered projections and rebuilds them on demand.
+type Manager struct {
+	JS nats.JetStreamContext
+	DB *rwdb.DB
+
+	mu      sync.Mutex
+	ctx     context.Context
+	defs    map[string]Definition
+	running map[string]*runner
+	busy    map[string]bool
+}
+
+func (m *Manager) Register(def Definition) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.defs == nil {
+		m.defs = map[string]Definition{}
+	}
+	m.defs[def.Name] = def
+}
+
+func (m *Manager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.defs))
+	for name := range m.defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run starts every registered projection and blocks until ctx is cancelled
+// and all of them have stopped.
+func (m *Manager) Run(ctx context.Context) {
+	m.mu.Lock()
+	m.ctx = ctx
+	m.running = map[string]*runner{}
+	for name := range m.defs {
+		m.start(name)
+	}
+	m.mu.Unlock()
+
+	<-ctx.Done()
+
+	m.mu.Lock()
+	runners := make([]*runner, 0, len(m.running))
+	for _, r := range m.running {
+		runners = append(runners, r)
+	}
+	m.mu.Unlock()
+	for _, r := range runners {
+		<-r.done
+	}
+}
+
+// start launches the live runner of a projection. m.mu must be held.
+func (m *Manager) start(name string) {
+	if m.ctx == nil || m.ctx.Err() != nil {
+		return
+	}
+	def := m.defs[name]
+	ctx, cancel := context.WithCancel(m.ctx)
+	r := &runner{cancel: cancel, done: make(chan struct{})}
+	m.running[name] = r
+	go func() {
+		defer close(r.done)
+		if err := Run(ctx, m.JS, m.DB, def.Name, def.Subject, def.Handler); err != nil {
+			log.Printf("Projection %s stopped: %v", def.Name, err)
+		}
+	}()
+}
+
+// stop cancels the live runner of a projection and waits for its current
+// transaction to finish. m.mu must be held.
+func (m *Manager) stop(name string) {
+	if r, ok := m.running[name]; ok {
+		r.cancel()
+		<-r.done
+		delete(m.running, name)
+	}
+}
+
+// Rebuild drops the tables of a projection, resets its checkpoint and
+// replays the stream into it. With shadow set the replay goes into shadow
+// tables while the live projection keeps serving, and the shadow tables
+// replace the live ones in a single transaction once they have caught up.
+func (m *Manager) Rebuild(ctx context.Context, name string, shadow bool, progress func(Progress)) error {
+	m.mu.Lock()
+	def, ok := m.defs[name]
+	if ok && m.busy[name] {
+		m.mu.Unlock()
+		return fmt.Errorf("projection %s is already being rebuilt", name)
+	}
+	if m.busy == nil {
+		m.busy = map[string]bool{}
+	}
+	m.busy[name] = true
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown projection: %s", name)
+	}
+	defer func() {
+		m.mu.Lock()
+		delete(m.busy, name)
+		m.mu.Unlock()
+	}()
+
+	if shadow {
+		return m.rebuildShadow(ctx, def, progress)
+	}
+	return m.rebuildInPlace(ctx, def, progress)
+}
+
+func (m *Manager) rebuildInPlace(ctx context.Context, def Definition, progress func(Progress)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stop(def.Name)
+	defer m.start(def.Name)
+
+	report(progress, Progress{Name: def.Name, Phase: "resetting"})
+	err := m.DB.WriteTX(ctx, func(tx *rwdb.Tx) error {
+		if err := tx.Migrator().DropTable(def.Models...); err != nil {
+			return err
+		}
+		if err := tx.AutoMigrate(def.Models...); err != nil {
+			return err
+		}
+		return tx.Where("name = ?", def.Name).Delete(&Checkpoint{}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("reset %s: %w", def.Name, err)
+	}
+
+	seq, err := CatchUp(ctx, m.JS, m.DB, def.Name, def.Subject, def.Handler, progress)
+	if err != nil {
+		return err
+	}
+	report(progress, Progress{Name: def.Name, Phase: "done", Sequence: seq})
+	return nil
+}
+
+type shadowNamer struct {
+	schema.NamingStrategy
+}
+
+func (n shadowNamer) TableName(table string) string {
+	return n.NamingStrategy.TableName(table) + ShadowSuffix
+}
+
+func (m *Manager) rebuildShadow(ctx context.Context, def Definition, progress func(Progress)) error {
+	shadowDB, err := m.DB.WithNamer(shadowNamer{})
+	if err != nil {
+		return err
+	}
+	shadowName := def.Name + ShadowSuffix
+
+	report(progress, Progress{Name: def.Name, Phase: "preparing shadow tables"})
+	err = shadowDB.WriteTX(ctx, func(tx *rwdb.Tx) error {
+		if err := tx.Migrator().DropTable(def.Models...); err != nil {
+			return err
+		}
+		if err := tx.AutoMigrate(def.Models...); err != nil {
+			return err
+		}
+		return tx.Where("name = ?", shadowName).Delete(&Checkpoint{}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("prepare shadow tables for %s: %w", def.Name, err)
+	}
+
+	// Replay while the live projection keeps serving reads.
+	if _, err := CatchUp(ctx, m.JS, shadowDB, shadowName, def.Subject, def.Handler, progress); err != nil {
+		return err
+	}
+
+	// Pause the live projection, apply what arrived meanwhile and swap.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stop(def.Name)
+	defer m.start(def.Name)
+
+	report(progress, Progress{Name: def.Name, Phase: "catching up"})
+	seq, err := CatchUp(ctx, m.JS, shadowDB, shadowName, def.Subject, def.Handler, progress)
+	if err != nil {
+		return err
+	}
+
+	err = m.DB.WriteTX(ctx, func(tx *rwdb.Tx) error {
+		for _, model := range def.Models {
+			live, err := tableName(tx.DB, model)
+			if err != nil {
+				return err
+			}
+			if err := tx.Migrator().DropTable(live); err != nil {
+				return err
+			}
+			if err := tx.Migrator().RenameTable(live+ShadowSuffix, live); err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("name = ?", shadowName).Delete(&Checkpoint{}).Error; err != nil {
+			return err
+		}
+		return Save(tx, def.Name, seq)
+	})
+	if err != nil {
+		return fmt.Errorf("swap shadow tables for %s: %w", def.Name, err)
+	}
+	report(progress, Progress{Name: def.Name, Phase: "swapped", Sequence: seq})
+	return nil
+}
+
+func tableName(db *gorm.DB, model any) (string, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return "", err
+	}
+	return stmt.Schema.Table, nil
+}
@@ -0,0 +1,160 @@
+package projection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/rwdb"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Checkpoint is the last EVENTS stream sequence a projection has applied.
+type Checkpoint struct {
+	Name     string `gorm:"primaryKey"`
+	Sequence uint64
+}
+
+func (Checkpoint) TableName() string {
+	return "projection_checkpoints"
+}
+
+// Handler applies an event to a read model inside the transaction that also
+// stores the checkpoint.
+type Handler interface {
+	ApplyEventTx(tx *rwdb.Tx, e *gen.EventEnvelope) error
+}
+
+// Subject is the filter for every event of an aggregate.
+func Subject(aggregate string) string {
+	return fmt.Sprintf("events.%s.>", aggregate)
+}
+
+// Load returns the stored sequence of a projection, 0 if it never ran.
+func Load(ctx context.Context, db *rwdb.DB, name string) (uint64, error) {
+	var cp Checkpoint
+	err := db.ReadTX(ctx, func(tx *rwdb.Tx) error {
+		return tx.Where("name = ?", name).First(&cp).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	return cp.Sequence, err
+}
+
+// Save stores the sequence of a projection within tx.
+func Save(tx *rwdb.Tx, name string, seq uint64) error {
+	return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&Checkpoint{Name: name, Sequence: seq}).Error
+}
+
+// Progress describes how far a projection is behind the stream.
+type Progress struct {
+	Name     string `json:"name"`
+	Phase    string `json:"phase"`
+	Sequence uint64 `json:"sequence"` // Last applied stream sequence
+	Applied  int    `json:"applied"`  // Events applied in this run
+	Pending  uint64 `json:"pending"`  // Matching events still to apply
+}
+
+func (p Progress) String() string {
+	return fmt.Sprintf("%s %s: sequence=%d applied=%d pending=%d", p.Name, p.Phase, p.Sequence, p.Applied, p.Pending)
+}
+
+// Run feeds every event matching subject to h, starting right after the
+// stored checkpoint. The read model change and the new checkpoint are
+// written in one transaction, so events are applied exactly once even if
+// the process dies in between. Run returns when ctx is cancelled or an
+// event cannot be applied.
+func Run(ctx context.Context, js nats.JetStreamContext, db *rwdb.DB, name, subject string, h Handler) error {
+	_, err := consume(ctx, js, db, name, subject, h, false, nil)
+	return err
+}
+
+// CatchUp is like Run but returns once every event stored in the stream
+// when it was called has been applied, reporting progress along the way.
+func CatchUp(ctx context.Context, js nats.JetStreamContext, db *rwdb.DB, name, subject string, h Handler, progress func(Progress)) (uint64, error) {
+	return consume(ctx, js, db, name, subject, h, true, progress)
+}
+
+func consume(ctx context.Context, js nats.JetStreamContext, db *rwdb.DB, name, subject string, h Handler, untilCaughtUp bool, progress func(Progress)) (uint64, error) {
+	seq, err := Load(ctx, db, name)
+	if err != nil {
+		return 0, fmt.Errorf("load checkpoint %s: %w", name, err)
+	}
+
+	start := nats.DeliverAll()
+	if seq > 0 {
+		start = nats.StartSequence(seq + 1)
+	}
+	sub, err := js.SubscribeSync(subject, nats.OrderedConsumer(), start)
+	if err != nil {
+		return seq, fmt.Errorf("subscribe %s: %w", subject, err)
+	}
+	defer sub.Unsubscribe()
+
+	if untilCaughtUp {
+		info, err := sub.ConsumerInfo()
+		if err != nil {
+			return seq, fmt.Errorf("consumer info %s: %w", name, err)
+		}
+		if info.NumPending == 0 && info.Delivered.Stream <= seq {
+			report(progress, Progress{Name: name, Phase: "caught up", Sequence: seq})
+			return seq, nil
+		}
+	}
+
+	// Writes use a context that outlives ctx so a shutdown never aborts a
+	// transaction halfway.
+	wctx := context.WithoutCancel(ctx)
+	applied := 0
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil && !untilCaughtUp {
+				return seq, nil
+			}
+			return seq, fmt.Errorf("next event %s: %w", name, err)
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return seq, fmt.Errorf("event metadata: %w", err)
+		}
+		if meta.Sequence.Stream > seq {
+			var e gen.EventEnvelope
+			if err := proto.Unmarshal(msg.Data, &e); err != nil {
+				return seq, fmt.Errorf("unmarshal event %d: %w", meta.Sequence.Stream, err)
+			}
+			err = db.WriteTX(wctx, func(tx *rwdb.Tx) error {
+				if err := h.ApplyEventTx(tx, &e); err != nil {
+					return err
+				}
+				return Save(tx, name, meta.Sequence.Stream)
+			})
+			if err != nil {
+				return seq, fmt.Errorf("apply event %d to %s: %w", meta.Sequence.Stream, name, err)
+			}
+			seq = meta.Sequence.Stream
+			applied++
+		}
+
+		if !untilCaughtUp {
+			continue
+		}
+		if applied%100 == 0 || meta.NumPending == 0 {
+			report(progress, Progress{Name: name, Phase: "replaying", Sequence: seq, Applied: applied, Pending: meta.NumPending})
+		}
+		if meta.NumPending == 0 {
+			return seq, nil
+		}
+	}
+}
+
+func report(progress func(Progress), p Progress) {
+	if progress != nil {
+		progress(p)
+	}
+}
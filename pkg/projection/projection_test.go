@@ -0,0 +1,211 @@
+package projection_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/pkg/projection"
+	"github.com/blinkinglight/gobeego/pkg/rwdb"
+	"github.com/delaneyj/toolbelt/embeddednats"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/proto"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type applied struct {
+	ID    string `gorm:"primaryKey"`
+	Count int
+}
+
+// counter deliberately is not idempotent, so a replayed event shows up as a
+// count above one.
+type counter struct{}
+
+func (counter) ApplyEventTx(tx *rwdb.Tx, e *gen.EventEnvelope) error {
+	return tx.Exec("INSERT INTO applieds (id, count) VALUES (?, 1) ON CONFLICT(id) DO UPDATE SET count = count + 1", e.AggregateId).Error
+}
+
+type rebuilt struct {
+	ID     string `gorm:"primaryKey"`
+	Events int
+}
+
+// upsert goes through the gorm model so rebuilds can redirect it into
+// shadow tables.
+type upsert struct{}
+
+func (upsert) ApplyEventTx(tx *rwdb.Tx, e *gen.EventEnvelope) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.Assignments(map[string]any{"events": gorm.Expr("events + 1")}),
+	}).Create(&rebuilt{ID: e.AggregateId, Events: 1}).Error
+}
+
+func publish(t *testing.T, js nats.JetStreamContext, id string) {
+	t.Helper()
+	b, err := proto.Marshal(&gen.EventEnvelope{AggregateType: "product", AggregateId: id, EventType: "created"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.Publish(fmt.Sprintf("events.product.%s.created", id), b); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+}
+
+func waitFor(t *testing.T, db *rwdb.DB, name string, seq uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		got, err := projection.Load(context.Background(), db, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == seq {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("projection never reached sequence %d", seq)
+}
+
+func setup(t *testing.T) (nats.JetStreamContext, *rwdb.DB) {
+	t.Helper()
+	dir := t.TempDir()
+	ns, err := embeddednats.New(context.Background(),
+		embeddednats.WithDirectory(dir),
+		embeddednats.WithNATSServerOptions(&server.Options{
+			JetStream: true,
+			Port:      server.RANDOM_PORT,
+			StoreDir:  dir,
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ns.Close() })
+	ns.WaitForServer()
+	nc, err := ns.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "EVENTS", Subjects: []string{"events.>"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	db := rwdb.Open(filepath.Join(dir, "test.db"))
+	t.Cleanup(func() { db.Close() })
+	err = db.WriteTX(context.Background(), func(tx *rwdb.Tx) error {
+		return tx.AutoMigrate(&applied{}, &rebuilt{}, &projection.Checkpoint{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js, db
+}
+
+func TestRunResumesFromCheckpoint(t *testing.T) {
+	js, db := setup(t)
+
+	for _, id := range []string{"p1", "p2", "p3"} {
+		publish(t, js, id)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- projection.Run(ctx, js, db, "test", projection.Subject("product"), counter{}) }()
+	waitFor(t, db, "test", 3)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	publish(t, js, "p4")
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go projection.Run(ctx, js, db, "test", projection.Subject("product"), counter{})
+	waitFor(t, db, "test", 4)
+
+	var rows []applied
+	err := db.ReadTX(context.Background(), func(tx *rwdb.Tx) error {
+		return tx.Order("id").Find(&rows).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("Expected 4 rows, got %d", len(rows))
+	}
+	for _, r := range rows {
+		if r.Count != 1 {
+			t.Errorf("Expected %s to be applied once, got %d", r.ID, r.Count)
+		}
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	for _, shadow := range []bool{false, true} {
+		t.Run(fmt.Sprintf("shadow=%t", shadow), func(t *testing.T) {
+			js, db := setup(t)
+			for _, id := range []string{"p1", "p2", "p3"} {
+				publish(t, js, id)
+			}
+
+			m := &projection.Manager{JS: js, DB: db}
+			m.Register(projection.Definition{
+				Name:    "rebuilt",
+				Subject: projection.Subject("product"),
+				Models:  []any{&rebuilt{}},
+				Handler: upsert{},
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go m.Run(ctx)
+			waitFor(t, db, "rebuilt", 3)
+
+			var phases []string
+			err := m.Rebuild(context.Background(), "rebuilt", shadow, func(p projection.Progress) {
+				phases = append(phases, p.Phase)
+			})
+			if err != nil {
+				t.Fatalf("Rebuild: %v", err)
+			}
+			if len(phases) == 0 {
+				t.Errorf("Expected progress to be reported")
+			}
+
+			publish(t, js, "p4")
+			waitFor(t, db, "rebuilt", 4)
+
+			var rows []rebuilt
+			err = db.ReadTX(context.Background(), func(tx *rwdb.Tx) error {
+				return tx.Order("id").Find(&rows).Error
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 4 {
+				t.Fatalf("Expected 4 rows, got %d", len(rows))
+			}
+			for _, r := range rows {
+				if r.Events != 1 {
+					t.Errorf("Expected %s to be applied once after rebuild, got %d", r.ID, r.Events)
+				}
+			}
+			if db.W.Migrator().HasTable("rebuilts" + projection.ShadowSuffix) {
+				t.Errorf("Expected shadow table to be swapped in")
+			}
+		})
+	}
+}
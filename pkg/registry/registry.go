@@ -0,0 +1,204 @@
+// Package registry declares the aggregates of an app together with their
+// command and event types, and registers them with bee. Apps also declare
+// which commands their routes and workers publish and which events their
+// handlers emit, so that Check can report anything that is sent but cannot
+// be decoded before the site starts serving.
+package registry
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/blinkinglight/bee"
+)
+
+// Kind tells commands and events apart.
+type Kind string
+
+const (
+	Command Kind = "command"
+	Event   Kind = "event"
+)
+
+// Type is a command or event type and the struct its payload decodes into.
+type Type struct {
+	Name   string
+	Struct reflect.Type
+
+	register func(kind Kind, aggregate string)
+}
+
+// Of declares the command or event type name with payload T.
+func Of[T any](name string) Type {
+	return Type{
+		Name:   name,
+		Struct: reflect.TypeFor[T](),
+		register: func(kind Kind, aggregate string) {
+			if kind == Command {
+				bee.RegisterCommand[T](aggregate, name)
+			} else {
+				bee.RegisterEvent[T](aggregate, name)
+			}
+		},
+	}
+}
+
+// Each declares several command or event types with the same payload T.
+func Each[T any](names ...string) []Type {
+	types := make([]Type, len(names))
+	for i, name := range names {
+		types[i] = Of[T](name)
+	}
+	return types
+}
+
+// Aggregate lists the command and event types of one aggregate.
+type Aggregate struct {
+	Name     string
+	Commands []Type
+	Events   []Type
+}
+
+// Use declares commands or events of an aggregate that some code sends.
+type Use struct {
+	By        string // The handler, route or worker sending them, for the report
+	Kind      Kind
+	Aggregate string
+	Types     []string
+}
+
+// Emits declares the events a handler can emit on aggregate.
+func Emits(by, aggregate string, eventTypes ...string) Use {
+	return Use{By: by, Kind: Event, Aggregate: aggregate, Types: eventTypes}
+}
+
+// Publishes declares the commands a route or worker publishes to aggregate.
+func Publishes(by, aggregate string, commandTypes ...string) Use {
+	return Use{By: by, Kind: Command, Aggregate: aggregate, Types: commandTypes}
+}
+
+// App is the declaration of one app: the aggregates it owns and what it
+// sends, to its own aggregates or to those of other apps.
+type App struct {
+	Name       string
+	Aggregates []Aggregate
+	Uses       []Use
+}
+
+type key struct {
+	kind      Kind
+	aggregate string
+	name      string
+}
+
+func (k key) String() string {
+	return fmt.Sprintf("%s %s.%s", k.kind, k.aggregate, k.name)
+}
+
+// Registry collects the declarations of every app.
+type Registry struct {
+	mu   sync.Mutex
+	apps []App
+}
+
+var defaultRegistry = &Registry{}
+
+// Register registers the types of app with bee and keeps its declaration
+// for Check. Apps call it from init.
+func Register(app App) {
+	defaultRegistry.Register(app)
+}
+
+// Check reports the problems in the declarations of every registered app.
+func Check() error {
+	return defaultRegistry.Check()
+}
+
+// Register registers the types of app with bee and keeps its declaration.
+func (r *Registry) Register(app App) {
+	for _, agg := range app.Aggregates {
+		for _, t := range agg.Commands {
+			if t.register != nil {
+				t.register(Command, agg.Name)
+			}
+		}
+		for _, t := range agg.Events {
+			if t.register != nil {
+				t.register(Event, agg.Name)
+			}
+		}
+	}
+	r.mu.Lock()
+	r.apps = append(r.apps, app)
+	r.mu.Unlock()
+}
+
+// Check returns an error listing every command or event that is published
+// or emitted but not registered, every type registered twice and every type
+// without a struct to decode into. It returns nil if there are none.
+func (r *Registry) Check() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var problems []string
+	owners := map[key]string{}
+	byName := map[string][]string{} // Aggregates registering a kind and name
+	for _, app := range r.apps {
+		for _, agg := range app.Aggregates {
+			if agg.Name == "" {
+				problems = append(problems, fmt.Sprintf("%s: aggregate without a name", app.Name))
+				continue
+			}
+			for kind, types := range map[Kind][]Type{Command: agg.Commands, Event: agg.Events} {
+				for _, t := range types {
+					k := key{kind, agg.Name, t.Name}
+					switch {
+					case t.Name == "":
+						problems = append(problems, fmt.Sprintf("%s: %s of %s without a name", app.Name, kind, agg.Name))
+						continue
+					case t.register == nil:
+						problems = append(problems, fmt.Sprintf("%s: %s is not declared with registry.Of", app.Name, k))
+					case t.Struct.Kind() != reflect.Struct:
+						problems = append(problems, fmt.Sprintf("%s: %s decodes into %s, which is not a struct", app.Name, k, t.Struct))
+					}
+					if owner, ok := owners[k]; ok {
+						problems = append(problems, fmt.Sprintf("%s: %s is already registered by %s", app.Name, k, owner))
+						continue
+					}
+					owners[k] = app.Name
+					byName[string(kind)+" "+t.Name] = append(byName[string(kind)+" "+t.Name], agg.Name)
+				}
+			}
+		}
+	}
+
+	for _, app := range r.apps {
+		for _, use := range app.Uses {
+			verb := "published"
+			if use.Kind == Event {
+				verb = "emitted"
+			}
+			for _, name := range use.Types {
+				k := key{use.Kind, use.Aggregate, name}
+				if _, ok := owners[k]; ok {
+					continue
+				}
+				problem := fmt.Sprintf("%s: %s is not registered, %s by %s", app.Name, k, verb, use.By)
+				if elsewhere := byName[string(use.Kind)+" "+name]; len(elsewhere) > 0 {
+					slices.Sort(elsewhere)
+					problem += fmt.Sprintf(" (%s is registered on %s)", name, strings.Join(elsewhere, ", "))
+				}
+				problems = append(problems, problem)
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	slices.Sort(problems)
+	return fmt.Errorf("registration problems:\n  %s", strings.Join(problems, "\n  "))
+}
@@ -0,0 +1,65 @@
+package registry_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/blinkinglight/gobeego/pkg/registry"
+)
+
+type opened struct {
+	ID string `json:"id"`
+}
+
+type open struct {
+	ID string `json:"id"`
+}
+
+func TestCheck(t *testing.T) {
+	r := &registry.Registry{}
+	r.Register(registry.App{
+		Name: "bank",
+		Aggregates: []registry.Aggregate{{
+			Name:     "payments",
+			Commands: []registry.Type{registry.Of[open]("open")},
+			Events:   []registry.Type{registry.Of[opened]("opened")},
+		}},
+		Uses: []registry.Use{
+			registry.Emits("PaymentService", "payments", "opened"),
+			registry.Publishes("routes", "payments", "open"),
+		},
+	})
+	if err := r.Check(); err != nil {
+		t.Fatalf("Expected the declarations to check out, got %v", err)
+	}
+
+	r.Register(registry.App{
+		Name: "site",
+		Aggregates: []registry.Aggregate{{
+			Name:   "accounts",
+			Events: append(registry.Each[opened]("opened"), registry.Of[string]("renamed")),
+		}, {
+			Name:     "payments",
+			Commands: []registry.Type{registry.Of[open]("open"), {Name: "close"}},
+		}},
+		Uses: []registry.Use{
+			registry.Emits("AccountService", "payments", "closed", "opened"),
+			registry.Publishes("routes", "accounts", "open"),
+		},
+	})
+	err := r.Check()
+	if err == nil {
+		t.Fatal("Expected the second app to fail the check")
+	}
+	want := []string{
+		"registration problems:",
+		"site: command accounts.open is not registered, published by routes (open is registered on payments)",
+		"site: command payments.close is not declared with registry.Of",
+		"site: command payments.open is already registered by bank",
+		"site: event accounts.renamed decodes into string, which is not a struct",
+		"site: event payments.closed is not registered, emitted by AccountService",
+	}
+	if got := strings.Split(err.Error(), "\n  "); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected report\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
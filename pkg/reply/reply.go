@@ -0,0 +1,172 @@
+package reply
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/nats-io/nats.go"
+)
+
+// MetadataKey is the command metadata entry holding the reply subject.
+const MetadataKey = "reply_to"
+
+// DefaultTimeout applies when the context passed to Send has no deadline.
+const DefaultTimeout = 5 * time.Second
+
+var ErrTimeout = errors.New("timed out waiting for command result")
+
+// ErrRefused marks the errors of handlers that refused a command on its
+// merits, e.g. for insufficient funds, rather than failing to handle it. A
+// refused command is refused again when repeated; any other error may go
+// away, and the command may even have taken effect.
+var ErrRefused = errors.New("command refused")
+
+// Refuse marks err as a refusal, see ErrRefused. It returns nil for nil.
+func Refuse(err error) error {
+	if err == nil || errors.Is(err, ErrRefused) {
+		return err
+	}
+	return &refusal{err}
+}
+
+type refusal struct {
+	error
+}
+
+func (r *refusal) Unwrap() error {
+	return r.error
+}
+
+func (r *refusal) Is(target error) bool {
+	return target == ErrRefused
+}
+
+// Rejected is returned by Send when the command handler returned an error.
+// It matches ErrRefused if the handler refused the command.
+type Rejected struct {
+	Reason  string
+	Refused bool
+}
+
+func (r *Rejected) Error() string {
+	return r.Reason
+}
+
+func (r *Rejected) Is(target error) bool {
+	return target == ErrRefused && r.Refused
+}
+
+type Event struct {
+	AggregateID string `json:"aggregate_id"`
+	EventType   string `json:"event_type"`
+	Payload     []byte `json:"payload"`
+}
+
+// Result is the outcome of a command as sent back to the publisher.
+type Result struct {
+	Events  []Event `json:"events,omitempty"`
+	Error   string  `json:"error,omitempty"`
+	Refused bool    `json:"refused,omitempty"`
+}
+
+type CommandHandler interface {
+	Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error)
+}
+
+// Handler wraps h so the outcome of every command that asks for a reply is
+// published to its reply subject.
+func Handler(nc *nats.Conn, h CommandHandler) CommandHandler {
+	return &replying{nc: nc, h: h}
+}
+
+type replying struct {
+	nc *nats.Conn
+	h  CommandHandler
+}
+
+func (r *replying) Handle(m *gen.CommandEnvelope) ([]*gen.EventEnvelope, error) {
+	events, err := r.h.Handle(m)
+	Publish(r.nc, m, events, err)
+	return events, err
+}
+
+// Publisher returns a callback that publishes command outcomes like Handler
+// does, for handlers that report their result themselves.
+func Publisher(nc *nats.Conn) func(m *gen.CommandEnvelope, events []*gen.EventEnvelope, err error) {
+	return func(m *gen.CommandEnvelope, events []*gen.EventEnvelope, err error) {
+		Publish(nc, m, events, err)
+	}
+}
+
+// Publish sends the outcome of m to its reply subject, if it has one.
+func Publish(nc *nats.Conn, m *gen.CommandEnvelope, events []*gen.EventEnvelope, err error) {
+	subject := m.Metadata[MetadataKey]
+	if subject == "" {
+		return
+	}
+	res := Result{}
+	if err != nil {
+		res.Error = err.Error()
+		res.Refused = errors.Is(err, ErrRefused)
+	} else {
+		for _, e := range events {
+			id := e.AggregateId
+			if id == "" {
+				id = m.AggregateId
+			}
+			res.Events = append(res.Events, Event{AggregateID: id, EventType: e.EventType, Payload: e.Payload})
+		}
+	}
+	b, _ := json.Marshal(res)
+	if perr := nc.Publish(subject, b); perr != nil {
+		log.Printf("Failed to publish result of %s %s: %v", m.Aggregate, m.CommandType, perr)
+	}
+}
+
+// Send publishes cmd and waits for its handler's outcome. It returns the
+// emitted events, a *Rejected error when the handler returned an error or
+// ErrTimeout when no answer arrived in time.
+func Send(ctx context.Context, nc *nats.Conn, cmd *gen.CommandEnvelope, payload any) ([]Event, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+	}
+
+	inbox := nats.NewInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, fmt.Errorf("subscribe to reply: %w", err)
+	}
+	defer sub.Unsubscribe()
+
+	if cmd.Metadata == nil {
+		cmd.Metadata = map[string]string{}
+	}
+	cmd.Metadata[MetadataKey] = inbox
+	if err := bee.PublishCommand(ctx, cmd, payload); err != nil {
+		return nil, fmt.Errorf("publish command: %w", err)
+	}
+
+	msg, err := sub.NextMsgWithContext(ctx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, ErrTimeout
+		}
+		return nil, err
+	}
+	var res Result
+	if err := json.Unmarshal(msg.Data, &res); err != nil {
+		return nil, fmt.Errorf("unmarshal result: %w", err)
+	}
+	if res.Error != "" {
+		return nil, &Rejected{Reason: res.Error, Refused: res.Refused}
+	}
+	return res.Events, nil
+}
@@ -0,0 +1,132 @@
+package reply_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/blinkinglight/bee"
+	"github.com/blinkinglight/bee/co"
+	"github.com/blinkinglight/bee/gen"
+	"github.com/blinkinglight/gobeego/apps/shopping"
+	"github.com/blinkinglight/gobeego/pkg/appctx"
+	"github.com/blinkinglight/gobeego/pkg/eventstore"
+	"github.com/blinkinglight/gobeego/pkg/reply"
+	"github.com/blinkinglight/gobeego/pkg/utils"
+	"github.com/delaneyj/toolbelt/embeddednats"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestSend(t *testing.T) {
+	ns, err := embeddednats.New(context.Background(),
+		embeddednats.WithDirectory(t.TempDir()),
+		embeddednats.WithNATSServerOptions(&server.Options{
+			JetStream: true,
+			Port:      server.RANDOM_PORT,
+			StoreDir:  t.TempDir(),
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	ns.WaitForServer()
+	nc, err := ns.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	js.AddStream(&nats.StreamConfig{
+		Name:     "events",
+		Subjects: []string{"events.>"},
+	})
+
+	ctx := bee.WithNats(t.Context(), nc)
+	ctx = bee.WithJetStream(ctx, js)
+	ctx = appctx.WithJetStream(ctx, js)
+	err = eventstore.Append(ctx, js, []*gen.EventEnvelope{{
+		AggregateId:   "item1",
+		AggregateType: "inventory",
+		EventType:     "received",
+		Payload:       utils.MustMarshal(&shopping.StockReceived{Quantity: 1}),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go bee.Command(ctx, reply.Handler(nc, &shopping.CartService{Ctx: ctx}), co.WithAggreate("cart"))
+	time.Sleep(100 * time.Millisecond)
+
+	addItem := func() error {
+		_, err := reply.Send(ctx, nc, &gen.CommandEnvelope{
+			Aggregate:   "cart",
+			AggregateId: "cart-1",
+			CommandType: "add_item",
+		}, shopping.CartItemAdd{Product: shopping.Product{ID: "item1", Name: "Test Item", Price: 10.0}})
+		return err
+	}
+
+	var rejected *reply.Rejected
+	if err := addItem(); !errors.As(err, &rejected) || !errors.Is(err, reply.ErrRefused) {
+		t.Fatalf("Expected adding to a missing cart to be refused, got %v", err)
+	}
+
+	events, err := reply.Send(ctx, nc, &gen.CommandEnvelope{
+		Aggregate:   "cart",
+		AggregateId: "cart-1",
+		CommandType: "create",
+		Payload:     []byte(`{"items":[],"total":0,"discount":0}`),
+	}, nil)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if len(events) != 1 || events[0].EventType != "created" {
+		t.Errorf("Expected a created event, got %+v", events)
+	}
+
+	if err := addItem(); err != nil {
+		t.Errorf("Expected add_item to succeed, got %v", err)
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	ns, err := embeddednats.New(context.Background(),
+		embeddednats.WithDirectory(t.TempDir()),
+		embeddednats.WithNATSServerOptions(&server.Options{
+			JetStream: true,
+			Port:      server.RANDOM_PORT,
+			StoreDir:  t.TempDir(),
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	ns.WaitForServer()
+	nc, err := ns.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := bee.WithNats(t.Context(), nc)
+	ctx = bee.WithJetStream(ctx, js)
+	ctx = appctx.WithJetStream(ctx, js)
+	tctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+
+	// Nobody handles "nobody" commands.
+	_, err = reply.Send(tctx, nc, &gen.CommandEnvelope{Aggregate: "nobody", AggregateId: "1", CommandType: "create"}, nil)
+	if !errors.Is(err, reply.ErrTimeout) {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package rwdb
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
 	"runtime"
@@ -10,6 +11,7 @@ import (
 	"github.com/glebarez/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
 )
 
 type DB struct {
@@ -35,6 +37,49 @@ func (db *DB) WriteTX(ctx context.Context, fn cbfn) error {
 	})
 }
 
+// Close closes both the read and the write connection pools.
+func (db *DB) Close() error {
+	rdb, err := db.R.DB()
+	if err != nil {
+		return err
+	}
+	wdb, err := db.W.DB()
+	if err != nil {
+		return err
+	}
+	return errors.Join(wdb.Close(), rdb.Close())
+}
+
+// WithNamer returns a DB that shares the connection pools of db but
+// resolves model table names through namer.
+func (db *DB) WithNamer(namer schema.Namer) (*DB, error) {
+	rdb, err := db.R.DB()
+	if err != nil {
+		return nil, err
+	}
+	wdb, err := db.W.DB()
+	if err != nil {
+		return nil, err
+	}
+	r, err := gorm.Open(&sqlite.Dialector{Conn: rdb}, &gorm.Config{
+		PrepareStmt:    true,
+		Logger:         db.R.Logger,
+		NamingStrategy: namer,
+	})
+	if err != nil {
+		return nil, err
+	}
+	w, err := gorm.Open(&sqlite.Dialector{Conn: wdb}, &gorm.Config{
+		PrepareStmt:    true,
+		Logger:         db.W.Logger,
+		NamingStrategy: namer,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DB{R: r, W: w}, nil
+}
+
 func Open(file string) *DB {
 	newLogger := logger.New(
 		log.New(os.Stdout, "\r\n", log.LstdFlags), // io writer
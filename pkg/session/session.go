@@ -0,0 +1,159 @@
+package session
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ituoga/appcontext"
+)
+
+const CookieName = "gobeego_cart"
+
+// CustomerCookieName is the cookie of the customer ID, which unlike the cart
+// ID stays the same across checkouts.
+const CustomerCookieName = "gobeego_customer"
+
+// MaxAge is how long a browser keeps its cart and customer cookies.
+const MaxAge = 30 * 24 * time.Hour
+
+var (
+	cartKey     = appcontext.Key[string]("cart_id")
+	customerKey = appcontext.Key[string]("customer_id")
+)
+
+// Manager hands out cart and customer IDs to browsers through HMAC-signed
+// cookies.
+type Manager struct {
+	secret []byte
+}
+
+func New(secret []byte) *Manager {
+	return &Manager{secret: secret}
+}
+
+// LoadOrCreateSecret reads the signing key from path, creating a random one
+// when the file does not exist yet, so cookies survive restarts.
+func LoadOrCreateSecret(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		if len(b) < 32 {
+			return nil, fmt.Errorf("session secret %s is too short", path)
+		}
+		return b, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read session secret: %w", err)
+	}
+	b = make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		return nil, fmt.Errorf("write session secret: %w", err)
+	}
+	return b, nil
+}
+
+func (m *Manager) sign(id string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns the cart ID stored in a signed cookie value.
+func (m *Manager) Verify(value string) (string, bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i <= 0 {
+		return "", false
+	}
+	id := value[:i]
+	if !hmac.Equal([]byte(m.sign(id)), []byte(value)) {
+		return "", false
+	}
+	return id, true
+}
+
+// Middleware makes sure every request carries a cart ID and a customer ID,
+// issuing a new cookie when the browser has none or its signature does not
+// match.
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := m.read(r, CookieName)
+		if id == "" {
+			id = m.Renew(w, r)
+		}
+		customer := m.read(r, CustomerCookieName)
+		if customer == "" {
+			customer = "customer-" + uuid.NewString()
+			m.set(w, r, CustomerCookieName, customer)
+		}
+		ctx := WithCartID(r.Context(), id)
+		next.ServeHTTP(w, r.WithContext(WithCustomerID(ctx, customer)))
+	})
+}
+
+// Renew issues a cookie with a new cart ID and returns the ID. The request
+// keeps the cart ID it came with; the next one carries the new cart. The
+// customer ID stays as it is.
+func (m *Manager) Renew(w http.ResponseWriter, r *http.Request) string {
+	id := "cart-" + uuid.NewString()
+	m.set(w, r, CookieName, id)
+	return id
+}
+
+// read returns the ID in cookie name, or "" if the request has none or its
+// signature does not match.
+func (m *Manager) read(r *http.Request, name string) string {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	id, _ := m.Verify(c.Value)
+	return id
+}
+
+func (m *Manager) set(w http.ResponseWriter, r *http.Request, name, id string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    m.sign(id),
+		Path:     "/",
+		MaxAge:   int(MaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func WithCartID(ctx context.Context, id string) context.Context {
+	return appcontext.With(ctx, cartKey, id)
+}
+
+func CartID(ctx context.Context) string {
+	if id, ok := appcontext.Get(ctx, cartKey); ok {
+		return id
+	}
+	panic("cart id not found in context")
+}
+
+func WithCustomerID(ctx context.Context, id string) context.Context {
+	return appcontext.With(ctx, customerKey, id)
+}
+
+// CustomerID returns the customer the request comes from, who owns the
+// orders checked out in that browser.
+func CustomerID(ctx context.Context) string {
+	if id, ok := appcontext.Get(ctx, customerKey); ok {
+		return id
+	}
+	panic("customer id not found in context")
+}
@@ -0,0 +1,114 @@
+package session_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/blinkinglight/gobeego/pkg/session"
+)
+
+func TestMiddlewareKeepsCartID(t *testing.T) {
+	m := session.New([]byte("0123456789abcdef0123456789abcdef"))
+
+	var seen []string
+	h := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, session.CartID(r.Context()))
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/cart", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 2 || cookies[0].Name != session.CookieName || cookies[1].Name != session.CustomerCookieName {
+		t.Fatalf("Expected a cart and a customer cookie to be issued, got %v", cookies)
+	}
+
+	req := httptest.NewRequest("GET", "/cart", nil)
+	req.AddCookie(cookies[0])
+	req.AddCookie(cookies[1])
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if len(rec.Result().Cookies()) != 0 {
+		t.Errorf("Expected no new cookie for a valid session")
+	}
+	if seen[0] != seen[1] {
+		t.Errorf("Expected the same cart ID, got %s and %s", seen[0], seen[1])
+	}
+
+	req = httptest.NewRequest("GET", "/cart", nil)
+	req.AddCookie(&http.Cookie{Name: session.CookieName, Value: seen[0] + ".forged"})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if seen[2] == seen[0] {
+		t.Errorf("Expected a forged cookie to get a new cart ID")
+	}
+}
+
+func TestVerifyRejectsOtherSecret(t *testing.T) {
+	a := session.New([]byte("0123456789abcdef0123456789abcdef"))
+	b := session.New([]byte("fedcba9876543210fedcba9876543210"))
+
+	rec := httptest.NewRecorder()
+	a.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).
+		ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	value := rec.Result().Cookies()[0].Value
+
+	if _, ok := a.Verify(value); !ok {
+		t.Errorf("Expected cookie to verify with its own secret")
+	}
+	if _, ok := b.Verify(value); ok {
+		t.Errorf("Expected cookie to be rejected with another secret")
+	}
+}
+
+func TestRenew(t *testing.T) {
+	m := session.New([]byte("0123456789abcdef0123456789abcdef"))
+
+	var customers []string
+	h := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		customers = append(customers, session.CustomerID(r.Context()))
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/cart", nil))
+	customer := rec.Result().Cookies()[1]
+
+	var old, renewed string
+	h = m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		customers = append(customers, session.CustomerID(r.Context()))
+		old = session.CartID(r.Context())
+		renewed = m.Renew(w, r)
+	}))
+	req := httptest.NewRequest("POST", "/cart/checkout", nil)
+	req.AddCookie(customer)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if customers[0] != customers[1] {
+		t.Errorf("Expected the customer ID to survive a checkout, got %s and %s", customers[0], customers[1])
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatalf("Expected a cart cookie to be issued")
+	}
+	if renewed == old {
+		t.Errorf("Expected a new cart ID, got %s again", old)
+	}
+	if id, ok := m.Verify(cookies[len(cookies)-1].Value); !ok || id != renewed {
+		t.Errorf("Expected the last cookie to carry %s, got %s", renewed, id)
+	}
+}
+
+func TestLoadOrCreateSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.key")
+	first, err := session.LoadOrCreateSecret(path)
+	if err != nil {
+		t.Fatalf("LoadOrCreateSecret: %v", err)
+	}
+	second, err := session.LoadOrCreateSecret(path)
+	if err != nil {
+		t.Fatalf("LoadOrCreateSecret: %v", err)
+	}
+	if string(first) != string(second) {
+		t.Errorf("Expected the secret to be reused across restarts")
+	}
+}
@@ -1 +1,13 @@
 package pages
+
+import "fmt"
+
+// money formats an amount in cents, e.g. 1050 as "10.50 EUR".
+func money(cents int64, currency string) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d %s", sign, cents/100, cents%100, currency)
+}